@@ -0,0 +1,767 @@
+package main
+
+import (
+	"cmp"
+	"errors"
+	"fmt"
+	"log"
+	"maps"
+	"os"
+	"path"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Alert states. Pending alerts wait for their condition to hold for the
+// rule's for duration, resolved ones are kept for a while to be shown.
+const (
+	alertPending  = "pending"
+	alertFiring   = "firing"
+	alertResolved = "resolved"
+)
+
+// resolvedRetention is how long resolved alerts stay on the dashboard
+const resolvedRetention = time.Hour
+
+// AlertsConfig holds the alerting rules and where their notifications go
+type AlertsConfig struct {
+	Interval       time.Duration    `toml:"interval"`        // how often the logs are read and rules evaluated
+	RepeatInterval time.Duration    `toml:"repeat_interval"` // resend alerts still firing, 0 to notify once
+	Rules          []AlertRule      `toml:"rules"`
+	Receivers      []ReceiverConfig `toml:"receivers"`
+	Silences       []SilenceConfig  `toml:"silences"`
+}
+
+// AlertRule compares a metric of the recent entries with a threshold. With
+// by set, every value of that field is its own alert, e.g. one per IP.
+type AlertRule struct {
+	Name      string        `toml:"name" json:"name"`
+	Source    string        `toml:"source" json:"source,omitempty"`       // source name or pattern, all sources when empty
+	Filter    string        `toml:"filter" json:"filter,omitempty"`       // entries the rule looks at
+	Metric    string        `toml:"metric" json:"metric"`                 // count, rate (per second), ratio or a percentile like p95
+	Match     string        `toml:"match" json:"match,omitempty"`         // entries counted by the ratio, in percent of the filtered ones
+	By        string        `toml:"by" json:"by,omitempty"`               // field evaluated per value
+	Op        string        `toml:"op" json:"op"`                         // >, >=, < or <=
+	Threshold float64       `toml:"threshold" json:"threshold"`           // fires when metric op threshold
+	Clear     float64       `toml:"clear" json:"clear,omitempty"`         // resolves when no longer metric op clear, 0 for threshold
+	Window    time.Duration `toml:"window" json:"window"`                 // of entries the metric is computed over
+	For       time.Duration `toml:"for" json:"for,omitempty"`             // the condition has to hold before the alert fires
+	ClearFor  time.Duration `toml:"clear_for" json:"clear_for,omitempty"` // the clear condition has to hold before it resolves
+	Severity  string        `toml:"severity" json:"severity,omitempty"`
+	Receivers []string      `toml:"receivers" json:"receivers,omitempty"` // all receivers when empty
+}
+
+// SilenceConfig mutes the notifications of matching alerts until a time
+type SilenceConfig struct {
+	Rule    string `toml:"rule"`   // all rules when empty
+	Source  string `toml:"source"` // all sources when empty
+	Group   string `toml:"group"`  // value of the rule's by field, all when empty
+	Until   string `toml:"until"`  // "2006-01-02 15:04:05" in local time
+	Comment string `toml:"comment"`
+}
+
+// Silence is an active silence, from the config or created through the API
+type Silence struct {
+	ID        string    `json:"id"`
+	Rule      string    `json:"rule,omitempty"`
+	Source    string    `json:"source,omitempty"`
+	Group     string    `json:"group,omitempty"`
+	Until     time.Time `json:"until"`
+	Comment   string    `json:"comment,omitempty"`
+	CreatedBy string    `json:"created_by,omitempty"`
+}
+
+func (s *Silence) matches(a *Alert) bool {
+	return (s.Rule == "" || s.Rule == a.Rule) &&
+		(s.Source == "" || s.Source == a.Source) &&
+		(s.Group == "" || s.Group == a.Group)
+}
+
+// Validate checks the rules, receivers and silences
+func (c *AlertsConfig) Validate() []error {
+	var errs []error
+	if len(c.Rules) > 0 && c.Interval <= 0 {
+		errs = append(errs, errors.New("alerts.interval must be positive"))
+	}
+
+	receivers := make(map[string]bool)
+	for i, r := range c.Receivers {
+		if r.Name == "" || receivers[r.Name] {
+			errs = append(errs, fmt.Errorf("alerts.receivers[%d]: missing or duplicate name %q", i, r.Name))
+		}
+		receivers[r.Name] = true
+		if err := r.validate(); err != nil {
+			errs = append(errs, fmt.Errorf("alerts receiver %q: %w", r.Name, err))
+		}
+	}
+
+	rules := make(map[string]bool)
+	for i, r := range c.Rules {
+		if r.Name == "" || rules[r.Name] {
+			errs = append(errs, fmt.Errorf("alerts.rules[%d]: missing or duplicate name %q", i, r.Name))
+		}
+		rules[r.Name] = true
+		if _, err := compileAlertRule(r); err != nil {
+			errs = append(errs, fmt.Errorf("alert rule %q: %w", r.Name, err))
+		}
+		for _, name := range r.Receivers {
+			if !receivers[name] {
+				errs = append(errs, fmt.Errorf("alert rule %q: unknown receiver %q", r.Name, name))
+			}
+		}
+	}
+
+	for i, s := range c.Silences {
+		if s.Rule != "" && !rules[s.Rule] {
+			errs = append(errs, fmt.Errorf("alerts.silences[%d]: unknown rule %q", i, s.Rule))
+		}
+		if _, err := time.ParseInLocation(rangeLayout, s.Until, time.Local); err != nil {
+			errs = append(errs, fmt.Errorf("alerts.silences[%d]: until must be %q", i, rangeLayout))
+		}
+	}
+	return errs
+}
+
+// alertSample is what a rule keeps of an entry
+type alertSample struct {
+	at      time.Time
+	key     alertKey
+	matched bool // by the ratio's match filter
+	rt      float64
+}
+
+// alertKey identifies one alert of a rule
+type alertKey struct {
+	source, group string
+}
+
+// alertRule is a compiled rule with its recent samples and alerts
+type alertRule struct {
+	AlertRule
+	filter, match *Filter
+	percentile    float64
+	by            func(*LogEntry) string
+
+	samples []alertSample // in arrival order
+	alerts  map[alertKey]*Alert
+}
+
+func compileAlertRule(r AlertRule) (*alertRule, error) {
+	rule := &alertRule{AlertRule: r, alerts: make(map[alertKey]*Alert)}
+	if rule.Op == "" {
+		rule.Op = ">"
+	}
+	if rule.Clear == 0 {
+		rule.Clear = rule.Threshold
+	}
+
+	var err error
+	if rule.filter, err = ParseFilter(r.Filter); err != nil {
+		return nil, fmt.Errorf("filter: %w", err)
+	}
+	switch r.Metric {
+	case "count", "rate":
+	case "ratio":
+		if r.Match == "" {
+			return nil, errors.New("the ratio metric needs a match filter")
+		}
+		if rule.match, err = ParseFilter(r.Match); err != nil {
+			return nil, fmt.Errorf("match: %w", err)
+		}
+	default:
+		var ok bool
+		if rule.percentile, ok = parsePercentile(r.Metric); !ok {
+			return nil, fmt.Errorf("unknown metric %q, use count, rate, ratio or a percentile like p95", r.Metric)
+		}
+	}
+	if r.By != "" {
+		if rule.by = groupDimensions[r.By]; rule.by == nil {
+			return nil, fmt.Errorf("unknown by field %q", r.By)
+		}
+	}
+	if _, err := path.Match(r.Source, ""); err != nil {
+		return nil, fmt.Errorf("bad source pattern %q", r.Source)
+	}
+
+	switch rule.Op {
+	case ">", ">=":
+		if rule.Clear > rule.Threshold {
+			return nil, errors.New("clear must not be above the threshold")
+		}
+	case "<", "<=":
+		if rule.Clear < rule.Threshold {
+			return nil, errors.New("clear must not be below the threshold")
+		}
+	default:
+		return nil, fmt.Errorf("unknown op %q", rule.Op)
+	}
+	if rule.Window <= 0 {
+		return nil, errors.New("window must be positive")
+	}
+	if rule.For < 0 || rule.ClearFor < 0 {
+		return nil, errors.New("for and clear_for must not be negative")
+	}
+	return rule, nil
+}
+
+// appliesTo reports whether the rule watches the named source
+func (r AlertRule) appliesTo(source string) bool {
+	if r.Source == "" {
+		return true
+	}
+	ok, _ := path.Match(r.Source, source)
+	return ok
+}
+
+func compareOp(op string, value, threshold float64) bool {
+	switch op {
+	case ">":
+		return value > threshold
+	case ">=":
+		return value >= threshold
+	case "<":
+		return value < threshold
+	}
+	return value <= threshold
+}
+
+// Alert is the state of a rule for one source and value of its by field
+type Alert struct {
+	Rule     string    `json:"rule"`
+	Source   string    `json:"source"`
+	Group    string    `json:"group,omitempty"` // value of the rule's by field
+	State    string    `json:"state"`
+	Value    float64   `json:"value"`
+	Since    time.Time `json:"since"` // of the current state
+	FiredAt  time.Time `json:"fired_at,omitzero"`
+	Severity string    `json:"severity,omitempty"`
+	Summary  string    `json:"summary"`
+	Silenced bool      `json:"silenced"`
+
+	By       string    `json:"-"`
+	notified time.Time // last firing notification
+	clearAt  time.Time // since when the clear condition holds
+}
+
+// AlertEngine evaluates the rules against the entries handed to Observe,
+// typically by a Follower, and sends notifications when alerts change
+type AlertEngine struct {
+	cfg       AlertsConfig
+	sources   []*Source
+	receivers map[string]Notifier
+
+	mu       sync.Mutex
+	rules    []*alertRule
+	silences []Silence
+	lastID   int
+
+	done chan struct{}
+}
+
+// NewAlertEngine compiles the rules and receivers. It returns nil without
+// rules, and every method of a nil engine is a no-op.
+func NewAlertEngine(cfg AlertsConfig, sources []*Source) (*AlertEngine, error) {
+	if len(cfg.Rules) == 0 {
+		return nil, nil
+	}
+	e := &AlertEngine{
+		cfg:       cfg,
+		sources:   sources,
+		receivers: make(map[string]Notifier),
+		done:      make(chan struct{}),
+	}
+	for _, r := range cfg.Rules {
+		rule, err := compileAlertRule(r)
+		if err != nil {
+			return nil, fmt.Errorf("alert rule %q: %w", r.Name, err)
+		}
+		e.rules = append(e.rules, rule)
+	}
+	for _, rc := range cfg.Receivers {
+		notifier, err := NewNotifier(rc)
+		if err != nil {
+			return nil, fmt.Errorf("alerts receiver %q: %w", rc.Name, err)
+		}
+		e.receivers[rc.Name] = notifier
+	}
+	for _, sc := range cfg.Silences {
+		until, err := time.ParseInLocation(rangeLayout, sc.Until, time.Local)
+		if err != nil {
+			return nil, fmt.Errorf("alerts silence: until must be %q", rangeLayout)
+		}
+		e.addSilence(Silence{Rule: sc.Rule, Source: sc.Source, Group: sc.Group, Until: until, Comment: sc.Comment})
+	}
+	return e, nil
+}
+
+// Start evaluates the rules every interval until Stop
+func (e *AlertEngine) Start() {
+	if e == nil {
+		return
+	}
+	go func() {
+		ticker := time.NewTicker(e.cfg.Interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-e.done:
+				return
+			case now := <-ticker.C:
+				e.Evaluate(now)
+			}
+		}
+	}()
+}
+
+// Stop ends the evaluation
+func (e *AlertEngine) Stop() {
+	if e != nil {
+		close(e.done)
+	}
+}
+
+// Observe records an entry for the rules watching its source
+func (e *AlertEngine) Observe(entry LogEntry) {
+	if e == nil {
+		return
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	for _, rule := range e.rules {
+		if !rule.appliesTo(entry.Source) || !rule.filter.Match(&entry) {
+			continue
+		}
+		sample := alertSample{
+			at:      entry.TimeStamp,
+			key:     alertKey{source: entry.Source},
+			matched: rule.match != nil && rule.match.Match(&entry),
+			rt:      requestDuration(&entry),
+		}
+		if rule.by != nil {
+			sample.key.group = rule.by(&entry)
+		}
+		rule.samples = append(rule.samples, sample)
+	}
+}
+
+// notification is an alert to send to some receivers
+type notification struct {
+	alert     Alert
+	receivers []string
+}
+
+// Evaluate computes the metric of every rule over its window ending at now,
+// moves the alerts through pending, firing and resolved, and sends the
+// notifications of alerts that fired, resolved or are due for a repeat.
+// Silenced alerts change state without notifications; when the silence ends
+// the alert is sent if it's still firing.
+func (e *AlertEngine) Evaluate(now time.Time) {
+	if e == nil {
+		return
+	}
+	e.mu.Lock()
+	e.silences = slices.DeleteFunc(e.silences, func(s Silence) bool { return !s.Until.After(now) })
+
+	var notifications []notification
+	for _, rule := range e.rules {
+		values := rule.evaluate(now, e.sources)
+		keys := make(map[alertKey]bool)
+		for key := range values {
+			keys[key] = true
+		}
+		for key := range rule.alerts {
+			keys[key] = true
+		}
+
+		for key := range keys {
+			value, ok := values[key]
+			if !ok && (rule.Metric == "count" || rule.Metric == "rate") {
+				// No entries left in the window
+				ok = true
+			}
+			active := ok && compareOp(rule.Op, value, rule.Threshold)
+			clear := !ok || !compareOp(rule.Op, value, rule.Clear)
+			alert := rule.alerts[key]
+
+			if alert == nil || alert.State == alertResolved {
+				if !active {
+					if alert != nil && now.Sub(alert.Since) > resolvedRetention {
+						delete(rule.alerts, key)
+					}
+					continue
+				}
+				alert = &Alert{
+					Rule:     rule.Name,
+					Source:   key.source,
+					Group:    key.group,
+					State:    alertPending,
+					Since:    now,
+					Severity: rule.Severity,
+					By:       rule.By,
+				}
+				rule.alerts[key] = alert
+			}
+			if ok {
+				alert.Value = value
+			}
+			alert.Summary = rule.summary(alert)
+			alert.Silenced = e.silenced(alert)
+
+			switch alert.State {
+			case alertPending:
+				if !active {
+					delete(rule.alerts, key)
+					continue
+				}
+				if now.Sub(alert.Since) >= rule.For {
+					alert.State, alert.Since, alert.FiredAt = alertFiring, now, now
+				}
+			case alertFiring:
+				if !clear {
+					alert.clearAt = time.Time{}
+					break
+				}
+				if alert.clearAt.IsZero() {
+					alert.clearAt = now
+				}
+				if now.Sub(alert.clearAt) >= rule.ClearFor {
+					alert.State, alert.Since = alertResolved, now
+					alert.Summary = rule.summary(alert)
+					if !alert.notified.IsZero() && !alert.Silenced {
+						notifications = append(notifications, notification{*alert, rule.Receivers})
+					}
+					continue
+				}
+			}
+
+			if alert.State == alertFiring && !alert.Silenced &&
+				(alert.notified.IsZero() || e.cfg.RepeatInterval > 0 && now.Sub(alert.notified) >= e.cfg.RepeatInterval) {
+				alert.notified = now
+				notifications = append(notifications, notification{*alert, rule.Receivers})
+			}
+		}
+	}
+	e.mu.Unlock()
+
+	if len(notifications) > 0 {
+		go e.send(notifications)
+	}
+}
+
+// evaluate drops the samples that left the window and computes the metric
+// for every source and value seen in it. Counts and rates are also
+// computed for sources without entries, so rules like rate < 1 fire when
+// a site goes quiet.
+func (r *alertRule) evaluate(now time.Time, sources []*Source) map[alertKey]float64 {
+	start := now.Add(-r.Window)
+	r.samples = slices.DeleteFunc(r.samples, func(s alertSample) bool { return s.at.Before(start) })
+
+	type acc struct {
+		count, matched int
+		rts            []float64
+	}
+	accs := make(map[alertKey]*acc)
+	if r.by == nil && (r.Metric == "count" || r.Metric == "rate") {
+		for _, src := range sources {
+			if r.appliesTo(src.Name) {
+				accs[alertKey{source: src.Name}] = &acc{}
+			}
+		}
+	}
+	for _, s := range r.samples {
+		if s.at.After(now) {
+			continue
+		}
+		a := accs[s.key]
+		if a == nil {
+			a = &acc{}
+			accs[s.key] = a
+		}
+		a.count++
+		if s.matched {
+			a.matched++
+		}
+		if r.percentile > 0 {
+			a.rts = append(a.rts, s.rt)
+		}
+	}
+
+	values := make(map[alertKey]float64, len(accs))
+	for key, a := range accs {
+		switch r.Metric {
+		case "count":
+			values[key] = float64(a.count)
+		case "rate":
+			values[key] = float64(a.count) / r.Window.Seconds()
+		case "ratio":
+			if a.count > 0 {
+				values[key] = 100 * float64(a.matched) / float64(a.count)
+			}
+		default:
+			if a.count > 0 {
+				sort.Float64s(a.rts)
+				values[key] = percentile(a.rts, r.percentile)
+			}
+		}
+	}
+	return values
+}
+
+// summary describes an alert in a line, e.g.
+// "api-5xx on shop: ratio 7.20% > 5% over 1m0s"
+func (r *alertRule) summary(a *Alert) string {
+	var b strings.Builder
+	b.WriteString(r.Name)
+	b.WriteString(" on ")
+	b.WriteString(a.Source)
+	if a.Group != "" {
+		fmt.Fprintf(&b, " %s=%s", r.By, a.Group)
+	}
+	value := strconv.FormatFloat(a.Value, 'f', 2, 64)
+	threshold := strconv.FormatFloat(r.Threshold, 'f', -1, 64)
+	if r.Metric == "ratio" {
+		value += "%"
+		threshold += "%"
+	}
+	if a.State == alertResolved {
+		fmt.Fprintf(&b, ": %s %s over %s, no longer %s %s", r.Metric, value, r.Window, r.Op, threshold)
+	} else {
+		fmt.Fprintf(&b, ": %s %s %s %s over %s", r.Metric, value, r.Op, threshold, r.Window)
+	}
+	return b.String()
+}
+
+func (e *AlertEngine) silenced(a *Alert) bool {
+	for i := range e.silences {
+		if e.silences[i].matches(a) {
+			return true
+		}
+	}
+	return false
+}
+
+// send delivers the notifications, grouped per receiver
+func (e *AlertEngine) send(notifications []notification) {
+	batches := make(map[string][]Alert)
+	for _, n := range notifications {
+		receivers := n.receivers
+		if len(receivers) == 0 {
+			receivers = slices.Sorted(maps.Keys(e.receivers))
+		}
+		for _, name := range receivers {
+			batches[name] = append(batches[name], n.alert)
+		}
+	}
+	for name, alerts := range batches {
+		if err := notifyWithRetry(e.receivers[name], alerts); err != nil {
+			log.Printf("Alerts: notifying %s: %v", name, err)
+		}
+	}
+}
+
+// Alerts returns the current alerts, firing ones first
+func (e *AlertEngine) Alerts() []Alert {
+	if e == nil {
+		return nil
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	var alerts []Alert
+	for _, rule := range e.rules {
+		for _, a := range rule.alerts {
+			alerts = append(alerts, *a)
+		}
+	}
+	order := map[string]int{alertFiring: 0, alertPending: 1, alertResolved: 2}
+	slices.SortFunc(alerts, func(a, b Alert) int {
+		if c := cmp.Compare(order[a.State], order[b.State]); c != 0 {
+			return c
+		}
+		if c := b.Since.Compare(a.Since); c != 0 {
+			return c
+		}
+		return cmp.Compare(a.Summary, b.Summary)
+	})
+	return alerts
+}
+
+// Rules returns the configured rules
+func (e *AlertEngine) Rules() []AlertRule {
+	if e == nil {
+		return nil
+	}
+	rules := make([]AlertRule, len(e.rules))
+	for i, r := range e.rules {
+		rules[i] = r.AlertRule
+	}
+	return rules
+}
+
+// Silences returns the active silences
+func (e *AlertEngine) Silences() []Silence {
+	if e == nil {
+		return nil
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return slices.Clone(e.silences)
+}
+
+// AddSilence mutes the matching alerts and returns the silence with its id
+func (e *AlertEngine) AddSilence(s Silence) Silence {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.addSilence(s)
+}
+
+func (e *AlertEngine) addSilence(s Silence) Silence {
+	e.lastID++
+	s.ID = strconv.Itoa(e.lastID)
+	e.silences = append(e.silences, s)
+	return s
+}
+
+// RemoveSilence ends a silence, returning false if there's no such id
+func (e *AlertEngine) RemoveSilence(id string) (Silence, bool) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	for i, s := range e.silences {
+		if s.ID == id {
+			e.silences = slices.Delete(e.silences, i, i+1)
+			return s, true
+		}
+	}
+	return Silence{}, false
+}
+
+// HasRule reports whether a rule of that name is configured
+func (e *AlertEngine) HasRule(name string) bool {
+	return slices.ContainsFunc(e.rules, func(r *alertRule) bool { return r.Name == name })
+}
+
+// testAlertsCommand sends a test alert to every configured receiver, so
+// webhooks and mail servers can be checked before an alert fires
+func testAlertsCommand(args []string) int {
+	fs := newFlagSet("test-alerts")
+	configFile := fs.String("config", os.Getenv("NLV_CONFIG"), "Path to the TOML config file")
+	receiver := fs.String("receiver", "", "Only test this receiver")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+
+	cfg := DefaultConfig()
+	if err := loadConfig(fs, cfg, *configFile); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	now := time.Now()
+	alert := Alert{
+		Rule:     "test",
+		Source:   "test",
+		State:    alertFiring,
+		Since:    now,
+		FiredAt:  now,
+		Severity: "info",
+		Summary:  "Test notification from the nginx log viewer",
+	}
+	status := 0
+	tested := 0
+	for _, rc := range cfg.Alerts.Receivers {
+		if *receiver != "" && rc.Name != *receiver {
+			continue
+		}
+		tested++
+		notifier, err := NewNotifier(rc)
+		if err == nil {
+			err = notifier.Notify([]Alert{alert})
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "receiver %s: %v\n", rc.Name, err)
+			status = 1
+			continue
+		}
+		fmt.Printf("receiver %s: sent\n", rc.Name)
+	}
+	if tested == 0 {
+		fmt.Fprintln(os.Stderr, "no receivers to test")
+		return 1
+	}
+	return status
+}
+
+// AlertsView is the alerts page and API response
+type AlertsView struct {
+	Alerts   []Alert     `json:"alerts"`
+	Silences []Silence   `json:"silences"`
+	Rules    []AlertRule `json:"rules"`
+
+	Sites  []string     `json:"-"`
+	Source string       `json:"-"`
+	Filter string       `json:"-"`
+	Chips  []FilterChip `json:"-"`
+	User   *User        `json:"-"`
+}
+
+// firingAlerts keeps the alerts that are firing
+func firingAlerts(alerts []Alert) []Alert {
+	return slices.DeleteFunc(alerts, func(a Alert) bool { return a.State != alertFiring })
+}
+
+// maskAlert redacts the value of an alert grouped by a field masked for the
+// user, the same way the field is masked in entries
+func maskAlert(mask FieldMask, a Alert) Alert {
+	switch a.By {
+	case "ip", "user", "ua", "uri", "path":
+	default:
+		return a
+	}
+	entry := LogEntry{IP: a.Group, UserID: a.Group, UserAgent: a.Group, RequestURI: a.Group}
+	mask.Apply(&entry)
+	if masked := groupDimensions[a.By](&entry); masked != a.Group {
+		a.Summary = strings.Replace(a.Summary, a.By+"="+a.Group, a.By+"="+masked, 1)
+		a.Group = masked
+	}
+	return a
+}
+
+// canSilence reports whether the user may silence the alerts of a source.
+// Silences of every source need access to every source.
+func canSilence(access Access, source string) bool {
+	if source == "" {
+		return access.CanView("*")
+	}
+	return access.CanView(source)
+}
+
+// silenceRequest is the body of a request creating a silence
+type silenceRequest struct {
+	Rule     string    `json:"rule"`
+	Source   string    `json:"source"`
+	Group    string    `json:"group"`
+	Duration string    `json:"duration"` // like "2h", or
+	Until    time.Time `json:"until"`
+	Comment  string    `json:"comment"`
+}
+
+func (r silenceRequest) silence(now time.Time, engine *AlertEngine) (Silence, error) {
+	s := Silence{Rule: r.Rule, Source: r.Source, Group: r.Group, Until: r.Until, Comment: r.Comment}
+	if r.Rule != "" && !engine.HasRule(r.Rule) {
+		return s, fmt.Errorf("unknown rule %q", r.Rule)
+	}
+	if r.Duration != "" {
+		d, err := time.ParseDuration(r.Duration)
+		if err != nil {
+			return s, fmt.Errorf("duration: %v", err)
+		}
+		s.Until = now.Add(d)
+	}
+	if !s.Until.After(now) {
+		return s, errors.New("a duration or an until time in the future is required")
+	}
+	return s, nil
+}
@@ -0,0 +1,272 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// recordingNotifier hands every notification to the test
+type recordingNotifier struct {
+	sent chan []Alert
+}
+
+func (n *recordingNotifier) Notify(alerts []Alert) error {
+	n.sent <- alerts
+	return nil
+}
+
+// alertStep adds entries at a second after the start, evaluates the rules
+// then and checks the state of the alert and the notifications sent
+type alertStep struct {
+	at       int
+	add      int
+	state    string // "" when there's no alert
+	notified []string
+}
+
+func TestAlertEngineEvaluate(t *testing.T) {
+	start := time.Date(2024, 2, 19, 16, 0, 0, 0, time.UTC)
+	count := func(threshold float64) AlertRule {
+		return AlertRule{Name: "r", Metric: "count", Op: ">", Threshold: threshold, Window: time.Minute}
+	}
+
+	tests := []struct {
+		name     string
+		rule     AlertRule
+		repeat   time.Duration
+		silences []SilenceConfig
+		silence  time.Duration // added through the API, until start plus this
+		steps    []alertStep
+	}{
+		{
+			name: "pending, firing and resolved",
+			rule: func() AlertRule { r := count(2); r.For = 30 * time.Second; return r }(),
+			steps: []alertStep{
+				{at: 0, add: 3, state: alertPending},
+				{at: 10, state: alertPending},
+				{at: 30, state: alertFiring, notified: []string{alertFiring}},
+				{at: 50, state: alertFiring},
+				{at: 70, state: alertResolved, notified: []string{alertResolved}},
+			},
+		},
+		{
+			name: "pending alert dropped before its for",
+			rule: func() AlertRule { r := count(2); r.For = 2 * time.Minute; return r }(),
+			steps: []alertStep{
+				{at: 0, add: 3, state: alertPending},
+				{at: 61, state: ""},
+				{at: 130, state: ""},
+			},
+		},
+		{
+			name: "fires at once without for",
+			rule: count(2),
+			steps: []alertStep{
+				{at: 0, add: 2, state: ""},
+				{at: 1, add: 1, state: alertFiring, notified: []string{alertFiring}},
+			},
+		},
+		{
+			name: "clear threshold",
+			rule: func() AlertRule { r := count(5); r.Clear = 2; return r }(),
+			steps: []alertStep{
+				{at: 0, add: 3, state: ""},
+				{at: 20, add: 3, state: alertFiring, notified: []string{alertFiring}},
+				// 3 entries left: below the threshold but above clear
+				{at: 65, state: alertFiring},
+				{at: 85, state: alertResolved, notified: []string{alertResolved}},
+			},
+		},
+		{
+			name: "clear_for",
+			rule: func() AlertRule { r := count(2); r.ClearFor = 30 * time.Second; return r }(),
+			steps: []alertStep{
+				{at: 0, add: 3, state: alertFiring, notified: []string{alertFiring}},
+				{at: 61, state: alertFiring},
+				{at: 80, add: 3, state: alertFiring},
+				// the clear condition has to hold again from the start
+				{at: 141, state: alertFiring},
+				{at: 160, state: alertFiring},
+				{at: 171, state: alertResolved, notified: []string{alertResolved}},
+			},
+		},
+		{
+			name:   "repeat_interval",
+			rule:   func() AlertRule { r := count(0); r.Window = 10 * time.Minute; return r }(),
+			repeat: time.Minute,
+			steps: []alertStep{
+				{at: 0, add: 1, state: alertFiring, notified: []string{alertFiring}},
+				{at: 30, state: alertFiring},
+				{at: 60, state: alertFiring, notified: []string{alertFiring}},
+				{at: 90, state: alertFiring},
+				{at: 120, state: alertFiring, notified: []string{alertFiring}},
+			},
+		},
+		{
+			name: "notified once without repeat_interval",
+			rule: func() AlertRule { r := count(0); r.Window = 10 * time.Minute; return r }(),
+			steps: []alertStep{
+				{at: 0, add: 1, state: alertFiring, notified: []string{alertFiring}},
+				{at: 300, state: alertFiring},
+				{at: 600, state: alertFiring},
+			},
+		},
+		{
+			name:     "silenced",
+			rule:     count(0),
+			silences: []SilenceConfig{{Rule: "r", Source: "site", Until: "2099-01-01 00:00:00"}},
+			steps: []alertStep{
+				{at: 0, add: 1, state: alertFiring},
+				{at: 61, state: alertResolved},
+			},
+		},
+		{
+			name:     "silence of another source",
+			rule:     count(0),
+			silences: []SilenceConfig{{Source: "other", Until: "2099-01-01 00:00:00"}},
+			steps: []alertStep{
+				{at: 0, add: 1, state: alertFiring, notified: []string{alertFiring}},
+			},
+		},
+		{
+			name:    "silence ending while firing",
+			rule:    count(0),
+			silence: 30 * time.Second,
+			steps: []alertStep{
+				{at: 0, add: 1, state: alertFiring},
+				{at: 20, state: alertFiring},
+				{at: 30, state: alertFiring, notified: []string{alertFiring}},
+			},
+		},
+		{
+			name: "quiet source",
+			rule: AlertRule{Name: "r", Metric: "rate", Op: "<", Threshold: 0.05, Window: time.Minute},
+			steps: []alertStep{
+				{at: 0, state: alertFiring, notified: []string{alertFiring}},
+				{at: 10, add: 6, state: alertResolved, notified: []string{alertResolved}},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := AlertsConfig{Interval: time.Second, RepeatInterval: tt.repeat, Rules: []AlertRule{tt.rule}, Silences: tt.silences}
+			e, err := NewAlertEngine(cfg, []*Source{{SourceConfig: SourceConfig{Name: "site"}}})
+			if err != nil {
+				t.Fatal(err)
+			}
+			notifier := &recordingNotifier{sent: make(chan []Alert, 10)}
+			e.receivers["test"] = notifier
+			if tt.silence > 0 {
+				e.AddSilence(Silence{Rule: "r", Until: start.Add(tt.silence)})
+			}
+
+			for _, step := range tt.steps {
+				now := start.Add(time.Duration(step.at) * time.Second)
+				for range step.add {
+					e.Observe(LogEntry{Source: "site", TimeStamp: now, Status: 200})
+				}
+				e.Evaluate(now)
+
+				var state string
+				if alerts := e.Alerts(); len(alerts) > 0 {
+					state = alerts[0].State
+				}
+				if state != step.state {
+					t.Fatalf("at %ds: state %q, want %q", step.at, state, step.state)
+				}
+				for _, want := range step.notified {
+					select {
+					case alerts := <-notifier.sent:
+						if len(alerts) != 1 || alerts[0].State != want {
+							t.Fatalf("at %ds: notified %+v, want one %s alert", step.at, alerts, want)
+						}
+					case <-time.After(2 * time.Second):
+						t.Fatalf("at %ds: no %s notification", step.at, want)
+					}
+				}
+				select {
+				case alerts := <-notifier.sent:
+					t.Fatalf("at %ds: unexpected notification %+v", step.at, alerts)
+				case <-time.After(20 * time.Millisecond):
+				}
+			}
+		})
+	}
+}
+
+func TestAlertEngineGroups(t *testing.T) {
+	start := time.Date(2024, 2, 19, 16, 0, 0, 0, time.UTC)
+	rule := AlertRule{Name: "5xx", Metric: "ratio", Match: "status >= 500", By: "ip", Op: ">", Threshold: 50, Window: time.Minute}
+	e, err := NewAlertEngine(AlertsConfig{Interval: time.Second, Rules: []AlertRule{rule}}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, entry := range []LogEntry{
+		{IP: "10.0.0.1", Status: 500}, {IP: "10.0.0.1", Status: 502}, {IP: "10.0.0.1", Status: 200},
+		{IP: "10.0.0.2", Status: 500}, {IP: "10.0.0.2", Status: 200},
+	} {
+		entry.Source, entry.TimeStamp = "site", start
+		e.Observe(entry)
+	}
+	e.Evaluate(start)
+
+	alerts := e.Alerts()
+	if len(alerts) != 1 {
+		t.Fatalf("got %d alerts, want 1: %+v", len(alerts), alerts)
+	}
+	if a := alerts[0]; a.Group != "10.0.0.1" || a.State != alertFiring || a.Summary != "5xx on site ip=10.0.0.1: ratio 66.67% > 50% over 1m0s" {
+		t.Errorf("unexpected alert %+v", a)
+	}
+}
+
+func TestCompileAlertRuleErrors(t *testing.T) {
+	base := AlertRule{Name: "r", Metric: "count", Op: ">", Threshold: 10, Window: time.Minute}
+	tests := map[string]func(r *AlertRule){
+		"unknown metric":       func(r *AlertRule) { r.Metric = "sum" },
+		"ratio without match":  func(r *AlertRule) { r.Metric = "ratio" },
+		"bad filter":           func(r *AlertRule) { r.Filter = "status >" },
+		"unknown by":           func(r *AlertRule) { r.By = "colour" },
+		"unknown op":           func(r *AlertRule) { r.Op = "!=" },
+		"clear above >":        func(r *AlertRule) { r.Clear = 20 },
+		"clear below <":        func(r *AlertRule) { r.Op, r.Clear = "<", 5 },
+		"no window":            func(r *AlertRule) { r.Window = 0 },
+		"negative for":         func(r *AlertRule) { r.For = -time.Second },
+		"bad source pattern":   func(r *AlertRule) { r.Source = "[" },
+		"negative clear_for":   func(r *AlertRule) { r.ClearFor = -time.Second },
+		"percentile above 100": func(r *AlertRule) { r.Metric = "p101" },
+	}
+	for name, modify := range tests {
+		rule := base
+		modify(&rule)
+		if _, err := compileAlertRule(rule); err == nil {
+			t.Errorf("%s: compiled %+v", name, rule)
+		}
+	}
+	if _, err := compileAlertRule(base); err != nil {
+		t.Errorf("valid rule: %v", err)
+	}
+}
+
+func TestSilenceMatches(t *testing.T) {
+	alert := &Alert{Rule: "r", Source: "site", Group: "10.0.0.1"}
+	tests := []struct {
+		silence Silence
+		want    bool
+	}{
+		{Silence{}, true},
+		{Silence{Rule: "r"}, true},
+		{Silence{Rule: "r", Source: "site", Group: "10.0.0.1"}, true},
+		{Silence{Rule: "other"}, false},
+		{Silence{Source: "other"}, false},
+		{Silence{Group: "10.0.0.2"}, false},
+	}
+	for _, tt := range tests {
+		if got := tt.silence.matches(alert); got != tt.want {
+			t.Errorf("%+v matches = %v, want %v", tt.silence, got, tt.want)
+		}
+	}
+	if canSilence(Access{Sources: []string{"site"}}, "") || !canSilence(fullAccess, "") {
+		t.Error("silences of every source need access to every source")
+	}
+}
@@ -0,0 +1,539 @@
+package main
+
+import (
+	"cmp"
+	"fmt"
+	"math"
+	"net/url"
+	"slices"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// Defaults and limits of the anomaly detector
+const (
+	defaultAnomalyThreshold = 3.5 // robust z-score
+	defaultAnomalyHistory   = 7   // days of seasonal baseline
+	maxAnomalyHistory       = 28
+	minSeasonalSamples      = 3  // same minute on earlier days needed for a seasonal baseline
+	minRatioRequests        = 5  // requests in a minute needed to judge its ratios and latency
+	minVolumeChange         = 10 // requests per minute a volume has to change by
+	ewmaAlpha               = 0.1
+	ewmaWarmup              = 10 // minutes before the EWMA baseline is trusted
+	anomalyRoutes           = 10 // busiest routes with their own volume series
+	maxAnomalies            = 100
+	maxContributors         = 5
+	contributorBaseline     = 60 * time.Minute // compared with the anomaly to find its contributors
+)
+
+// minuteStats aggregates the entries of one minute
+type minuteStats struct {
+	count      int
+	c4xx, c5xx int
+	latencies  []float64 // dropped once p95 is known
+	p95        float64
+	routes     map[string]int
+}
+
+// anomalyMetric is a per-minute series the detector watches
+type anomalyMetric struct {
+	name   string
+	value  func(m *minuteStats) (float64, bool) // false when the minute can't be judged
+	floor  func(expected float64, m *minuteStats) float64
+	change float64                                // smallest change from the baseline worth reporting
+	match  func(entry *LogEntry, a *Anomaly) bool // the entries behind an anomaly
+	format func(float64) string
+}
+
+// volumeFloor keeps Poisson noise of low volumes from being flagged
+func volumeFloor(expected float64, _ *minuteStats) float64 {
+	return math.Sqrt(max(expected, 1))
+}
+
+// ratioFloor is the binomial noise of a ratio over the minute's requests.
+// A rare status is assumed to happen once in the minute, so a single error
+// in an otherwise clean series isn't an anomaly.
+func ratioFloor(expected float64, m *minuteStats) float64 {
+	n := float64(m.count)
+	p := min(max(expected, 1/n), 0.999)
+	return math.Sqrt(p * (1 - p) / n)
+}
+
+func formatVolume(v float64) string { return strconv.FormatFloat(v, 'f', 0, 64) + " req/min" }
+func formatRatio(v float64) string  { return formatPercent(100 * v) }
+
+var anomalyMetrics = []anomalyMetric{
+	{
+		name:   "volume",
+		value:  func(m *minuteStats) (float64, bool) { return float64(m.count), true },
+		floor:  volumeFloor,
+		change: minVolumeChange,
+		match:  func(*LogEntry, *Anomaly) bool { return true },
+		format: formatVolume,
+	},
+	{
+		name: "5xx ratio",
+		value: func(m *minuteStats) (float64, bool) {
+			return float64(m.c5xx) / float64(m.count), m.count >= minRatioRequests
+		},
+		floor:  ratioFloor,
+		match:  func(e *LogEntry, _ *Anomaly) bool { return e.Status >= 500 },
+		format: formatRatio,
+	},
+	{
+		name: "4xx ratio",
+		value: func(m *minuteStats) (float64, bool) {
+			return float64(m.c4xx) / float64(m.count), m.count >= minRatioRequests
+		},
+		floor:  ratioFloor,
+		match:  func(e *LogEntry, _ *Anomaly) bool { return e.Status >= 400 && e.Status < 500 },
+		format: formatRatio,
+	},
+	{
+		name:  "p95 latency",
+		value: func(m *minuteStats) (float64, bool) { return m.p95, m.count >= minRatioRequests },
+		floor: func(expected float64, _ *minuteStats) float64 { return max(0.1*expected, 0.01) },
+		// The requests slower than the usual p95
+		match:  func(e *LogEntry, a *Anomaly) bool { return requestDuration(e) >= a.Expected },
+		format: formatSeconds,
+	},
+}
+
+// routeMetric is the volume of a single route
+func routeMetric(route string) anomalyMetric {
+	return anomalyMetric{
+		name:   "route volume",
+		value:  func(m *minuteStats) (float64, bool) { return float64(m.routes[route]), true },
+		floor:  volumeFloor,
+		change: minVolumeChange,
+		match:  func(e *LogEntry, a *Anomaly) bool { return requestPath(e.RequestURI) == a.Route },
+		format: formatVolume,
+	}
+}
+
+// Contributor is a value that changed the most during an anomaly. Expected
+// is its count in the hour before, scaled to the length of the anomaly.
+type Contributor struct {
+	Field    string  `json:"field"`
+	Value    string  `json:"value"`
+	Count    int     `json:"count"`
+	Expected float64 `json:"expected"`
+	Delta    float64 `json:"delta"`
+}
+
+// Anomaly is a run of minutes where a metric left its baseline
+type Anomaly struct {
+	Metric       string        `json:"metric"`
+	Route        string        `json:"route,omitempty"` // of route volume anomalies
+	Direction    string        `json:"direction"`       // spike or drop
+	Start        time.Time     `json:"start"`
+	End          time.Time     `json:"end"`
+	Minutes      int           `json:"minutes"`
+	Actual       float64       `json:"actual"` // at the peak minute
+	Expected     float64       `json:"expected"`
+	Score        float64       `json:"score"`    // robust z-score of the peak minute
+	Baseline     string        `json:"baseline"` // seasonal or ewma
+	Change       string        `json:"change"`
+	Contributors []Contributor `json:"contributors"`
+
+	ActualDisplay   string `json:"-"`
+	ExpectedDisplay string `json:"-"`
+
+	metric *anomalyMetric
+}
+
+// AnomalyQuery tunes the detector
+type AnomalyQuery struct {
+	Threshold float64 // robust z-score from which a minute is anomalous
+	History   int     // days before the range used as seasonal baseline
+}
+
+// parseAnomalyQuery reads threshold and history
+func parseAnomalyQuery(values url.Values) (AnomalyQuery, error) {
+	q := AnomalyQuery{Threshold: defaultAnomalyThreshold, History: defaultAnomalyHistory}
+	if s := values.Get("threshold"); s != "" {
+		t, err := strconv.ParseFloat(s, 64)
+		if err != nil || t <= 0 || math.IsInf(t, 0) {
+			return q, fmt.Errorf("threshold must be a positive number")
+		}
+		q.Threshold = t
+	}
+	if s := values.Get("history"); s != "" {
+		h, err := strconv.Atoi(s)
+		if err != nil || h < 0 || h > maxAnomalyHistory {
+			return q, fmt.Errorf("history must be a number of days up to %d", maxAnomalyHistory)
+		}
+		q.History = h
+	}
+	return q, nil
+}
+
+// AnomalyReport lists the anomalies of a site in the date range
+type AnomalyReport struct {
+	Date      string    `json:"date"`
+	Source    string    `json:"source"`
+	Filter    string    `json:"filter,omitempty"`
+	Threshold float64   `json:"threshold"`
+	History   int       `json:"history"`
+	Anomalies []Anomaly `json:"anomalies"`
+
+	Chips []FilterChip `json:"-"`
+	Sites []string     `json:"-"`
+	User  *User        `json:"-"`
+}
+
+// detector holds the per-minute series from the start of the history to the
+// end of the range. Minutes outside the span covered by the logs are nil so
+// they're never mistaken for a drop to zero.
+type detector struct {
+	origin  time.Time // the first minute
+	minutes []*minuteStats
+	first   int // index of the first minute of the range
+	q       AnomalyQuery
+}
+
+// detectAnomalies watches the per-minute volume, 5xx and 4xx ratios, p95
+// latency and the volume of the busiest routes. Each minute is scored with a
+// robust z-score against the median and MAD of the same minute on earlier
+// days when the history has enough of them, and against an EWMA of the
+// preceding minutes otherwise. Consecutive anomalous minutes are merged, and
+// a second read finds the values that changed the most during each anomaly.
+func detectAnomalies(src *Source, start, end time.Time, opts ReportOptions, q AnomalyQuery) (*AnomalyReport, error) {
+	origin := start.Add(-time.Duration(q.History) * 24 * time.Hour).Truncate(time.Minute)
+	d := &detector{
+		origin:  origin,
+		minutes: make([]*minuteStats, int(end.Sub(origin)/time.Minute)+1),
+		first:   int(start.Sub(origin) / time.Minute),
+		q:       q,
+	}
+	firstSeen, lastSeen := len(d.minutes), -1
+	_, err := src.ReadEntries(func(entry LogEntry) {
+		if entry.TimeStamp.Before(origin) || entry.TimeStamp.After(end) {
+			return
+		}
+		i := d.index(entry.TimeStamp)
+		firstSeen, lastSeen = min(firstSeen, i), max(lastSeen, i)
+		opts.Mask.Apply(&entry)
+		if !opts.Filter.Match(&entry) {
+			return
+		}
+		m := d.minutes[i]
+		if m == nil {
+			m = &minuteStats{routes: make(map[string]int)}
+			d.minutes[i] = m
+		}
+		m.count++
+		switch {
+		case entry.Status >= 500:
+			m.c5xx++
+		case entry.Status >= 400:
+			m.c4xx++
+		}
+		m.latencies = append(m.latencies, requestDuration(&entry))
+		m.routes[requestPath(entry.RequestURI)]++
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	routes := make(map[string]int)
+	for i := firstSeen; i <= lastSeen; i++ {
+		m := d.minutes[i]
+		if m == nil {
+			d.minutes[i] = &minuteStats{}
+			continue
+		}
+		sort.Float64s(m.latencies)
+		m.p95 = percentile(m.latencies, 95)
+		m.latencies = nil
+		if i >= d.first {
+			for route, n := range m.routes {
+				routes[route] += n
+			}
+		}
+	}
+
+	var anomalies []Anomaly
+	for i := range anomalyMetrics {
+		anomalies = append(anomalies, d.detect(&anomalyMetrics[i], "")...)
+	}
+	for _, route := range topKeys(routes, anomalyRoutes) {
+		metric := routeMetric(route)
+		anomalies = append(anomalies, d.detect(&metric, route)...)
+	}
+
+	// Keep the strongest, shown in time order
+	slices.SortFunc(anomalies, func(a, b Anomaly) int {
+		return cmp.Compare(math.Abs(b.Score), math.Abs(a.Score))
+	})
+	anomalies = anomalies[:min(len(anomalies), maxAnomalies)]
+	slices.SortStableFunc(anomalies, func(a, b Anomaly) int {
+		return a.Start.Compare(b.Start)
+	})
+
+	coverage := origin.Add(time.Duration(firstSeen) * time.Minute)
+	if err := findContributors(src, opts, anomalies, coverage); err != nil {
+		return nil, err
+	}
+
+	return &AnomalyReport{
+		Date:      formatRange(start, end),
+		Source:    src.Name,
+		Filter:    opts.Filter.String(),
+		Threshold: q.Threshold,
+		History:   q.History,
+		Anomalies: anomalies,
+	}, nil
+}
+
+func (d *detector) index(t time.Time) int {
+	return int(t.Sub(d.origin) / time.Minute)
+}
+
+// flaggedMinute is a minute scoring above the threshold
+type flaggedMinute struct {
+	i                int
+	actual, expected float64
+	score            float64
+	baseline         string
+}
+
+// detect scores the minutes of the range and merges the flagged ones into
+// anomalies, allowing a gap of one minute
+func (d *detector) detect(metric *anomalyMetric, route string) []Anomaly {
+	var mean, variance float64
+	var seen int
+	var flagged []flaggedMinute
+	for i, m := range d.minutes {
+		if m == nil {
+			continue
+		}
+		v, ok := metric.value(m)
+		if !ok {
+			continue
+		}
+		if i >= d.first {
+			if f, ok := d.score(metric, i, m, v, mean, variance, seen); ok {
+				// Anomalous minutes stay out of the EWMA so it doesn't
+				// adapt to the anomaly and end it early
+				flagged = append(flagged, f)
+				continue
+			}
+		}
+		if seen == 0 {
+			mean = v
+		} else {
+			diff := v - mean
+			incr := ewmaAlpha * diff
+			mean += incr
+			variance = (1 - ewmaAlpha) * (variance + diff*incr)
+		}
+		seen++
+	}
+
+	var anomalies []Anomaly
+	for len(flagged) > 0 {
+		run := 1
+		for run < len(flagged) && flagged[run].i-flagged[run-1].i <= 2 &&
+			(flagged[run].score > 0) == (flagged[0].score > 0) {
+			run++
+		}
+		anomalies = append(anomalies, d.anomaly(metric, route, flagged[:run]))
+		flagged = flagged[run:]
+	}
+	return anomalies
+}
+
+// score compares a minute with its seasonal baseline, or the EWMA of the
+// preceding minutes when there's not enough history
+func (d *detector) score(metric *anomalyMetric, i int, m *minuteStats, v, mean, variance float64, seen int) (flaggedMinute, bool) {
+	var seasonal []float64
+	for k := 1; k <= d.q.History; k++ {
+		j := i - k*24*60
+		if j < 0 {
+			break
+		}
+		if past := d.minutes[j]; past != nil {
+			if pv, ok := metric.value(past); ok {
+				seasonal = append(seasonal, pv)
+			}
+		}
+	}
+
+	f := flaggedMinute{i: i, actual: v}
+	var scale float64
+	switch {
+	case len(seasonal) >= minSeasonalSamples:
+		f.expected = median(seasonal)
+		deviations := make([]float64, len(seasonal))
+		for k, s := range seasonal {
+			deviations[k] = math.Abs(s - f.expected)
+		}
+		// MAD scaled to be comparable to a standard deviation
+		scale = 1.4826 * median(deviations)
+		f.baseline = "seasonal"
+	case seen >= ewmaWarmup:
+		f.expected = mean
+		scale = math.Sqrt(variance)
+		f.baseline = "ewma"
+	default:
+		return f, false
+	}
+	scale = max(scale, metric.floor(f.expected, m))
+	f.score = (v - f.expected) / scale
+	return f, math.Abs(f.score) >= d.q.Threshold && math.Abs(v-f.expected) >= metric.change
+}
+
+// anomaly describes a run of flagged minutes by its peak
+func (d *detector) anomaly(metric *anomalyMetric, route string, run []flaggedMinute) Anomaly {
+	peak := run[0]
+	for _, f := range run[1:] {
+		if math.Abs(f.score) > math.Abs(peak.score) {
+			peak = f
+		}
+	}
+	last := run[len(run)-1]
+	a := Anomaly{
+		Metric:          metric.name,
+		Route:           route,
+		Direction:       "spike",
+		Start:           d.origin.Add(time.Duration(run[0].i) * time.Minute),
+		End:             d.origin.Add(time.Duration(last.i+1)*time.Minute - time.Second),
+		Minutes:         last.i - run[0].i + 1,
+		Actual:          peak.actual,
+		Expected:        peak.expected,
+		Score:           math.Round(peak.score*100) / 100,
+		Baseline:        peak.baseline,
+		Change:          "new",
+		ActualDisplay:   metric.format(peak.actual),
+		ExpectedDisplay: metric.format(peak.expected),
+		metric:          metric,
+	}
+	if peak.score < 0 {
+		a.Direction = "drop"
+	}
+	if peak.expected != 0 {
+		a.Change = fmt.Sprintf("%+.0f%%", 100*(peak.actual-peak.expected)/peak.expected)
+	}
+	return a
+}
+
+// median of values, which it sorts
+func median(values []float64) float64 {
+	sort.Float64s(values)
+	n := len(values)
+	if n%2 == 1 {
+		return values[n/2]
+	}
+	return (values[n/2-1] + values[n/2]) / 2
+}
+
+// contributorFields are the dimensions searched for contributors
+var contributorFields = []struct {
+	name  string
+	value func(e *LogEntry) string
+}{
+	{"path", func(e *LogEntry) string { return requestPath(e.RequestURI) }},
+	{"status", func(e *LogEntry) string { return strconv.Itoa(e.Status) }},
+	{"ip", func(e *LogEntry) string { return e.IP }},
+	{"country", func(e *LogEntry) string { return e.Country }},
+	{"ua", func(e *LogEntry) string { return e.UserAgent }},
+}
+
+// findContributors compares the entries behind each anomaly with those of
+// the hour before it, counted from coverage at the earliest
+func findContributors(src *Source, opts ReportOptions, anomalies []Anomaly, coverage time.Time) error {
+	if len(anomalies) == 0 {
+		return nil
+	}
+	type counts map[[2]string]int
+	during := make([]counts, len(anomalies))
+	before := make([]counts, len(anomalies))
+	baseStart := make([]time.Time, len(anomalies))
+	for i, a := range anomalies {
+		during[i], before[i] = make(counts), make(counts)
+		baseStart[i] = a.Start.Add(-contributorBaseline)
+		if baseStart[i].Before(coverage) {
+			baseStart[i] = coverage
+		}
+	}
+
+	_, err := src.ReadEntries(func(entry LogEntry) {
+		masked := false
+		for i := range anomalies {
+			a := &anomalies[i]
+			var c counts
+			switch {
+			case entry.TimeStamp.Before(baseStart[i]) || entry.TimeStamp.After(a.End):
+				continue
+			case entry.TimeStamp.Before(a.Start):
+				c = before[i]
+			default:
+				c = during[i]
+			}
+			if !masked {
+				opts.Mask.Apply(&entry)
+				if !opts.Filter.Match(&entry) {
+					return
+				}
+				masked = true
+			}
+			if !a.metric.match(&entry, a) {
+				continue
+			}
+			for _, field := range contributorFields {
+				if field.name == "path" && a.Route != "" {
+					continue
+				}
+				if value := field.value(&entry); value != "" {
+					c[[2]string{field.name, value}]++
+				}
+			}
+		}
+	})
+	if err != nil {
+		return err
+	}
+
+	for i := range anomalies {
+		a := &anomalies[i]
+		scale := 0.0
+		if baseMinutes := a.Start.Sub(baseStart[i]).Minutes(); baseMinutes > 0 {
+			scale = float64(a.Minutes) / baseMinutes
+		}
+		keys := make(map[[2]string]bool)
+		for key := range during[i] {
+			keys[key] = true
+		}
+		for key := range before[i] {
+			keys[key] = true
+		}
+		var contributors []Contributor
+		for key := range keys {
+			expected := float64(before[i][key]) * scale
+			delta := float64(during[i][key]) - expected
+			if (delta > 0) != (a.Direction == "spike") || delta == 0 {
+				continue
+			}
+			contributors = append(contributors, Contributor{
+				Field:    key[0],
+				Value:    key[1],
+				Count:    during[i][key],
+				Expected: math.Round(expected*10) / 10,
+				Delta:    math.Round(delta*10) / 10,
+			})
+		}
+		slices.SortFunc(contributors, func(x, y Contributor) int {
+			if c := cmp.Compare(math.Abs(y.Delta), math.Abs(x.Delta)); c != 0 {
+				return c
+			}
+			if c := cmp.Compare(x.Field, y.Field); c != 0 {
+				return c
+			}
+			return cmp.Compare(x.Value, y.Value)
+		})
+		a.Contributors = contributors[:min(len(contributors), maxContributors)]
+	}
+	return nil
+}
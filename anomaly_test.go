@@ -0,0 +1,239 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"slices"
+	"testing"
+	"time"
+)
+
+var anomalyOrigin = time.Date(2024, 2, 19, 0, 0, 0, 0, time.UTC)
+
+// newTestDetector returns a detector over minutes of count requests, the
+// range being the last rangeMinutes of them
+func newTestDetector(minutes, rangeMinutes, count, history int) *detector {
+	d := &detector{
+		origin:  anomalyOrigin,
+		minutes: make([]*minuteStats, minutes),
+		first:   minutes - rangeMinutes,
+		q:       AnomalyQuery{Threshold: defaultAnomalyThreshold, History: history},
+	}
+	for i := range d.minutes {
+		// A little noise, so the baseline has some variance
+		d.minutes[i] = &minuteStats{count: count + i%3}
+	}
+	return d
+}
+
+func anomalyMetricNamed(t *testing.T, name string) *anomalyMetric {
+	t.Helper()
+	i := slices.IndexFunc(anomalyMetrics, func(m anomalyMetric) bool { return m.name == name })
+	if i < 0 {
+		t.Fatalf("no metric %q", name)
+	}
+	return &anomalyMetrics[i]
+}
+
+// anomalyMinutes summarizes anomalies as their first minute, length and
+// direction
+func anomalyMinutes(d *detector, anomalies []Anomaly) []string {
+	var runs []string
+	for _, a := range anomalies {
+		runs = append(runs, fmt.Sprintf("%d+%d %s %s", d.index(a.Start), a.Minutes, a.Direction, a.Baseline))
+	}
+	return runs
+}
+
+func TestDetectEWMASpike(t *testing.T) {
+	d := newTestDetector(60, 60, 100, 0)
+	d.minutes[40].count = 300
+	// Minutes without entries inside the logs' span count as no requests,
+	// those outside it aren't judged
+	d.minutes[50] = &minuteStats{}
+	d.minutes[55] = nil
+
+	volume := anomalyMetricNamed(t, "volume")
+	anomalies := d.detect(volume, "")
+	want := []string{"40+1 spike ewma", "50+1 drop ewma"}
+	if got := anomalyMinutes(d, anomalies); !slices.Equal(got, want) {
+		t.Fatalf("anomalies %q, want %q", got, want)
+	}
+	a := anomalies[0]
+	if a.Actual != 300 || a.Expected < 100 || a.Expected > 102 || a.Score < defaultAnomalyThreshold || a.Change != "+197%" {
+		t.Errorf("spike %+v", a)
+	}
+	if !a.End.Equal(a.Start.Add(59 * time.Second)) {
+		t.Errorf("spike from %v to %v", a.Start, a.End)
+	}
+
+	// The EWMA needs ewmaWarmup minutes before it judges anything
+	d = newTestDetector(60, 60, 100, 0)
+	d.minutes[ewmaWarmup-1].count = 300
+	if anomalies := d.detect(volume, ""); len(anomalies) != 0 {
+		t.Errorf("flagged during the warmup: %q", anomalyMinutes(d, anomalies))
+	}
+}
+
+func TestDetectSeasonalSpike(t *testing.T) {
+	const day = 24 * 60
+	d := newTestDetector(3*day+60, 60, 100, 7)
+	// A daily peak at minute 30 of the range is expected, the same volume at
+	// minute 45 isn't
+	for k := range 4 {
+		d.minutes[k*day+d.first-3*day+30].count = 500
+	}
+	d.minutes[d.first+45].count = 500
+
+	anomalies := d.detect(anomalyMetricNamed(t, "volume"), "")
+	if got, want := anomalyMinutes(d, anomalies), []string{fmt.Sprintf("%d+1 spike seasonal", d.first+45)}; !slices.Equal(got, want) {
+		t.Fatalf("anomalies %q, want %q", got, want)
+	}
+	if a := anomalies[0]; a.Expected != 100 && a.Expected != 101 && a.Expected != 102 {
+		t.Errorf("expected %v from the same minute on earlier days", a.Expected)
+	}
+
+	// With fewer than minSeasonalSamples earlier days the EWMA is used, and
+	// flags the daily peak too
+	d = newTestDetector(day+60, 60, 100, 7)
+	d.minutes[d.first-day+30].count = 500
+	d.minutes[d.first+30].count = 500
+	d.minutes[d.first+45].count = 500
+	want := []string{fmt.Sprintf("%d+1 spike ewma", d.first+30), fmt.Sprintf("%d+1 spike ewma", d.first+45)}
+	if got := anomalyMinutes(d, d.detect(anomalyMetricNamed(t, "volume"), "")); !slices.Equal(got, want) {
+		t.Errorf("one earlier day: %q, want %q", got, want)
+	}
+}
+
+func TestDetectRatioFloor(t *testing.T) {
+	ratio := anomalyMetricNamed(t, "5xx ratio")
+
+	// A single 5xx in a series without any isn't an anomaly
+	d := newTestDetector(60, 60, 20, 0)
+	d.minutes[30].c5xx = 1
+	if anomalies := d.detect(ratio, ""); len(anomalies) != 0 {
+		t.Errorf("single 5xx flagged: %q", anomalyMinutes(d, anomalies))
+	}
+
+	d.minutes[30].c5xx = 8
+	if got := anomalyMinutes(d, d.detect(ratio, "")); !slices.Equal(got, []string{"30+1 spike ewma"}) {
+		t.Errorf("8 5xx: %q", got)
+	}
+
+	// Minutes with too few requests aren't judged
+	d = newTestDetector(60, 60, 20, 0)
+	d.minutes[30] = &minuteStats{count: minRatioRequests - 1, c5xx: minRatioRequests - 1}
+	if anomalies := d.detect(ratio, ""); len(anomalies) != 0 {
+		t.Errorf("quiet minute flagged: %q", anomalyMinutes(d, anomalies))
+	}
+}
+
+func TestDetectMergesRuns(t *testing.T) {
+	d := newTestDetector(90, 90, 100, 0)
+	// One minute apart, merged
+	d.minutes[30].count = 300
+	d.minutes[32].count = 400
+	// Two minutes apart, separate
+	d.minutes[50].count = 300
+	d.minutes[53].count = 300
+	// A drop right after a spike is an anomaly of its own
+	d.minutes[70].count = 300
+	d.minutes[71].count = 0
+
+	anomalies := d.detect(anomalyMetricNamed(t, "volume"), "")
+	want := []string{"30+3 spike ewma", "50+1 spike ewma", "53+1 spike ewma", "70+1 spike ewma", "71+1 drop ewma"}
+	if got := anomalyMinutes(d, anomalies); !slices.Equal(got, want) {
+		t.Fatalf("anomalies %q, want %q", got, want)
+	}
+	// A merged run is described by its peak minute
+	if anomalies[0].Actual != 400 {
+		t.Errorf("peak of the run %v, want 400", anomalies[0].Actual)
+	}
+}
+
+func TestDetectAnomaliesContributors(t *testing.T) {
+	var lines []string
+	request := func(minute, second int, ip, path string) {
+		lines = append(lines, fmt.Sprintf(`%s - - [19/Feb/2024:16:%02d:%02d +0000] "GET %s HTTP/1.1" 200 1 "-" "curl" 0.1 - - - -`, ip, minute, second, path))
+	}
+	for minute := range 30 {
+		for i := range 20 {
+			request(minute, i, fmt.Sprintf("10.0.0.%d", i%4+1), "/a")
+		}
+	}
+	// The spike, on top of the usual requests
+	for i := range 100 {
+		if i < 70 {
+			request(20, 20+i%30, "10.9.9.9", "/b")
+		} else {
+			request(20, 20+i%30, "10.8.8.8", "/a")
+		}
+	}
+	src := newTestSource(t, lines)
+
+	start := time.Date(2024, 2, 19, 16, 0, 0, 0, time.UTC)
+	report, err := detectAnomalies(src, start, start.Add(30*time.Minute), ReportOptions{}, AnomalyQuery{Threshold: defaultAnomalyThreshold})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var volume *Anomaly
+	for i, a := range report.Anomalies {
+		if a.Metric == "volume" {
+			volume = &report.Anomalies[i]
+		}
+	}
+	if volume == nil || !volume.Start.Equal(start.Add(20*time.Minute)) || volume.Actual != 120 {
+		t.Fatalf("no volume spike at 16:20 in %+v", report.Anomalies)
+	}
+
+	// Ranked by their change from the 20 minutes before, scaled to one minute
+	want := []Contributor{
+		{Field: "status", Value: "200", Count: 120, Expected: 20, Delta: 100},
+		{Field: "ua", Value: "curl", Count: 120, Expected: 20, Delta: 100},
+		{Field: "ip", Value: "10.9.9.9", Count: 70, Expected: 0, Delta: 70},
+		{Field: "path", Value: "/b", Count: 70, Expected: 0, Delta: 70},
+		{Field: "ip", Value: "10.8.8.8", Count: 30, Expected: 0, Delta: 30},
+	}
+	if !slices.Equal(volume.Contributors, want) {
+		t.Errorf("contributors\n%+v\nwant\n%+v", volume.Contributors, want)
+	}
+
+	// The route's own anomaly doesn't list the path
+	for _, a := range report.Anomalies {
+		if a.Route == "/b" {
+			if slices.ContainsFunc(a.Contributors, func(c Contributor) bool { return c.Field == "path" }) {
+				t.Errorf("route anomaly contributors %+v", a.Contributors)
+			}
+			return
+		}
+	}
+	t.Errorf("no route volume anomaly for /b in %+v", report.Anomalies)
+}
+
+func TestParseAnomalyQuery(t *testing.T) {
+	tests := []struct {
+		query string
+		want  AnomalyQuery
+		err   string
+	}{
+		{"", AnomalyQuery{Threshold: defaultAnomalyThreshold, History: defaultAnomalyHistory}, ""},
+		{"threshold=5&history=0", AnomalyQuery{Threshold: 5, History: 0}, ""},
+		{"threshold=0", AnomalyQuery{}, "threshold must be a positive number"},
+		{"threshold=Inf", AnomalyQuery{}, "threshold must be a positive number"},
+		{"history=29", AnomalyQuery{}, "history must be a number of days up to 28"},
+		{"history=-1", AnomalyQuery{}, "history must be a number of days up to 28"},
+	}
+	for _, tt := range tests {
+		values, _ := url.ParseQuery(tt.query)
+		q, err := parseAnomalyQuery(values)
+		if tt.err != "" {
+			if err == nil || err.Error() != tt.err {
+				t.Errorf("%s: error %v, want %q", tt.query, err, tt.err)
+			}
+			continue
+		}
+		if err != nil || q != tt.want {
+			t.Errorf("%s: %+v, %v, want %+v", tt.query, q, err, tt.want)
+		}
+	}
+}
@@ -0,0 +1,773 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// App serves the dashboards and API of all configured sources
+type App struct {
+	cfg     *Config
+	sources []*Source
+	roles   *RolesConfig
+	alerts  *AlertEngine // nil without alert rules
+	metrics *Metrics     // nil unless the exporter is enabled
+}
+
+// NewApp creates the web application for the given sources
+func NewApp(cfg *Config, sources []*Source, roles *RolesConfig, alerts *AlertEngine, metrics *Metrics) *App {
+	return &App{cfg: cfg, sources: sources, roles: roles, alerts: alerts, metrics: metrics}
+}
+
+// Routes registers the dashboard and API handlers
+func (a *App) Routes(mux *http.ServeMux) {
+	mux.HandleFunc("GET /{$}", a.handleIndex)
+	mux.HandleFunc("GET /site/{site}", a.handleSite)
+	mux.HandleFunc("GET /site/{site}/table/{table}", a.handleTable)
+	mux.HandleFunc("GET /site/{site}/group", a.handleGroup)
+	mux.HandleFunc("GET /site/{site}/logs", a.handleLogs)
+	mux.HandleFunc("GET /site/{site}/entry", a.handleEntry)
+	mux.HandleFunc("GET /site/{site}/compare", a.handleCompare)
+	mux.HandleFunc("GET /site/{site}/anomalies", a.handleAnomalies)
+	mux.HandleFunc("GET /site/{site}/upstreams", a.handleUpstreams)
+	mux.HandleFunc("GET /site/{site}/errors", a.handleErrors)
+	mux.HandleFunc("GET /site/{site}/cache", a.handleCache)
+	mux.HandleFunc("GET /api/sites", a.handleSitesAPI)
+	mux.HandleFunc("GET /api/summary", a.handleSummaryAPI)
+	mux.HandleFunc("GET /api/table", a.handleTableAPI)
+	mux.HandleFunc("GET /api/group", a.handleGroupAPI)
+	mux.HandleFunc("GET /api/logs", a.handleLogsAPI)
+	mux.HandleFunc("GET /api/entry", a.handleEntryAPI)
+	mux.HandleFunc("GET /api/compare", a.handleCompareAPI)
+	mux.HandleFunc("GET /api/anomalies", a.handleAnomaliesAPI)
+	mux.HandleFunc("GET /api/upstreams", a.handleUpstreamsAPI)
+	mux.HandleFunc("GET /api/errors", a.handleErrorsAPI)
+	mux.HandleFunc("GET /api/cache", a.handleCacheAPI)
+	mux.HandleFunc("GET /alerts", a.handleAlerts)
+	mux.HandleFunc("GET /api/alerts", a.handleAlertsAPI)
+	mux.HandleFunc("POST /api/silences", a.handleAddSilence)
+	mux.HandleFunc("DELETE /api/silences/{id}", a.handleRemoveSilence)
+	if a.metrics != nil {
+		mux.HandleFunc("GET /metrics", a.handleMetrics)
+	}
+}
+
+// visibleSources returns the sources the user's roles allow
+func (a *App) visibleSources(access Access) []*Source {
+	var visible []*Source
+	for _, src := range a.sources {
+		if access.CanView(src.Name) {
+			visible = append(visible, src)
+		}
+	}
+	return visible
+}
+
+// siteNames lists the visible sources for the site switcher
+func siteNames(sources []*Source) []string {
+	names := make([]string, len(sources))
+	for i, src := range sources {
+		names[i] = src.Name
+	}
+	return names
+}
+
+// handleIndex shows the overview, or the only site's dashboard when the user
+// can see a single source
+func (a *App) handleIndex(w http.ResponseWriter, r *http.Request) {
+	// Links from before multi-site mode used ?source=name
+	if name := r.URL.Query().Get("source"); name != "" {
+		http.Redirect(w, r, "/site/"+url.PathEscape(name), http.StatusFound)
+		return
+	}
+
+	access := a.roles.AccessFor(userFromRequest(r))
+	visible := a.visibleSources(access)
+	switch len(visible) {
+	case 0:
+		http.Error(w, "Forbidden", http.StatusForbidden)
+	case 1:
+		a.renderSite(w, r, visible[0].Name)
+	default:
+		overview, ok := a.overview(w, r)
+		if !ok {
+			return
+		}
+		render(w, overviewTemplate, overview)
+	}
+}
+
+func (a *App) handleSite(w http.ResponseWriter, r *http.Request) {
+	a.renderSite(w, r, r.PathValue("site"))
+}
+
+func (a *App) renderSite(w http.ResponseWriter, r *http.Request, name string) {
+	tables, err := parseTableQueries(r.URL.Query())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	viewData, ok := a.report(w, r, name, tables)
+	if !ok {
+		return
+	}
+	render(w, dashboardTemplate, viewData)
+}
+
+func (a *App) handleSummaryAPI(w http.ResponseWriter, r *http.Request) {
+	tables, err := parseTableQueries(r.URL.Query())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	viewData, ok := a.report(w, r, r.URL.Query().Get("source"), tables)
+	if !ok {
+		return
+	}
+	writeJSON(w, viewData)
+}
+
+func (a *App) handleTable(w http.ResponseWriter, r *http.Request) {
+	view, ok := a.table(w, r, r.PathValue("site"), r.PathValue("table"))
+	if !ok {
+		return
+	}
+	render(w, tableTemplate, view)
+}
+
+func (a *App) handleTableAPI(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	view, ok := a.table(w, r, query.Get("source"), query.Get("table"))
+	if !ok {
+		return
+	}
+	writeJSON(w, view)
+}
+
+// table builds the report of a site with a single table paged by the
+// request's page, limit, sort and order parameters
+func (a *App) table(w http.ResponseWriter, r *http.Request, name, table string) (*TableView, bool) {
+	def, found := findTableDef(table)
+	if !found {
+		http.Error(w, "Unknown table", http.StatusNotFound)
+		return nil, false
+	}
+	q, err := parseTableQuery(r.URL.Query(), "")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return nil, false
+	}
+
+	viewData, ok := a.report(w, r, name, map[string]TableQuery{table: q})
+	if !ok {
+		return nil, false
+	}
+	return newTableView(viewData, def), true
+}
+
+func (a *App) handleSitesAPI(w http.ResponseWriter, r *http.Request) {
+	overview, ok := a.overview(w, r)
+	if !ok {
+		return
+	}
+	writeJSON(w, overview)
+}
+
+func (a *App) handleGroup(w http.ResponseWriter, r *http.Request) {
+	report, ok := a.group(w, r, r.PathValue("site"))
+	if !ok {
+		return
+	}
+	render(w, groupTemplate, report)
+}
+
+func (a *App) handleGroupAPI(w http.ResponseWriter, r *http.Request) {
+	report, ok := a.group(w, r, r.URL.Query().Get("source"))
+	if !ok {
+		return
+	}
+	writeJSON(w, report)
+}
+
+// group builds a grouping of the named source from the request's by,
+// metrics and paging parameters
+func (a *App) group(w http.ResponseWriter, r *http.Request, name string) (*GroupReport, bool) {
+	q, err := parseGroupQuery(r.URL.Query(), a.cfg.TopN)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return nil, false
+	}
+	req, ok := a.siteRequest(w, r, name)
+	if !ok {
+		return nil, false
+	}
+
+	report, err := buildGroupReport([]*Source{req.src}, req.start, req.end, req.opts, q)
+	if err != nil {
+		log.Printf("Error reading source %s: %v", req.src.Name, err)
+		http.Error(w, "Error opening file", http.StatusInternalServerError)
+		return nil, false
+	}
+	report.Links = groupLinks(report)
+	report.Chips = filterChips(r.URL, req.opts.Filter)
+	report.User = req.user
+	report.Sites = req.sites
+	return report, true
+}
+
+func (a *App) handleLogs(w http.ResponseWriter, r *http.Request) {
+	result, ok := a.logs(w, r, r.PathValue("site"))
+	if !ok {
+		return
+	}
+	render(w, logsTemplate, result)
+}
+
+func (a *App) handleLogsAPI(w http.ResponseWriter, r *http.Request) {
+	result, ok := a.logs(w, r, r.URL.Query().Get("source"))
+	if !ok {
+		return
+	}
+	writeJSON(w, result)
+}
+
+// logs searches the raw lines of the named source
+func (a *App) logs(w http.ResponseWriter, r *http.Request, name string) (*ExploreResult, bool) {
+	q, err := parseExploreQuery(r.URL.Query(), a.cfg.TopN)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return nil, false
+	}
+	req, ok := a.rawRequest(w, r, name)
+	if !ok {
+		return nil, false
+	}
+
+	result, err := explore(req.src, req.start, req.end, req.opts.Filter, q)
+	if err != nil {
+		log.Printf("Error reading source %s: %v", req.src.Name, err)
+		http.Error(w, "Error opening file", http.StatusInternalServerError)
+		return nil, false
+	}
+	result.Links = exploreLinks(result)
+	result.Chips = filterChips(r.URL, req.opts.Filter)
+	result.User = req.user
+	result.Sites = req.sites
+	return result, true
+}
+
+func (a *App) handleEntry(w http.ResponseWriter, r *http.Request) {
+	view, ok := a.entry(w, r, r.PathValue("site"))
+	if !ok {
+		return
+	}
+	render(w, entryTemplate, view)
+}
+
+func (a *App) handleEntryAPI(w http.ResponseWriter, r *http.Request) {
+	view, ok := a.entry(w, r, r.URL.Query().Get("source"))
+	if !ok {
+		return
+	}
+	writeJSON(w, view)
+}
+
+// entry looks up the line a permalink points to
+func (a *App) entry(w http.ResponseWriter, r *http.Request, name string) (*EntryView, bool) {
+	file, offset, hash, context, err := parseEntryQuery(r.URL.Query())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return nil, false
+	}
+	req, ok := a.rawRequest(w, r, name)
+	if !ok {
+		return nil, false
+	}
+
+	lines, err := findEntry(req.src, file, offset, hash, context)
+	if errors.Is(err, errEntryNotFound) {
+		http.Error(w, "Log entry not found, the file may have been rotated away", http.StatusNotFound)
+		return nil, false
+	}
+	if err != nil {
+		log.Printf("Error reading source %s: %v", req.src.Name, err)
+		http.Error(w, "Error opening file", http.StatusInternalServerError)
+		return nil, false
+	}
+
+	view := &EntryView{
+		Lines:   lines,
+		Context: context,
+		Source:  req.src.Name,
+		Filter:  req.opts.Filter.String(),
+		Chips:   filterChips(r.URL, req.opts.Filter),
+		Sites:   req.sites,
+		User:    req.user,
+	}
+	if context < maxContextLines {
+		more := r.URL.Query()
+		more.Set("context", strconv.Itoa(min(context*2+5, maxContextLines)))
+		view.MoreContext = r.URL.Path + "?" + more.Encode()
+	}
+	return view, true
+}
+
+func (a *App) handleCompare(w http.ResponseWriter, r *http.Request) {
+	report, ok := a.compare(w, r, r.PathValue("site"))
+	if !ok {
+		return
+	}
+	render(w, compareTemplate, report)
+}
+
+func (a *App) handleCompareAPI(w http.ResponseWriter, r *http.Request) {
+	report, ok := a.compare(w, r, r.URL.Query().Get("source"))
+	if !ok {
+		return
+	}
+	writeJSON(w, report)
+}
+
+// compare compares two periods of the named source, the configured range or
+// the request's start and end against the base period
+func (a *App) compare(w http.ResponseWriter, r *http.Request, name string) (*CompareReport, bool) {
+	q, err := parseCompareQuery(r.URL.Query(), a.cfg.Range)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return nil, false
+	}
+	req, ok := a.siteRequest(w, r, name)
+	if !ok {
+		return nil, false
+	}
+	baseStart, baseEnd, start, end, err := q.Resolve(time.Now(), req.src.Location())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return nil, false
+	}
+
+	report, err := buildCompareReport(req.src, baseStart, baseEnd, start, end, req.opts)
+	if err != nil {
+		log.Printf("Error reading source %s: %v", req.src.Name, err)
+		http.Error(w, "Error opening file", http.StatusInternalServerError)
+		return nil, false
+	}
+	report.Query = q
+	report.Chips = filterChips(r.URL, req.opts.Filter)
+	report.User = req.user
+	report.Sites = req.sites
+	return report, true
+}
+
+func (a *App) handleAnomalies(w http.ResponseWriter, r *http.Request) {
+	report, ok := a.anomalies(w, r, r.PathValue("site"))
+	if !ok {
+		return
+	}
+	render(w, anomaliesTemplate, report)
+}
+
+func (a *App) handleAnomaliesAPI(w http.ResponseWriter, r *http.Request) {
+	report, ok := a.anomalies(w, r, r.URL.Query().Get("source"))
+	if !ok {
+		return
+	}
+	writeJSON(w, report)
+}
+
+// anomalies runs the anomaly detector over the date range of the named
+// source
+func (a *App) anomalies(w http.ResponseWriter, r *http.Request, name string) (*AnomalyReport, bool) {
+	q, err := parseAnomalyQuery(r.URL.Query())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return nil, false
+	}
+	req, ok := a.siteRequest(w, r, name)
+	if !ok {
+		return nil, false
+	}
+
+	report, err := detectAnomalies(req.src, req.start, req.end, req.opts, q)
+	if err != nil {
+		log.Printf("Error reading source %s: %v", req.src.Name, err)
+		http.Error(w, "Error opening file", http.StatusInternalServerError)
+		return nil, false
+	}
+	report.Chips = filterChips(r.URL, req.opts.Filter)
+	report.User = req.user
+	report.Sites = req.sites
+	return report, true
+}
+
+func (a *App) handleUpstreams(w http.ResponseWriter, r *http.Request) {
+	report, ok := a.upstreams(w, r, r.PathValue("site"))
+	if !ok {
+		return
+	}
+	render(w, upstreamsTemplate, report)
+}
+
+func (a *App) handleUpstreamsAPI(w http.ResponseWriter, r *http.Request) {
+	report, ok := a.upstreams(w, r, r.URL.Query().Get("source"))
+	if !ok {
+		return
+	}
+	writeJSON(w, report)
+}
+
+// upstreams aggregates the upstream attempts over the date range of the
+// named source
+func (a *App) upstreams(w http.ResponseWriter, r *http.Request, name string) (*UpstreamReport, bool) {
+	q, err := parseUpstreamQuery(r.URL.Query(), a.cfg.TopN)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return nil, false
+	}
+	req, ok := a.siteRequest(w, r, name)
+	if !ok {
+		return nil, false
+	}
+
+	report, err := buildUpstreamReport(req.src, req.start, req.end, req.opts, q)
+	if err != nil {
+		log.Printf("Error reading source %s: %v", req.src.Name, err)
+		http.Error(w, "Error opening file", http.StatusInternalServerError)
+		return nil, false
+	}
+	report.Chips = filterChips(r.URL, req.opts.Filter)
+	report.User = req.user
+	report.Sites = req.sites
+	return report, true
+}
+
+func (a *App) handleCache(w http.ResponseWriter, r *http.Request) {
+	report, ok := a.cache(w, r, r.PathValue("site"))
+	if !ok {
+		return
+	}
+	render(w, cacheTemplate, report)
+}
+
+func (a *App) handleCacheAPI(w http.ResponseWriter, r *http.Request) {
+	report, ok := a.cache(w, r, r.URL.Query().Get("source"))
+	if !ok {
+		return
+	}
+	writeJSON(w, report)
+}
+
+// cache aggregates the cache statuses over the date range of the named
+// source
+func (a *App) cache(w http.ResponseWriter, r *http.Request, name string) (*CacheReport, bool) {
+	q, err := parseCacheQuery(r.URL.Query(), a.cfg.TopN)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return nil, false
+	}
+	req, ok := a.siteRequest(w, r, name)
+	if !ok {
+		return nil, false
+	}
+
+	report, err := buildCacheReport(req.src, req.start, req.end, req.opts, q)
+	if err != nil {
+		log.Printf("Error reading source %s: %v", req.src.Name, err)
+		http.Error(w, "Error opening file", http.StatusInternalServerError)
+		return nil, false
+	}
+	report.Chips = filterChips(r.URL, req.opts.Filter)
+	report.User = req.user
+	report.Sites = req.sites
+	return report, true
+}
+
+func (a *App) handleErrors(w http.ResponseWriter, r *http.Request) {
+	report, ok := a.errors(w, r, r.PathValue("site"))
+	if !ok {
+		return
+	}
+	render(w, errorsTemplate, report)
+}
+
+func (a *App) handleErrorsAPI(w http.ResponseWriter, r *http.Request) {
+	report, ok := a.errors(w, r, r.URL.Query().Get("source"))
+	if !ok {
+		return
+	}
+	writeJSON(w, report)
+}
+
+// errors reads the error log of the named source over the date range. Like
+// raw lines, error messages aren't shown to users with masked fields.
+func (a *App) errors(w http.ResponseWriter, r *http.Request, name string) (*ErrorReport, bool) {
+	q, err := parseErrorQuery(r.URL.Query(), a.cfg.TopN)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return nil, false
+	}
+	req, ok := a.rawRequest(w, r, name)
+	if !ok {
+		return nil, false
+	}
+	if req.src.ErrorLog == "" {
+		http.Error(w, "No error_log configured for this source", http.StatusNotFound)
+		return nil, false
+	}
+
+	report, err := buildErrorReport(req.src, req.start, req.end, req.opts.Filter, q)
+	if err != nil {
+		log.Printf("Error reading error log of %s: %v", req.src.Name, err)
+		http.Error(w, "Error opening file", http.StatusInternalServerError)
+		return nil, false
+	}
+	report.Chips = filterChips(r.URL, req.opts.Filter)
+	report.User = req.user
+	report.Sites = req.sites
+	return report, true
+}
+
+func (a *App) handleAlerts(w http.ResponseWriter, r *http.Request) {
+	render(w, alertsTemplate, a.alertsView(r))
+}
+
+func (a *App) handleAlertsAPI(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, a.alertsView(r))
+}
+
+// alertsView lists the alerts, silences and rules of the sources visible to
+// the user
+func (a *App) alertsView(r *http.Request) *AlertsView {
+	user := userFromRequest(r)
+	access := a.roles.AccessFor(user)
+	view := &AlertsView{
+		Alerts:   a.visibleAlerts(access, ""),
+		Silences: []Silence{},
+		Rules:    []AlertRule{},
+		Sites:    siteNames(a.visibleSources(access)),
+		User:     user,
+	}
+	for _, s := range a.alerts.Silences() {
+		if s.Source == "" || access.CanView(s.Source) {
+			view.Silences = append(view.Silences, s)
+		}
+	}
+	for _, rule := range a.alerts.Rules() {
+		if slices.ContainsFunc(a.visibleSources(access), func(src *Source) bool { return rule.appliesTo(src.Name) }) {
+			view.Rules = append(view.Rules, rule)
+		}
+	}
+	return view
+}
+
+// visibleAlerts returns the alerts of the sources the user may view, or only
+// of the named one, with the values of masked fields redacted
+func (a *App) visibleAlerts(access Access, source string) []Alert {
+	alerts := []Alert{}
+	for _, alert := range a.alerts.Alerts() {
+		if (source == "" || alert.Source == source) && access.CanView(alert.Source) {
+			alerts = append(alerts, maskAlert(access.Mask, alert))
+		}
+	}
+	return alerts
+}
+
+// handleAddSilence creates a silence from a JSON body like
+// {"rule": "api-5xx", "source": "shop", "duration": "2h", "comment": "deploy"}
+func (a *App) handleAddSilence(w http.ResponseWriter, r *http.Request) {
+	if a.alerts == nil {
+		http.Error(w, "No alert rules are configured", http.StatusNotFound)
+		return
+	}
+	// Requiring JSON keeps plain HTML forms on other sites from posting here
+	if !strings.HasPrefix(r.Header.Get("Content-Type"), "application/json") {
+		http.Error(w, "Content-Type must be application/json", http.StatusUnsupportedMediaType)
+		return
+	}
+
+	var req silenceRequest
+	decoder := json.NewDecoder(http.MaxBytesReader(w, r.Body, 64*1024))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&req); err != nil {
+		http.Error(w, "Invalid silence: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	silence, err := req.silence(time.Now(), a.alerts)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	user := userFromRequest(r)
+	if !canSilence(a.roles.AccessFor(user), silence.Source) {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+	if user != nil {
+		silence.CreatedBy = user.Name
+	}
+	silence = a.alerts.AddSilence(silence)
+	log.Printf("Alerts: silence %s added by %s until %s", silence.ID, silence.CreatedBy, silence.Until.Format(rangeLayout))
+	w.WriteHeader(http.StatusCreated)
+	writeJSON(w, silence)
+}
+
+func (a *App) handleRemoveSilence(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+	var silence *Silence
+	for _, s := range a.alerts.Silences() {
+		if s.ID == id {
+			silence = &s
+		}
+	}
+	if silence == nil {
+		http.Error(w, "No such silence", http.StatusNotFound)
+		return
+	}
+	user := userFromRequest(r)
+	if !canSilence(a.roles.AccessFor(user), silence.Source) {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+	a.alerts.RemoveSilence(id)
+	if user != nil {
+		log.Printf("Alerts: silence %s removed by %s", id, user.Name)
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handleMetrics serves the Prometheus exporter, limited to the sources the
+// scraper's roles allow
+func (a *App) handleMetrics(w http.ResponseWriter, r *http.Request) {
+	a.metrics.serve(w, r, a.roles.AccessFor(userFromRequest(r)))
+}
+
+// rawRequest is a siteRequest for the raw log lines, which can't be shown to
+// users with masked fields since a line holds more than the parsed fields
+func (a *App) rawRequest(w http.ResponseWriter, r *http.Request, name string) (*siteRequest, bool) {
+	req, ok := a.siteRequest(w, r, name)
+	if !ok {
+		return nil, false
+	}
+	if req.opts.Mask != (FieldMask{}) {
+		http.Error(w, "Raw log lines are not available to roles with masked fields", http.StatusForbidden)
+		return nil, false
+	}
+	return req, true
+}
+
+// siteRequest is what every view of a single site starts from
+type siteRequest struct {
+	user       *User
+	access     Access
+	sites      []string // visible to the user
+	src        *Source
+	start, end time.Time
+	opts       ReportOptions // the user's mask and the request's filter
+}
+
+// siteRequest checks the user's access to the named source (or the first
+// visible one) and resolves the date range and filter of the request
+func (a *App) siteRequest(w http.ResponseWriter, r *http.Request, name string) (*siteRequest, bool) {
+	user := userFromRequest(r)
+	access := a.roles.AccessFor(user)
+	src, status := pickSource(a.sources, name, access)
+	if src == nil {
+		http.Error(w, http.StatusText(status), status)
+		return nil, false
+	}
+
+	start, end, err := a.cfg.Range.Resolve(time.Now(), src.Location())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return nil, false
+	}
+	filter, err := ParseFilter(r.URL.Query().Get("q"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return nil, false
+	}
+
+	return &siteRequest{
+		user:   user,
+		access: access,
+		sites:  siteNames(a.visibleSources(access)),
+		src:    src,
+		start:  start,
+		end:    end,
+		opts:   ReportOptions{Mask: access.Mask, TopN: a.cfg.TopN, TableLimits: a.cfg.TableLimits, Filter: filter},
+	}, true
+}
+
+// report builds the dashboard report of the named source with the requested
+// pages of its tables
+func (a *App) report(w http.ResponseWriter, r *http.Request, name string, tables map[string]TableQuery) (*ViewData, bool) {
+	req, ok := a.siteRequest(w, r, name)
+	if !ok {
+		return nil, false
+	}
+
+	opts := req.opts
+	opts.Tables = tables
+	viewData, err := buildReport(req.src, req.start, req.end, opts)
+	if err != nil {
+		log.Printf("Error reading source %s: %v", req.src.Name, err)
+		http.Error(w, "Error opening file", http.StatusInternalServerError)
+		return nil, false
+	}
+	viewData.User = req.user
+	viewData.Sites = req.sites
+	viewData.Chips = filterChips(r.URL, req.opts.Filter)
+	viewData.Alerts = firingAlerts(a.visibleAlerts(req.access, req.src.Name))
+	viewData.ErrorLog = req.src.ErrorLog != "" && req.opts.Mask == (FieldMask{})
+	return viewData, true
+}
+
+// overview summarizes every source visible to the user
+func (a *App) overview(w http.ResponseWriter, r *http.Request) (*OverviewData, bool) {
+	user := userFromRequest(r)
+	access := a.roles.AccessFor(user)
+	visible := a.visibleSources(access)
+	if len(visible) == 0 {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return nil, false
+	}
+	filter, err := ParseFilter(r.URL.Query().Get("q"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return nil, false
+	}
+
+	overview, err := buildOverview(visible, a.cfg.Range, time.Now(), ReportOptions{Mask: access.Mask, Filter: filter})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return nil, false
+	}
+	overview.User = user
+	overview.Sites = siteNames(visible)
+	overview.Chips = filterChips(r.URL, filter)
+	overview.Alerts = firingAlerts(a.visibleAlerts(access, ""))
+	return overview, true
+}
+
+// pickSource returns the named source, or the first source the user may view
+// when no name is given. The status code explains a nil result; sources the
+// user may not view are reported as not found so their names don't leak.
+func pickSource(sources []*Source, name string, access Access) (*Source, int) {
+	for _, src := range sources {
+		if (name == "" || src.Name == name) && access.CanView(src.Name) {
+			return src, http.StatusOK
+		}
+	}
+	if name == "" {
+		return nil, http.StatusForbidden
+	}
+	return nil, http.StatusNotFound
+}
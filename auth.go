@@ -0,0 +1,402 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// User is the identity attached to an authenticated request
+type User struct {
+	Name   string
+	Method string // basic, token, oidc or anonymous
+	Groups []string
+}
+
+type contextKey int
+
+const userContextKey contextKey = iota
+
+const sessionCookieName = "nlv_session"
+
+// userFromRequest returns the authenticated user, or nil when auth is disabled
+func userFromRequest(r *http.Request) *User {
+	user, _ := r.Context().Value(userContextKey).(*User)
+	return user
+}
+
+// AuthConfig selects which authentication methods are enabled. Any
+// combination may be used; with none configured the dashboard stays open.
+type AuthConfig struct {
+	HtpasswdFile string        `toml:"htpasswd"`
+	TokenFile    string        `toml:"tokens"`
+	RolesFile    string        `toml:"roles"`
+	OIDC         OIDCConfig    `toml:"oidc"`
+	SessionTTL   time.Duration `toml:"session_ttl"`
+}
+
+// Auth authenticates dashboard and API requests
+type Auth struct {
+	htpasswd *Htpasswd
+	tokens   map[[32]byte]string // sha256(token) -> name
+	oidc     *OIDCProvider
+	sessions *SessionStore
+}
+
+// NewAuth loads the configured credential sources
+func NewAuth(cfg AuthConfig) (*Auth, error) {
+	a := &Auth{}
+	var err error
+
+	if cfg.HtpasswdFile != "" {
+		a.htpasswd, err = LoadHtpasswd(cfg.HtpasswdFile)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if cfg.TokenFile != "" {
+		a.tokens, err = loadTokens(cfg.TokenFile)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if cfg.OIDC.Issuer != "" {
+		ctx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
+		defer cancel()
+		a.oidc, err = NewOIDCProvider(ctx, cfg.OIDC)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if cfg.SessionTTL <= 0 {
+		cfg.SessionTTL = 12 * time.Hour
+	}
+	a.sessions = NewSessionStore(cfg.SessionTTL)
+	return a, nil
+}
+
+// Enabled reports whether any authentication method is configured
+func (a *Auth) Enabled() bool {
+	return a.htpasswd != nil || a.tokens != nil || a.oidc != nil
+}
+
+// RegisterRoutes adds the login, callback and logout endpoints
+func (a *Auth) RegisterRoutes(mux *http.ServeMux) {
+	mux.HandleFunc("/logout", a.handleLogout)
+	if a.oidc != nil {
+		mux.HandleFunc("/login", a.handleLogin)
+		mux.HandleFunc("/auth/callback", a.handleCallback)
+	}
+}
+
+// Middleware rejects unauthenticated requests and stores the user in the
+// request context for the handlers behind it.
+func (a *Auth) Middleware(next http.Handler) http.Handler {
+	if !a.Enabled() {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/login", "/auth/callback", "/logout":
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		user, err := a.authenticate(r)
+		if err != nil {
+			log.Printf("auth: %s %s from %s: %v", r.Method, r.URL.Path, r.RemoteAddr, err)
+		}
+		if user == nil {
+			a.challenge(w, r)
+			return
+		}
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), userContextKey, user)))
+	})
+}
+
+// authenticate checks, in order, the Authorization header and the session cookie
+func (a *Auth) authenticate(r *http.Request) (*User, error) {
+	if header := r.Header.Get("Authorization"); header != "" {
+		scheme, credentials, _ := strings.Cut(header, " ")
+		switch strings.ToLower(scheme) {
+		case "bearer":
+			if a.tokens == nil {
+				return nil, fmt.Errorf("bearer tokens are not enabled")
+			}
+			name, ok := a.tokens[sha256.Sum256([]byte(strings.TrimSpace(credentials)))]
+			if !ok {
+				return nil, fmt.Errorf("invalid bearer token")
+			}
+			return &User{Name: name, Method: "token"}, nil
+		case "basic":
+			if a.htpasswd == nil {
+				return nil, fmt.Errorf("basic auth is not enabled")
+			}
+			username, password, ok := r.BasicAuth()
+			if !ok || !a.htpasswd.Verify(username, password) {
+				return nil, fmt.Errorf("invalid credentials for %q", username)
+			}
+			return &User{Name: username, Method: "basic"}, nil
+		}
+		return nil, fmt.Errorf("unsupported authorization scheme %q", scheme)
+	}
+
+	if cookie, err := r.Cookie(sessionCookieName); err == nil {
+		if s := a.sessions.Get(cookie.Value); s != nil {
+			return s.User, nil
+		}
+	}
+	return nil, nil
+}
+
+// challenge sends browsers to the OIDC login page and everything else a 401
+func (a *Auth) challenge(w http.ResponseWriter, r *http.Request) {
+	if a.oidc != nil && r.Method == http.MethodGet && strings.Contains(r.Header.Get("Accept"), "text/html") {
+		http.Redirect(w, r, "/login?next="+url.QueryEscape(r.URL.RequestURI()), http.StatusFound)
+		return
+	}
+	if a.htpasswd != nil {
+		w.Header().Set("WWW-Authenticate", `Basic realm="Nginx Log Viewer", charset="UTF-8"`)
+	} else if a.tokens != nil {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="Nginx Log Viewer"`)
+	}
+	http.Error(w, "Unauthorized", http.StatusUnauthorized)
+}
+
+func (a *Auth) handleLogin(w http.ResponseWriter, r *http.Request) {
+	login := &pendingLogin{
+		State:    randomToken(),
+		Nonce:    randomToken(),
+		Verifier: randomToken(),
+		Next:     safeRedirect(r.URL.Query().Get("next")),
+		Expires:  time.Now().Add(10 * time.Minute),
+	}
+	a.sessions.AddPending(login)
+	http.Redirect(w, r, a.oidc.AuthCodeURL(login.State, login.Nonce, login.Verifier), http.StatusFound)
+}
+
+func (a *Auth) handleCallback(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	if errCode := query.Get("error"); errCode != "" {
+		log.Printf("oidc: login failed: %s: %s", errCode, query.Get("error_description"))
+		http.Error(w, "Login failed", http.StatusUnauthorized)
+		return
+	}
+
+	login := a.sessions.TakePending(query.Get("state"))
+	if login == nil {
+		http.Error(w, "Login expired or invalid state, please try again", http.StatusBadRequest)
+		return
+	}
+
+	claims, idToken, err := a.oidc.Exchange(r.Context(), query.Get("code"), login.Verifier, login.Nonce)
+	if err != nil {
+		log.Printf("oidc: %v", err)
+		http.Error(w, "Login failed", http.StatusUnauthorized)
+		return
+	}
+
+	name := claims.PreferredUsername
+	if name == "" {
+		name = claims.Email
+	}
+	if name == "" {
+		name = claims.Subject
+	}
+	s := a.sessions.Create(&User{Name: name, Method: "oidc", Groups: claims.Groups}, idToken)
+	a.setSessionCookie(w, r, s.ID, s.Expires)
+	http.Redirect(w, r, login.Next, http.StatusFound)
+}
+
+func (a *Auth) handleLogout(w http.ResponseWriter, r *http.Request) {
+	var idToken string
+	if cookie, err := r.Cookie(sessionCookieName); err == nil {
+		if s := a.sessions.Get(cookie.Value); s != nil {
+			idToken = s.IDToken
+		}
+		a.sessions.Delete(cookie.Value)
+	}
+	a.setSessionCookie(w, r, "", time.Unix(0, 0))
+
+	if a.oidc != nil && a.oidc.EndSessionEndpoint != "" && idToken != "" {
+		http.Redirect(w, r, a.oidc.EndSessionEndpoint+"?id_token_hint="+url.QueryEscape(idToken), http.StatusFound)
+		return
+	}
+	if r.Header.Get("Authorization") != "" && a.htpasswd != nil {
+		// Browsers cache basic credentials until they see another 401
+		a.challenge(w, r)
+		return
+	}
+	http.Redirect(w, r, "/", http.StatusFound)
+}
+
+func (a *Auth) setSessionCookie(w http.ResponseWriter, r *http.Request, value string, expires time.Time) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     sessionCookieName,
+		Value:    value,
+		Path:     "/",
+		Expires:  expires,
+		HttpOnly: true,
+		Secure:   r.TLS != nil || r.Header.Get("X-Forwarded-Proto") == "https",
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+// loadTokens reads API tokens, one per line as `name:token` or just `token`
+func loadTokens(path string) (map[[32]byte]string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	tokens := make(map[[32]byte]string)
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		name, token, ok := strings.Cut(line, ":")
+		if !ok {
+			name, token = fmt.Sprintf("token-%d", len(tokens)+1), line
+		}
+		if len(token) < 16 {
+			return nil, fmt.Errorf("%s: token for %q is shorter than 16 characters", path, name)
+		}
+		tokens[sha256.Sum256([]byte(token))] = name
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return tokens, nil
+}
+
+// Session is a logged-in browser session
+type Session struct {
+	ID      string
+	User    *User
+	IDToken string
+	Expires time.Time
+}
+
+// pendingLogin tracks an OIDC login between the redirect and the callback
+type pendingLogin struct {
+	State    string
+	Nonce    string
+	Verifier string
+	Next     string
+	Expires  time.Time
+}
+
+// SessionStore keeps sessions in memory; they are lost on restart
+type SessionStore struct {
+	ttl time.Duration
+
+	mu       sync.Mutex
+	sessions map[string]*Session
+	pending  map[string]*pendingLogin
+}
+
+// NewSessionStore creates a store whose sessions live for ttl
+func NewSessionStore(ttl time.Duration) *SessionStore {
+	return &SessionStore{
+		ttl:      ttl,
+		sessions: make(map[string]*Session),
+		pending:  make(map[string]*pendingLogin),
+	}
+}
+
+// Create starts a new session for user
+func (s *SessionStore) Create(user *User, idToken string) *Session {
+	session := &Session{ID: randomToken(), User: user, IDToken: idToken, Expires: time.Now().Add(s.ttl)}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.expire()
+	s.sessions[session.ID] = session
+	return session
+}
+
+// Get returns the session with the given id if it has not expired
+func (s *SessionStore) Get(id string) *Session {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	session, ok := s.sessions[id]
+	if !ok || time.Now().After(session.Expires) {
+		return nil
+	}
+	return session
+}
+
+// Delete ends a session
+func (s *SessionStore) Delete(id string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.sessions, id)
+}
+
+// AddPending remembers an in-flight login until its callback arrives
+func (s *SessionStore) AddPending(login *pendingLogin) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.expire()
+	s.pending[login.State] = login
+}
+
+// TakePending returns and forgets the login started with state
+func (s *SessionStore) TakePending(state string) *pendingLogin {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	login, ok := s.pending[state]
+	if !ok || time.Now().After(login.Expires) {
+		return nil
+	}
+	delete(s.pending, state)
+	return login
+}
+
+// expire drops stale entries; callers must hold s.mu
+func (s *SessionStore) expire() {
+	now := time.Now()
+	for id, session := range s.sessions {
+		if now.After(session.Expires) {
+			delete(s.sessions, id)
+		}
+	}
+	for state, login := range s.pending {
+		if now.After(login.Expires) {
+			delete(s.pending, state)
+		}
+	}
+}
+
+// randomToken returns 32 random bytes encoded for use in URLs and cookies
+func randomToken() string {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// safeRedirect only allows local paths so the login flow can't be used as an
+// open redirect.
+func safeRedirect(next string) string {
+	if !strings.HasPrefix(next, "/") || strings.HasPrefix(next, "//") || strings.HasPrefix(next, "/\\") {
+		return "/"
+	}
+	return next
+}
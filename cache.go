@@ -0,0 +1,278 @@
+package main
+
+import (
+	"cmp"
+	"fmt"
+	"net/url"
+	"slices"
+	"strings"
+	"time"
+)
+
+// cacheStatuses are the values of $upstream_cache_status in the order they
+// are shown
+var cacheStatuses = []string{"HIT", "MISS", "EXPIRED", "BYPASS", "STALE", "UPDATING", "REVALIDATED"}
+
+// servedFromCache tells whether a response came out of the cache. STALE and
+// UPDATING responses are cached copies served while the origin fails or is
+// asked for a fresh one, REVALIDATED ones were confirmed by the origin with
+// a 304.
+func servedFromCache(status string) bool {
+	switch status {
+	case "HIT", "STALE", "UPDATING", "REVALIDATED":
+		return true
+	}
+	return false
+}
+
+// cacheCounter adds up the cache statuses and bytes of entries
+type cacheCounter struct {
+	requests    int // entries with a cache status
+	hits        int // served from cache
+	cacheBytes  int64
+	originBytes int64
+}
+
+func (c *cacheCounter) add(e *LogEntry) {
+	if e.CacheStatus == "" {
+		return
+	}
+	c.requests++
+	if servedFromCache(e.CacheStatus) {
+		c.hits++
+		c.cacheBytes += int64(e.ResponseSize)
+	} else {
+		c.originBytes += int64(e.ResponseSize)
+	}
+}
+
+// CacheSummary is the hit ratio of the requests passing through the cache
+// and the bytes served from the cache and from the origin
+type CacheSummary struct {
+	Requests    int     `json:"requests"`
+	Hits        int     `json:"hits"`
+	HitRatio    float64 `json:"hit_ratio"`
+	CacheBytes  int64   `json:"cache_bytes"`
+	OriginBytes int64   `json:"origin_bytes"`
+	ByteRatio   float64 `json:"byte_ratio"` // percent of the bytes served from cache
+
+	CacheBytesDisplay  string `json:"-"`
+	OriginBytesDisplay string `json:"-"`
+}
+
+func (c *cacheCounter) summary() CacheSummary {
+	var byteRatio float64
+	if bytes := c.cacheBytes + c.originBytes; bytes > 0 {
+		byteRatio = float64(c.cacheBytes) * 100 / float64(bytes)
+	}
+	return CacheSummary{
+		Requests:           c.requests,
+		Hits:               c.hits,
+		HitRatio:           percentOf(c.hits, c.requests),
+		CacheBytes:         c.cacheBytes,
+		OriginBytes:        c.originBytes,
+		ByteRatio:          byteRatio,
+		CacheBytesDisplay:  formatBytes(c.cacheBytes),
+		OriginBytesDisplay: formatBytes(c.originBytes),
+	}
+}
+
+// cacheRouteSorts are the orders of the routes table: the busiest routes,
+// the routes missing the cache most or the routes costing the most origin
+// traffic
+var cacheRouteSorts = []string{"requests", "hit_ratio", "origin_bytes"}
+
+// CacheQuery selects the rows and order of the routes table
+type CacheQuery struct {
+	Sort  string
+	Limit int
+}
+
+func parseCacheQuery(values url.Values, topN int) (CacheQuery, error) {
+	q := CacheQuery{Sort: cmp.Or(values.Get("sort"), "requests")}
+	if !slices.Contains(cacheRouteSorts, q.Sort) {
+		return q, fmt.Errorf("sort must be one of %s", strings.Join(cacheRouteSorts, ", "))
+	}
+	limit, err := parsePositive(values, "limit")
+	if err != nil {
+		return q, err
+	}
+	if limit == 0 {
+		limit = max(topN, 25)
+	}
+	q.Limit = min(limit, maxTableLimit)
+	return q, nil
+}
+
+// CacheReport shows how well the cache works over the date range: the
+// statuses, the hit ratio per route and the statuses over time
+type CacheReport struct {
+	Date     string           `json:"date"`
+	Source   string           `json:"source"`
+	Filter   string           `json:"filter,omitempty"`
+	Sort     string           `json:"sort"`
+	Total    int              `json:"total"` // requests, cached or not
+	Summary  CacheSummary     `json:"summary"`
+	Statuses []CacheStatusRow `json:"statuses"`
+	Routes   []CacheRouteRow  `json:"routes"`
+
+	Bucket   string             `json:"bucket"` // minute, hour or day
+	Columns  []string           `json:"columns"`
+	Timeline []CacheTimelineRow `json:"timeline"`
+
+	Sorts []string     `json:"-"`
+	Chips []FilterChip `json:"-"`
+	Sites []string     `json:"-"`
+	User  *User        `json:"-"`
+}
+
+// CacheStatusRow is a cache status with its requests and bytes
+type CacheStatusRow struct {
+	Status       string  `json:"status"`
+	Requests     int     `json:"requests"`
+	Share        float64 `json:"share"`
+	Bytes        int64   `json:"bytes"`
+	BytesDisplay string  `json:"-"`
+	Cached       bool    `json:"cached"` // served from cache
+}
+
+// CacheRouteRow is the cache use of a path
+type CacheRouteRow struct {
+	Path string `json:"path"`
+	CacheSummary
+	Statuses map[string]int `json:"statuses"`
+}
+
+// CacheTimelineRow counts the requests of a bucket per status column
+type CacheTimelineRow struct {
+	Time     string  `json:"time"`
+	Requests int     `json:"requests"`
+	HitRatio float64 `json:"hit_ratio"`
+	Counts   []int   `json:"counts"`
+
+	hits int
+}
+
+// buildCacheReport reads the source and aggregates the cache statuses of
+// the entries between start and end. Entries without a cache status, not
+// passing through a cache, only count in Total.
+func buildCacheReport(src *Source, start, end time.Time, opts ReportOptions, q CacheQuery) (*CacheReport, error) {
+	report := &CacheReport{
+		Date:   formatRange(start, end),
+		Source: src.Name,
+		Filter: opts.Filter.String(),
+		Sort:   q.Sort,
+		Sorts:  cacheRouteSorts,
+	}
+	bucket, layout := rangeBucket(start, end)
+	report.Bucket = bucket
+
+	var total cacheCounter
+	statuses := make(map[string]*CacheStatusRow)
+	routes := make(map[string]*cacheRoute)
+	timeline := make(map[string]map[string]int)
+
+	_, err := src.ReadEntries(func(entry LogEntry) {
+		if entry.TimeStamp.Before(start) || entry.TimeStamp.After(end) {
+			return
+		}
+		opts.Mask.Apply(&entry)
+		if !opts.Filter.Match(&entry) {
+			return
+		}
+		report.Total++
+		if entry.CacheStatus == "" {
+			return
+		}
+		total.add(&entry)
+
+		row := statuses[entry.CacheStatus]
+		if row == nil {
+			row = &CacheStatusRow{Status: entry.CacheStatus, Cached: servedFromCache(entry.CacheStatus)}
+			statuses[entry.CacheStatus] = row
+		}
+		row.Requests++
+		row.Bytes += int64(entry.ResponseSize)
+
+		t := entry.TimeStamp.Format(layout)
+		if timeline[t] == nil {
+			timeline[t] = make(map[string]int)
+		}
+		timeline[t][entry.CacheStatus]++
+
+		p := requestPath(entry.RequestURI)
+		route := routes[p]
+		if route == nil {
+			if len(routes) >= maxGroups {
+				return
+			}
+			route = &cacheRoute{statuses: make(map[string]int)}
+			routes[p] = route
+		}
+		route.add(&entry)
+		route.statuses[entry.CacheStatus]++
+	})
+	if err != nil {
+		return nil, err
+	}
+	report.Summary = total.summary()
+
+	for _, row := range statuses {
+		row.Share = percentOf(row.Requests, total.requests)
+		row.BytesDisplay = formatBytes(row.Bytes)
+		report.Statuses = append(report.Statuses, *row)
+	}
+	slices.SortFunc(report.Statuses, func(a, b CacheStatusRow) int {
+		return cmp.Or(cmp.Compare(cacheStatusOrder(a.Status), cacheStatusOrder(b.Status)), strings.Compare(a.Status, b.Status))
+	})
+	for _, row := range report.Statuses {
+		report.Columns = append(report.Columns, row.Status)
+	}
+
+	for p, route := range routes {
+		report.Routes = append(report.Routes, CacheRouteRow{Path: p, CacheSummary: route.summary(), Statuses: route.statuses})
+	}
+	slices.SortFunc(report.Routes, func(a, b CacheRouteRow) int {
+		var c int
+		switch q.Sort {
+		case "hit_ratio":
+			c = cmp.Or(cmp.Compare(a.HitRatio, b.HitRatio), cmp.Compare(b.Requests, a.Requests))
+		case "origin_bytes":
+			c = cmp.Compare(b.OriginBytes, a.OriginBytes)
+		default:
+			c = cmp.Compare(b.Requests, a.Requests)
+		}
+		return cmp.Or(c, strings.Compare(a.Path, b.Path))
+	})
+	report.Routes = report.Routes[:min(len(report.Routes), q.Limit)]
+
+	for t, counts := range timeline {
+		row := CacheTimelineRow{Time: t, Counts: make([]int, len(report.Columns))}
+		for i, status := range report.Columns {
+			row.Counts[i] = counts[status]
+			row.Requests += counts[status]
+			if servedFromCache(status) {
+				row.hits += counts[status]
+			}
+		}
+		row.HitRatio = percentOf(row.hits, row.Requests)
+		report.Timeline = append(report.Timeline, row)
+	}
+	slices.SortFunc(report.Timeline, func(a, b CacheTimelineRow) int { return strings.Compare(a.Time, b.Time) })
+	return report, nil
+}
+
+// cacheRoute is a cacheCounter keeping the statuses of a path
+type cacheRoute struct {
+	cacheCounter
+	statuses map[string]int
+}
+
+// cacheStatusOrder sorts the known statuses first, in the order nginx
+// documents them
+func cacheStatusOrder(status string) int {
+	if i := slices.Index(cacheStatuses, status); i >= 0 {
+		return i
+	}
+	return len(cacheStatuses)
+}
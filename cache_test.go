@@ -0,0 +1,149 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestServedFromCache(t *testing.T) {
+	for _, status := range cacheStatuses {
+		want := status == "HIT" || status == "STALE" || status == "UPDATING" || status == "REVALIDATED"
+		if got := servedFromCache(status); got != want {
+			t.Errorf("servedFromCache(%s) = %v", status, got)
+		}
+	}
+	if servedFromCache("") || servedFromCache("hit") {
+		t.Error("served from cache without a known status")
+	}
+}
+
+func TestParseCacheQuery(t *testing.T) {
+	values, _ := url.ParseQuery("sort=origin_bytes&limit=5000")
+	if q, err := parseCacheQuery(values, 10); err != nil || q.Sort != "origin_bytes" || q.Limit != maxTableLimit {
+		t.Errorf("query %+v, %v", q, err)
+	}
+	// At least 25 routes by default
+	if q, _ := parseCacheQuery(url.Values{}, 10); q.Sort != "requests" || q.Limit != 25 {
+		t.Errorf("defaults %+v", q)
+	}
+	if q, _ := parseCacheQuery(url.Values{}, 50); q.Limit != 50 {
+		t.Errorf("limit %d with 50 rows per table", q.Limit)
+	}
+
+	for query, want := range map[string]string{
+		"sort=bytes": "sort must be one of requests, hit_ratio, origin_bytes",
+		"limit=0":    "limit must be a positive number",
+	} {
+		values, _ := url.ParseQuery(query)
+		if _, err := parseCacheQuery(values, 10); err == nil || !strings.HasPrefix(err.Error(), want) {
+			t.Errorf("%s: error %v, want %q", query, err, want)
+		}
+	}
+}
+
+func TestBuildCacheReport(t *testing.T) {
+	line := func(clock, uri string, size int, cache string) string {
+		return fmt.Sprintf(`10.0.0.1 - - [19/Feb/2024:%s +0000] "GET %s HTTP/1.1" 200 %d "-" "curl" 0.1 - - - %s`, clock, uri, size, cache)
+	}
+	src := newTestSource(t, []string{
+		line("16:00:10", "/img?x=1", 1000, "HIT"),
+		line("16:00:20", "/img", 1000, "HIT"),
+		line("16:01:00", "/img", 2000, "MISS"),
+		line("16:01:10", "/api", 500, "BYPASS"),
+		line("16:02:00", "/api?q", 300, "STALE"),
+		line("16:02:05", "/api", 700, "EXPIRED"),
+		// Not passing through a cache
+		line("16:02:10", "/page", 100, "-"),
+		line("16:03:00", "/old", 50, "CUSTOM"),
+		line("17:30:00", "/img", 1000, "HIT"),
+	})
+	start := time.Date(2024, 2, 19, 16, 0, 0, 0, time.UTC)
+	build := func(sort string, limit int) *CacheReport {
+		t.Helper()
+		report, err := buildCacheReport(src, start, start.Add(time.Hour), ReportOptions{}, CacheQuery{Sort: sort, Limit: limit})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return report
+	}
+
+	report := build("requests", 10)
+	if report.Total != 8 || report.Bucket != "minute" || report.Date != "2024-02-19 16:00:00 - 2024-02-19 17:00:00" {
+		t.Errorf("report %+v", report)
+	}
+	// HIT and STALE responses are served from cache, bytes of the others
+	// from the origin
+	s := report.Summary
+	if s.Requests != 7 || s.Hits != 3 || s.HitRatio != 300.0/7 || s.CacheBytes != 2300 || s.OriginBytes != 3250 ||
+		s.ByteRatio != 2300*100.0/5550 || s.CacheBytesDisplay != "2.2 KiB" {
+		t.Errorf("summary %+v", s)
+	}
+
+	var statuses []string
+	for _, row := range report.Statuses {
+		statuses = append(statuses, fmt.Sprintf("%s %d %d %v", row.Status, row.Requests, row.Bytes, row.Cached))
+	}
+	// Known statuses in the order nginx documents them, others last
+	want := []string{"HIT 2 2000 true", "MISS 1 2000 false", "EXPIRED 1 700 false", "BYPASS 1 500 false", "STALE 1 300 true", "CUSTOM 1 50 false"}
+	if !slices.Equal(statuses, want) {
+		t.Errorf("statuses %q, want %q", statuses, want)
+	}
+	if row := report.Statuses[0]; row.Share != 200.0/7 {
+		t.Errorf("share of hits %v", row.Share)
+	}
+	if want := []string{"HIT", "MISS", "EXPIRED", "BYPASS", "STALE", "CUSTOM"}; !slices.Equal(report.Columns, want) {
+		t.Errorf("columns %q, want %q", report.Columns, want)
+	}
+
+	tests := []struct {
+		sort   string
+		limit  int
+		routes []string
+	}{
+		// Routes are paths without the query string, ties by path
+		{"requests", 10, []string{"/api", "/img", "/old"}},
+		{"hit_ratio", 10, []string{"/old", "/api", "/img"}},
+		{"origin_bytes", 10, []string{"/img", "/api", "/old"}},
+		{"origin_bytes", 2, []string{"/img", "/api"}},
+	}
+	for _, tt := range tests {
+		var routes []string
+		for _, row := range build(tt.sort, tt.limit).Routes {
+			routes = append(routes, row.Path)
+		}
+		if !slices.Equal(routes, tt.routes) {
+			t.Errorf("%s limit %d: %q, want %q", tt.sort, tt.limit, routes, tt.routes)
+		}
+	}
+	img := report.Routes[1]
+	if img.Requests != 3 || img.Hits != 2 || img.OriginBytes != 2000 || img.Statuses["HIT"] != 2 || img.Statuses["MISS"] != 1 {
+		t.Errorf("route %+v", img)
+	}
+
+	var timeline []string
+	for _, row := range report.Timeline {
+		timeline = append(timeline, fmt.Sprintf("%s %d %.0f %v", row.Time, row.Requests, row.HitRatio, row.Counts))
+	}
+	want = []string{
+		"2024-02-19 16:00 2 100 [2 0 0 0 0 0]",
+		"2024-02-19 16:01 2 0 [0 1 0 1 0 0]",
+		"2024-02-19 16:02 2 50 [0 0 1 0 1 0]",
+		"2024-02-19 16:03 1 0 [0 0 0 0 0 1]",
+	}
+	if !slices.Equal(timeline, want) {
+		t.Errorf("timeline %q, want %q", timeline, want)
+	}
+
+	filter, _ := ParseFilter("cache=HIT")
+	report, err := buildCacheReport(src, start, start.Add(time.Hour), ReportOptions{Filter: filter}, CacheQuery{Sort: "requests", Limit: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Total != 2 || report.Summary.HitRatio != 100 || len(report.Columns) != 1 || report.Filter != "cache=HIT" {
+		t.Errorf("filtered report %+v", report)
+	}
+}
@@ -0,0 +1,585 @@
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"syscall"
+	"text/tabwriter"
+	"time"
+)
+
+// Exit codes of the commands, for scripts and CI checks
+const (
+	exitOK        = 0
+	exitError     = 1
+	exitUsage     = 2
+	exitThreshold = 3 // more lines failed to parse than -max-failed allows
+)
+
+// command is a subcommand of the viewer
+type command struct {
+	name    string
+	summary string
+	run     func(args []string) int
+}
+
+// commandList lists the commands in the order of the help
+func commandList() []command {
+	return []command{
+		{"serve", "Serve the dashboard, API and metrics", serveCommand},
+		{"convert", "Convert the logs to CSV or JSON lines", convertCommand},
+		{"report", "Print the dashboard tables as text or JSON", reportCommand},
+		{"query", "Group entries by fields and print metrics as a table, JSON or CSV", queryCommand},
+		{"tail", "Print entries as they are appended to the logs", tailCommand},
+		{"stats", "Print how many lines of each source were parsed", statsCommand},
+		{"tui", "Show the dashboard in the terminal", tuiCommand},
+		{"validate-config", "Check the config file and the log files it names", validateConfigCommand},
+		{"test-alerts", "Send a test alert to every receiver", testAlertsCommand},
+	}
+}
+
+func findCommand(name string) (command, bool) {
+	for _, cmd := range commandList() {
+		if cmd.name == name {
+			return cmd, true
+		}
+	}
+	return command{}, false
+}
+
+func programName() string {
+	return filepath.Base(os.Args[0])
+}
+
+// printUsage lists the commands
+func printUsage(w io.Writer) {
+	fmt.Fprintf(w, "Usage: %s <command> [flags]\n\nCommands:\n", programName())
+	for _, cmd := range commandList() {
+		fmt.Fprintf(w, "  %-16s %s\n", cmd.name, cmd.summary)
+	}
+	fmt.Fprintf(w, "\nRun %s help <command> for the flags of a command.\n", programName())
+	fmt.Fprintf(w, "Exit codes: %d ok, %d error, %d usage, %d -max-failed exceeded.\n", exitOK, exitError, exitUsage, exitThreshold)
+}
+
+// helpCommand implements `help [command]`
+func helpCommand(args []string) int {
+	if len(args) == 0 {
+		printUsage(os.Stdout)
+		return exitOK
+	}
+	cmd, ok := findCommand(args[0])
+	if !ok {
+		fmt.Fprintf(os.Stderr, "unknown command %q\n", args[0])
+		return exitUsage
+	}
+	cmd.run([]string{"-h"})
+	return exitOK
+}
+
+// newFlagSet creates the flag set of a command, its usage shows the summary
+// of the command before the flags
+func newFlagSet(name string) *flag.FlagSet {
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	fs.Usage = func() {
+		cmd, _ := findCommand(name)
+		fmt.Fprintf(fs.Output(), "Usage: %s %s [flags]\n\n%s.\n\nFlags:\n", programName(), name, cmd.summary)
+		fs.PrintDefaults()
+	}
+	return fs
+}
+
+// logFlags are the flags shared by the commands reading the logs
+type logFlags struct {
+	config string
+	input  string
+	source string
+	filter string
+}
+
+func addLogFlags(fs *flag.FlagSet) *logFlags {
+	f := &logFlags{}
+	fs.StringVar(&f.config, "config", os.Getenv("NLV_CONFIG"), "Path to the TOML config file (default $NLV_CONFIG)")
+	fs.StringVar(&f.input, "input", "", "Path to an Nginx log file, replaces the configured sources")
+	fs.StringVar(&f.source, "source", "", "Comma separated sources to read, all by default")
+	fs.StringVar(&f.filter, "filter", "", `Only include entries matching this filter, e.g. status>=500 and uri~"^/api/"`)
+	return f
+}
+
+// addRangeFlags registers -start and -end
+func addRangeFlags(fs *flag.FlagSet, cfg *Config) {
+	fs.StringVar(&cfg.Range.Start, "start", cfg.Range.Start, "Start of the date range, \"2006-01-02 15:04:05\" or now-<duration>")
+	fs.StringVar(&cfg.Range.End, "end", cfg.Range.End, "End of the date range")
+}
+
+// load reads the config and returns the selected sources and the filter
+func (f *logFlags) load(fs *flag.FlagSet, cfg *Config) ([]*Source, *Filter, error) {
+	if err := loadConfig(fs, cfg, f.config); err != nil {
+		return nil, nil, err
+	}
+	if f.input != "" {
+		cfg.Sources = []SourceConfig{{Path: f.input}}
+		cfg.fillSourceDefaults()
+	}
+	sources, err := cfg.BuildSources()
+	if err != nil {
+		return nil, nil, err
+	}
+	if f.source != "" {
+		var selected []*Source
+		for _, name := range strings.Split(f.source, ",") {
+			i := slices.IndexFunc(sources, func(src *Source) bool { return src.Name == strings.TrimSpace(name) })
+			if i < 0 {
+				return nil, nil, fmt.Errorf("unknown source %q", name)
+			}
+			selected = append(selected, sources[i])
+		}
+		sources = selected
+	}
+	if len(sources) == 0 {
+		return nil, nil, errors.New("no sources configured")
+	}
+	filter, err := ParseFilter(f.filter)
+	if err != nil {
+		return nil, nil, err
+	}
+	return sources, filter, nil
+}
+
+// failureLimit is the -max-failed threshold, a number of lines or a
+// percentage of the lines read like 0.5%
+type failureLimit struct {
+	value   float64
+	percent bool
+	set     bool
+}
+
+func (l *failureLimit) String() string {
+	if !l.set {
+		return ""
+	}
+	s := strconv.FormatFloat(l.value, 'f', -1, 64)
+	if l.percent {
+		s += "%"
+	}
+	return s
+}
+
+func (l *failureLimit) Set(s string) error {
+	number, percent := strings.CutSuffix(s, "%")
+	value, err := strconv.ParseFloat(number, 64)
+	if err != nil || value < 0 {
+		return errors.New("must be a number of lines or a percentage like 1%")
+	}
+	*l = failureLimit{value: value, percent: percent, set: true}
+	return nil
+}
+
+func addFailureFlag(fs *flag.FlagSet) *failureLimit {
+	l := &failureLimit{}
+	fs.Var(l, "max-failed", fmt.Sprintf("Exit with code %d when more lines fail to parse, a count or a percentage like 1%%", exitThreshold))
+	return l
+}
+
+// check reports the sources failing more lines than allowed on stderr and
+// returns the exit code
+func (l *failureLimit) check(names []string, stats []ParseStats) int {
+	code := exitOK
+	for i, s := range stats {
+		failed := float64(s.Failed)
+		if l.percent && s.Lines > 0 {
+			failed = failed * 100 / float64(s.Lines)
+		}
+		if l.set && failed > l.value {
+			fmt.Fprintf(os.Stderr, "source %s: %d of %d lines failed to parse, more than -max-failed %s\n", names[i], s.Failed, s.Lines, l)
+			code = exitThreshold
+		}
+	}
+	return code
+}
+
+func sourceNames(sources []*Source) []string {
+	names := make([]string, len(sources))
+	for i, src := range sources {
+		names[i] = src.Name
+	}
+	return names
+}
+
+// convertCommand implements `convert`
+func convertCommand(args []string) int {
+	cfg := DefaultConfig()
+	fs := newFlagSet("convert")
+	lf := addLogFlags(fs)
+	fs.StringVar(&cfg.CSVOutput, "output", cfg.CSVOutput, "Path to the output file, - for stdout")
+	format := fs.String("format", "csv", "Output format, csv or json (one entry per line)")
+	maxFailed := addFailureFlag(fs)
+	if err := fs.Parse(args); err != nil {
+		return exitUsage
+	}
+
+	sources, filter, err := lf.load(fs, cfg)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return exitError
+	}
+	if cfg.CSVOutput == "" {
+		fmt.Fprintln(os.Stderr, "convert needs an -output file or - for stdout")
+		return exitUsage
+	}
+	stats, err := convertLogs(sources, cfg.CSVOutput, *format, filter)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return exitError
+	}
+	return maxFailed.check(sourceNames(sources), stats)
+}
+
+// reportCommand implements `report`, the dashboard of each source
+func reportCommand(args []string) int {
+	cfg := DefaultConfig()
+	fs := newFlagSet("report")
+	lf := addLogFlags(fs)
+	addRangeFlags(fs, cfg)
+	fs.IntVar(&cfg.TopN, "top", cfg.TopN, "Rows of each table")
+	format := fs.String("format", "text", "Output format, text or json")
+	maxFailed := addFailureFlag(fs)
+	if err := fs.Parse(args); err != nil {
+		return exitUsage
+	}
+	if *format != "text" && *format != "json" {
+		fmt.Fprintf(os.Stderr, "unknown format %q, use text or json\n", *format)
+		return exitUsage
+	}
+
+	sources, filter, err := lf.load(fs, cfg)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return exitError
+	}
+	var reports []*ViewData
+	var stats []ParseStats
+	for _, src := range sources {
+		start, end, err := cfg.Range.Resolve(time.Now(), src.Location())
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return exitError
+		}
+		report, err := buildReport(src, start, end, ReportOptions{TopN: cfg.TopN, TableLimits: cfg.TableLimits, Filter: filter})
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return exitError
+		}
+		reports = append(reports, report)
+		stats = append(stats, report.Stats)
+	}
+
+	if *format == "json" {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(reports); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return exitError
+		}
+	} else {
+		for i, report := range reports {
+			if i > 0 {
+				fmt.Println()
+			}
+			printReport(os.Stdout, report)
+		}
+	}
+	return maxFailed.check(sourceNames(sources), stats)
+}
+
+// printReport writes the tables of a report as text
+func printReport(w io.Writer, v *ViewData) {
+	fmt.Fprintf(w, "%s  %s\n", v.Source, v.Date)
+	if v.Filter != "" {
+		fmt.Fprintf(w, "filter: %s\n", v.Filter)
+	}
+	fmt.Fprintf(w, "%s requests, %s of %s lines parsed, %s failed\n",
+		formatNumberWithCommas(v.TotalRequests), formatNumberWithCommas(v.Stats.Parsed),
+		formatNumberWithCommas(v.Stats.Lines), formatNumberWithCommas(v.Stats.Failed))
+	for _, def := range tableDefs {
+		view := newTableView(v, def)
+		fmt.Fprintf(w, "\n%s\n", def.Title)
+		for _, e := range view.Entries {
+			fmt.Fprintf(w, "%8.3fs  %3d  %s %s\n", requestDuration(&e), e.Status, e.Method, e.RequestURI)
+		}
+		for _, row := range view.Rows {
+			fmt.Fprintf(w, "%9s  %s\n", formatNumberWithCommas(row.Count), row.Key)
+		}
+	}
+}
+
+// queryCommand implements `query`, a grouping like /group for scripts
+func queryCommand(args []string) int {
+	cfg := DefaultConfig()
+	fs := newFlagSet("query")
+	lf := addLogFlags(fs)
+	addRangeFlags(fs, cfg)
+	values := url.Values{}
+	for _, f := range []struct{ name, usage string }{
+		{"by", "Comma separated fields to group by: " + strings.Join(groupDimensionNames(), ", ")},
+		{"metrics", "Comma separated metrics: " + strings.Join(groupMetrics, ", ") + " or p<N> like p95 (default count)"},
+		{"sort", "Metric to sort by or key (default the first metric)"},
+		{"order", "Sort order, asc or desc (default desc)"},
+		{"limit", fmt.Sprintf("Groups printed, up to %d (default top_n)", maxTableLimit)},
+		{"page", "Page of groups to print"},
+	} {
+		fs.Var(queryParam{values, f.name}, f.name, f.usage)
+	}
+	format := fs.String("format", "table", "Output format, table, json or csv")
+	maxFailed := addFailureFlag(fs)
+	if err := fs.Parse(args); err != nil {
+		return exitUsage
+	}
+	if !slices.Contains([]string{"table", "json", "csv"}, *format) {
+		fmt.Fprintf(os.Stderr, "unknown format %q, use table, json or csv\n", *format)
+		return exitUsage
+	}
+
+	sources, filter, err := lf.load(fs, cfg)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return exitError
+	}
+	q, err := parseGroupQuery(values, cfg.TopN)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return exitUsage
+	}
+	// The range is resolved in the time zone of the first source
+	start, end, err := cfg.Range.Resolve(time.Now(), sources[0].Location())
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return exitError
+	}
+	report, err := buildGroupReport(sources, start, end, ReportOptions{Filter: filter}, q)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return exitError
+	}
+
+	switch *format {
+	case "json":
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		err = enc.Encode(report)
+	case "csv":
+		writer := csv.NewWriter(os.Stdout)
+		writer.Write(append(slices.Clone(report.Dimensions), report.Metrics...))
+		for _, row := range report.Rows {
+			record := slices.Clone(row.Keys)
+			for _, v := range row.Values {
+				record = append(record, strconv.FormatFloat(v, 'f', -1, 64))
+			}
+			writer.Write(record)
+		}
+		writer.Flush()
+		err = writer.Error()
+	default:
+		tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(tw, strings.ToUpper(strings.Join(append(slices.Clone(report.Dimensions), report.Metrics...), "\t")))
+		for _, row := range report.Rows {
+			fmt.Fprintln(tw, strings.Join(append(slices.Clone(row.Keys), row.Display...), "\t"))
+		}
+		err = tw.Flush()
+		if len(report.Rows) < report.Total {
+			fmt.Fprintf(os.Stderr, "page %d of %d, %d groups\n", report.Page, report.Pages, report.Total)
+		}
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return exitError
+	}
+	if report.Truncated {
+		fmt.Fprintf(os.Stderr, "more than %d groups, the rest are counted as %s\n", maxGroups, groupOther)
+	}
+	return maxFailed.check([]string{report.Source}, []ParseStats{report.Stats})
+}
+
+// queryParam is a flag stored as a parameter of the group query, so the flags
+// are checked like the parameters of /group
+type queryParam struct {
+	values url.Values
+	name   string
+}
+
+func (p queryParam) String() string {
+	if p.values == nil {
+		return ""
+	}
+	return p.values.Get(p.name)
+}
+
+func (p queryParam) Set(s string) error {
+	p.values.Set(p.name, s)
+	return nil
+}
+
+// tailCommand implements `tail`, following the logs until interrupted
+func tailCommand(args []string) int {
+	cfg := DefaultConfig()
+	fs := newFlagSet("tail")
+	lf := addLogFlags(fs)
+	format := fs.String("format", "text", "Output format, text or json (one entry per line)")
+	interval := fs.Duration("interval", time.Second, "How often the logs are checked for new lines")
+	if err := fs.Parse(args); err != nil {
+		return exitUsage
+	}
+	if *format != "text" && *format != "json" {
+		fmt.Fprintf(os.Stderr, "unknown format %q, use text or json\n", *format)
+		return exitUsage
+	}
+	if *interval <= 0 {
+		fmt.Fprintln(os.Stderr, "-interval must be positive")
+		return exitUsage
+	}
+
+	sources, filter, err := lf.load(fs, cfg)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return exitError
+	}
+
+	enc := json.NewEncoder(os.Stdout)
+	follower := NewFollower(sources)
+	follower.Subscribe(func(entry LogEntry) {
+		if !filter.Match(&entry) {
+			return
+		}
+		if *format == "json" {
+			enc.Encode(entry)
+			return
+		}
+		fmt.Printf("%s %s %s %s %s %d %d %.3f %q\n", entry.TimeStamp.Format(rangeLayout), entry.Source, entry.IP,
+			entry.Method, entry.RequestURI, entry.Status, entry.ResponseSize, requestDuration(&entry), entry.UserAgent)
+	}, *interval)
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	follower.Start()
+
+	// Piped input ends the command once every source reached its end
+	ended := make(chan struct{})
+	go func() {
+		for _, src := range sources {
+			if src.stream == nil || src.stream.fifo {
+				return
+			}
+			<-src.stream.done
+		}
+		close(ended)
+	}()
+	select {
+	case <-ctx.Done():
+	case <-ended:
+	}
+	follower.Stop()
+	return exitOK
+}
+
+// sourceStats are the parse stats of a source printed by `stats`
+type sourceStats struct {
+	Source  string    `json:"source"`
+	Files   int       `json:"files"`
+	Lines   int       `json:"lines"`
+	Parsed  int       `json:"parsed"`
+	Failed  int       `json:"failed"`
+	Matched int       `json:"matched"` // entries matching -filter
+	First   time.Time `json:"first"`   // oldest matching entry
+	Last    time.Time `json:"last"`    // newest matching entry
+}
+
+// statsCommand implements `stats`, for checking the log format of each source
+func statsCommand(args []string) int {
+	cfg := DefaultConfig()
+	fs := newFlagSet("stats")
+	lf := addLogFlags(fs)
+	format := fs.String("format", "text", "Output format, text or json")
+	maxFailed := addFailureFlag(fs)
+	if err := fs.Parse(args); err != nil {
+		return exitUsage
+	}
+	if *format != "text" && *format != "json" {
+		fmt.Fprintf(os.Stderr, "unknown format %q, use text or json\n", *format)
+		return exitUsage
+	}
+
+	sources, filter, err := lf.load(fs, cfg)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return exitError
+	}
+	var results []sourceStats
+	var stats []ParseStats
+	for _, src := range sources {
+		files, err := src.Files()
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return exitError
+		}
+		result := sourceStats{Source: src.Name, Files: len(files)}
+		parsed, err := src.ReadEntries(func(entry LogEntry) {
+			if !filter.Match(&entry) {
+				return
+			}
+			result.Matched++
+			if result.First.IsZero() || entry.TimeStamp.Before(result.First) {
+				result.First = entry.TimeStamp
+			}
+			if entry.TimeStamp.After(result.Last) {
+				result.Last = entry.TimeStamp
+			}
+		})
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return exitError
+		}
+		result.Lines, result.Parsed, result.Failed = parsed.Lines, parsed.Parsed, parsed.Failed
+		results = append(results, result)
+		stats = append(stats, parsed)
+	}
+
+	if *format == "json" {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(results); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return exitError
+		}
+	} else {
+		tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', tabwriter.AlignRight)
+		fmt.Fprintln(tw, "SOURCE\tFILES\tLINES\tPARSED\tFAILED\tFAILED %\tMATCHED\tFIRST\tLAST\t")
+		for _, r := range results {
+			percent := 0.0
+			if r.Lines > 0 {
+				percent = float64(r.Failed) * 100 / float64(r.Lines)
+			}
+			fmt.Fprintf(tw, "%s\t%d\t%d\t%d\t%d\t%.2f\t%d\t%s\t%s\t\n", r.Source, r.Files, r.Lines, r.Parsed, r.Failed, percent, r.Matched,
+				formatStatsTime(r.First), formatStatsTime(r.Last))
+		}
+		tw.Flush()
+	}
+	return maxFailed.check(sourceNames(sources), stats)
+}
+
+func formatStatsTime(t time.Time) string {
+	if t.IsZero() {
+		return "-"
+	}
+	return t.Format(rangeLayout)
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestMaxFailedExitCode(t *testing.T) {
+	t.Setenv("NLV_CONFIG", "")
+	// One of the five lines, in the default format, fails to parse: 20%
+	input := writeTestFile(t, "access.log", strings.Join([]string{
+		`10.0.0.1 - [19/Feb/2024:16:00:01 +0000] "GET / HTTP/1.1" 200 1 - "curl" - 0.100`,
+		`10.0.0.1 - [19/Feb/2024:16:00:02 +0000] "GET / HTTP/1.1" 200 1 - "curl" - 0.100`,
+		`not an access log line`,
+		`10.0.0.1 - [19/Feb/2024:16:00:03 +0000] "GET / HTTP/1.1" 200 1 - "curl" - 0.100`,
+		`10.0.0.1 - [19/Feb/2024:16:00:04 +0000] "GET / HTTP/1.1" 200 1 - "curl" - 0.100`,
+	}, "\n")+"\n")
+	output := filepath.Join(t.TempDir(), "out.csv")
+
+	tests := []struct {
+		flags []string
+		code  int
+	}{
+		{nil, exitOK},
+		{[]string{"-max-failed", "1"}, exitOK},
+		{[]string{"-max-failed", "0"}, exitThreshold},
+		{[]string{"-max-failed", "20%"}, exitOK},
+		{[]string{"-max-failed", "19.5%"}, exitThreshold},
+		{[]string{"-max-failed", "many"}, exitUsage},
+		{[]string{"-max-failed", "-1"}, exitUsage},
+	}
+	commands := map[string][]string{
+		"convert": {"-input", input, "-output", output},
+		"stats":   {"-input", input, "-format", "json"},
+	}
+	for name, args := range commands {
+		cmd, _ := findCommand(name)
+		for _, tt := range tests {
+			if code := cmd.run(append(slices.Clone(args), tt.flags...)); code != tt.code {
+				t.Errorf("%s %q: exit code %d, want %d", name, tt.flags, code, tt.code)
+			}
+		}
+	}
+
+	// A missing log is an error, not a threshold failure
+	cmd, _ := findCommand("stats")
+	if code := cmd.run([]string{"-input", filepath.Join(t.TempDir(), "missing.log"), "-max-failed", "0"}); code != exitError {
+		t.Errorf("missing input: exit code %d, want %d", code, exitError)
+	}
+}
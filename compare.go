@@ -0,0 +1,402 @@
+package main
+
+import (
+	"cmp"
+	"fmt"
+	"maps"
+	"math"
+	"net/url"
+	"slices"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// significanceZ is the z-score above which a change is highlighted as
+// significant, two-sided at 95%
+const significanceZ = 1.96
+
+// baseShifts are the preset comparison periods; "previous" is the period of
+// the same length right before the current one
+var baseShifts = map[string]time.Duration{
+	"day":  24 * time.Hour,
+	"week": 7 * 24 * time.Hour,
+}
+
+// CompareQuery holds the two date ranges being compared
+type CompareQuery struct {
+	Range     RangeConfig // current period
+	Base      string      // previous, day, week or custom
+	BaseRange RangeConfig // used when Base is custom
+}
+
+// parseCompareQuery reads start, end, base, base_start and base_end. The
+// current period defaults to the configured range.
+func parseCompareQuery(values url.Values, defaults RangeConfig) (CompareQuery, error) {
+	q := CompareQuery{
+		Range:     defaults,
+		Base:      values.Get("base"),
+		BaseRange: RangeConfig{Start: values.Get("base_start"), End: values.Get("base_end")},
+	}
+	if start := values.Get("start"); start != "" {
+		q.Range.Start = start
+	}
+	if end := values.Get("end"); end != "" {
+		q.Range.End = end
+	}
+	switch {
+	case q.Base == "" && q.BaseRange.Start != "":
+		q.Base = "custom"
+	case q.Base == "":
+		q.Base = "previous"
+	}
+	switch q.Base {
+	case "previous", "day", "week":
+	case "custom":
+		if q.BaseRange.Start == "" || q.BaseRange.End == "" {
+			return q, fmt.Errorf("base_start and base_end are required to compare with a custom period")
+		}
+	default:
+		return q, fmt.Errorf("base must be previous, day, week or custom")
+	}
+	return q, nil
+}
+
+// Resolve returns the base and current periods in loc
+func (q CompareQuery) Resolve(now time.Time, loc *time.Location) (baseStart, baseEnd, start, end time.Time, err error) {
+	start, end, err = q.Range.Resolve(now, loc)
+	if err != nil {
+		return
+	}
+	switch q.Base {
+	case "previous":
+		// Ranges include their last second
+		baseEnd = start.Add(-time.Second)
+		baseStart = baseEnd.Add(-end.Sub(start))
+	case "custom":
+		baseStart, baseEnd, err = q.BaseRange.Resolve(now, loc)
+		if err != nil {
+			err = fmt.Errorf("base %w", err)
+		}
+	default:
+		shift := baseShifts[q.Base]
+		baseStart, baseEnd = start.Add(-shift), end.Add(-shift)
+	}
+	return
+}
+
+// periodStats aggregates one of the compared periods
+type periodStats struct {
+	start, end time.Time
+	requests   int
+	bytes      int64
+	errors     int // 5xx responses
+	statuses   map[int]int
+	uris       map[string]int
+	ips        map[string]int
+	routes     map[string]int
+	latencies  []float64
+}
+
+func newPeriodStats(start, end time.Time) *periodStats {
+	return &periodStats{
+		start:    start,
+		end:      end,
+		statuses: make(map[int]int),
+		uris:     make(map[string]int),
+		ips:      make(map[string]int),
+		routes:   make(map[string]int),
+	}
+}
+
+func (p *periodStats) contains(t time.Time) bool {
+	return !t.Before(p.start) && !t.After(p.end)
+}
+
+func (p *periodStats) add(entry *LogEntry) {
+	p.requests++
+	p.bytes += int64(entry.ResponseSize)
+	if entry.Status >= 500 {
+		p.errors++
+	}
+	p.statuses[entry.Status]++
+	p.uris[entry.RequestURI]++
+	p.ips[entry.IP]++
+	p.routes[entry.Method+" "+requestPath(entry.RequestURI)]++
+	p.latencies = append(p.latencies, requestDuration(entry))
+}
+
+// minutes is the length of the period, at least one
+func (p *periodStats) minutes() float64 {
+	return max(p.end.Sub(p.start).Minutes(), 1)
+}
+
+// PeriodSummary describes one of the compared periods
+type PeriodSummary struct {
+	Date     string `json:"date"`
+	Requests int    `json:"requests"`
+}
+
+// CompareRow is one compared value. Change is relative to the base period
+// in percent and is NaN when the base is zero.
+type CompareRow struct {
+	Key         string  `json:"key"`
+	Base        float64 `json:"base"`
+	Current     float64 `json:"current"`
+	Change      float64 `json:"-"`
+	Significant bool    `json:"significant"`
+
+	BaseDisplay    string `json:"-"`
+	CurrentDisplay string `json:"-"`
+	ChangeDisplay  string `json:"change"`
+}
+
+// CountRow is a value with its number of requests
+type CountRow struct {
+	Key   string `json:"key"`
+	Count int    `json:"count"`
+}
+
+// CompareReport compares two periods of a site
+type CompareReport struct {
+	Base       PeriodSummary `json:"base"`
+	Current    PeriodSummary `json:"current"`
+	Totals     []CompareRow  `json:"totals"`
+	Status     []CompareRow  `json:"status"` // share of requests per status code
+	URIs       []CompareRow  `json:"uris"`
+	NewIPs     []CountRow    `json:"new_ips"`
+	GoneIPs    []CountRow    `json:"gone_ips"`
+	NewRoutes  []CountRow    `json:"new_routes"`
+	GoneRoutes []CountRow    `json:"gone_routes"`
+	Source     string        `json:"source"`
+	Filter     string        `json:"filter,omitempty"`
+
+	Query CompareQuery `json:"-"`
+	Chips []FilterChip `json:"-"`
+	Sites []string     `json:"-"`
+	User  *User        `json:"-"`
+}
+
+// buildCompareReport reads the source once and compares the entries of the
+// base period with those of the current one. Request counts are compared as
+// rates so periods of different length can be compared, status codes by
+// their share of requests and latencies with a Mann-Whitney U test.
+func buildCompareReport(src *Source, baseStart, baseEnd, start, end time.Time, opts ReportOptions) (*CompareReport, error) {
+	base := newPeriodStats(baseStart, baseEnd)
+	current := newPeriodStats(start, end)
+	_, err := src.ReadEntries(func(entry LogEntry) {
+		period := current
+		if !current.contains(entry.TimeStamp) {
+			if !base.contains(entry.TimeStamp) {
+				return
+			}
+			period = base
+		}
+		opts.Mask.Apply(&entry)
+		if !opts.Filter.Match(&entry) {
+			return
+		}
+		period.add(&entry)
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Float64s(base.latencies)
+	sort.Float64s(current.latencies)
+
+	report := &CompareReport{
+		Base:    PeriodSummary{Date: formatRange(baseStart, baseEnd), Requests: base.requests},
+		Current: PeriodSummary{Date: formatRange(start, end), Requests: current.requests},
+		Source:  src.Name,
+		Filter:  opts.Filter.String(),
+	}
+
+	rateSignificant := func(b, c int) bool {
+		return math.Abs(rateZ(b, base.minutes(), c, current.minutes())) >= significanceZ
+	}
+	report.Totals = append(report.Totals,
+		newCompareRow("Requests", float64(base.requests), float64(current.requests), rateSignificant(base.requests, current.requests), formatCount),
+		newCompareRow("Requests / Minute", float64(base.requests)/base.minutes(), float64(current.requests)/current.minutes(), rateSignificant(base.requests, current.requests), formatRate),
+		newCompareRow("5xx Rate", share(base.errors, base.requests), share(current.errors, current.requests),
+			math.Abs(proportionZ(base.errors, base.requests, current.errors, current.requests)) >= significanceZ, formatPercent),
+		newCompareRow("Bytes Sent", float64(base.bytes), float64(current.bytes), false, formatByteCount),
+	)
+	latencySignificant := math.Abs(mannWhitneyZ(base.latencies, current.latencies)) >= significanceZ
+	for _, p := range []float64{50, 95, 99} {
+		report.Totals = append(report.Totals, newCompareRow(fmt.Sprintf("Latency p%g", p),
+			percentile(base.latencies, p), percentile(current.latencies, p), latencySignificant, formatSeconds))
+	}
+
+	codes := make(map[int]bool)
+	for code := range base.statuses {
+		codes[code] = true
+	}
+	for code := range current.statuses {
+		codes[code] = true
+	}
+	for _, code := range slices.Sorted(maps.Keys(codes)) {
+		b, c := base.statuses[code], current.statuses[code]
+		report.Status = append(report.Status, newCompareRow(strconv.Itoa(code),
+			share(b, base.requests), share(c, current.requests),
+			math.Abs(proportionZ(b, base.requests, c, current.requests)) >= significanceZ, formatPercent))
+	}
+
+	// The URIs that are among the most requested in either period
+	uris := make(map[string]bool)
+	for _, counts := range []map[string]int{base.uris, current.uris} {
+		for _, uri := range topKeys(counts, opts.TopN) {
+			uris[uri] = true
+		}
+	}
+	for uri := range uris {
+		b, c := base.uris[uri], current.uris[uri]
+		report.URIs = append(report.URIs, newCompareRow(uri, float64(b), float64(c), rateSignificant(b, c), formatCount))
+	}
+	slices.SortFunc(report.URIs, func(a, b CompareRow) int {
+		if c := cmp.Compare(b.Current+b.Base, a.Current+a.Base); c != 0 {
+			return c
+		}
+		return cmp.Compare(a.Key, b.Key)
+	})
+
+	report.NewIPs = onlyIn(current.ips, base.ips, opts.TopN)
+	report.GoneIPs = onlyIn(base.ips, current.ips, opts.TopN)
+	report.NewRoutes = onlyIn(current.routes, base.routes, opts.TopN)
+	report.GoneRoutes = onlyIn(base.routes, current.routes, opts.TopN)
+	return report, nil
+}
+
+// compareTable is a table of compared values in the comparison page. Keys
+// link to the dashboard filtered by Field unless it's empty.
+type compareTable struct {
+	Label, Field   string
+	Source, Filter string
+	Rows           []CompareRow
+}
+
+func newCompareTable(report *CompareReport, label, field string, rows []CompareRow) compareTable {
+	return compareTable{Label: label, Field: field, Source: report.Source, Filter: report.Filter, Rows: rows}
+}
+
+// countTable is a table of values only seen in one of the periods
+type countTable struct {
+	Label string
+	Rows  []CountRow
+}
+
+func newCountTable(label string, rows []CountRow) countTable {
+	return countTable{Label: label, Rows: rows}
+}
+
+func newCompareRow(key string, base, current float64, significant bool, format func(float64) string) CompareRow {
+	row := CompareRow{
+		Key:            key,
+		Base:           base,
+		Current:        current,
+		Change:         math.NaN(),
+		Significant:    significant,
+		BaseDisplay:    format(base),
+		CurrentDisplay: format(current),
+		ChangeDisplay:  "new",
+	}
+	switch {
+	case base != 0:
+		row.Change = 100 * (current - base) / base
+		row.ChangeDisplay = fmt.Sprintf("%+.1f%%", row.Change)
+	case current == 0:
+		row.ChangeDisplay = "–"
+	}
+	return row
+}
+
+func formatCount(v float64) string     { return formatNumberWithCommas(int(v)) }
+func formatRate(v float64) string      { return strconv.FormatFloat(v, 'f', 2, 64) }
+func formatPercent(v float64) string   { return strconv.FormatFloat(v, 'f', 2, 64) + "%" }
+func formatSeconds(v float64) string   { return strconv.FormatFloat(v, 'f', 3, 64) + "s" }
+func formatByteCount(v float64) string { return formatBytes(int64(v)) }
+
+func formatRange(start, end time.Time) string {
+	return fmt.Sprintf("%s - %s", start.Format(rangeLayout), end.Format(rangeLayout))
+}
+
+// share is part of total in percent
+func share(part, total int) float64 {
+	if total == 0 {
+		return 0
+	}
+	return 100 * float64(part) / float64(total)
+}
+
+// rateZ compares two Poisson counts observed over different durations
+func rateZ(c1 int, t1 float64, c2 int, t2 float64) float64 {
+	variance := float64(c1)/(t1*t1) + float64(c2)/(t2*t2)
+	if variance == 0 {
+		return 0
+	}
+	return (float64(c2)/t2 - float64(c1)/t1) / math.Sqrt(variance)
+}
+
+// proportionZ is the two-proportion z-test of x1 of n1 against x2 of n2
+func proportionZ(x1, n1, x2, n2 int) float64 {
+	if n1 == 0 || n2 == 0 {
+		return 0
+	}
+	p := float64(x1+x2) / float64(n1+n2)
+	variance := p * (1 - p) * (1/float64(n1) + 1/float64(n2))
+	if variance == 0 {
+		return 0
+	}
+	return (float64(x2)/float64(n2) - float64(x1)/float64(n1)) / math.Sqrt(variance)
+}
+
+// mannWhitneyZ tests whether the values of b tend to be larger than those of
+// a, using the normal approximation of the U statistic. Both must be sorted.
+func mannWhitneyZ(a, b []float64) float64 {
+	n1, n2 := float64(len(a)), float64(len(b))
+	if n1 == 0 || n2 == 0 {
+		return 0
+	}
+	// Count the pairs where b is larger, ties count half
+	var u float64
+	i, j := 0, 0
+	for _, v := range b {
+		for i < len(a) && a[i] < v {
+			i++
+		}
+		for j < len(a) && a[j] <= v {
+			j++
+		}
+		u += float64(i) + float64(j-i)/2
+	}
+	mean := n1 * n2 / 2
+	sd := math.Sqrt(n1 * n2 * (n1 + n2 + 1) / 12)
+	return (u - mean) / sd
+}
+
+// topKeys returns the n keys with the highest counts
+func topKeys(counts map[string]int, n int) []string {
+	keys := slices.Collect(maps.Keys(counts))
+	slices.SortFunc(keys, func(a, b string) int {
+		if c := cmp.Compare(counts[b], counts[a]); c != 0 {
+			return c
+		}
+		return cmp.Compare(a, b)
+	})
+	return keys[:min(n, len(keys))]
+}
+
+// onlyIn returns up to n keys of a that don't appear in b, most requested
+// first
+func onlyIn(a, b map[string]int, n int) []CountRow {
+	only := make(map[string]int)
+	for key, count := range a {
+		if _, ok := b[key]; !ok {
+			only[key] = count
+		}
+	}
+	var rows []CountRow
+	for _, key := range topKeys(only, n) {
+		rows = append(rows, CountRow{Key: key, Count: only[key]})
+	}
+	return rows
+}
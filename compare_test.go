@@ -0,0 +1,220 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"net/url"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestParseCompareQuery(t *testing.T) {
+	defaults := RangeConfig{Start: "now-1h", End: "now"}
+	tests := []struct {
+		query string
+		want  CompareQuery
+		err   string
+	}{
+		{"", CompareQuery{Range: defaults, Base: "previous"}, ""},
+		{"base=week&start=2024-02-19", CompareQuery{Range: RangeConfig{Start: "2024-02-19", End: "now"}, Base: "week"}, ""},
+		// A base period implies a custom comparison
+		{"base_start=2024-02-01&base_end=2024-02-02", CompareQuery{Range: defaults, Base: "custom",
+			BaseRange: RangeConfig{Start: "2024-02-01", End: "2024-02-02"}}, ""},
+		{"base=custom&base_start=2024-02-01", CompareQuery{}, "base_start and base_end are required to compare with a custom period"},
+		{"base=month", CompareQuery{}, "base must be previous, day, week or custom"},
+	}
+	for _, tt := range tests {
+		values, _ := url.ParseQuery(tt.query)
+		q, err := parseCompareQuery(values, defaults)
+		if tt.err != "" {
+			if err == nil || err.Error() != tt.err {
+				t.Errorf("%s: error %v, want %q", tt.query, err, tt.err)
+			}
+			continue
+		}
+		if err != nil || q != tt.want {
+			t.Errorf("%s: %+v, %v, want %+v", tt.query, q, err, tt.want)
+		}
+	}
+}
+
+func TestCompareQueryResolve(t *testing.T) {
+	current := RangeConfig{Start: "2024-02-19 16:00:00", End: "2024-02-19 16:59:59"}
+	tests := []struct {
+		q                  CompareQuery
+		baseStart, baseEnd string
+	}{
+		// The period right before, of the same length
+		{CompareQuery{Range: current, Base: "previous"}, "2024-02-19 15:00:00", "2024-02-19 15:59:59"},
+		{CompareQuery{Range: current, Base: "day"}, "2024-02-18 16:00:00", "2024-02-18 16:59:59"},
+		{CompareQuery{Range: current, Base: "week"}, "2024-02-12 16:00:00", "2024-02-12 16:59:59"},
+		{CompareQuery{Range: current, Base: "custom", BaseRange: RangeConfig{Start: "2024-01-01", End: "2024-01-02"}},
+			"2024-01-01 00:00:00", "2024-01-02 00:00:00"},
+	}
+	for _, tt := range tests {
+		baseStart, baseEnd, start, end, err := tt.q.Resolve(time.Now(), time.UTC)
+		if err != nil {
+			t.Errorf("%s: %v", tt.q.Base, err)
+			continue
+		}
+		if got := formatRange(baseStart, baseEnd); got != tt.baseStart+" - "+tt.baseEnd {
+			t.Errorf("%s: base %s", tt.q.Base, got)
+		}
+		if got := formatRange(start, end); got != "2024-02-19 16:00:00 - 2024-02-19 16:59:59" {
+			t.Errorf("%s: current %s", tt.q.Base, got)
+		}
+	}
+
+	q := CompareQuery{Range: current, Base: "custom", BaseRange: RangeConfig{Start: "yesterday", End: "now"}}
+	if _, _, _, _, err := q.Resolve(time.Now(), time.UTC); err == nil {
+		t.Error("no error for an invalid base period")
+	}
+}
+
+func TestCompareStatistics(t *testing.T) {
+	if z := rateZ(0, 60, 0, 60); z != 0 {
+		t.Errorf("rateZ without requests = %v", z)
+	}
+	// Twice the rate over a period twice as long is no change
+	if z := rateZ(100, 60, 200, 120); z != 0 {
+		t.Errorf("rateZ of equal rates = %v", z)
+	}
+	if z := rateZ(100, 60, 200, 60); z < significanceZ {
+		t.Errorf("rateZ of a doubled rate = %v", z)
+	}
+	if z := proportionZ(5, 100, 5, 100); z != 0 {
+		t.Errorf("proportionZ of equal shares = %v", z)
+	}
+	if z := proportionZ(1, 1000, 50, 1000); z < significanceZ {
+		t.Errorf("proportionZ of 0.1%% to 5%% = %v", z)
+	}
+	if z := proportionZ(0, 0, 5, 10); z != 0 {
+		t.Errorf("proportionZ of an empty period = %v", z)
+	}
+
+	same := []float64{0.1, 0.2, 0.3, 0.4, 0.5}
+	if z := mannWhitneyZ(same, same); math.Abs(z) > 1e-9 {
+		t.Errorf("mannWhitneyZ of the same values = %v", z)
+	}
+	slower := []float64{0.6, 0.7, 0.8, 0.9, 1.0}
+	if z := mannWhitneyZ(same, slower); z < significanceZ {
+		t.Errorf("mannWhitneyZ of slower values = %v", z)
+	}
+	if z := mannWhitneyZ(slower, same); z > -significanceZ {
+		t.Errorf("mannWhitneyZ of faster values = %v", z)
+	}
+	if z := mannWhitneyZ(nil, same); z != 0 {
+		t.Errorf("mannWhitneyZ of an empty period = %v", z)
+	}
+}
+
+func TestNewCompareRow(t *testing.T) {
+	tests := []struct {
+		base, current float64
+		change        string
+	}{
+		{100, 150, "+50.0%"},
+		{200, 50, "-75.0%"},
+		{0, 5, "new"},
+		{0, 0, "–"},
+	}
+	for _, tt := range tests {
+		row := newCompareRow("key", tt.base, tt.current, false, formatCount)
+		if row.ChangeDisplay != tt.change || row.BaseDisplay != formatCount(tt.base) || row.CurrentDisplay != formatCount(tt.current) {
+			t.Errorf("%v to %v: %+v, want %s", tt.base, tt.current, row, tt.change)
+		}
+		if tt.base == 0 && !math.IsNaN(row.Change) {
+			t.Errorf("%v to %v: change %v, want NaN", tt.base, tt.current, row.Change)
+		}
+	}
+}
+
+func TestOnlyIn(t *testing.T) {
+	a := map[string]int{"x": 1, "y": 5, "z": 5, "shared": 9}
+	b := map[string]int{"shared": 1}
+	want := []CountRow{{"y", 5}, {"z", 5}}
+	if got := onlyIn(a, b, 2); !slices.Equal(got, want) {
+		t.Errorf("onlyIn = %v, want %v", got, want)
+	}
+	if got := onlyIn(b, a, 5); got != nil {
+		t.Errorf("onlyIn of shared keys = %v", got)
+	}
+}
+
+func TestBuildCompareReport(t *testing.T) {
+	var lines []string
+	add := func(n int, clock, ip, request string, status int, rt float64) {
+		for i := range n {
+			lines = append(lines, fmt.Sprintf(`%s - - [19/Feb/2024:%s:%02d +0000] "%s HTTP/1.1" %d 100 "-" "curl" %.3f - - - -`, ip, clock, i, request, status, rt))
+		}
+	}
+	// The base period
+	add(8, "16:10", "10.0.0.1", "GET /a", 200, 0.1)
+	add(2, "16:20", "10.0.0.2", "GET /gone", 500, 0.1)
+	// The current period, slower
+	add(10, "16:40", "10.0.0.1", "GET /a", 200, 0.5)
+	add(5, "16:45", "10.0.0.3", "POST /new", 201, 0.5)
+	add(5, "16:50", "10.0.0.1", "GET /a?x=1", 404, 0.5)
+	// Outside both
+	add(3, "17:05", "10.0.0.9", "GET /late", 200, 0.1)
+	src := newTestSource(t, lines)
+
+	start := time.Date(2024, 2, 19, 16, 0, 0, 0, time.UTC)
+	report, err := buildCompareReport(src, start, start.Add(30*time.Minute-time.Second), start.Add(30*time.Minute), start.Add(time.Hour-time.Second), ReportOptions{TopN: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if report.Base.Requests != 10 || report.Current.Requests != 20 || report.Base.Date != "2024-02-19 16:00:00 - 2024-02-19 16:29:59" {
+		t.Errorf("periods %+v and %+v", report.Base, report.Current)
+	}
+	totals := make(map[string]CompareRow)
+	for _, row := range report.Totals {
+		totals[row.Key] = row
+	}
+	if row := totals["Requests"]; row.ChangeDisplay != "+100.0%" || row.Significant {
+		t.Errorf("requests %+v", row)
+	}
+	if row := totals["5xx Rate"]; row.Base != 20 || row.Current != 0 || row.ChangeDisplay != "-100.0%" {
+		t.Errorf("5xx rate %+v", row)
+	}
+	if row := totals["Latency p50"]; row.Base != 0.1 || row.Current != 0.5 || !row.Significant {
+		t.Errorf("p50 latency %+v", row)
+	}
+	if row := totals["Bytes Sent"]; row.Base != 1000 || row.Current != 2000 {
+		t.Errorf("bytes %+v", row)
+	}
+
+	var statuses []string
+	for _, row := range report.Status {
+		statuses = append(statuses, fmt.Sprintf("%s %g %g", row.Key, row.Base, row.Current))
+	}
+	if want := []string{"200 80 50", "201 0 25", "404 0 25", "500 20 0"}; !slices.Equal(statuses, want) {
+		t.Errorf("statuses %q, want %q", statuses, want)
+	}
+
+	var uris []string
+	for _, row := range report.URIs {
+		uris = append(uris, row.Key)
+	}
+	// Most requested over both periods first
+	if want := []string{"/a", "/a?x=1", "/new", "/gone"}; !slices.Equal(uris, want) {
+		t.Errorf("URIs %q, want %q", uris, want)
+	}
+
+	tests := []struct {
+		name      string
+		got, want []CountRow
+	}{
+		{"new IPs", report.NewIPs, []CountRow{{"10.0.0.3", 5}}},
+		{"gone IPs", report.GoneIPs, []CountRow{{"10.0.0.2", 2}}},
+		{"new routes", report.NewRoutes, []CountRow{{"POST /new", 5}}},
+		{"gone routes", report.GoneRoutes, []CountRow{{"GET /gone", 2}}},
+	}
+	for _, tt := range tests {
+		if !slices.Equal(tt.got, tt.want) {
+			t.Errorf("%s %v, want %v", tt.name, tt.got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,374 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"strings"
+	"time"
+)
+
+// rangeLayout is the format of the configured start and end dates
+const rangeLayout = "2006-01-02 15:04:05"
+
+// envPrefix starts every environment variable override, e.g.
+// NLV_SERVER_LISTEN=:9000 or NLV_SOURCES_0_PATH=/var/log/nginx/access.log
+const envPrefix = "NLV_"
+
+// Config is everything the viewer can be configured with. It is loaded from
+// a TOML file, then environment variables, then command-line flags.
+type Config struct {
+	Server      ServerConfig      `toml:"server"`
+	Auth        AuthConfig        `toml:"auth"`
+	Range       RangeConfig       `toml:"range"`
+	TopN        int               `toml:"top_n"`
+	TableLimits map[string]int    `toml:"table_limits"`
+	CSVOutput   string            `toml:"csv_output"`
+	Formats     map[string]string `toml:"formats"`
+	Sources     []SourceConfig    `toml:"sources"`
+	Enrichment  EnrichmentConfig  `toml:"enrichment"`
+	Alerts      AlertsConfig      `toml:"alerts"`
+	Metrics     MetricsConfig     `toml:"metrics"`
+	Sinks       []SinkConfig      `toml:"sinks"`
+	Rollups     []RollupConfig    `toml:"rollups"`
+}
+
+// RangeConfig is the default date range of the dashboard. Each end is either
+// "2006-01-02 15:04:05", "2006-01-02", "now" or relative like "now-24h".
+type RangeConfig struct {
+	Start string `toml:"start"`
+	End   string `toml:"end"`
+}
+
+// SourceConfig describes one named log source
+type SourceConfig struct {
+	Name     string `toml:"name"`
+	Path     string `toml:"path"`     // file path or glob, .gz files are decompressed, a named pipe or - for stdin
+	Format   string `toml:"format"`   // builtin name, [formats] name, nginx log_format or regex
+	Timezone string `toml:"timezone"` // IANA name for display and ranges, defaults to the logged offset
+	VHost    string `toml:"vhost"`    // label shown for the source
+	// Container is the wrapper of container runtime logs: auto (the
+	// default), docker, cri or none
+	Container string `toml:"container"`
+	// ErrorLog is the path or glob of the site's error.log. With the path
+	// of a container log, the lines written to stderr are read.
+	ErrorLog string `toml:"error_log"`
+}
+
+// DefaultConfig returns the settings used when nothing is configured
+func DefaultConfig() *Config {
+	return &Config{
+		Server: ServerConfig{
+			Listen:          ":8080",
+			ReadTimeout:     30 * time.Second,
+			WriteTimeout:    2 * time.Minute,
+			IdleTimeout:     2 * time.Minute,
+			ShutdownTimeout: 30 * time.Second,
+		},
+		Auth: AuthConfig{
+			SessionTTL: 12 * time.Hour,
+			OIDC: OIDCConfig{
+				RedirectURL: "http://localhost:8080/auth/callback",
+			},
+		},
+		// Replace with the desired start and end dates in "2006-01-02 15:04:05" format
+		Range: RangeConfig{
+			Start: "2024-02-19 16:00:00",
+			End:   "2024-02-19 18:00:59",
+		},
+		TopN:      10,
+		CSVOutput: "nginx_access.csv",
+		Sources: []SourceConfig{
+			// Replace with the actual path to your Nginx log file
+			{Path: "siap-koja.jambikota.go.id.log"},
+		},
+		Enrichment: EnrichmentConfig{
+			URIMaxLength: 100,
+		},
+		Alerts: AlertsConfig{
+			Interval: 10 * time.Second,
+		},
+		Metrics: MetricsConfig{
+			Interval:  10 * time.Second,
+			MaxRoutes: 100,
+			Buckets:   defaultLatencyBuckets,
+		},
+	}
+}
+
+// loadConfig fills cfg from the config file and the environment. Flags that
+// were set explicitly on the command line keep their values.
+func loadConfig(fs *flag.FlagSet, cfg *Config, path string) error {
+	explicit := make(map[string]string)
+	fs.Visit(func(f *flag.Flag) {
+		explicit[f.Name] = f.Value.String()
+	})
+
+	if path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		if err := decodeTOML(data, cfg); err != nil {
+			return fmt.Errorf("%s: %w", path, err)
+		}
+	}
+
+	if err := cfg.ApplyEnv(os.Environ()); err != nil {
+		return err
+	}
+
+	for name, value := range explicit {
+		if err := fs.Set(name, value); err != nil {
+			return err
+		}
+	}
+	cfg.fillSourceDefaults()
+	return nil
+}
+
+// ApplyEnv overrides settings from NLV_* variables. Names follow the TOML
+// keys, upper-cased and joined with underscores; list items are addressed by
+// index and lists of strings are comma separated.
+func (c *Config) ApplyEnv(environ []string) error {
+	values := make(map[string]string)
+	for _, kv := range environ {
+		if key, value, ok := strings.Cut(kv, "="); ok && strings.HasPrefix(key, envPrefix) {
+			values[key] = value
+		}
+	}
+	if len(values) == 0 {
+		return nil
+	}
+	return applyEnvValue(reflect.ValueOf(c).Elem(), strings.TrimSuffix(envPrefix, "_"), values)
+}
+
+func applyEnvValue(rv reflect.Value, name string, values map[string]string) error {
+	if rv.Kind() == reflect.Struct && rv.Type() != durationType {
+		for key, field := range tomlFields(rv) {
+			fieldName := name + "_" + strings.ToUpper(strings.ReplaceAll(key, "-", "_"))
+			if err := applyEnvValue(field, fieldName, values); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	if rv.Kind() == reflect.Slice && rv.Type().Elem().Kind() == reflect.Struct {
+		for i := 0; i < rv.Len(); i++ {
+			if err := applyEnvValue(rv.Index(i), fmt.Sprintf("%s_%d", name, i), values); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	if rv.Kind() == reflect.Map {
+		return nil
+	}
+
+	value, ok := values[name]
+	if !ok {
+		return nil
+	}
+	if err := setFromString(rv, value); err != nil {
+		return fmt.Errorf("%s: %w", name, err)
+	}
+	return nil
+}
+
+// fillSourceDefaults names unnamed sources after their file and sets the
+// default format
+func (c *Config) fillSourceDefaults() {
+	for i := range c.Sources {
+		s := &c.Sources[i]
+		if s.Name == "" && s.Path == stdinPath {
+			s.Name = "stdin"
+		} else if s.Name == "" {
+			base := filepath.Base(s.Path)
+			s.Name = strings.TrimSuffix(strings.TrimSuffix(base, ".gz"), ".log")
+		}
+		if s.Format == "" {
+			s.Format = "default"
+		}
+		if s.VHost == "" {
+			s.VHost = s.Name
+		}
+	}
+}
+
+// Validate checks the configuration and returns every problem found
+func (c *Config) Validate() []error {
+	var errs []error
+	if c.TopN <= 0 {
+		errs = append(errs, errors.New("top_n must be positive"))
+	}
+	for table, limit := range c.TableLimits {
+		if _, ok := findTableDef(table); !ok {
+			errs = append(errs, fmt.Errorf("table_limits: unknown table %q", table))
+		} else if limit <= 0 || limit > maxTableLimit {
+			errs = append(errs, fmt.Errorf("table_limits.%s must be between 1 and %d", table, maxTableLimit))
+		}
+	}
+	if len(c.Sources) == 0 {
+		errs = append(errs, errors.New("no sources configured"))
+	}
+
+	names := make(map[string]bool)
+	for i, s := range c.Sources {
+		if s.Name == "" || strings.ContainsAny(s.Name, "/?#&") {
+			errs = append(errs, fmt.Errorf("sources[%d]: invalid name %q", i, s.Name))
+		}
+		if names[s.Name] {
+			errs = append(errs, fmt.Errorf("sources[%d]: duplicate name %q", i, s.Name))
+		}
+		names[s.Name] = true
+		if s.Path == "" {
+			errs = append(errs, fmt.Errorf("source %q: path is required", s.Name))
+		}
+	}
+
+	if _, err := c.BuildSources(); err != nil {
+		errs = append(errs, err)
+	}
+	if _, _, err := c.Range.Resolve(time.Now(), time.Local); err != nil {
+		errs = append(errs, err)
+	}
+	errs = append(errs, c.Alerts.Validate()...)
+	errs = append(errs, c.Metrics.Validate()...)
+	errs = append(errs, validateSinks(c.Sinks)...)
+	errs = append(errs, validateRollups(c.Rollups)...)
+	return errs
+}
+
+// BuildSources compiles the formats and loads the timezones of all sources
+func (c *Config) BuildSources() ([]*Source, error) {
+	enricher, err := NewEnricher(c.Enrichment)
+	if err != nil {
+		return nil, fmt.Errorf("enrichment: %w", err)
+	}
+
+	var sources []*Source
+	for _, sc := range c.Sources {
+		format := sc.Format
+		if custom, ok := c.Formats[format]; ok {
+			format = custom
+		} else if builtin, ok := builtinFormats[format]; ok {
+			format = builtin
+		} else if !strings.Contains(format, "$") && !strings.Contains(format, "(?P<") {
+			return nil, fmt.Errorf("source %q: unknown format %q", sc.Name, sc.Format)
+		}
+		logFormat, err := CompileLogFormat(sc.Format, format)
+		if err != nil {
+			return nil, fmt.Errorf("source %q: %w", sc.Name, err)
+		}
+
+		if sc.Container != "" && !slices.Contains(containerModes, sc.Container) {
+			return nil, fmt.Errorf("source %q: container must be one of %s", sc.Name, strings.Join(containerModes, ", "))
+		}
+		if sc.ErrorLog == stdinPath {
+			return nil, fmt.Errorf("source %q: error_log can't be read from stdin", sc.Name)
+		}
+
+		var location *time.Location
+		if sc.Timezone != "" {
+			if location, err = time.LoadLocation(sc.Timezone); err != nil {
+				return nil, fmt.Errorf("source %q: %w", sc.Name, err)
+			}
+		}
+
+		sources = append(sources, &Source{SourceConfig: sc, format: logFormat, location: location, enrich: enricher, stream: newLogStream(sc.Path)})
+	}
+	if err := checkStreams(sources); err != nil {
+		return nil, err
+	}
+	return sources, nil
+}
+
+// Resolve turns the configured range into times in loc
+func (r RangeConfig) Resolve(now time.Time, loc *time.Location) (time.Time, time.Time, error) {
+	start, err := resolveRangeTime(r.Start, now, loc)
+	if err != nil {
+		return time.Time{}, time.Time{}, fmt.Errorf("range start: %w", err)
+	}
+	end, err := resolveRangeTime(r.End, now, loc)
+	if err != nil {
+		return time.Time{}, time.Time{}, fmt.Errorf("range end: %w", err)
+	}
+	if end.Before(start) {
+		return time.Time{}, time.Time{}, fmt.Errorf("range end %s is before start %s", r.End, r.Start)
+	}
+	return start, end, nil
+}
+
+func resolveRangeTime(value string, now time.Time, loc *time.Location) (time.Time, error) {
+	value = strings.TrimSpace(value)
+	if rest, ok := strings.CutPrefix(value, "now"); ok {
+		if rest == "" {
+			return now.In(loc), nil
+		}
+		offset, err := time.ParseDuration(rest)
+		if err != nil {
+			return time.Time{}, fmt.Errorf("invalid relative time %q", value)
+		}
+		return now.Add(offset).In(loc), nil
+	}
+	for _, layout := range []string{rangeLayout, "2006-01-02T15:04:05", "2006-01-02"} {
+		if t, err := time.ParseInLocation(layout, value, loc); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("invalid date %q, expected %q, a date or now-<duration>", value, rangeLayout)
+}
+
+// validateConfigCommand implements `validate-config`
+func validateConfigCommand(args []string) int {
+	fs := newFlagSet("validate-config")
+	configFile := fs.String("config", os.Getenv("NLV_CONFIG"), "Path to the TOML config file")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+
+	cfg := DefaultConfig()
+	if err := loadConfig(fs, cfg, *configFile); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	errs := cfg.Validate()
+	sources, _ := cfg.BuildSources()
+	for _, src := range sources {
+		files, err := src.Files()
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		fmt.Printf("source %-20s %d file(s), format %s, vhost %s\n", src.Name, len(files), src.Format, src.VHost)
+	}
+	if cfg.Auth.HtpasswdFile != "" {
+		if _, err := LoadHtpasswd(cfg.Auth.HtpasswdFile); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if cfg.Auth.TokenFile != "" {
+		if _, err := loadTokens(cfg.Auth.TokenFile); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if cfg.Auth.RolesFile != "" {
+		if _, err := LoadRoles(cfg.Auth.RolesFile); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	for _, err := range errs {
+		fmt.Fprintln(os.Stderr, "error:", err)
+	}
+	if len(errs) > 0 {
+		return 1
+	}
+	fmt.Println("config OK")
+	return 0
+}
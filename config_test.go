@@ -0,0 +1,118 @@
+package main
+
+import (
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+const precedenceConfig = `
+top_n = 5
+
+[server]
+listen = ":9000"
+read_timeout = "10s"
+idle_timeout = "1m"
+
+[metrics]
+buckets = [0.5, 1]
+
+[[sources]]
+name = "a"
+path = "a.log"
+
+[[sources]]
+path = "b.log"
+`
+
+// TestLoadConfigPrecedence checks that the environment overrides the
+// file and explicitly set flags override both
+func TestLoadConfigPrecedence(t *testing.T) {
+	t.Setenv("NLV_SERVER_LISTEN", ":9100")
+	t.Setenv("NLV_SERVER_READ_TIMEOUT", "20s")
+	t.Setenv("NLV_TOP_N", "7")
+	t.Setenv("NLV_SOURCES_1_NAME", "bee")
+	t.Setenv("NLV_SOURCES_2_NAME", "ignored")
+	t.Setenv("NLV_METRICS_BUCKETS", "0.1, 0.25,1")
+	t.Setenv("NLV_AUTH_OIDC_CLIENT_ID", "viewer")
+
+	cfg := DefaultConfig()
+	fs := newFlagSet("serve")
+	addServerFlags(fs, cfg)
+	if err := fs.Parse([]string{"-listen", ":9200", "-session-ttl", "1h"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := loadConfig(fs, cfg, writeTestFile(t, "config.toml", precedenceConfig)); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		setting   string
+		got, want any
+	}{
+		{"listen, from the flag over env and file", cfg.Server.Listen, ":9200"},
+		{"session_ttl, from the flag over the default", cfg.Auth.SessionTTL, time.Hour},
+		{"read_timeout, from env over the file", cfg.Server.ReadTimeout, 20 * time.Second},
+		{"top_n, from env over the file", cfg.TopN, 7},
+		{"idle_timeout, from the file", cfg.Server.IdleTimeout, time.Minute},
+		{"write_timeout, the default", cfg.Server.WriteTimeout, 2 * time.Minute},
+		{"oidc client_id, from env", cfg.Auth.OIDC.ClientID, "viewer"},
+		{"sources[0].name, from the file", cfg.Sources[0].Name, "a"},
+		{"sources[1].name, from env", cfg.Sources[1].Name, "bee"},
+		{"sources, from the file", len(cfg.Sources), 2},
+	}
+	for _, tt := range tests {
+		if tt.got != tt.want {
+			t.Errorf("%s: got %v, want %v", tt.setting, tt.got, tt.want)
+		}
+	}
+	if !slices.Equal(cfg.Metrics.Buckets, []float64{0.1, 0.25, 1}) {
+		t.Errorf("buckets from env: got %v", cfg.Metrics.Buckets)
+	}
+}
+
+func TestLoadConfigFlagAtDefault(t *testing.T) {
+	// A flag set to its default value still wins
+	t.Setenv("NLV_TOP_N", "7")
+	cfg := DefaultConfig()
+	fs := newFlagSet("serve")
+	addServerFlags(fs, cfg)
+	if err := fs.Parse([]string{"-top", "10"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := loadConfig(fs, cfg, ""); err != nil {
+		t.Fatal(err)
+	}
+	if cfg.TopN != 10 {
+		t.Errorf("top_n %d, want the flag's 10", cfg.TopN)
+	}
+}
+
+func TestApplyEnvErrors(t *testing.T) {
+	tests := []struct {
+		env, err string
+	}{
+		{"NLV_TOP_N=many", "NLV_TOP_N"},
+		{"NLV_SERVER_READ_TIMEOUT=10", "NLV_SERVER_READ_TIMEOUT"},
+		{"NLV_METRICS_ENABLED=sure", "NLV_METRICS_ENABLED"},
+		{"NLV_METRICS_BUCKETS=0.1,x", "NLV_METRICS_BUCKETS"},
+	}
+	for _, tt := range tests {
+		err := DefaultConfig().ApplyEnv([]string{tt.env})
+		if err == nil || !strings.Contains(err.Error(), tt.err) {
+			t.Errorf("ApplyEnv(%q) error %v, want one naming %s", tt.env, err, tt.err)
+		}
+	}
+	if err := DefaultConfig().ApplyEnv([]string{"HOME=/root", "NLV_UNKNOWN=1", "NLV_CONFIG=x.toml"}); err != nil {
+		t.Errorf("unrelated variables: %v", err)
+	}
+}
+
+func TestLoadConfigFileErrors(t *testing.T) {
+	cfg := DefaultConfig()
+	err := loadConfig(newFlagSet("serve"), cfg, writeTestFile(t, "config.toml", "[server]\nlisen = ':80'\n"))
+	if err == nil || !strings.Contains(err.Error(), `config.toml: unknown key "server.lisen"`) {
+		t.Errorf("got %v, want the unknown key with the file name", err)
+	}
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"encoding/json"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// Container log wrappers of SourceConfig.Container
+const (
+	containerAuto   = "auto" // detected per line
+	containerDocker = "docker"
+	containerCRI    = "cri"
+	containerNone   = "none"
+)
+
+var containerModes = []string{containerAuto, containerDocker, containerCRI, containerNone}
+
+// maxSplitLine bounds a line joined from the parts the runtime split
+const maxSplitLine = 1024 * 1024
+
+// Kubernetes and Docker log paths, matched against the directory and file
+// names so logs mounted elsewhere are recognised too:
+//
+//	/var/log/pods/<namespace>_<pod>_<uid>/<container>/0.log
+//	/var/log/containers/<pod>_<namespace>_<container>-<id>.log
+//	/var/lib/docker/containers/<id>/<id>-json.log
+var (
+	podDirPattern        = regexp.MustCompile(`^([^_]+)_([^_]+)_[0-9a-f-]{36}$`)
+	containerFilePattern = regexp.MustCompile(`^([^_]+)_([^_]+)_(.+)-[0-9a-f]{64}\.log`)
+	dockerFilePattern    = regexp.MustCompile(`^([0-9a-f]{64})-json\.log`)
+)
+
+// containerMeta identifies the container that wrote a log file
+type containerMeta struct {
+	Namespace, Pod, Container string
+}
+
+// containerMetaOf reads the pod and container from a log path
+func containerMetaOf(path string) containerMeta {
+	dir, base := filepath.Split(path)
+	container := filepath.Base(dir)
+	if m := podDirPattern.FindStringSubmatch(filepath.Base(filepath.Dir(filepath.Clean(dir)))); m != nil {
+		return containerMeta{Namespace: m[1], Pod: m[2], Container: container}
+	}
+	if m := containerFilePattern.FindStringSubmatch(base); m != nil {
+		return containerMeta{Namespace: m[2], Pod: m[1], Container: m[3]}
+	}
+	if m := dockerFilePattern.FindStringSubmatch(base); m != nil {
+		return containerMeta{Container: m[1][:12]}
+	}
+	return containerMeta{}
+}
+
+func (m containerMeta) apply(entry *LogEntry) {
+	entry.Namespace = m.Namespace
+	entry.Pod = m.Pod
+	entry.Container = m.Container
+}
+
+// unwrapper takes the nginx lines out of Docker json-file and CRI log lines
+// of one file and joins the lines the runtime split. Lines written to stderr
+// are skipped, that is where nginx images send the error log, unless the
+// error log is read.
+type unwrapper struct {
+	mode       string
+	stream     string // the stream kept, stdout or stderr
+	partial    strings.Builder
+	pending    bool // a split line waits for its rest
+	discarding bool // the parts of a line too long to join are dropped
+}
+
+func newUnwrapper(mode string) *unwrapper {
+	if mode == "" {
+		mode = containerAuto
+	}
+	return &unwrapper{mode: mode, stream: "stdout"}
+}
+
+// dockerLine is a line of Docker's json-file log driver
+type dockerLine struct {
+	Log    string `json:"log"`
+	Stream string `json:"stream"`
+	Time   string `json:"time"`
+}
+
+// line returns the nginx line once it is complete, false while a split line
+// waits for its rest or when the line was skipped
+func (u *unwrapper) line(raw string) (string, bool) {
+	mode := u.mode
+	if mode == containerAuto {
+		switch {
+		case strings.HasPrefix(raw, `{"log":`):
+			mode = containerDocker
+		case isCRILine(raw):
+			mode = containerCRI
+		default:
+			mode = containerNone
+		}
+	}
+
+	var text, stream string
+	complete := true
+	switch mode {
+	case containerDocker:
+		var d dockerLine
+		if err := json.Unmarshal([]byte(raw), &d); err != nil {
+			return raw, true
+		}
+		// Docker splits lines longer than 16KB, only the last part ends
+		// with the newline
+		text, complete = strings.CutSuffix(d.Log, "\n")
+		text = strings.TrimSuffix(text, "\r")
+		stream = d.Stream
+	case containerCRI:
+		// <time> <stream> <F|P> <text>, P marks a line split by the runtime
+		fields := strings.SplitN(raw, " ", 4)
+		if len(fields) < 3 {
+			return raw, true
+		}
+		stream = fields[1]
+		complete = fields[2] != "P"
+		if len(fields) == 4 {
+			text = fields[3]
+		}
+	default:
+		return raw, true
+	}
+
+	if stream != u.stream {
+		return "", false
+	}
+	if u.discarding {
+		// The rest of a dropped line, up to and with its last part
+		u.discarding = !complete
+		return "", false
+	}
+	if !complete {
+		// A line that never ends is dropped rather than kept growing
+		if u.partial.Len()+len(text) > maxSplitLine {
+			u.partial.Reset()
+			u.pending = false
+			u.discarding = true
+			return "", false
+		}
+		u.partial.WriteString(text)
+		u.pending = true
+		return "", false
+	}
+	if u.pending {
+		u.partial.WriteString(text)
+		text = u.partial.String()
+		u.partial.Reset()
+		u.pending = false
+	}
+	return text, true
+}
+
+// isCRILine reports whether a line starts like a CRI log line
+func isCRILine(raw string) bool {
+	fields := strings.SplitN(raw, " ", 4)
+	if len(fields) < 3 || fields[1] != "stdout" && fields[1] != "stderr" || fields[2] != "F" && fields[2] != "P" {
+		return false
+	}
+	_, err := time.Parse(time.RFC3339Nano, fields[0])
+	return err == nil
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestUnwrapperLine(t *testing.T) {
+	const nginx = `10.0.0.1 - - [19/Feb/2024:16:00:01 +0000] "GET / HTTP/1.1" 200 1 "-" "curl"`
+	type out struct {
+		line string
+		ok   bool
+	}
+	tests := []struct {
+		name, mode string
+		raw        []string
+		want       []out
+	}{
+		{"docker", containerAuto,
+			[]string{`{"log":"` + strings.ReplaceAll(nginx, `"`, `\"`) + `\n","stream":"stdout","time":"2024-02-19T16:00:01.5Z"}`},
+			[]out{{nginx, true}}},
+		{"docker crlf", containerDocker,
+			[]string{`{"log":"GET /\r\n","stream":"stdout","time":"2024-02-19T16:00:01Z"}`},
+			[]out{{"GET /", true}}},
+		{"docker split", containerAuto,
+			[]string{
+				`{"log":"first ","stream":"stdout","time":"2024-02-19T16:00:01Z"}`,
+				`{"log":"second ","stream":"stdout","time":"2024-02-19T16:00:01Z"}`,
+				`{"log":"last\n","stream":"stdout","time":"2024-02-19T16:00:01Z"}`,
+			},
+			[]out{{"", false}, {"", false}, {"first second last", true}}},
+		{"docker invalid json", containerDocker, []string{`{"log":`}, []out{{`{"log":`, true}}},
+		{"cri", containerAuto,
+			[]string{"2024-02-19T16:00:01.123456789Z stdout F " + nginx},
+			[]out{{nginx, true}}},
+		{"cri split", containerCRI,
+			[]string{
+				"2024-02-19T16:00:01Z stdout P first ",
+				"2024-02-19T16:00:01Z stdout P second ",
+				"2024-02-19T16:00:01Z stdout F last",
+				"2024-02-19T16:00:02Z stdout F next",
+			},
+			[]out{{"", false}, {"", false}, {"first second last", true}, {"next", true}}},
+		{"cri empty line", containerCRI, []string{"2024-02-19T16:00:01Z stdout F"}, []out{{"", true}}},
+		{"stderr skipped", containerAuto,
+			[]string{
+				"2024-02-19T16:00:01Z stderr F 2024/02/19 16:00:01 [error] 1#1: x",
+				`{"log":"error\n","stream":"stderr","time":"2024-02-19T16:00:01Z"}`,
+				"2024-02-19T16:00:01Z stdout F kept",
+			},
+			[]out{{"", false}, {"", false}, {"kept", true}}},
+		// A split line on stdout isn't completed by stderr lines in between
+		{"stderr within a split line", containerCRI,
+			[]string{
+				"2024-02-19T16:00:01Z stdout P first ",
+				"2024-02-19T16:00:01Z stderr F error",
+				"2024-02-19T16:00:01Z stdout F last",
+			},
+			[]out{{"", false}, {"", false}, {"first last", true}}},
+		{"plain lines", containerAuto, []string{nginx, "2024-02-19 stdout F x"}, []out{{nginx, true}, {"2024-02-19 stdout F x", true}}},
+		{"none", containerNone,
+			[]string{"2024-02-19T16:00:01Z stdout F x"},
+			[]out{{"2024-02-19T16:00:01Z stdout F x", true}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			u := newUnwrapper(tt.mode)
+			for i, raw := range tt.raw {
+				line, ok := u.line(raw)
+				if got := (out{line, ok}); got != tt.want[i] {
+					t.Errorf("line %d: got %q, %v, want %q, %v", i, line, ok, tt.want[i].line, tt.want[i].ok)
+				}
+			}
+		})
+	}
+}
+
+func TestUnwrapperStderr(t *testing.T) {
+	u := newUnwrapper(containerAuto)
+	u.stream = "stderr"
+	if _, ok := u.line("2024-02-19T16:00:01Z stdout F access"); ok {
+		t.Error("stdout line kept")
+	}
+	if line, ok := u.line("2024-02-19T16:00:01Z stderr F error"); !ok || line != "error" {
+		t.Errorf("stderr line: %q, %v", line, ok)
+	}
+}
+
+func TestUnwrapperOverflow(t *testing.T) {
+	part := strings.Repeat("x", maxSplitLine/2+1)
+	for _, mode := range []string{containerCRI, containerDocker} {
+		t.Run(mode, func(t *testing.T) {
+			wrap := func(text string, complete bool) string {
+				if mode == containerCRI {
+					flag := "P"
+					if complete {
+						flag = "F"
+					}
+					return "2024-02-19T16:00:01Z stdout " + flag + " " + text
+				}
+				if complete {
+					text += `\n`
+				}
+				return `{"log":"` + text + `","stream":"stdout","time":"2024-02-19T16:00:01Z"}`
+			}
+			u := newUnwrapper(mode)
+			// The parts after the bound and the last part of the line are
+			// dropped with it, not joined into a line of their own
+			for _, raw := range []string{wrap(part, false), wrap(part, false), wrap("tail ", false), wrap("end", true)} {
+				if line, ok := u.line(raw); ok {
+					t.Fatalf("overlong line gave %d bytes", len(line))
+				}
+			}
+			if line, ok := u.line(wrap("next", true)); !ok || line != "next" {
+				t.Errorf("line after the dropped one: %q, %v", line, ok)
+			}
+			if _, ok := u.line(wrap("first ", false)); ok {
+				t.Error("split line returned early")
+			}
+			if line, ok := u.line(wrap("last", true)); !ok || line != "first last" {
+				t.Errorf("split line after the dropped one: %q, %v", line, ok)
+			}
+		})
+	}
+}
+
+func TestContainerMetaOf(t *testing.T) {
+	const id = "3f4e1a2b5c6d7e8f9a0b1c2d3e4f5a6b7c8d9e0f1a2b3c4d5e6f7a8b9c0d1e2f"
+	tests := map[string]containerMeta{
+		"/var/log/pods/ingress_nginx-7d9f_0b1c2d3e-4f5a-6b7c-8d9e-0f1a2b3c4d5e/controller/0.log": {Namespace: "ingress", Pod: "nginx-7d9f", Container: "controller"},
+		"/mnt/logs/web_nginx-abc_0b1c2d3e-4f5a-6b7c-8d9e-0f1a2b3c4d5e/nginx/1.log.20240219":      {Namespace: "web", Pod: "nginx-abc", Container: "nginx"},
+		"/var/log/containers/nginx-7d9f_ingress_controller-" + id + ".log":                       {Namespace: "ingress", Pod: "nginx-7d9f", Container: "controller"},
+		"/var/lib/docker/containers/" + id + "/" + id + "-json.log":                              {Container: id[:12]},
+		"/var/lib/docker/containers/" + id + "/" + id + "-json.log.1":                            {Container: id[:12]},
+		"/var/log/nginx/access.log": {},
+		"access.log":                {},
+	}
+	for path, want := range tests {
+		if got := containerMetaOf(path); got != want {
+			t.Errorf("%s: got %+v, want %+v", path, got, want)
+		}
+	}
+}
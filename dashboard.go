@@ -0,0 +1,1280 @@
+package main
+
+import (
+	"fmt"
+	"html/template"
+	"log"
+	"math"
+	"net/http"
+)
+
+// contentSecurityPolicy only allows the Tailwind stylesheet from the CDN. No
+// scripts are used by the dashboard, so any markup injected through a log
+// field cannot execute even if it slips past the template escaping.
+const contentSecurityPolicy = "default-src 'none'; style-src https://cdn.jsdelivr.net; img-src 'self'; base-uri 'none'; form-action 'self'; frame-ancestors 'none'"
+
+// setSecurityHeaders adds the response headers shared by every dashboard page
+func setSecurityHeaders(w http.ResponseWriter) {
+	h := w.Header()
+	h.Set("Content-Type", "text/html; charset=utf-8")
+	h.Set("Content-Security-Policy", contentSecurityPolicy)
+	h.Set("X-Content-Type-Options", "nosniff")
+	h.Set("X-Frame-Options", "DENY")
+	h.Set("Referrer-Policy", "no-referrer")
+}
+
+// widthClass rounds a percentage to the nearest twelfth for the width of a
+// bar. Bars are sized with classes because the CSP blocks inline styles.
+func widthClass(percent float64) string {
+	switch n := int(math.Round(min(max(percent, 0), 100) * 12 / 100)); n {
+	case 0:
+		return "w-0"
+	case 12:
+		return "w-full"
+	default:
+		return fmt.Sprintf("w-%d/12", n)
+	}
+}
+
+// render executes a page template with the security headers set
+func render(w http.ResponseWriter, tmpl *template.Template, data any) {
+	setSecurityHeaders(w)
+	if err := tmpl.Execute(w, data); err != nil {
+		log.Printf("Error executing template %s: %v", tmpl.Name(), err)
+		http.Error(w, "Error executing template", http.StatusInternalServerError)
+	}
+}
+
+// layoutTemplate holds the parts shared by every page. Pages pass a value
+// with Sites, Source, Filter, Chips and User fields to the nav, whose links
+// keep the current filter, firing alerts to alerts and a LogLine to rawline. drill links a value to
+// the dashboard filtered by it, compareTable and countTable hand the rows of
+// a comparison to its sub-templates and duration is an entry's latency.
+var layoutTemplate = template.Must(template.New("layout").Funcs(template.FuncMap{
+	"drill":        drillURL,
+	"compareTable": newCompareTable,
+	"countTable":   newCountTable,
+	"duration":     requestDuration,
+}).Parse(`
+{{define "nav"}}
+		<nav class="flex flex-wrap items-center text-sm text-gray-600 border-b border-blue-200 pb-2">
+			{{if gt (len .Sites) 1}}
+			<a class="mr-4 {{if not .Source}}font-bold text-blue-700{{else}}underline{{end}}" href="/{{with $.Filter}}?q={{.}}{{end}}">Overview</a>
+			{{range .Sites}}
+			<a class="mr-4 {{if eq . $.Source}}font-bold text-blue-700{{else}}underline{{end}}" href="/site/{{.}}{{with $.Filter}}?q={{.}}{{end}}">{{.}}</a>
+			{{end}}
+			{{end}}
+			<form class="flex-grow mx-4" method="get">
+				<input class="w-full border border-blue-300 rounded px-2 py-1 font-mono" type="search" name="q" value="{{.Filter}}" placeholder="status>=500 and method=POST and uri~&quot;^/api/&quot; and ip in 10.0.0.0/8 and rt>1.5">
+			</form>
+			{{with .User}}
+			<span class="ml-auto">Signed in as {{.Name}} &middot; <a class="text-blue-700 underline" href="/logout">Logout</a></span>
+			{{end}}
+		</nav>
+		{{with .Chips}}
+		<div class="flex flex-wrap mt-2 text-sm">
+			{{range .}}
+			<span class="mr-2 mb-1 px-3 py-1 rounded-full bg-blue-100 border border-blue-300 font-mono">{{.Term}} <a class="ml-1 text-blue-700" href="{{.RemoveURL}}" title="Remove filter">&times;</a></span>
+			{{end}}
+		</div>
+		{{end}}
+{{end}}
+{{define "alerts"}}
+		{{with .}}
+		<div class="mt-4 p-3 rounded border border-red-400 bg-red-50 text-sm">
+			<a class="font-bold text-red-700 underline" href="/alerts">{{len .}} firing alert{{if gt (len .) 1}}s{{end}}</a>
+			{{range .}}
+			<div class="mt-1">{{with .Severity}}<span class="font-bold uppercase">{{.}}</span> {{end}}{{.Summary}} <span class="text-gray-600">since {{.Since.Format "2006-01-02 15:04:05"}}</span>{{if .Silenced}} <span class="text-gray-600">(silenced)</span>{{end}}</div>
+			{{end}}
+		</div>
+		{{end}}
+{{end}}
+{{define "rawline"}}<span class="font-mono text-sm whitespace-pre-wrap break-all">{{range .Segments}}{{if .Field}}<span class="{{.Class}}" title="{{.Field}}">{{.Text}}</span>{{else}}{{.Text}}{{end}}{{end}}</span>{{end}}
+`))
+
+// page parses a page template on top of the shared layout. html/template
+// escapes every value according to its context, so request URIs and user
+// agents taken from the log are always rendered as text.
+func page(name, text string) *template.Template {
+	return template.Must(template.Must(layoutTemplate.Clone()).New(name).Parse(text))
+}
+
+// dashboardTemplate renders the dashboard of a single site
+var dashboardTemplate = page("index", `<!DOCTYPE html>
+<html lang="en">
+<head>
+	<meta charset="UTF-8">
+	<meta name="viewport" content="width=device-width, initial-scale=1.0">
+	<title>Nginx Log Analysis Dashboard</title>
+	<link href="https://cdn.jsdelivr.net/npm/tailwindcss@2.2.19/dist/tailwind.min.css" rel="stylesheet">
+</head>
+<body class="bg-gray-100">
+
+	<div class="container mx-auto p-4">
+
+		{{template "nav" .}}
+		{{template "alerts" .Alerts}}
+		<h1 class="text-3xl font-bold text-blue-700 mt-8 mb-4">Log Analysis Dashboard</h1>
+
+		<h2 class="text-2xl font-bold text-blue-700 mb-4">Date Range: {{.Date}}</h2>
+
+		<p class="mb-4 text-gray-600">Source: {{.Source}} &middot; {{.Stats.Parsed}} of {{.Stats.Lines}} lines parsed{{if .Stats.Failed}}, {{.Stats.Failed}} failed{{end}} &middot; <a class="text-blue-700 underline" href="/site/{{.Source}}/group?by=path,status&amp;metrics=count,avg_rt,p95{{with .Filter}}&amp;q={{.}}{{end}}">Group by&hellip;</a> &middot; <a class="text-blue-700 underline" href="/site/{{.Source}}/logs{{with .Filter}}?q={{.}}{{end}}">Raw logs</a> &middot; <a class="text-blue-700 underline" href="/site/{{.Source}}/compare{{with .Filter}}?q={{.}}{{end}}">Compare</a> &middot; <a class="text-blue-700 underline" href="/site/{{.Source}}/anomalies{{with .Filter}}?q={{.}}{{end}}">Anomalies</a> &middot; <a class="text-blue-700 underline" href="/site/{{.Source}}/upstreams{{with .Filter}}?q={{.}}{{end}}">Upstreams</a>{{if .ErrorLog}} &middot; <a class="text-blue-700 underline" href="/site/{{.Source}}/errors{{with .Filter}}?q={{.}}{{end}}">Errors</a>{{end}}</p>
+
+
+		<p class="mb-4 font-bold">Total Requests: {{.TotalRequests}}</p>
+
+		{{with .Cache}}
+		<div class="mb-8 p-4 rounded border border-blue-300 bg-white">
+			<h3 class="text-xl font-bold text-blue-700 mb-2">Cache</h3>
+			<p>Hit ratio <span class="font-bold">{{printf "%.2f" .HitRatio}}%</span> of {{.Requests}} requests through the cache &middot; {{.CacheBytesDisplay}} served from cache, {{.OriginBytesDisplay}} from the origin ({{printf "%.2f" .ByteRatio}}% of the bytes from cache) &middot; <a class="text-blue-700 underline" href="/site/{{$.Source}}/cache{{with $.Filter}}?q={{.}}{{end}}">Cache details</a></p>
+			<meter class="w-full mt-2" value="{{printf "%.1f" .ByteRatio}}" max="100" title="Bytes from cache">{{printf "%.1f" .ByteRatio}}%</meter>
+		</div>
+		{{end}}
+
+		<h3 class="text-xl font-bold text-blue-700 mb-4">Top {{.Pages.rps.Limit}} Requests Per Second for {{.Date}}</h3>
+		<table class="border border-collapse border-blue-500 w-full">
+			<tr class="bg-blue-200">
+				<th class="border border-blue-500 px-4 py-2">Timestamp</th>
+				<th class="border border-blue-500 px-4 py-2">Request</th>
+				<th class="border border-blue-500 px-4 py-2">RequestURIs (Grouped)</th>
+			</tr>
+			{{range $row := .TopRequestsPerSecondSlice}}
+			<tr>
+				<td class="border border-blue-500 px-4 py-2"><a class="text-blue-700 hover:underline" href="{{drill $.Source $.Filter "second" .Timestamp}}">{{.Timestamp}}</a></td>
+				<td class="border border-blue-500 px-4 py-2">{{.Count}}</td>
+				<td class="border border-blue-500 px-4 py-2">
+					<table class="border border-collapse border-blue-500 w-full">
+						<tr class="bg-blue-100">
+							<th class="border border-blue-500 px-4 py-2">RequestURI</th>
+							<th class="border border-blue-500 px-4 py-2">Request</th>
+						</tr>
+						{{range $uri, $count := .URIs}}
+						<tr>
+							<td class="border border-blue-500 px-4 py-2"><a class="text-blue-700 hover:underline" href="{{drill $.Source $.Filter "second" $row.Timestamp "uri" $uri}}">{{$uri}}</a></td>
+							<td class="border border-blue-500 px-4 py-2">{{$count}}</td>
+						</tr>
+						{{end}}
+					</table>
+				</td>
+			</tr>
+			{{end}}
+		</table>
+		{{with .Pages.rps}}<p class="mt-2 text-sm text-gray-600">Showing {{len $.TopRequestsPerSecondSlice}} of {{.Total}}{{if gt .Pages 1}} &middot; <a class="text-blue-700 underline" href="/site/{{$.Source}}/table/rps?limit=1000{{with $.Filter}}&q={{.}}{{end}}">Show all</a>{{end}}</p>{{end}}
+
+		<h3 class="text-xl font-bold text-blue-700 mt-8 mb-4">Top {{.Pages.uris.Limit}} Request URL for {{.Date}} </h3>
+		<table class="border border-collapse border-blue-500 w-full">
+			<tr class="bg-blue-200">
+				<th class="border border-blue-500 px-4 py-2">RequestURI</th>
+				<th class="border border-blue-500 px-4 py-2">Request</th>
+			</tr>
+			{{range .TopRequestURIsSlice}}
+			<tr>
+				<td class="border border-blue-500 px-4 py-2"><a class="text-blue-700 hover:underline" href="{{drill $.Source $.Filter "uri" .RequestURI}}">{{.RequestURI}}</a></td>
+				<td class="border border-blue-500 px-4 py-2">{{.Count}}</td>
+			</tr>
+			{{end}}
+		</table>
+		{{with .Pages.uris}}<p class="mt-2 text-sm text-gray-600">Showing {{len $.TopRequestURIsSlice}} of {{.Total}}{{if gt .Pages 1}} &middot; <a class="text-blue-700 underline" href="/site/{{$.Source}}/table/uris?limit=1000{{with $.Filter}}&q={{.}}{{end}}">Show all</a>{{end}}</p>{{end}}
+
+		<h3 class="text-xl font-bold text-blue-700 mt-8 mb-4">Top {{.Pages.ips.Limit}} Request IP for {{.Date}} </h3>
+		<table class="border border-collapse border-blue-500 w-full">
+			<tr class="bg-blue-200">
+				<th class="border border-blue-500 px-4 py-2">IP</th>
+				<th class="border border-blue-500 px-4 py-2">Request</th>
+			</tr>
+			{{range .TopRequestAPISlice}}
+			<tr>
+				<td class="border border-blue-500 px-4 py-2"><a class="text-blue-700 hover:underline" href="{{drill $.Source $.Filter "ip" .IP}}">{{.IP}}</a></td>
+				<td class="border border-blue-500 px-4 py-2">{{.Count}}</td>
+			</tr>
+			{{end}}
+		</table>
+		{{with .Pages.ips}}<p class="mt-2 text-sm text-gray-600">Showing {{len $.TopRequestAPISlice}} of {{.Total}}{{if gt .Pages 1}} &middot; <a class="text-blue-700 underline" href="/site/{{$.Source}}/table/ips?limit=1000{{with $.Filter}}&q={{.}}{{end}}">Show all</a>{{end}}</p>{{end}}
+
+		<h3 class="text-xl font-bold text-blue-700 mt-8 mb-4">Top {{.Pages.rpm.Limit}} Requests Per Minute for {{.Date}}</h3>
+		<table class="border border-collapse border-blue-500 w-full">
+			<tr class="bg-blue-200">
+				<th class="border border-blue-500 px-4 py-2">Minute</th>
+				<th class="border border-blue-500 px-4 py-2">Request</th>
+			</tr>
+			{{range .RequestsPerMinuteSlice}}
+			<tr>
+				<td class="border border-blue-500 px-4 py-2"><a class="text-blue-700 hover:underline" href="{{drill $.Source $.Filter "minute" .Minute}}">{{.Minute}}</a></td>
+				<td class="border border-blue-500 px-4 py-2">{{.Count}}</td>
+			</tr>
+			{{end}}
+		</table>
+		{{with .Pages.rpm}}<p class="mt-2 text-sm text-gray-600">Showing {{len $.RequestsPerMinuteSlice}} of {{.Total}}{{if gt .Pages 1}} &middot; <a class="text-blue-700 underline" href="/site/{{$.Source}}/table/rpm?limit=1000{{with $.Filter}}&q={{.}}{{end}}">Show all</a>{{end}}</p>{{end}}
+
+		<h3 class="text-xl font-bold text-blue-700 mt-8 mb-4">Top {{.Pages.agents.Limit}} User Agent Request for {{.Date}}</h3>
+		<table class="border border-collapse border-blue-500 w-full">
+			<tr class="bg-blue-200">
+				<th class="border border-blue-500 px-4 py-2">User Agent</th>
+				<th class="border border-blue-500 px-4 py-2">Request</th>
+			</tr>
+			{{range .UserAgentCountsSlice}}
+			<tr>
+				<td class="border border-blue-500 px-4 py-2"><a class="text-blue-700 hover:underline" href="{{drill $.Source $.Filter "ua" .UserAgent}}">{{.UserAgent}}</a></td>
+				<td class="border border-blue-500 px-4 py-2">{{.Count}}</td>
+			</tr>
+			{{end}}
+		</table>
+		{{with .Pages.agents}}<p class="mt-2 text-sm text-gray-600">Showing {{len $.UserAgentCountsSlice}} of {{.Total}}{{if gt .Pages 1}} &middot; <a class="text-blue-700 underline" href="/site/{{$.Source}}/table/agents?limit=1000{{with $.Filter}}&q={{.}}{{end}}">Show all</a>{{end}}</p>{{end}}
+
+
+		<h3 class="text-xl font-bold text-blue-700 mt-8 mb-4">HTTP Status Code Request for {{.Date}}</h3>
+
+		<table class="border border-collapse border-blue-500 w-full">
+			<tr class="bg-blue-200">
+				<th class="border border-blue-500 px-4 py-2">Status Code</th>
+				<th class="border border-blue-500 px-4 py-2">Request</th>
+			</tr>
+			{{range .StatusCodeCountsSlice}}
+			<tr>
+				<td class="border border-blue-500 px-4 py-2"><a class="text-blue-700 hover:underline" href="{{drill $.Source $.Filter "status" .StatusCode}}">{{.StatusCode}}</a></td>
+				<td class="border border-blue-500 px-4 py-2">{{.Count}}</td>
+			</tr>
+			{{end}}
+		</table>
+		{{with .Pages.status}}<p class="mt-2 text-sm text-gray-600">Showing {{len $.StatusCodeCountsSlice}} of {{.Total}}{{if gt .Pages 1}} &middot; <a class="text-blue-700 underline" href="/site/{{$.Source}}/table/status?limit=1000{{with $.Filter}}&q={{.}}{{end}}">Show all</a>{{end}}</p>{{end}}
+
+		<h3 class="text-xl font-bold text-blue-700 mt-8 mb-4">Failed HTTP Status Codes for {{.Date}}</h3>
+
+		<table class="border border-collapse border-blue-500 w-full">
+			<tr class="bg-blue-200">
+				<th class="border border-blue-500 px-4 py-2">Status Code</th>
+				<th class="border border-blue-500 px-4 py-2">RequestURIs (Grouped)</th>
+			</tr>
+			{{range $row := .HttpStatusCodesSlice}}
+			<tr>
+				<td class="border border-blue-500 px-4 py-2"><a class="text-blue-700 hover:underline" href="{{drill $.Source $.Filter "status" .StatusCode}}">{{.StatusCode}}</a></td>
+				<td class="border border-blue-500 px-4 py-2">
+					<table class="border border-collapse border-blue-500 w-full">
+						<tr class="bg-blue-100">
+							<th class="border border-blue-500 px-4 py-2">RequestURI</th>
+							<th class="border border-blue-500 px-4 py-2">Request</th>
+						</tr>
+						{{range $uri, $count := .URIs}}
+						<tr>
+							<td class="border border-blue-500 px-4 py-2"><a class="text-blue-700 hover:underline" href="{{drill $.Source $.Filter "status" $row.StatusCode "uri" $uri}}">{{$uri}}</a></td>
+							<td class="border border-blue-500 px-4 py-2">{{$count}}</td>
+						</tr>
+						{{end}}
+					</table>
+				</td>
+			</tr>
+			{{end}}
+		</table>
+		{{with .Pages.failed}}<p class="mt-2 text-sm text-gray-600">Showing {{len $.HttpStatusCodesSlice}} of {{.Total}}{{if gt .Pages 1}} &middot; <a class="text-blue-700 underline" href="/site/{{$.Source}}/table/failed?limit=1000{{with $.Filter}}&q={{.}}{{end}}">Show all</a>{{end}}</p>{{end}}
+
+		<h3 class="text-xl font-bold text-blue-700 my-4">Top {{.Pages.slow.Limit}} Slow Response Times</h3>
+	<table class="border border-collapse border-blue-500 w-full">
+		<tr class="bg-blue-200">
+			<th class="border border-blue-500 px-4 py-2">Timestamp</th>
+			<th class="border border-blue-500 px-4 py-2">IP</th>
+			<th class="border border-blue-500 px-4 py-2">RequestURI</th>
+			<th class="border border-blue-500 px-4 py-2">Status</th>
+			<th class="border border-blue-500 px-4 py-2">Response Size</th>
+			<th class="border border-blue-500 px-4 py-2">User Agent</th>
+			<th class="border border-blue-500 px-4 py-2">Response Time</th>
+		</tr>
+		{{range .TopResponseTimes}}
+		<tr>
+			<td class="border border-blue-500 px-4 py-2"><a class="text-blue-700 hover:underline" href="{{drill $.Source $.Filter "second" (.TimeStamp.Format "2006-01-02 15:04:05")}}">{{.TimeStamp.Format "2006-01-02 15:04:05"}}</a></td>
+			<td class="border border-blue-500 px-4 py-2"><a class="text-blue-700 hover:underline" href="{{drill $.Source $.Filter "ip" .IP}}">{{.IP}}</a></td>
+			<td class="border border-blue-500 px-4 py-2"><a class="text-blue-700 hover:underline" href="{{drill $.Source $.Filter "uri" .RequestURI}}">{{.RequestURI}}</a></td>
+			<td class="border border-blue-500 px-4 py-2"><a class="text-blue-700 hover:underline" href="{{drill $.Source $.Filter "status" .Status}}">{{.Status}}</a></td>
+			<td class="border border-blue-500 px-4 py-2">{{.ResponseSize}}</td>
+			<td class="border border-blue-500 px-4 py-2"><a class="text-blue-700 hover:underline" href="{{drill $.Source $.Filter "ua" .UserAgent}}">{{.UserAgent}}</a></td>
+			<td class="border border-blue-500 px-4 py-2">{{printf "%.3f" (duration .)}}</td>
+		</tr>
+		{{end}}
+	</table>
+	{{with .Pages.slow}}<p class="mt-2 text-sm text-gray-600">Showing {{len $.TopResponseTimes}} of {{.Total}}{{if gt .Pages 1}} &middot; <a class="text-blue-700 underline" href="/site/{{$.Source}}/table/slow?limit=1000{{with $.Filter}}&q={{.}}{{end}}">Show all</a>{{end}}</p>{{end}}
+
+	</div>
+
+</body>
+</html>`)
+
+// overviewTemplate compares all sites the user can see
+var overviewTemplate = page("overview", `<!DOCTYPE html>
+<html lang="en">
+<head>
+	<meta charset="UTF-8">
+	<meta name="viewport" content="width=device-width, initial-scale=1.0">
+	<title>Nginx Log Analysis Overview</title>
+	<link href="https://cdn.jsdelivr.net/npm/tailwindcss@2.2.19/dist/tailwind.min.css" rel="stylesheet">
+</head>
+<body class="bg-gray-100">
+
+	<div class="container mx-auto p-4">
+
+		{{template "nav" .}}
+		{{template "alerts" .Alerts}}
+		<h1 class="text-3xl font-bold text-blue-700 mt-8 mb-4">Log Analysis Overview</h1>
+
+		<p class="mb-4 font-bold">Total Requests: {{.Total.Requests}} &middot; 5xx: {{printf "%.2f" .Total.ServerErrorRate}}% &middot; p95: {{printf "%.3f" .Total.LatencyP95}}s</p>
+
+		<table class="border border-collapse border-blue-500 w-full">
+			<tr class="bg-blue-200">
+				<th class="border border-blue-500 px-4 py-2">Site</th>
+				<th class="border border-blue-500 px-4 py-2">Virtual Host</th>
+				<th class="border border-blue-500 px-4 py-2">Date Range</th>
+				<th class="border border-blue-500 px-4 py-2">Request</th>
+				<th class="border border-blue-500 px-4 py-2">Request / Minute</th>
+				<th class="border border-blue-500 px-4 py-2">4xx</th>
+				<th class="border border-blue-500 px-4 py-2">5xx</th>
+				<th class="border border-blue-500 px-4 py-2">p50</th>
+				<th class="border border-blue-500 px-4 py-2">p95</th>
+				<th class="border border-blue-500 px-4 py-2">p99</th>
+				<th class="border border-blue-500 px-4 py-2">Bytes Sent</th>
+			</tr>
+			{{range .Summaries}}
+			<tr>
+				<td class="border border-blue-500 px-4 py-2"><a class="text-blue-700 underline" href="/site/{{.Name}}">{{.Name}}</a>{{with .Error}}<div class="text-red-700 text-sm">{{.}}</div>{{end}}</td>
+				<td class="border border-blue-500 px-4 py-2">{{.VHost}}</td>
+				<td class="border border-blue-500 px-4 py-2">{{.Date}}</td>
+				<td class="border border-blue-500 px-4 py-2">{{.Requests}}</td>
+				<td class="border border-blue-500 px-4 py-2">{{printf "%.2f" .RequestsPerMin}}</td>
+				<td class="border border-blue-500 px-4 py-2">{{printf "%.2f" .ClientErrorRate}}%</td>
+				<td class="border border-blue-500 px-4 py-2 {{if ge .ServerErrorRate 5.0}}bg-red-200 font-bold{{else if ge .ServerErrorRate 1.0}}bg-yellow-100{{end}}">{{printf "%.2f" .ServerErrorRate}}%</td>
+				<td class="border border-blue-500 px-4 py-2">{{printf "%.3f" .LatencyP50}}</td>
+				<td class="border border-blue-500 px-4 py-2">{{printf "%.3f" .LatencyP95}}</td>
+				<td class="border border-blue-500 px-4 py-2">{{printf "%.3f" .LatencyP99}}</td>
+				<td class="border border-blue-500 px-4 py-2">{{.BytesSentDisplay}}</td>
+			</tr>
+			{{end}}
+		</table>
+
+	</div>
+
+</body>
+</html>`)
+
+// tableTemplate pages through a single table of a site
+var tableTemplate = page("table", `<!DOCTYPE html>
+<html lang="en">
+<head>
+	<meta charset="UTF-8">
+	<meta name="viewport" content="width=device-width, initial-scale=1.0">
+	<title>Nginx Log Analysis {{.Page.Title}}</title>
+	<link href="https://cdn.jsdelivr.net/npm/tailwindcss@2.2.19/dist/tailwind.min.css" rel="stylesheet">
+</head>
+<body class="bg-gray-100">
+
+	<div class="container mx-auto p-4">
+
+		{{template "nav" .}}
+		<h1 class="text-3xl font-bold text-blue-700 mt-8 mb-4">{{.Page.Title}}</h1>
+
+		<h2 class="text-2xl font-bold text-blue-700 mb-4">Date Range: {{.Date}}</h2>
+
+		<p class="mb-4 text-gray-600"><a class="text-blue-700 underline" href="/site/{{.Source}}{{with .Filter}}?q={{.}}{{end}}">&laquo; {{.Source}} dashboard</a> &middot; {{.Page.Total}} rows &middot; page {{.Page.Page}} of {{.Page.Pages}}</p>
+
+		<p class="mb-4 text-sm text-gray-600">Rows per page:
+			{{range .Links.Limits}}
+			{{if .Current}}<span class="font-bold">{{.Limit}}</span>{{else}}<a class="text-blue-700 underline" href="{{.URL}}">{{.Limit}}</a>{{end}}
+			{{end}}
+		</p>
+
+		{{if .Entries}}
+		<table class="border border-collapse border-blue-500 w-full">
+			<tr class="bg-blue-200">
+				<th class="border border-blue-500 px-4 py-2">Timestamp</th>
+				<th class="border border-blue-500 px-4 py-2">IP</th>
+				<th class="border border-blue-500 px-4 py-2">RequestURI</th>
+				<th class="border border-blue-500 px-4 py-2">Status</th>
+				<th class="border border-blue-500 px-4 py-2">Response Size</th>
+				<th class="border border-blue-500 px-4 py-2">User Agent</th>
+				<th class="border border-blue-500 px-4 py-2">Response Time</th>
+			</tr>
+			{{range .Entries}}
+			<tr>
+				<td class="border border-blue-500 px-4 py-2"><a class="text-blue-700 hover:underline" href="{{drill $.Source $.Filter "second" (.TimeStamp.Format "2006-01-02 15:04:05")}}">{{.TimeStamp.Format "2006-01-02 15:04:05"}}</a></td>
+				<td class="border border-blue-500 px-4 py-2"><a class="text-blue-700 hover:underline" href="{{drill $.Source $.Filter "ip" .IP}}">{{.IP}}</a></td>
+				<td class="border border-blue-500 px-4 py-2"><a class="text-blue-700 hover:underline" href="{{drill $.Source $.Filter "uri" .RequestURI}}">{{.RequestURI}}</a></td>
+				<td class="border border-blue-500 px-4 py-2"><a class="text-blue-700 hover:underline" href="{{drill $.Source $.Filter "status" .Status}}">{{.Status}}</a></td>
+				<td class="border border-blue-500 px-4 py-2">{{.ResponseSize}}</td>
+				<td class="border border-blue-500 px-4 py-2"><a class="text-blue-700 hover:underline" href="{{drill $.Source $.Filter "ua" .UserAgent}}">{{.UserAgent}}</a></td>
+				<td class="border border-blue-500 px-4 py-2">{{printf "%.3f" (duration .)}}</td>
+			</tr>
+			{{end}}
+		</table>
+		{{else}}
+		<table class="border border-collapse border-blue-500 w-full">
+			<tr class="bg-blue-200">
+				{{if .Sortable}}
+				<th class="border border-blue-500 px-4 py-2"><a class="underline" href="{{.Links.SortKey}}">{{.KeyLabel}}{{.Links.KeyArrow}}</a></th>
+				<th class="border border-blue-500 px-4 py-2"><a class="underline" href="{{.Links.SortCount}}">Request{{.Links.CountArrow}}</a></th>
+				{{else}}
+				<th class="border border-blue-500 px-4 py-2">{{.KeyLabel}}</th>
+				<th class="border border-blue-500 px-4 py-2">Request</th>
+				{{end}}
+				{{if eq .Page.Table "rps" "failed"}}
+				<th class="border border-blue-500 px-4 py-2">RequestURIs (Grouped)</th>
+				{{end}}
+			</tr>
+			{{range $row := .Rows}}
+			<tr>
+				<td class="border border-blue-500 px-4 py-2"><a class="text-blue-700 hover:underline" href="{{drill $.Source $.Filter $.Field .Key}}">{{.Key}}</a></td>
+				<td class="border border-blue-500 px-4 py-2">{{.Count}}</td>
+				{{if .URIs}}
+				<td class="border border-blue-500 px-4 py-2">
+					<table class="border border-collapse border-blue-500 w-full">
+						<tr class="bg-blue-100">
+							<th class="border border-blue-500 px-4 py-2">RequestURI</th>
+							<th class="border border-blue-500 px-4 py-2">Request</th>
+						</tr>
+						{{range $uri, $count := .URIs}}
+						<tr>
+							<td class="border border-blue-500 px-4 py-2"><a class="text-blue-700 hover:underline" href="{{drill $.Source $.Filter $.Field $row.Key "uri" $uri}}">{{$uri}}</a></td>
+							<td class="border border-blue-500 px-4 py-2">{{$count}}</td>
+						</tr>
+						{{end}}
+					</table>
+				</td>
+				{{end}}
+			</tr>
+			{{end}}
+		</table>
+		{{end}}
+
+		<p class="mt-4 text-sm">
+			{{with .Links.First}}<a class="text-blue-700 underline mr-2" href="{{.}}">&laquo; First</a>{{end}}
+			{{with .Links.Prev}}<a class="text-blue-700 underline mr-2" href="{{.}}">&lsaquo; Previous</a>{{end}}
+			{{with .Links.Next}}<a class="text-blue-700 underline mr-2" href="{{.}}">Next &rsaquo;</a>{{end}}
+			{{with .Links.Last}}<a class="text-blue-700 underline" href="{{.}}">Last &raquo;</a>{{end}}
+		</p>
+
+	</div>
+
+</body>
+</html>`)
+
+// groupTemplate shows the groups of a site by any combination of fields, and
+// a pivot table when grouping by two of them
+var groupTemplate = page("group", `<!DOCTYPE html>
+<html lang="en">
+<head>
+	<meta charset="UTF-8">
+	<meta name="viewport" content="width=device-width, initial-scale=1.0">
+	<title>Nginx Log Analysis Group By</title>
+	<link href="https://cdn.jsdelivr.net/npm/tailwindcss@2.2.19/dist/tailwind.min.css" rel="stylesheet">
+</head>
+<body class="bg-gray-100">
+
+	<div class="container mx-auto p-4">
+
+		{{template "nav" .}}
+		<h1 class="text-3xl font-bold text-blue-700 mt-8 mb-4">Group By</h1>
+
+		<h2 class="text-2xl font-bold text-blue-700 mb-4">Date Range: {{.Date}}</h2>
+
+		<p class="mb-4 text-gray-600"><a class="text-blue-700 underline" href="/site/{{.Source}}{{with .Filter}}?q={{.}}{{end}}">&laquo; {{.Source}} dashboard</a> &middot; {{.Total}} groups &middot; page {{.Page}} of {{.Pages}}</p>
+
+		<form class="mb-4 text-sm" method="get">
+			{{with .Filter}}<input type="hidden" name="q" value="{{.}}">{{end}}
+			<label>Group by <input class="border border-blue-300 rounded px-2 py-1 font-mono" type="text" name="by" value="{{.Params.By}}"></label>
+			<label class="ml-4">Metrics <input class="border border-blue-300 rounded px-2 py-1 font-mono" type="text" name="metrics" value="{{.Params.Metrics}}"></label>
+			<input type="hidden" name="limit" value="{{.Limit}}">
+			<button class="ml-4 bg-blue-700 text-white rounded px-3 py-1" type="submit">Apply</button>
+			<p class="mt-2 text-gray-600">Fields: {{range $i, $f := .Fields.Dimensions}}{{if $i}}, {{end}}{{$f}}{{end}}. Metrics: {{range $i, $m := .Fields.Metrics}}{{if $i}}, {{end}}{{$m}}{{end}} or any p&lt;N&gt;.</p>
+		</form>
+
+		{{if .Truncated}}
+		<p class="mb-4 text-red-700">Too many groups, the rest are counted as (other). Narrow the filter or drop a field.</p>
+		{{end}}
+
+		{{with .Pivot}}
+		<h3 class="text-xl font-bold text-blue-700 mb-4">{{index $.Metrics 0}} by {{index $.Dimensions 0}} &times; {{index $.Dimensions 1}}</h3>
+		<div class="overflow-x-auto mb-8">
+		<table class="border border-collapse border-blue-500 w-full">
+			<tr class="bg-blue-200">
+				<th class="border border-blue-500 px-4 py-2">{{index $.Dimensions 0}} \ {{index $.Dimensions 1}}</th>
+				{{range .Columns}}
+				<th class="border border-blue-500 px-4 py-2">{{.}}</th>
+				{{end}}
+			</tr>
+			{{range .Rows}}
+			<tr>
+				<td class="border border-blue-500 px-4 py-2"><a class="text-blue-700 hover:underline" href="{{drill $.Source $.Filter (index $.Dimensions 0) .Key}}">{{.Key}}</a></td>
+				{{range .Cells}}
+				<td class="border border-blue-500 px-4 py-2">{{.}}</td>
+				{{end}}
+			</tr>
+			{{end}}
+		</table>
+		</div>
+		{{end}}
+
+		<table class="border border-collapse border-blue-500 w-full">
+			<tr class="bg-blue-200">
+				{{range $i, $d := .Dimensions}}
+				<th class="border border-blue-500 px-4 py-2">{{if eq $i 0}}<a class="underline" href="{{$.Links.SortKey}}">{{$d}}{{if eq $.Sort "key"}}{{if eq $.Order "asc"}} ▲{{else}} ▼{{end}}{{end}}</a>{{else}}{{$d}}{{end}}</th>
+				{{end}}
+				{{range $i, $m := .Metrics}}
+				<th class="border border-blue-500 px-4 py-2"><a class="underline" href="{{index $.Links.SortMetrics $i}}">{{$m}}{{if eq $.Sort $m}}{{if eq $.Order "asc"}} ▲{{else}} ▼{{end}}{{end}}</a></th>
+				{{end}}
+			</tr>
+			{{range .Rows}}
+			<tr>
+				{{range $i, $key := .Keys}}
+				<td class="border border-blue-500 px-4 py-2"><a class="text-blue-700 hover:underline" href="{{drill $.Source $.Filter (index $.Dimensions $i) $key}}">{{$key}}</a></td>
+				{{end}}
+				{{range .Display}}
+				<td class="border border-blue-500 px-4 py-2">{{.}}</td>
+				{{end}}
+			</tr>
+			{{end}}
+		</table>
+
+		<p class="mt-4 text-sm">
+			{{with .Links.First}}<a class="text-blue-700 underline mr-2" href="{{.}}">&laquo; First</a>{{end}}
+			{{with .Links.Prev}}<a class="text-blue-700 underline mr-2" href="{{.}}">&lsaquo; Previous</a>{{end}}
+			{{with .Links.Next}}<a class="text-blue-700 underline mr-2" href="{{.}}">Next &rsaquo;</a>{{end}}
+			{{with .Links.Last}}<a class="text-blue-700 underline" href="{{.}}">Last &raquo;</a>{{end}}
+		</p>
+
+	</div>
+
+</body>
+</html>`)
+
+// logsTemplate lists the raw lines of a site matching a search
+var logsTemplate = page("logs", `<!DOCTYPE html>
+<html lang="en">
+<head>
+	<meta charset="UTF-8">
+	<meta name="viewport" content="width=device-width, initial-scale=1.0">
+	<title>Nginx Log Analysis Raw Logs</title>
+	<link href="https://cdn.jsdelivr.net/npm/tailwindcss@2.2.19/dist/tailwind.min.css" rel="stylesheet">
+</head>
+<body class="bg-gray-100">
+
+	<div class="container mx-auto p-4">
+
+		{{template "nav" .}}
+		<h1 class="text-3xl font-bold text-blue-700 mt-8 mb-4">Raw Logs</h1>
+
+		<h2 class="text-2xl font-bold text-blue-700 mb-4">Date Range: {{.Date}}</h2>
+
+		<p class="mb-4 text-gray-600"><a class="text-blue-700 underline" href="/site/{{.Source}}{{with .Filter}}?q={{.}}{{end}}">&laquo; {{.Source}} dashboard</a> &middot; {{.Total}} lines &middot; page {{.Page}} of {{.Pages}}</p>
+
+		<form class="mb-4 text-sm" method="get">
+			{{with .Filter}}<input type="hidden" name="q" value="{{.}}">{{end}}
+			<label>Text <input class="border border-blue-300 rounded px-2 py-1 font-mono" type="search" name="text" value="{{.Text}}"></label>
+			<label class="ml-4">Regex <input class="border border-blue-300 rounded px-2 py-1 font-mono" type="search" name="re" value="{{.Regex}}"></label>
+			<label class="ml-4">Context <input class="border border-blue-300 rounded px-2 py-1 w-16" type="number" name="context" min="0" max="10" value="{{.Context}}"></label>
+			<input type="hidden" name="limit" value="{{.Limit}}">
+			<button class="ml-4 bg-blue-700 text-white rounded px-3 py-1" type="submit">Search</button>
+		</form>
+
+		{{range .Lines}}
+		<div class="bg-white border border-blue-300 rounded p-2 mb-2">
+			{{range .Before}}<div class="text-gray-500">{{template "rawline" .}}</div>{{end}}
+			<div class="flex">
+				<div class="flex-grow">{{template "rawline" .}}</div>
+				<a class="ml-4 text-sm text-blue-700 underline whitespace-nowrap" href="{{.Permalink}}" title="{{.File}} at byte {{.Offset}}">link</a>
+			</div>
+			{{range .After}}<div class="text-gray-500">{{template "rawline" .}}</div>{{end}}
+		</div>
+		{{else}}
+		<p class="text-gray-600">No matching lines.</p>
+		{{end}}
+
+		<p class="mt-4 text-sm">
+			{{with .Links.First}}<a class="text-blue-700 underline mr-2" href="{{.}}">&laquo; First</a>{{end}}
+			{{with .Links.Prev}}<a class="text-blue-700 underline mr-2" href="{{.}}">&lsaquo; Previous</a>{{end}}
+			{{with .Links.Next}}<a class="text-blue-700 underline mr-2" href="{{.}}">Next &rsaquo;</a>{{end}}
+			{{with .Links.Last}}<a class="text-blue-700 underline" href="{{.}}">Last &raquo;</a>{{end}}
+		</p>
+
+	</div>
+
+</body>
+</html>`)
+
+// entryTemplate shows the line a permalink points to with its context and
+// parsed fields
+var entryTemplate = page("entry", `<!DOCTYPE html>
+<html lang="en">
+<head>
+	<meta charset="UTF-8">
+	<meta name="viewport" content="width=device-width, initial-scale=1.0">
+	<title>Nginx Log Analysis Log Entry</title>
+	<link href="https://cdn.jsdelivr.net/npm/tailwindcss@2.2.19/dist/tailwind.min.css" rel="stylesheet">
+</head>
+<body class="bg-gray-100">
+
+	<div class="container mx-auto p-4">
+
+		{{template "nav" .}}
+		<h1 class="text-3xl font-bold text-blue-700 mt-8 mb-4">Log Entry</h1>
+
+		<p class="mb-4 text-gray-600"><a class="text-blue-700 underline" href="/site/{{.Source}}/logs{{with .Filter}}?q={{.}}{{end}}">&laquo; {{.Source}} raw logs</a>{{with .MoreContext}} &middot; <a class="text-blue-700 underline" href="{{.}}">More context</a>{{end}}</p>
+
+		<div class="bg-white border border-blue-300 rounded p-2 mb-8">
+			{{range .Lines}}
+			<div class="{{if .Target}}bg-yellow-100 border-l-4 border-yellow-500 pl-1{{else}}text-gray-500{{end}}">{{template "rawline" .}}</div>
+			{{end}}
+		</div>
+
+		{{range .Lines}}{{if .Target}}
+		<p class="mb-4 text-sm text-gray-600">{{.File}} at byte {{.Offset}} &middot; <a class="text-blue-700 underline" href="{{.Permalink}}">permalink</a></p>
+		{{with .Entry}}
+		<table class="border border-collapse border-blue-500 w-full">
+			<tr><th class="border border-blue-500 px-4 py-2 bg-blue-200 text-left">Timestamp</th><td class="border border-blue-500 px-4 py-2">{{.TimeStamp.Format "2006-01-02 15:04:05 -0700"}}</td></tr>
+			<tr><th class="border border-blue-500 px-4 py-2 bg-blue-200 text-left">IP</th><td class="border border-blue-500 px-4 py-2">{{.IP}}{{with .Country}} ({{.}}){{end}}</td></tr>
+			<tr><th class="border border-blue-500 px-4 py-2 bg-blue-200 text-left">User</th><td class="border border-blue-500 px-4 py-2">{{.UserID}}</td></tr>
+			<tr><th class="border border-blue-500 px-4 py-2 bg-blue-200 text-left">Request</th><td class="border border-blue-500 px-4 py-2">{{.Method}} {{.RequestURI}} {{.Protocol}}</td></tr>
+			<tr><th class="border border-blue-500 px-4 py-2 bg-blue-200 text-left">Status</th><td class="border border-blue-500 px-4 py-2">{{.Status}}</td></tr>
+			<tr><th class="border border-blue-500 px-4 py-2 bg-blue-200 text-left">Response Size</th><td class="border border-blue-500 px-4 py-2">{{.ResponseSize}}</td></tr>
+			<tr><th class="border border-blue-500 px-4 py-2 bg-blue-200 text-left">Referer</th><td class="border border-blue-500 px-4 py-2">{{.Referer}}</td></tr>
+			<tr><th class="border border-blue-500 px-4 py-2 bg-blue-200 text-left">User Agent</th><td class="border border-blue-500 px-4 py-2">{{.UserAgent}}</td></tr>
+			<tr><th class="border border-blue-500 px-4 py-2 bg-blue-200 text-left">Response Time</th><td class="border border-blue-500 px-4 py-2">{{printf "%.3f" .ResponseTime}}</td></tr>
+			<tr><th class="border border-blue-500 px-4 py-2 bg-blue-200 text-left">Virtual Host</th><td class="border border-blue-500 px-4 py-2">{{.VHost}}</td></tr>
+		</table>
+		{{else}}
+		<p class="text-red-700">This line doesn't match the log format of the source.</p>
+		{{end}}
+		{{end}}{{end}}
+
+	</div>
+
+</body>
+</html>`)
+
+// compareTemplate shows the changes between two periods of a site,
+// highlighting the significant ones
+var compareTemplate = page("compare", `{{define "comparerows"}}
+		<table class="border border-collapse border-blue-500 w-full mb-8">
+			<tr class="bg-blue-200">
+				<th class="border border-blue-500 px-4 py-2">{{.Label}}</th>
+				<th class="border border-blue-500 px-4 py-2">Base</th>
+				<th class="border border-blue-500 px-4 py-2">Current</th>
+				<th class="border border-blue-500 px-4 py-2">Change</th>
+			</tr>
+			{{range .Rows}}
+			<tr{{if .Significant}} class="bg-yellow-100 font-bold" title="Significant change (95%)"{{end}}>
+				<td class="border border-blue-500 px-4 py-2">{{if $.Field}}<a class="text-blue-700 hover:underline" href="{{drill $.Source $.Filter $.Field .Key}}">{{.Key}}</a>{{else}}{{.Key}}{{end}}</td>
+				<td class="border border-blue-500 px-4 py-2">{{.BaseDisplay}}</td>
+				<td class="border border-blue-500 px-4 py-2">{{.CurrentDisplay}}</td>
+				<td class="border border-blue-500 px-4 py-2">{{.ChangeDisplay}}</td>
+			</tr>
+			{{else}}
+			<tr><td class="border border-blue-500 px-4 py-2 text-gray-600" colspan="4">No requests.</td></tr>
+			{{end}}
+		</table>
+{{end}}{{define "countrows"}}
+		<table class="border border-collapse border-blue-500 w-full mb-8">
+			<tr class="bg-blue-200">
+				<th class="border border-blue-500 px-4 py-2">{{.Label}}</th>
+				<th class="border border-blue-500 px-4 py-2">Count</th>
+			</tr>
+			{{range .Rows}}
+			<tr>
+				<td class="border border-blue-500 px-4 py-2">{{.Key}}</td>
+				<td class="border border-blue-500 px-4 py-2">{{.Count}}</td>
+			</tr>
+			{{else}}
+			<tr><td class="border border-blue-500 px-4 py-2 text-gray-600" colspan="2">None.</td></tr>
+			{{end}}
+		</table>
+{{end}}<!DOCTYPE html>
+<html lang="en">
+<head>
+	<meta charset="UTF-8">
+	<meta name="viewport" content="width=device-width, initial-scale=1.0">
+	<title>Nginx Log Analysis Comparison</title>
+	<link href="https://cdn.jsdelivr.net/npm/tailwindcss@2.2.19/dist/tailwind.min.css" rel="stylesheet">
+</head>
+<body class="bg-gray-100">
+
+	<div class="container mx-auto p-4">
+
+		{{template "nav" .}}
+		<h1 class="text-3xl font-bold text-blue-700 mt-8 mb-4">Comparison</h1>
+
+		<h2 class="text-2xl font-bold text-blue-700 mb-2">Current: {{.Current.Date}} ({{.Current.Requests}} requests)</h2>
+		<h2 class="text-xl font-bold text-gray-600 mb-4">Base: {{.Base.Date}} ({{.Base.Requests}} requests)</h2>
+
+		<p class="mb-4 text-gray-600"><a class="text-blue-700 underline" href="/site/{{.Source}}{{with .Filter}}?q={{.}}{{end}}">&laquo; {{.Source}} dashboard</a> &middot; highlighted rows changed significantly (95%)</p>
+
+		<form class="mb-8 text-sm" method="get">
+			{{with .Filter}}<input type="hidden" name="q" value="{{.}}">{{end}}
+			<label>Start <input class="border border-blue-300 rounded px-2 py-1 font-mono" type="text" name="start" value="{{.Query.Range.Start}}"></label>
+			<label class="ml-4">End <input class="border border-blue-300 rounded px-2 py-1 font-mono" type="text" name="end" value="{{.Query.Range.End}}"></label>
+			<label class="ml-4">Compare with
+				<select class="border border-blue-300 rounded px-2 py-1" name="base">
+					<option value="previous"{{if eq .Query.Base "previous"}} selected{{end}}>previous period</option>
+					<option value="day"{{if eq .Query.Base "day"}} selected{{end}}>day before</option>
+					<option value="week"{{if eq .Query.Base "week"}} selected{{end}}>week before</option>
+					<option value="custom"{{if eq .Query.Base "custom"}} selected{{end}}>custom</option>
+				</select>
+			</label>
+			<label class="ml-4">Base start <input class="border border-blue-300 rounded px-2 py-1 font-mono" type="text" name="base_start" value="{{.Query.BaseRange.Start}}"></label>
+			<label class="ml-4">Base end <input class="border border-blue-300 rounded px-2 py-1 font-mono" type="text" name="base_end" value="{{.Query.BaseRange.End}}"></label>
+			<button class="ml-4 bg-blue-700 text-white rounded px-3 py-1" type="submit">Compare</button>
+		</form>
+
+		<h3 class="text-xl font-bold text-blue-700 mb-4">Totals</h3>
+		{{template "comparerows" (compareTable . "Metric" "" .Totals)}}
+
+		<h3 class="text-xl font-bold text-blue-700 mb-4">Status Codes (share of requests)</h3>
+		{{template "comparerows" (compareTable . "Status" "status" .Status)}}
+
+		<h3 class="text-xl font-bold text-blue-700 mb-4">Top URIs</h3>
+		{{template "comparerows" (compareTable . "URI" "uri" .URIs)}}
+
+		<div class="grid grid-cols-1 md:grid-cols-2 gap-x-8">
+			<div>
+				<h3 class="text-xl font-bold text-blue-700 mb-4">New IPs</h3>
+				{{template "countrows" (countTable "IP" .NewIPs)}}
+			</div>
+			<div>
+				<h3 class="text-xl font-bold text-blue-700 mb-4">Disappeared IPs</h3>
+				{{template "countrows" (countTable "IP" .GoneIPs)}}
+			</div>
+			<div>
+				<h3 class="text-xl font-bold text-blue-700 mb-4">New Routes</h3>
+				{{template "countrows" (countTable "Route" .NewRoutes)}}
+			</div>
+			<div>
+				<h3 class="text-xl font-bold text-blue-700 mb-4">Disappeared Routes</h3>
+				{{template "countrows" (countTable "Route" .GoneRoutes)}}
+			</div>
+		</div>
+
+	</div>
+
+</body>
+</html>`)
+
+// anomaliesTemplate lists the anomalies detected in the per-minute series
+// of a site with the values contributing to them
+var anomaliesTemplate = page("anomalies", `<!DOCTYPE html>
+<html lang="en">
+<head>
+	<meta charset="UTF-8">
+	<meta name="viewport" content="width=device-width, initial-scale=1.0">
+	<title>Nginx Log Analysis Anomalies</title>
+	<link href="https://cdn.jsdelivr.net/npm/tailwindcss@2.2.19/dist/tailwind.min.css" rel="stylesheet">
+</head>
+<body class="bg-gray-100">
+
+	<div class="container mx-auto p-4">
+
+		{{template "nav" .}}
+		<h1 class="text-3xl font-bold text-blue-700 mt-8 mb-4">Anomalies</h1>
+
+		<h2 class="text-2xl font-bold text-blue-700 mb-4">Date Range: {{.Date}}</h2>
+
+		<p class="mb-4 text-gray-600"><a class="text-blue-700 underline" href="/site/{{.Source}}{{with .Filter}}?q={{.}}{{end}}">&laquo; {{.Source}} dashboard</a> &middot; {{len .Anomalies}} anomalies</p>
+
+		<form class="mb-8 text-sm" method="get">
+			{{with .Filter}}<input type="hidden" name="q" value="{{.}}">{{end}}
+			<label>Threshold <input class="border border-blue-300 rounded px-2 py-1 w-20" type="number" name="threshold" min="0.1" step="0.1" value="{{.Threshold}}"></label>
+			<label class="ml-4">History (days) <input class="border border-blue-300 rounded px-2 py-1 w-16" type="number" name="history" min="0" max="28" value="{{.History}}"></label>
+			<button class="ml-4 bg-blue-700 text-white rounded px-3 py-1" type="submit">Detect</button>
+		</form>
+
+		<table class="border border-collapse border-blue-500 w-full">
+			<tr class="bg-blue-200">
+				<th class="border border-blue-500 px-4 py-2">Time</th>
+				<th class="border border-blue-500 px-4 py-2">Metric</th>
+				<th class="border border-blue-500 px-4 py-2">Actual</th>
+				<th class="border border-blue-500 px-4 py-2">Expected</th>
+				<th class="border border-blue-500 px-4 py-2">Change</th>
+				<th class="border border-blue-500 px-4 py-2">Score</th>
+				<th class="border border-blue-500 px-4 py-2">Contributors</th>
+			</tr>
+			{{range .Anomalies}}
+			<tr class="{{if eq .Direction "spike"}}bg-red-50{{else}}bg-yellow-50{{end}}">
+				<td class="border border-blue-500 px-4 py-2 whitespace-nowrap">{{.Start.Format "2006-01-02 15:04"}} &ndash; {{.End.Format "15:04"}}<br><span class="text-sm text-gray-600">{{.Minutes}} min</span></td>
+				<td class="border border-blue-500 px-4 py-2">{{.Metric}} {{.Direction}}{{with .Route}}<br><a class="text-blue-700 hover:underline font-mono text-sm" href="{{drill $.Source $.Filter "path" .}}">{{.}}</a>{{end}}</td>
+				<td class="border border-blue-500 px-4 py-2">{{.ActualDisplay}}</td>
+				<td class="border border-blue-500 px-4 py-2" title="{{.Baseline}} baseline">{{.ExpectedDisplay}}</td>
+				<td class="border border-blue-500 px-4 py-2 font-bold">{{.Change}}</td>
+				<td class="border border-blue-500 px-4 py-2">{{.Score}}</td>
+				<td class="border border-blue-500 px-4 py-2 text-sm">
+					{{range .Contributors}}
+					<div>{{.Field}} <a class="text-blue-700 hover:underline font-mono" href="{{drill $.Source $.Filter .Field .Value}}">{{.Value}}</a> {{.Count}} (expected {{.Expected}})</div>
+					{{end}}
+				</td>
+			</tr>
+			{{else}}
+			<tr><td class="border border-blue-500 px-4 py-2 text-gray-600" colspan="7">No anomalies.</td></tr>
+			{{end}}
+		</table>
+
+	</div>
+
+</body>
+</html>`)
+
+// upstreamsTemplate shows the upstream services of a site with the phases
+// their requests spent time in, their servers and the paths retried most.
+// latency renders the cells of a LatencyBreakdown.
+var upstreamsTemplate = page("upstreams", `{{define "latency"}}
+				<td class="border border-blue-500 px-4 py-2">{{printf "%.3f" .Connect}}</td>
+				<td class="border border-blue-500 px-4 py-2">{{printf "%.3f" .Header}}</td>
+				<td class="border border-blue-500 px-4 py-2">{{printf "%.3f" .Response}}</td>
+				<td class="border border-blue-500 px-4 py-2">{{printf "%.3f" .Upstream}}</td>
+				<td class="border border-blue-500 px-4 py-2">{{if .Request}}{{printf "%.3f" .Request}}{{else}}-{{end}}</td>
+				<td class="border border-blue-500 px-4 py-2">{{if .Request}}{{printf "%.3f" .Nginx}} ({{printf "%.1f" .NginxShare}}%){{else}}-{{end}}</td>
+				<td class="border border-blue-500 px-4 py-2">
+					<div class="flex h-3 bg-gray-200">
+						<div class="bg-blue-300 {{.Width .Connect}}"></div>
+						<div class="bg-blue-500 {{.Width .Header}}"></div>
+						<div class="bg-blue-700 {{.Width .Response}}"></div>
+						<div class="bg-yellow-400 {{.Width .Nginx}}"></div>
+					</div>
+				</td>
+{{end}}<!DOCTYPE html>
+<html lang="en">
+<head>
+	<meta charset="UTF-8">
+	<meta name="viewport" content="width=device-width, initial-scale=1.0">
+	<title>Nginx Log Analysis Upstreams</title>
+	<link href="https://cdn.jsdelivr.net/npm/tailwindcss@2.2.19/dist/tailwind.min.css" rel="stylesheet">
+</head>
+<body class="bg-gray-100">
+
+	<div class="container mx-auto p-4">
+
+		{{template "nav" .}}
+		<h1 class="text-3xl font-bold text-blue-700 mt-8 mb-4">Upstreams</h1>
+
+		<h2 class="text-2xl font-bold text-blue-700 mb-4">Date Range: {{.Date}}</h2>
+
+		<p class="mb-8 text-gray-600"><a class="text-blue-700 underline" href="/site/{{.Source}}{{with .Filter}}?q={{.}}{{end}}">&laquo; {{.Source}} dashboard</a> &middot; {{.Proxied}} of {{.Requests}} requests proxied &middot; {{.Retried}} retried ({{printf "%.2f" .RetryRate}}%) &middot; {{.Attempts}} attempts{{if .Latency.Request}} &middot; {{printf "%.2f" .Latency.NginxShare}}% of the request time spent in nginx{{end}}</p>
+
+		{{if not .Proxied}}
+		<p class="mb-8 text-gray-600">No upstream attempts in this range. Log <code>$upstream_addr</code> or <code>$upstream_status</code>, as the <code>ingress</code> format does, to see them here.</p>
+		{{end}}
+
+		<h3 class="text-xl font-bold text-blue-700 mb-4">Services</h3>
+		<table class="border border-collapse border-blue-500 w-full mb-8">
+			<tr class="bg-blue-200">
+				<th class="border border-blue-500 px-4 py-2">Service</th>
+				<th class="border border-blue-500 px-4 py-2">Requests</th>
+				<th class="border border-blue-500 px-4 py-2">Retried</th>
+				<th class="border border-blue-500 px-4 py-2">5xx</th>
+				<th class="border border-blue-500 px-4 py-2">Avg</th>
+				<th class="border border-blue-500 px-4 py-2">p50</th>
+				<th class="border border-blue-500 px-4 py-2">p95</th>
+				<th class="border border-blue-500 px-4 py-2">p99</th>
+			</tr>
+			{{range .Services}}
+			<tr>
+				<td class="border border-blue-500 px-4 py-2"><a class="text-blue-700 hover:underline font-mono" href="{{drill $.Source $.Filter "upstream" .Name}}">{{.Name}}</a></td>
+				<td class="border border-blue-500 px-4 py-2">{{.Requests}}</td>
+				<td class="border border-blue-500 px-4 py-2">{{.Retried}} ({{printf "%.2f" .RetryRate}}%)</td>
+				<td class="border border-blue-500 px-4 py-2">{{.Errors}} ({{printf "%.2f" .ErrorRate}}%)</td>
+				<td class="border border-blue-500 px-4 py-2">{{printf "%.3f" .Avg}}</td>
+				<td class="border border-blue-500 px-4 py-2">{{printf "%.3f" .P50}}</td>
+				<td class="border border-blue-500 px-4 py-2">{{printf "%.3f" .P95}}</td>
+				<td class="border border-blue-500 px-4 py-2">{{printf "%.3f" .P99}}</td>
+			</tr>
+			{{else}}
+			<tr><td class="border border-blue-500 px-4 py-2 text-gray-600" colspan="8">No upstream services.</td></tr>
+			{{end}}
+		</table>
+
+		<h3 class="text-xl font-bold text-blue-700 mb-4">Latency Breakdown</h3>
+		<p class="mb-4 text-sm text-gray-600">Average seconds per request: <span class="px-1 bg-blue-300">connect</span> <span class="px-1 bg-blue-500 text-white">header</span> <span class="px-1 bg-blue-700 text-white">response</span> at the upstreams, <span class="px-1 bg-yellow-400">nginx</span> the rest of <code>$request_time</code>.</p>
+		<table class="border border-collapse border-blue-500 w-full mb-8">
+			<tr class="bg-blue-200">
+				<th class="border border-blue-500 px-4 py-2">Service</th>
+				<th class="border border-blue-500 px-4 py-2">Connect</th>
+				<th class="border border-blue-500 px-4 py-2">Header</th>
+				<th class="border border-blue-500 px-4 py-2">Response</th>
+				<th class="border border-blue-500 px-4 py-2">Upstream</th>
+				<th class="border border-blue-500 px-4 py-2">Request</th>
+				<th class="border border-blue-500 px-4 py-2">Nginx</th>
+				<th class="border border-blue-500 px-4 py-2 w-1/4"></th>
+			</tr>
+			{{if .Proxied}}
+			<tr class="font-bold">
+				<td class="border border-blue-500 px-4 py-2">All</td>
+				{{template "latency" .Latency}}
+			</tr>
+			{{end}}
+			{{range .Services}}
+			<tr>
+				<td class="border border-blue-500 px-4 py-2 font-mono">{{.Name}}</td>
+				{{template "latency" .Latency}}
+			</tr>
+			{{end}}
+		</table>
+
+		<h3 class="text-xl font-bold text-blue-700 mb-4">Backends</h3>
+		<table class="border border-collapse border-blue-500 w-full mb-8">
+			<tr class="bg-blue-200">
+				<th class="border border-blue-500 px-4 py-2">Server</th>
+				<th class="border border-blue-500 px-4 py-2">Service</th>
+				<th class="border border-blue-500 px-4 py-2">Attempts</th>
+				<th class="border border-blue-500 px-4 py-2">Failed</th>
+				<th class="border border-blue-500 px-4 py-2">Connect</th>
+				<th class="border border-blue-500 px-4 py-2">Header</th>
+				<th class="border border-blue-500 px-4 py-2">Avg</th>
+				<th class="border border-blue-500 px-4 py-2">p95</th>
+			</tr>
+			{{range .Backends}}
+			<tr class="{{if .Failed}}bg-red-50{{end}}">
+				<td class="border border-blue-500 px-4 py-2"><a class="text-blue-700 hover:underline font-mono" href="{{drill $.Source $.Filter "upstream_addr" .Addr}}">{{.Addr}}</a></td>
+				<td class="border border-blue-500 px-4 py-2 font-mono">{{.Service}}</td>
+				<td class="border border-blue-500 px-4 py-2">{{.Attempts}}</td>
+				<td class="border border-blue-500 px-4 py-2">{{.Failed}} ({{printf "%.2f" .ErrorRate}}%)</td>
+				<td class="border border-blue-500 px-4 py-2">{{printf "%.3f" .Connect}}</td>
+				<td class="border border-blue-500 px-4 py-2">{{printf "%.3f" .Header}}</td>
+				<td class="border border-blue-500 px-4 py-2">{{printf "%.3f" .Avg}}</td>
+				<td class="border border-blue-500 px-4 py-2">{{printf "%.3f" .P95}}</td>
+			</tr>
+			{{else}}
+			<tr><td class="border border-blue-500 px-4 py-2 text-gray-600" colspan="8">No backends.</td></tr>
+			{{end}}
+		</table>
+
+		<h3 class="text-xl font-bold text-blue-700 mb-4">Retried Paths</h3>
+		<table class="border border-collapse border-blue-500 w-full">
+			<tr class="bg-blue-200">
+				<th class="border border-blue-500 px-4 py-2">Path</th>
+				<th class="border border-blue-500 px-4 py-2">Requests</th>
+				<th class="border border-blue-500 px-4 py-2">Retried</th>
+			</tr>
+			{{range .Retries}}
+			<tr>
+				<td class="border border-blue-500 px-4 py-2"><a class="text-blue-700 hover:underline font-mono" href="{{drill $.Source $.Filter "path" .Path}}">{{.Path}}</a></td>
+				<td class="border border-blue-500 px-4 py-2">{{.Requests}}</td>
+				<td class="border border-blue-500 px-4 py-2">{{.Retried}} ({{printf "%.2f" .RetryRate}}%)</td>
+			</tr>
+			{{else}}
+			<tr><td class="border border-blue-500 px-4 py-2 text-gray-600" colspan="3">No retried requests.</td></tr>
+			{{end}}
+		</table>
+
+	</div>
+
+</body>
+</html>`)
+
+// cacheTemplate shows how well the cache of a site works: its statuses, the
+// hit ratio of each route and the statuses over time
+var cacheTemplate = page("cache", `<!DOCTYPE html>
+<html lang="en">
+<head>
+	<meta charset="UTF-8">
+	<meta name="viewport" content="width=device-width, initial-scale=1.0">
+	<title>Nginx Log Analysis Cache</title>
+	<link href="https://cdn.jsdelivr.net/npm/tailwindcss@2.2.19/dist/tailwind.min.css" rel="stylesheet">
+</head>
+<body class="bg-gray-100">
+
+	<div class="container mx-auto p-4">
+
+		{{template "nav" .}}
+		<h1 class="text-3xl font-bold text-blue-700 mt-8 mb-4">Cache</h1>
+
+		<h2 class="text-2xl font-bold text-blue-700 mb-4">Date Range: {{.Date}}</h2>
+
+		<p class="mb-8 text-gray-600"><a class="text-blue-700 underline" href="/site/{{.Source}}{{with .Filter}}?q={{.}}{{end}}">&laquo; {{.Source}} dashboard</a> &middot; {{.Summary.Requests}} of {{.Total}} requests through the cache &middot; hit ratio {{printf "%.2f" .Summary.HitRatio}}% &middot; {{.Summary.CacheBytesDisplay}} from cache, {{.Summary.OriginBytesDisplay}} from the origin ({{printf "%.2f" .Summary.ByteRatio}}% from cache)</p>
+
+		{{if not .Summary.Requests}}
+		<p class="mb-8 text-gray-600">No cache statuses in this range. Log <code>$upstream_cache_status</code> to see them here.</p>
+		{{end}}
+
+		<h3 class="text-xl font-bold text-blue-700 mb-4">Statuses</h3>
+		<table class="border border-collapse border-blue-500 w-full mb-8">
+			<tr class="bg-blue-200">
+				<th class="border border-blue-500 px-4 py-2">Status</th>
+				<th class="border border-blue-500 px-4 py-2">Requests</th>
+				<th class="border border-blue-500 px-4 py-2">Bytes</th>
+				<th class="border border-blue-500 px-4 py-2">Served From</th>
+			</tr>
+			{{range .Statuses}}
+			<tr>
+				<td class="border border-blue-500 px-4 py-2"><a class="text-blue-700 hover:underline font-mono" href="{{drill $.Source $.Filter "cache" .Status}}">{{.Status}}</a></td>
+				<td class="border border-blue-500 px-4 py-2">{{.Requests}} ({{printf "%.2f" .Share}}%)</td>
+				<td class="border border-blue-500 px-4 py-2">{{.BytesDisplay}}</td>
+				<td class="border border-blue-500 px-4 py-2">{{if .Cached}}cache{{else}}origin{{end}}</td>
+			</tr>
+			{{end}}
+		</table>
+
+		<h3 class="text-xl font-bold text-blue-700 mb-4">Routes</h3>
+		<form class="mb-4 text-sm" method="get">
+			{{with .Filter}}<input type="hidden" name="q" value="{{.}}">{{end}}
+			<label>Sort by <select class="border border-blue-300 rounded px-2 py-1" name="sort">
+				{{range .Sorts}}<option value="{{.}}"{{if eq . $.Sort}} selected{{end}}>{{.}}</option>{{end}}
+			</select></label>
+			<button class="ml-4 bg-blue-700 text-white rounded px-3 py-1" type="submit">Sort</button>
+		</form>
+		<table class="border border-collapse border-blue-500 w-full mb-8">
+			<tr class="bg-blue-200">
+				<th class="border border-blue-500 px-4 py-2">Path</th>
+				<th class="border border-blue-500 px-4 py-2">Requests</th>
+				<th class="border border-blue-500 px-4 py-2">Hit Ratio</th>
+				<th class="border border-blue-500 px-4 py-2">From Cache</th>
+				<th class="border border-blue-500 px-4 py-2">From Origin</th>
+				{{range .Columns}}<th class="border border-blue-500 px-4 py-2">{{.}}</th>{{end}}
+			</tr>
+			{{range $route := .Routes}}
+			<tr>
+				<td class="border border-blue-500 px-4 py-2"><a class="text-blue-700 hover:underline font-mono" href="{{drill $.Source $.Filter "path" .Path}}">{{.Path}}</a></td>
+				<td class="border border-blue-500 px-4 py-2">{{.Requests}}</td>
+				<td class="border border-blue-500 px-4 py-2 font-bold">{{printf "%.2f" .HitRatio}}%</td>
+				<td class="border border-blue-500 px-4 py-2">{{.CacheBytesDisplay}}</td>
+				<td class="border border-blue-500 px-4 py-2">{{.OriginBytesDisplay}}</td>
+				{{range $.Columns}}<td class="border border-blue-500 px-4 py-2">{{with index $route.Statuses .}}{{.}}{{end}}</td>{{end}}
+			</tr>
+			{{else}}
+			<tr><td class="border border-blue-500 px-4 py-2 text-gray-600" colspan="5">No cached routes.</td></tr>
+			{{end}}
+		</table>
+
+		{{with .Timeline}}
+		<h3 class="text-xl font-bold text-blue-700 mb-4">Statuses per {{$.Bucket}}</h3>
+		<table class="border border-collapse border-blue-500 w-full">
+			<tr class="bg-blue-200">
+				<th class="border border-blue-500 px-4 py-2">Time</th>
+				<th class="border border-blue-500 px-4 py-2">Requests</th>
+				<th class="border border-blue-500 px-4 py-2">Hit Ratio</th>
+				{{range $.Columns}}<th class="border border-blue-500 px-4 py-2">{{.}}</th>{{end}}
+			</tr>
+			{{range .}}
+			<tr>
+				<td class="border border-blue-500 px-4 py-2 whitespace-nowrap">{{.Time}}</td>
+				<td class="border border-blue-500 px-4 py-2">{{.Requests}}</td>
+				<td class="border border-blue-500 px-4 py-2 font-bold">{{printf "%.2f" .HitRatio}}%</td>
+				{{range .Counts}}<td class="border border-blue-500 px-4 py-2">{{if .}}{{.}}{{end}}</td>{{end}}
+			</tr>
+			{{end}}
+		</table>
+		{{end}}
+
+	</div>
+
+</body>
+</html>`)
+
+// errorsTemplate shows the error log of a site: its categories, how they
+// changed over time and the latest errors with the access log entry of their
+// request
+var errorsTemplate = page("errors", `<!DOCTYPE html>
+<html lang="en">
+<head>
+	<meta charset="UTF-8">
+	<meta name="viewport" content="width=device-width, initial-scale=1.0">
+	<title>Nginx Log Analysis Errors</title>
+	<link href="https://cdn.jsdelivr.net/npm/tailwindcss@2.2.19/dist/tailwind.min.css" rel="stylesheet">
+</head>
+<body class="bg-gray-100">
+
+	<div class="container mx-auto p-4">
+
+		{{template "nav" .}}
+		<h1 class="text-3xl font-bold text-blue-700 mt-8 mb-4">Errors</h1>
+
+		<h2 class="text-2xl font-bold text-blue-700 mb-4">Date Range: {{.Date}}</h2>
+
+		<p class="mb-4 text-gray-600"><a class="text-blue-700 underline" href="/site/{{.Source}}{{with .Filter}}?q={{.}}{{end}}">&laquo; {{.Source}} dashboard</a> &middot; {{.Stats.Parsed}} of {{.Stats.Lines}} error log lines parsed{{if .Stats.Failed}}, {{.Stats.Failed}} failed{{end}} &middot; {{.Total}} errors, {{.Correlated}} found in the access log{{range .Levels}} &middot; {{.Count}} {{.Value}}{{end}}</p>
+		{{if .Truncated}}
+		<p class="mb-4 text-yellow-700">Only the first errors of the range were read, narrow the range or the filter.</p>
+		{{end}}
+
+		<form class="mb-8 text-sm" method="get">
+			{{with .Filter}}<input type="hidden" name="q" value="{{.}}">{{end}}
+			<label>Level <select class="border border-blue-300 rounded px-2 py-1" name="level">
+				<option value="">all</option>
+				{{range .AllLevels}}<option value="{{.}}"{{if eq . $.Level}} selected{{end}}>{{.}} and above</option>{{end}}
+			</select></label>
+			{{with .Category}}<input type="hidden" name="category" value="{{.}}"><span class="ml-4 px-3 py-1 rounded-full bg-blue-100 border border-blue-300">{{.}}</span>{{end}}
+			<button class="ml-4 bg-blue-700 text-white rounded px-3 py-1" type="submit">Show</button>
+			{{if .Category}}<a class="ml-4 text-blue-700 underline" href="?{{with .Filter}}q={{.}}&amp;{{end}}level={{.Level}}">All categories</a>{{end}}
+		</form>
+
+		<h3 class="text-xl font-bold text-blue-700 mb-4">Categories</h3>
+		<table class="border border-collapse border-blue-500 w-full mb-8">
+			<tr class="bg-blue-200">
+				<th class="border border-blue-500 px-4 py-2">Category</th>
+				<th class="border border-blue-500 px-4 py-2">Errors</th>
+				<th class="border border-blue-500 px-4 py-2">Response Status</th>
+				<th class="border border-blue-500 px-4 py-2">Example</th>
+			</tr>
+			{{range .Categories}}
+			<tr>
+				<td class="border border-blue-500 px-4 py-2"><a class="text-blue-700 hover:underline" href="?{{with $.Filter}}q={{.}}&amp;{{end}}level={{$.Level}}&amp;category={{.Category}}">{{.Category}}</a></td>
+				<td class="border border-blue-500 px-4 py-2">{{.Count}} ({{printf "%.2f" .Share}}%)</td>
+				<td class="border border-blue-500 px-4 py-2 text-sm">{{range .Statuses}}<span class="mr-2 whitespace-nowrap"><span class="font-bold">{{.Value}}</span> &times;{{.Count}}</span>{{end}}</td>
+				<td class="border border-blue-500 px-4 py-2 font-mono text-sm break-all">{{.Example}}</td>
+			</tr>
+			{{else}}
+			<tr><td class="border border-blue-500 px-4 py-2 text-gray-600" colspan="4">No errors.</td></tr>
+			{{end}}
+		</table>
+
+		{{with .Timeline}}
+		<h3 class="text-xl font-bold text-blue-700 mb-4">Errors per {{$.Bucket}}</h3>
+		<table class="border border-collapse border-blue-500 w-full mb-8">
+			<tr class="bg-blue-200">
+				<th class="border border-blue-500 px-4 py-2">Time</th>
+				<th class="border border-blue-500 px-4 py-2">Total</th>
+				{{range $.Columns}}<th class="border border-blue-500 px-4 py-2">{{.}}</th>{{end}}
+			</tr>
+			{{range .}}
+			<tr>
+				<td class="border border-blue-500 px-4 py-2 whitespace-nowrap">{{.Time}}</td>
+				<td class="border border-blue-500 px-4 py-2 font-bold">{{.Total}}</td>
+				{{range .Counts}}<td class="border border-blue-500 px-4 py-2">{{if .}}{{.}}{{end}}</td>{{end}}
+			</tr>
+			{{end}}
+		</table>
+		{{end}}
+
+		<div class="flex flex-wrap -mx-2 mb-8">
+			<div class="w-full md:w-1/2 px-2">
+				<h3 class="text-xl font-bold text-blue-700 mb-4">Upstreams</h3>
+				<table class="border border-collapse border-blue-500 w-full">
+					<tr class="bg-blue-200">
+						<th class="border border-blue-500 px-4 py-2">Upstream</th>
+						<th class="border border-blue-500 px-4 py-2">Errors</th>
+					</tr>
+					{{range .Upstreams}}
+					<tr>
+						<td class="border border-blue-500 px-4 py-2 font-mono text-sm break-all">{{.Value}}</td>
+						<td class="border border-blue-500 px-4 py-2">{{.Count}}</td>
+					</tr>
+					{{else}}
+					<tr><td class="border border-blue-500 px-4 py-2 text-gray-600" colspan="2">No upstream errors.</td></tr>
+					{{end}}
+				</table>
+			</div>
+			<div class="w-full md:w-1/2 px-2">
+				<h3 class="text-xl font-bold text-blue-700 mb-4">Clients</h3>
+				<table class="border border-collapse border-blue-500 w-full">
+					<tr class="bg-blue-200">
+						<th class="border border-blue-500 px-4 py-2">Client</th>
+						<th class="border border-blue-500 px-4 py-2">Errors</th>
+					</tr>
+					{{range .Clients}}
+					<tr>
+						<td class="border border-blue-500 px-4 py-2"><a class="text-blue-700 hover:underline font-mono" href="{{drill $.Source $.Filter "ip" .Value}}">{{.Value}}</a></td>
+						<td class="border border-blue-500 px-4 py-2">{{.Count}}</td>
+					</tr>
+					{{else}}
+					<tr><td class="border border-blue-500 px-4 py-2 text-gray-600" colspan="2">No client errors.</td></tr>
+					{{end}}
+				</table>
+			</div>
+		</div>
+
+		<h3 class="text-xl font-bold text-blue-700 mb-4">Latest Errors</h3>
+		<table class="border border-collapse border-blue-500 w-full">
+			<tr class="bg-blue-200">
+				<th class="border border-blue-500 px-4 py-2">Time</th>
+				<th class="border border-blue-500 px-4 py-2">Level</th>
+				<th class="border border-blue-500 px-4 py-2">Error</th>
+				<th class="border border-blue-500 px-4 py-2">Request</th>
+				<th class="border border-blue-500 px-4 py-2">Access Log</th>
+			</tr>
+			{{range .Errors}}
+			<tr class="{{if or (eq .Level "crit") (eq .Level "alert") (eq .Level "emerg")}}bg-red-50{{else if eq .Level "error"}}bg-yellow-50{{end}}">
+				<td class="border border-blue-500 px-4 py-2 whitespace-nowrap">{{.TimeStamp.Format "2006-01-02 15:04:05"}}</td>
+				<td class="border border-blue-500 px-4 py-2">{{.Level}}</td>
+				<td class="border border-blue-500 px-4 py-2 text-sm"><span class="font-bold">{{.Category}}</span><br><span class="font-mono break-all">{{.Message}}</span>{{with .Upstream}}<br><span class="text-gray-600 font-mono break-all">upstream {{.}}</span>{{end}}</td>
+				<td class="border border-blue-500 px-4 py-2 text-sm">{{with .Client}}<span class="font-mono">{{.}}</span>{{end}}{{with .Request}}<br><span class="font-mono break-all">{{.}}</span>{{end}}</td>
+				<td class="border border-blue-500 px-4 py-2 text-sm whitespace-nowrap">{{if .Access}}<a class="text-blue-700 hover:underline" href="{{.LogsURL}}">{{.Access.Status}} &middot; {{printf "%.3f" (duration .Access)}}s</a>{{else}}<span class="text-gray-600">not found</span>{{end}}</td>
+			</tr>
+			{{else}}
+			<tr><td class="border border-blue-500 px-4 py-2 text-gray-600" colspan="5">No errors.</td></tr>
+			{{end}}
+		</table>
+
+	</div>
+
+</body>
+</html>`)
+
+// alertsTemplate lists the alerts, silences and rules
+var alertsTemplate = page("alerts", `<!DOCTYPE html>
+<html lang="en">
+<head>
+	<meta charset="UTF-8">
+	<meta name="viewport" content="width=device-width, initial-scale=1.0">
+	<title>Nginx Log Analysis Alerts</title>
+	<link href="https://cdn.jsdelivr.net/npm/tailwindcss@2.2.19/dist/tailwind.min.css" rel="stylesheet">
+</head>
+<body class="bg-gray-100">
+
+	<div class="container mx-auto p-4">
+
+		{{template "nav" .}}
+		<h1 class="text-3xl font-bold text-blue-700 mt-8 mb-4">Alerts</h1>
+
+		<table class="border border-collapse border-blue-500 w-full mb-8">
+			<tr class="bg-blue-200">
+				<th class="border border-blue-500 px-4 py-2">State</th>
+				<th class="border border-blue-500 px-4 py-2">Severity</th>
+				<th class="border border-blue-500 px-4 py-2">Alert</th>
+				<th class="border border-blue-500 px-4 py-2">Since</th>
+			</tr>
+			{{range .Alerts}}
+			<tr class="{{if eq .State "firing"}}bg-red-50{{else if eq .State "pending"}}bg-yellow-50{{end}}">
+				<td class="border border-blue-500 px-4 py-2 font-bold">{{.State}}{{if .Silenced}} <span class="font-normal text-gray-600">(silenced)</span>{{end}}</td>
+				<td class="border border-blue-500 px-4 py-2">{{.Severity}}</td>
+				<td class="border border-blue-500 px-4 py-2"><a class="text-blue-700 hover:underline" href="/site/{{.Source}}">{{.Summary}}</a></td>
+				<td class="border border-blue-500 px-4 py-2 whitespace-nowrap">{{.Since.Format "2006-01-02 15:04:05"}}</td>
+			</tr>
+			{{else}}
+			<tr><td class="border border-blue-500 px-4 py-2 text-gray-600" colspan="4">No alerts.</td></tr>
+			{{end}}
+		</table>
+
+		<h3 class="text-xl font-bold text-blue-700 mb-4">Silences</h3>
+		<table class="border border-collapse border-blue-500 w-full mb-8">
+			<tr class="bg-blue-200">
+				<th class="border border-blue-500 px-4 py-2">ID</th>
+				<th class="border border-blue-500 px-4 py-2">Rule</th>
+				<th class="border border-blue-500 px-4 py-2">Source</th>
+				<th class="border border-blue-500 px-4 py-2">Value</th>
+				<th class="border border-blue-500 px-4 py-2">Until</th>
+				<th class="border border-blue-500 px-4 py-2">Comment</th>
+			</tr>
+			{{range .Silences}}
+			<tr>
+				<td class="border border-blue-500 px-4 py-2">{{.ID}}</td>
+				<td class="border border-blue-500 px-4 py-2">{{or .Rule "all"}}</td>
+				<td class="border border-blue-500 px-4 py-2">{{or .Source "all"}}</td>
+				<td class="border border-blue-500 px-4 py-2">{{or .Group "all"}}</td>
+				<td class="border border-blue-500 px-4 py-2 whitespace-nowrap">{{.Until.Format "2006-01-02 15:04:05"}}</td>
+				<td class="border border-blue-500 px-4 py-2">{{.Comment}}{{with .CreatedBy}} <span class="text-gray-600">&mdash; {{.}}</span>{{end}}</td>
+			</tr>
+			{{else}}
+			<tr><td class="border border-blue-500 px-4 py-2 text-gray-600" colspan="6">No silences. Create one with POST /api/silences.</td></tr>
+			{{end}}
+		</table>
+
+		<h3 class="text-xl font-bold text-blue-700 mb-4">Rules</h3>
+		<table class="border border-collapse border-blue-500 w-full">
+			<tr class="bg-blue-200">
+				<th class="border border-blue-500 px-4 py-2">Name</th>
+				<th class="border border-blue-500 px-4 py-2">Source</th>
+				<th class="border border-blue-500 px-4 py-2">Condition</th>
+				<th class="border border-blue-500 px-4 py-2">For</th>
+			</tr>
+			{{range .Rules}}
+			<tr>
+				<td class="border border-blue-500 px-4 py-2">{{.Name}}</td>
+				<td class="border border-blue-500 px-4 py-2">{{or .Source "all"}}</td>
+				<td class="border border-blue-500 px-4 py-2 font-mono text-sm">{{.Metric}}{{with .Match}} of {{.}}{{end}} {{.Op}} {{.Threshold}} over {{.Window}}{{with .Filter}} where {{.}}{{end}}{{with .By}} per {{.}}{{end}}</td>
+				<td class="border border-blue-500 px-4 py-2">{{.For}}</td>
+			</tr>
+			{{end}}
+		</table>
+
+	</div>
+
+</body>
+</html>`)
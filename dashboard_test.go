@@ -0,0 +1,181 @@
+package main
+
+import (
+	"html/template"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// hostileLines carry markup and javascript: URLs in every field a client
+// controls: the request URI, the referer and the user agent
+var hostileLines = []string{
+	`10.0.0.1 - - [19/Feb/2024:16:00:01 +0000] "GET /search?q=<script>alert('uri')</script>&x=' HTTP/1.1" 200 512 "javascript:alert('ref')" "<script>alert('ua')</script>" 0.120 10.1.0.1:80 200 0.100 MISS`,
+	`10.0.0.2 - - [19/Feb/2024:16:00:02 +0000] "POST /'><img/src=x/onerror=alert(1)> HTTP/1.1" 502 0 "https://example.com/?a=</a><script>alert(2)</script>" "Mozilla/5.0 '><img src=x onerror=alert(3)>" 1.500 10.1.0.2:80 502 1.400 -`,
+	`10.0.0.3 - - [19/Feb/2024:16:00:03 +0000] "GET /javascript:alert(4) HTTP/1.1" 404 20 "-" "curl/8.0 javascript:alert(5)" 0.010 - - - HIT`,
+}
+
+var hostileErrorLines = []string{
+	`2024/02/19 16:00:02 [error] 7#7: *12 upstream prematurely closed connection while reading response header from upstream, client: 10.0.0.2, server: example.com, request: "POST /'><img/src=x/onerror=alert(1)> HTTP/1.1", upstream: "http://10.1.0.2:80/<script>alert('up')</script>", host: "example.com"`,
+	`2024/02/19 16:00:03 [warn] 7#7: *13 "<script>alert('err')</script>" is not found, client: 10.0.0.3, server: example.com`,
+}
+
+func newTestApp(t *testing.T, lines, errorLines []string) http.Handler {
+	t.Helper()
+	dir := t.TempDir()
+	accessLog := writeTestFile(t, "access.log", strings.Join(lines, "\n")+"\n")
+	errorLog := filepath.Join(dir, "error.log")
+	if len(errorLines) > 0 {
+		errorLog = writeTestFile(t, "error.log", strings.Join(errorLines, "\n")+"\n")
+	}
+
+	cfg := DefaultConfig()
+	cfg.Range = RangeConfig{Start: "2024-02-19 16:00:00", End: "2024-02-19 17:00:00"}
+	format := builtinFormats["combined"] + ` $request_time $upstream_addr $upstream_status $upstream_response_time $upstream_cache_status`
+	cfg.Sources = []SourceConfig{
+		{Name: "site", Path: accessLog, Format: format, Timezone: "UTC", ErrorLog: errorLog},
+		{Name: "other", Path: accessLog, Format: format, Timezone: "UTC"},
+	}
+	cfg.fillSourceDefaults()
+	sources, err := cfg.BuildSources()
+	if err != nil {
+		t.Fatal(err)
+	}
+	mux := http.NewServeMux()
+	NewApp(cfg, sources, nil, nil, nil).Routes(mux)
+	return mux
+}
+
+func TestPagesEscapeLogFields(t *testing.T) {
+	handler := newTestApp(t, hostileLines, hostileErrorLines)
+
+	pages := []string{
+		"/",
+		"/site/site",
+		"/site/site?q=" + url.QueryEscape(`ua ~ "<script>"`),
+		"/site/site/logs",
+		"/site/site/logs?context=2",
+		"/site/site/entry?file=access.log&offset=0&h=" + lineHash(hostileLines[0]),
+		"/site/site/group?by=ua,uri",
+		"/site/site/group?by=referer",
+		"/site/site/compare",
+		"/site/site/anomalies",
+		"/site/site/upstreams",
+		"/site/site/errors",
+		"/site/site/cache",
+		"/alerts",
+	}
+	for _, def := range tableDefs {
+		pages = append(pages, "/site/site/table/"+def.ID)
+	}
+
+	for _, page := range pages {
+		t.Run(page, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, page, nil))
+			if w.Code != http.StatusOK {
+				t.Fatalf("status %d: %s", w.Code, w.Body)
+			}
+			if got := w.Header().Get("Content-Security-Policy"); got != contentSecurityPolicy {
+				t.Errorf("Content-Security-Policy %q", got)
+			}
+			if got := w.Header().Get("X-Content-Type-Options"); got != "nosniff" {
+				t.Errorf("X-Content-Type-Options %q", got)
+			}
+
+			body := strings.ToLower(w.Body.String())
+			for _, unsafe := range []string{"<script", "<img", `href="javascript:`, `src="javascript:`} {
+				if strings.Contains(body, unsafe) {
+					i := strings.Index(body, unsafe)
+					t.Errorf("unescaped %q in %s", unsafe, body[max(i-80, 0):min(i+80, len(body))])
+				}
+			}
+		})
+	}
+}
+
+// TestPagesShowEscapedFields makes sure the hostile values are displayed,
+// escaped, rather than dropped
+func TestPagesShowEscapedFields(t *testing.T) {
+	handler := newTestApp(t, hostileLines, hostileErrorLines)
+
+	tests := []struct {
+		page, want string
+	}{
+		{"/site/site/table/agents", "&lt;script&gt;alert(&#39;ua&#39;)&lt;/script&gt;"},
+		{"/site/site/table/uris", "&lt;script&gt;alert(&#39;uri&#39;)&lt;/script&gt;"},
+		{"/site/site/logs", "javascript:alert(&#39;ref&#39;)"},
+		{"/site/site/group?by=referer", "javascript:alert(&#39;ref&#39;)"},
+		{"/site/site/errors", "&lt;script&gt;alert(&#39;err&#39;)&lt;/script&gt;"},
+	}
+	for _, tt := range tests {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, tt.page, nil))
+		if !strings.Contains(w.Body.String(), tt.want) {
+			t.Errorf("%s does not show %s", tt.page, tt.want)
+		}
+	}
+}
+
+func TestJSONResponsesAreNotSniffed(t *testing.T) {
+	handler := newTestApp(t, hostileLines, nil)
+	for _, page := range []string{"/api/summary?source=site", "/api/logs?source=site", "/api/sites"} {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, page, nil))
+		if w.Code != http.StatusOK {
+			t.Fatalf("%s: status %d: %s", page, w.Code, w.Body)
+		}
+		if ct := w.Header().Get("Content-Type"); ct != "application/json" {
+			t.Errorf("%s: Content-Type %q", page, ct)
+		}
+		if w.Header().Get("X-Content-Type-Options") != "nosniff" {
+			t.Errorf("%s: missing nosniff", page)
+		}
+		if strings.Contains(w.Body.String(), "<script") {
+			t.Errorf("%s: markup is not escaped in JSON", page)
+		}
+	}
+}
+
+func TestWidthClass(t *testing.T) {
+	tests := map[float64]string{-5: "w-0", 0: "w-0", 4: "w-0", 5: "w-1/12", 50: "w-6/12", 95: "w-11/12", 96: "w-full", 140: "w-full"}
+	for percent, want := range tests {
+		if got := widthClass(percent); got != want {
+			t.Errorf("widthClass(%v) = %q, want %q", percent, got, want)
+		}
+	}
+
+	l := LatencyBreakdown{Connect: 0.25, Header: 0.5, Response: 0.25, Upstream: 1, Request: 2, Nginx: 1}
+	if got := l.Width(l.Header) + " " + l.Width(l.Nginx); got != "w-3/12 w-6/12" {
+		t.Errorf("widths %q", got)
+	}
+}
+
+// TestTemplatesHaveNoInlineStyles guards the CSP, which blocks style
+// attributes: anything sized with one renders as if it had no style
+func TestTemplatesHaveNoInlineStyles(t *testing.T) {
+	pages := []*template.Template{
+		dashboardTemplate, overviewTemplate, tableTemplate, groupTemplate, logsTemplate, entryTemplate,
+		compareTemplate, anomaliesTemplate, upstreamsTemplate, cacheTemplate, errorsTemplate, alertsTemplate,
+	}
+	for _, page := range pages {
+		for _, tmpl := range page.Templates() {
+			if tmpl.Tree == nil {
+				continue
+			}
+			text := strings.ToLower(tmpl.Tree.Root.String())
+			if i := strings.Index(text, "style="); i >= 0 {
+				t.Errorf("%s/%s has an inline style: %s", page.Name(), tmpl.Name(), text[max(i-60, 0):min(i+60, len(text))])
+			}
+			if strings.Contains(text, "<style") {
+				t.Errorf("%s/%s has a style element", page.Name(), tmpl.Name())
+			}
+		}
+	}
+	if strings.Contains(contentSecurityPolicy, "unsafe-inline") {
+		t.Error("the CSP allows inline styles")
+	}
+}
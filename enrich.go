@@ -0,0 +1,124 @@
+package main
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"net/netip"
+	"os"
+	"sort"
+	"strings"
+)
+
+// EnrichmentConfig controls how parsed entries are post-processed
+type EnrichmentConfig struct {
+	URIMaxLength int    `toml:"uri_max_length"` // longer request URIs are truncated
+	StripQuery   bool   `toml:"strip_query"`    // drop query strings so routes group together
+	GeoIPCSV     string `toml:"geoip_csv"`      // CSV of network,country_code rows
+}
+
+// Enricher applies the enrichment options to each entry
+type Enricher struct {
+	config  EnrichmentConfig
+	country *countryTable
+}
+
+// NewEnricher loads any lookup tables referenced by cfg
+func NewEnricher(cfg EnrichmentConfig) (*Enricher, error) {
+	e := &Enricher{config: cfg}
+	if cfg.GeoIPCSV != "" {
+		table, err := loadCountryTable(cfg.GeoIPCSV)
+		if err != nil {
+			return nil, err
+		}
+		e.country = table
+	}
+	return e, nil
+}
+
+// Apply enriches entry in place
+func (e *Enricher) Apply(entry *LogEntry) {
+	if e.config.StripQuery {
+		if i := strings.IndexByte(entry.RequestURI, '?'); i >= 0 {
+			entry.RequestURI = entry.RequestURI[:i]
+		}
+	}
+	if e.config.URIMaxLength > 0 {
+		entry.RequestURI = truncateString(entry.RequestURI, e.config.URIMaxLength)
+	}
+	if e.country != nil {
+		entry.Country = e.country.Lookup(entry.IP)
+	}
+}
+
+// countryTable maps IP networks to country codes
+type countryTable struct {
+	prefixes  []netip.Prefix // sorted by start address
+	countries []string
+}
+
+func loadCountryTable(path string) (*countryTable, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	type row struct {
+		prefix  netip.Prefix
+		country string
+	}
+	var rows []row
+	reader := csv.NewReader(file)
+	reader.FieldsPerRecord = -1
+	reader.Comment = '#'
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		if len(record) < 2 {
+			continue
+		}
+		prefix, err := netip.ParsePrefix(strings.TrimSpace(record[0]))
+		if err != nil {
+			// Allow a header line
+			if len(rows) == 0 {
+				continue
+			}
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+		rows = append(rows, row{prefix.Masked(), strings.ToUpper(strings.TrimSpace(record[1]))})
+	}
+
+	sort.Slice(rows, func(i, j int) bool {
+		return rows[i].prefix.Addr().Less(rows[j].prefix.Addr())
+	})
+	table := &countryTable{}
+	for _, r := range rows {
+		table.prefixes = append(table.prefixes, r.prefix)
+		table.countries = append(table.countries, r.country)
+	}
+	return table, nil
+}
+
+// Lookup returns the country of ip, or "" when it isn't in the table. The
+// table is expected not to contain overlapping networks.
+func (t *countryTable) Lookup(ip string) string {
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return ""
+	}
+	addr = addr.Unmap()
+	// Find the last network starting at or before addr
+	i := sort.Search(len(t.prefixes), func(i int) bool {
+		return addr.Less(t.prefixes[i].Addr())
+	}) - 1
+	if i >= 0 && t.prefixes[i].Contains(addr) {
+		return t.countries[i]
+	}
+	return ""
+}
@@ -0,0 +1,517 @@
+package main
+
+import (
+	"cmp"
+	"fmt"
+	"net/url"
+	"regexp"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// errorLevels are the severities of nginx's error log, lowest first
+var errorLevels = []string{"debug", "info", "notice", "warn", "error", "crit", "alert", "emerg"}
+
+// errorLinePattern matches the start of an error log line:
+//
+//	2024/02/19 16:01:02 [error] 1234#5678: *90 upstream timed out ...
+var errorLinePattern = regexp.MustCompile(`^(\d{4}/\d{2}/\d{2} \d{2}:\d{2}:\d{2}) \[(\w+)\] (\d+)#(\d+): (?:\*(\d+) )?(.*)$`)
+
+// errorContextPattern matches the context nginx appends to a message, like
+// `, client: 10.0.0.1, server: example.com, request: "GET / HTTP/1.1"`
+var errorContextPattern = regexp.MustCompile(`, (client|server|request|subrequest|upstream|host|referrer): ("(?:[^"\\]|\\.)*"|[^,]*)`)
+
+// ErrorEntry is a parsed line of nginx's error log
+type ErrorEntry struct {
+	TimeStamp  time.Time `json:"timestamp"`
+	Level      string    `json:"level"`
+	PID        int       `json:"pid"`
+	TID        int       `json:"tid"`
+	Connection int64     `json:"connection,omitempty"` // the *N serial number, shared by the errors of a connection
+	Message    string    `json:"message"`
+	Category   string    `json:"category"`
+	Client     string    `json:"client,omitempty"`
+	Server     string    `json:"server,omitempty"`
+	Request    string    `json:"request,omitempty"` // the request line
+	Method     string    `json:"method,omitempty"`
+	RequestURI string    `json:"request_uri,omitempty"`
+	Upstream   string    `json:"upstream,omitempty"`
+	Host       string    `json:"host,omitempty"`
+	Referrer   string    `json:"referrer,omitempty"`
+	Source     string    `json:"source"`
+}
+
+// parseErrorLine parses an error log line, with its local time in loc
+func parseErrorLine(line string, loc *time.Location) (ErrorEntry, bool) {
+	m := errorLinePattern.FindStringSubmatch(line)
+	if m == nil {
+		return ErrorEntry{}, false
+	}
+	timestamp, err := time.ParseInLocation("2006/01/02 15:04:05", m[1], loc)
+	if err != nil {
+		return ErrorEntry{}, false
+	}
+	e := ErrorEntry{
+		TimeStamp: timestamp,
+		Level:     m[2],
+		PID:       atoi(m[3]),
+		TID:       atoi(m[4]),
+		Message:   m[6],
+	}
+	if m[5] != "" {
+		e.Connection, _ = strconv.ParseInt(m[5], 10, 64)
+	}
+
+	// The context starts at the first known key, the message is before it
+	if loc := errorContextPattern.FindStringIndex(e.Message); loc != nil {
+		context := e.Message[loc[0]:]
+		e.Message = e.Message[:loc[0]]
+		for _, kv := range errorContextPattern.FindAllStringSubmatch(context, -1) {
+			value := kv[2]
+			if unquoted, err := strconv.Unquote(value); err == nil {
+				value = unquoted
+			} else {
+				value = strings.Trim(value, `"`)
+			}
+			switch kv[1] {
+			case "client":
+				e.Client = value
+			case "server":
+				e.Server = value
+			case "request":
+				e.Request = value
+			case "upstream":
+				e.Upstream = value
+			case "host":
+				e.Host = value
+			case "referrer":
+				e.Referrer = value
+			}
+		}
+	}
+	if method, rest, ok := strings.Cut(e.Request, " "); ok {
+		e.Method = method
+		e.RequestURI, _, _ = strings.Cut(rest, " ")
+	}
+	e.Category = errorCategory(e.Message)
+	return e, true
+}
+
+// errorCategories group messages by their cause, the first category with a
+// matching phrase wins
+var errorCategories = []struct {
+	name    string
+	phrases []string
+}{
+	{"upstream timeout", []string{"upstream timed out"}},
+	{"upstream refused", []string{"Connection refused) while connecting to upstream"}},
+	// nginx logs "no live upstreams while connecting to upstream"
+	{"no live upstreams", []string{"no live upstreams"}},
+	{"upstream connect failed", []string{"while connecting to upstream"}},
+	{"upstream closed", []string{"upstream prematurely closed", "reset by peer) while reading response header from upstream"}},
+	{"upstream header too big", []string{"upstream sent too big header"}},
+	{"invalid upstream response", []string{"upstream sent invalid", "upstream sent no valid"}},
+	{"body too large", []string{"client intended to send too large body"}},
+	{"rate limited", []string{"limiting requests"}},
+	{"connections limited", []string{"limiting connections"}},
+	{"access denied", []string{"access forbidden by rule", "is forbidden"}},
+	{"file not found", []string{"No such file or directory", "is not found"}},
+	{"permission denied", []string{"Permission denied"}},
+	{"ssl", []string{"SSL_"}},
+	{"client timeout", []string{"client timed out"}},
+	{"client closed", []string{"client prematurely closed", "client closed"}},
+	{"resolver", []string{"could not be resolved"}},
+	{"buffered to file", []string{"buffered to a temporary file"}},
+}
+
+// otherErrors is the category of messages matching no other
+const otherErrors = "other"
+
+func errorCategory(message string) string {
+	for _, c := range errorCategories {
+		for _, phrase := range c.phrases {
+			if strings.Contains(message, phrase) {
+				return c.name
+			}
+		}
+	}
+	return otherErrors
+}
+
+// ErrorFiles returns the files of the source's error log, oldest first
+func (s *Source) ErrorFiles() ([]string, error) {
+	if s.ErrorLog == "" {
+		return nil, fmt.Errorf("source %q: no error_log configured", s.Name)
+	}
+	files, err := globByModTime(s.ErrorLog)
+	if err != nil {
+		return nil, err
+	}
+	if len(files) == 0 {
+		return nil, fmt.Errorf("source %q: no files match %s", s.Name, s.ErrorLog)
+	}
+	return files, nil
+}
+
+// ReadErrors parses every file of the source's error log and calls fn for
+// each entry. Lines of container logs written to stdout are skipped.
+func (s *Source) ReadErrors(fn func(ErrorEntry)) (ParseStats, error) {
+	var stats ParseStats
+	files, err := s.ErrorFiles()
+	if err != nil {
+		return stats, err
+	}
+	loc := s.Location()
+	for _, name := range files {
+		u := newUnwrapper(s.Container)
+		u.stream = "stderr"
+		err := scanFile(name, func(_ int64, raw string) bool {
+			line := raw
+			if s.Container != containerNone {
+				var ok bool
+				if line, ok = u.line(raw); !ok {
+					return true
+				}
+			}
+			stats.Lines++
+			entry, ok := parseErrorLine(line, loc)
+			if !ok {
+				stats.Failed++
+				return true
+			}
+			stats.Parsed++
+			entry.Source = s.Name
+			fn(entry)
+			return true
+		})
+		if err != nil {
+			return stats, fmt.Errorf("%s: %w", name, err)
+		}
+	}
+	return stats, nil
+}
+
+// correlationWindow is how long after an error its request may be logged in
+// the access log, which happens when the response is done
+const correlationWindow = 5 * time.Minute
+
+// maxErrorEntries bounds the errors of a range kept for correlation
+const maxErrorEntries = 100000
+
+// maxTimelineCategories are the categories with a column in the timeline,
+// the rest are added up
+const maxTimelineCategories = 5
+
+// ErrorQuery selects the errors shown
+type ErrorQuery struct {
+	Level    string // lowest level included, all when empty
+	Category string // only this category when set
+	Limit    int    // recent errors listed
+}
+
+func parseErrorQuery(values url.Values, topN int) (ErrorQuery, error) {
+	q := ErrorQuery{Level: values.Get("level"), Category: values.Get("category")}
+	if q.Level != "" && !slices.Contains(errorLevels, q.Level) {
+		return q, fmt.Errorf("level must be one of %s", strings.Join(errorLevels, ", "))
+	}
+	limit, err := parsePositive(values, "limit")
+	if err != nil {
+		return q, err
+	}
+	if limit == 0 {
+		limit = max(topN, 25)
+	}
+	q.Limit = min(limit, maxTableLimit)
+	return q, nil
+}
+
+// ErrorReport shows the error log of a site over the date range: errors per
+// level and category, the categories over time, and the latest errors with
+// the access log entry of their request
+type ErrorReport struct {
+	Date       string     `json:"date"`
+	Source     string     `json:"source"`
+	Filter     string     `json:"filter,omitempty"`
+	Level      string     `json:"level,omitempty"`
+	Category   string     `json:"category,omitempty"`
+	Stats      ParseStats `json:"stats"`
+	Total      int        `json:"total"`
+	Correlated int        `json:"correlated"` // errors whose request was found in the access log
+	Truncated  bool       `json:"truncated,omitempty"`
+
+	Levels     []ErrorCount       `json:"levels"`
+	Categories []ErrorCategoryRow `json:"categories"`
+	Upstreams  []ErrorCount       `json:"upstreams"`
+	Clients    []ErrorCount       `json:"clients"`
+
+	Bucket   string             `json:"bucket"` // minute, hour or day
+	Columns  []string           `json:"columns"`
+	Timeline []ErrorTimelineRow `json:"timeline"`
+	Errors   []CorrelatedError  `json:"errors"` // newest first
+
+	AllLevels []string     `json:"-"`
+	Chips     []FilterChip `json:"-"`
+	Sites     []string     `json:"-"`
+	User      *User        `json:"-"`
+}
+
+// ErrorCount is a value and the errors having it
+type ErrorCount struct {
+	Value string `json:"value"`
+	Count int    `json:"count"`
+}
+
+// ErrorCategoryRow is a category of errors with the statuses their requests
+// ended with
+type ErrorCategoryRow struct {
+	Category string       `json:"category"`
+	Count    int          `json:"count"`
+	Share    float64      `json:"share"`
+	Statuses []ErrorCount `json:"statuses"`
+	Example  string       `json:"example"`
+}
+
+// ErrorTimelineRow counts the errors of a bucket per column of the report
+type ErrorTimelineRow struct {
+	Time   string `json:"time"`
+	Total  int    `json:"total"`
+	Counts []int  `json:"counts"`
+}
+
+// CorrelatedError is an error with the access log entry of its request, if
+// it was found
+type CorrelatedError struct {
+	ErrorEntry
+	Access  *LogEntry `json:"access,omitempty"`
+	LogsURL string    `json:"-"` // the access log lines of the request
+}
+
+// rangeBucket picks the resolution of a timeline over a date range, with
+// the layout of its buckets
+func rangeBucket(start, end time.Time) (string, string) {
+	switch d := end.Sub(start); {
+	case d <= 3*time.Hour:
+		return "minute", "2006-01-02 15:04"
+	case d <= 3*24*time.Hour:
+		return "hour", "2006-01-02 15:00"
+	}
+	return "day", "2006-01-02"
+}
+
+// accessEntry is the error as an access log entry, enriched like the access
+// log so it can be matched against its entries and filters
+func (s *Source) accessEntry(e *ErrorEntry) LogEntry {
+	entry := LogEntry{
+		IP:         e.Client,
+		UserID:     e.Client,
+		TimeStamp:  e.TimeStamp,
+		Method:     e.Method,
+		RequestURI: e.RequestURI,
+		Referer:    e.Referrer,
+		Source:     s.Name,
+		VHost:      s.VHost,
+	}
+	if u, err := url.Parse(e.Upstream); err == nil && u.Host != "" {
+		entry.Upstreams = []UpstreamAttempt{{Addr: u.Host}}
+	}
+	s.enrich.Apply(&entry)
+	return entry
+}
+
+// requestKey identifies the requests of a client to a URI
+func requestKey(e *LogEntry) string {
+	return e.IP + " " + e.Method + " " + e.RequestURI
+}
+
+// buildErrorReport reads the error log of the source between start and end
+// and finds the access log entry of each error's request: the first entry
+// of the same client, method and URI logged at most correlationWindow after
+// the error. The filter applies to the error's client and request, and to
+// the fields of the access entry, like its status, once one was found.
+func buildErrorReport(src *Source, start, end time.Time, filter *Filter, q ErrorQuery) (*ErrorReport, error) {
+	report := &ErrorReport{
+		Date:      formatRange(start, end),
+		Source:    src.Name,
+		Filter:    filter.String(),
+		Level:     q.Level,
+		Category:  q.Category,
+		AllLevels: errorLevels,
+	}
+	minLevel := max(slices.Index(errorLevels, q.Level), 0)
+
+	var errs []CorrelatedError
+	var entries []LogEntry // the access entry of each error
+	keys := make(map[string]bool)
+	stats, err := src.ReadErrors(func(e ErrorEntry) {
+		if e.TimeStamp.Before(start) || e.TimeStamp.After(end) {
+			return
+		}
+		if slices.Index(errorLevels, e.Level) < minLevel || q.Category != "" && e.Category != q.Category {
+			return
+		}
+		if len(errs) >= maxErrorEntries {
+			report.Truncated = true
+			return
+		}
+		entry := src.accessEntry(&e)
+		if e.Client != "" && e.Method != "" {
+			keys[requestKey(&entry)] = true
+		}
+		errs = append(errs, CorrelatedError{ErrorEntry: e})
+		entries = append(entries, entry)
+	})
+	report.Stats = stats
+	if err != nil {
+		return nil, err
+	}
+
+	// The access entries of the requests that logged errors
+	candidates := make(map[string][]LogEntry)
+	if len(keys) > 0 {
+		_, err := src.ReadEntries(func(entry LogEntry) {
+			if entry.TimeStamp.Before(start) || entry.TimeStamp.After(end.Add(correlationWindow)) {
+				return
+			}
+			if key := requestKey(&entry); keys[key] {
+				candidates[key] = append(candidates[key], entry)
+			}
+		})
+		if err != nil {
+			return nil, err
+		}
+		for _, c := range candidates {
+			slices.SortStableFunc(c, func(a, b LogEntry) int { return a.TimeStamp.Compare(b.TimeStamp) })
+		}
+	}
+
+	bucket, layout := rangeBucket(start, end)
+	report.Bucket = bucket
+	levels := make(map[string]int)
+	categories := make(map[string]*ErrorCategoryRow)
+	statuses := make(map[string]map[int]int)
+	upstreams := make(map[string]int)
+	clients := make(map[string]int)
+	var matched []CorrelatedError
+	var matchedCategories []string
+
+	for i := range errs {
+		e := &errs[i]
+		entry := entries[i]
+		// Access entries are logged with second precision once the response
+		// is done, so the error can't come after its request's entry
+		c := candidates[requestKey(&entry)]
+		j := sort.Search(len(c), func(j int) bool { return !c[j].TimeStamp.Before(e.TimeStamp) })
+		if j < len(c) && c[j].TimeStamp.Sub(e.TimeStamp) <= correlationWindow {
+			e.Access = &c[j]
+			entry = c[j]
+		}
+		if !filter.Match(&entry) {
+			continue
+		}
+
+		report.Total++
+		levels[e.Level]++
+		row := categories[e.Category]
+		if row == nil {
+			row = &ErrorCategoryRow{Category: e.Category, Example: e.Message}
+			categories[e.Category] = row
+			statuses[e.Category] = make(map[int]int)
+		}
+		row.Count++
+		if e.Access != nil {
+			report.Correlated++
+			statuses[e.Category][e.Access.Status]++
+			e.LogsURL = "/site/" + url.PathEscape(src.Name) + "/logs?q=" + url.QueryEscape(strings.Join([]string{
+				filterTerm("ip", e.Access.IP), filterTerm("uri", e.Access.RequestURI),
+				filterTerm("second", e.Access.TimeStamp.Format("2006-01-02 15:04:05")),
+			}, " and "))
+		}
+		if addr := lastUpstream(&entries[i]).Addr; addr != "" {
+			upstreams[addr]++
+		} else if e.Upstream != "" {
+			upstreams[e.Upstream]++
+		}
+		if e.Client != "" {
+			clients[e.Client]++
+		}
+		matched = append(matched, *e)
+		matchedCategories = append(matchedCategories, e.Category)
+	}
+
+	for level, n := range levels {
+		report.Levels = append(report.Levels, ErrorCount{level, n})
+	}
+	// Most severe first
+	slices.SortFunc(report.Levels, func(a, b ErrorCount) int {
+		return cmp.Compare(slices.Index(errorLevels, b.Value), slices.Index(errorLevels, a.Value))
+	})
+
+	for _, row := range categories {
+		row.Share = percentOf(row.Count, report.Total)
+		for status, n := range statuses[row.Category] {
+			row.Statuses = append(row.Statuses, ErrorCount{strconv.Itoa(status), n})
+		}
+		sortErrorCounts(row.Statuses)
+		report.Categories = append(report.Categories, *row)
+	}
+	slices.SortFunc(report.Categories, func(a, b ErrorCategoryRow) int {
+		return cmp.Or(cmp.Compare(b.Count, a.Count), strings.Compare(a.Category, b.Category))
+	})
+	report.Upstreams = topErrorCounts(upstreams, q.Limit)
+	report.Clients = topErrorCounts(clients, q.Limit)
+
+	// The busiest categories get a column, the others share the last one
+	column := make(map[string]int)
+	for i, row := range report.Categories {
+		if i < maxTimelineCategories {
+			column[row.Category] = i
+			report.Columns = append(report.Columns, row.Category)
+		}
+	}
+	if len(report.Categories) > maxTimelineCategories {
+		report.Columns = append(report.Columns, "others")
+	}
+	rows := make(map[string]*ErrorTimelineRow)
+	for i, e := range matched {
+		t := e.TimeStamp.Format(layout)
+		row := rows[t]
+		if row == nil {
+			row = &ErrorTimelineRow{Time: t, Counts: make([]int, len(report.Columns))}
+			rows[t] = row
+		}
+		row.Total++
+		if c, ok := column[matchedCategories[i]]; ok {
+			row.Counts[c]++
+		} else {
+			row.Counts[len(row.Counts)-1]++
+		}
+	}
+	for _, row := range rows {
+		report.Timeline = append(report.Timeline, *row)
+	}
+	slices.SortFunc(report.Timeline, func(a, b ErrorTimelineRow) int { return strings.Compare(a.Time, b.Time) })
+
+	for i := len(matched) - 1; i >= 0 && len(report.Errors) < q.Limit; i-- {
+		report.Errors = append(report.Errors, matched[i])
+	}
+	return report, nil
+}
+
+// topErrorCounts returns the limit values with the most errors
+func topErrorCounts(counts map[string]int, limit int) []ErrorCount {
+	rows := make([]ErrorCount, 0, len(counts))
+	for value, n := range counts {
+		rows = append(rows, ErrorCount{value, n})
+	}
+	sortErrorCounts(rows)
+	return rows[:min(len(rows), limit)]
+}
+
+func sortErrorCounts(rows []ErrorCount) {
+	slices.SortFunc(rows, func(a, b ErrorCount) int {
+		return cmp.Or(cmp.Compare(b.Count, a.Count), strings.Compare(a.Value, b.Value))
+	})
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseErrorLine(t *testing.T) {
+	tests := []struct {
+		name, line string
+		want       ErrorEntry
+	}{
+		{"upstream timed out",
+			`2024/02/19 16:01:02 [error] 1234#5678: *90 upstream timed out (110: Connection timed out) while reading response header from upstream, client: 10.0.0.1, server: example.com, request: "GET /api/slow?x=1 HTTP/1.1", upstream: "http://10.1.0.1:8080/api/slow?x=1", host: "example.com", referrer: "https://example.com/cart"`,
+			ErrorEntry{
+				TimeStamp: time.Date(2024, 2, 19, 16, 1, 2, 0, time.UTC), Level: "error", PID: 1234, TID: 5678, Connection: 90,
+				Message:  "upstream timed out (110: Connection timed out) while reading response header from upstream",
+				Category: "upstream timeout", Client: "10.0.0.1", Server: "example.com",
+				Request: "GET /api/slow?x=1 HTTP/1.1", Method: "GET", RequestURI: "/api/slow?x=1",
+				Upstream: "http://10.1.0.1:8080/api/slow?x=1", Host: "example.com", Referrer: "https://example.com/cart",
+			}},
+		{"connect() refused",
+			`2024/02/19 16:01:03 [error] 31#31: *7 connect() failed (111: Connection refused) while connecting to upstream, client: 2001:db8::5, server: _, request: "POST /login HTTP/2.0", upstream: "http://127.0.0.1:3000/login", host: "app.example.com"`,
+			ErrorEntry{
+				TimeStamp: time.Date(2024, 2, 19, 16, 1, 3, 0, time.UTC), Level: "error", PID: 31, TID: 31, Connection: 7,
+				Message:  "connect() failed (111: Connection refused) while connecting to upstream",
+				Category: "upstream refused", Client: "2001:db8::5", Server: "_",
+				Request: "POST /login HTTP/2.0", Method: "POST", RequestURI: "/login",
+				Upstream: "http://127.0.0.1:3000/login", Host: "app.example.com",
+			}},
+		{"connect() no route",
+			`2024/02/19 16:01:04 [error] 31#31: *8 connect() failed (113: No route to host) while connecting to upstream, client: 10.0.0.2, server: example.com, request: "GET / HTTP/1.1", upstream: "http://10.1.0.9:80/", host: "example.com"`,
+			ErrorEntry{
+				TimeStamp: time.Date(2024, 2, 19, 16, 1, 4, 0, time.UTC), Level: "error", PID: 31, TID: 31, Connection: 8,
+				Message:  "connect() failed (113: No route to host) while connecting to upstream",
+				Category: "upstream connect failed", Client: "10.0.0.2", Server: "example.com",
+				Request: "GET / HTTP/1.1", Method: "GET", RequestURI: "/",
+				Upstream: "http://10.1.0.9:80/", Host: "example.com",
+			}},
+		{"no live upstreams",
+			`2024/02/19 16:01:05 [error] 31#31: *9 no live upstreams while connecting to upstream, client: 10.0.0.3, server: example.com, request: "GET /api HTTP/1.1", upstream: "http://backend/api", host: "example.com"`,
+			ErrorEntry{
+				TimeStamp: time.Date(2024, 2, 19, 16, 1, 5, 0, time.UTC), Level: "error", PID: 31, TID: 31, Connection: 9,
+				Message:  "no live upstreams while connecting to upstream",
+				Category: "no live upstreams", Client: "10.0.0.3", Server: "example.com",
+				Request: "GET /api HTTP/1.1", Method: "GET", RequestURI: "/api",
+				Upstream: "http://backend/api", Host: "example.com",
+			}},
+		{"file not found",
+			`2024/02/19 16:01:06 [error] 31#31: *10 open() "/var/www/html/favicon.ico" failed (2: No such file or directory), client: 10.0.0.4, server: example.com, request: "GET /favicon.ico HTTP/1.1", host: "example.com", referrer: "https://example.com/"`,
+			ErrorEntry{
+				TimeStamp: time.Date(2024, 2, 19, 16, 1, 6, 0, time.UTC), Level: "error", PID: 31, TID: 31, Connection: 10,
+				Message:  `open() "/var/www/html/favicon.ico" failed (2: No such file or directory)`,
+				Category: "file not found", Client: "10.0.0.4", Server: "example.com",
+				Request: "GET /favicon.ico HTTP/1.1", Method: "GET", RequestURI: "/favicon.ico",
+				Host: "example.com", Referrer: "https://example.com/",
+			}},
+		{"rate limited",
+			`2024/02/19 16:01:07 [warn] 31#31: *11 limiting requests, excess: 10.520 by zone "api", client: 10.0.0.5, server: example.com, request: "GET /api/search HTTP/1.1", host: "example.com"`,
+			ErrorEntry{
+				TimeStamp: time.Date(2024, 2, 19, 16, 1, 7, 0, time.UTC), Level: "warn", PID: 31, TID: 31, Connection: 11,
+				Message:  `limiting requests, excess: 10.520 by zone "api"`,
+				Category: "rate limited", Client: "10.0.0.5", Server: "example.com",
+				Request: "GET /api/search HTTP/1.1", Method: "GET", RequestURI: "/api/search", Host: "example.com",
+			}},
+		{"escaped quote in the request",
+			`2024/02/19 16:01:08 [info] 31#31: *12 client prematurely closed connection, client: 10.0.0.6, server: example.com, request: "GET /a\"b HTTP/1.1", host: "example.com"`,
+			ErrorEntry{
+				TimeStamp: time.Date(2024, 2, 19, 16, 1, 8, 0, time.UTC), Level: "info", PID: 31, TID: 31, Connection: 12,
+				Message:  "client prematurely closed connection",
+				Category: "client closed", Client: "10.0.0.6", Server: "example.com",
+				Request: `GET /a"b HTTP/1.1`, Method: "GET", RequestURI: `/a"b`, Host: "example.com",
+			}},
+		{"without a connection or context",
+			`2024/02/19 16:00:00 [notice] 1#1: signal process started`,
+			ErrorEntry{
+				TimeStamp: time.Date(2024, 2, 19, 16, 0, 0, 0, time.UTC), Level: "notice", PID: 1, TID: 1,
+				Message: "signal process started", Category: otherErrors,
+			}},
+		{"truncated request line",
+			`2024/02/19 16:01:09 [error] 31#31: *13 client sent invalid request, client: 10.0.0.7, server: example.com, request: "GARBAGE"`,
+			ErrorEntry{
+				TimeStamp: time.Date(2024, 2, 19, 16, 1, 9, 0, time.UTC), Level: "error", PID: 31, TID: 31, Connection: 13,
+				Message: "client sent invalid request", Category: otherErrors, Client: "10.0.0.7", Server: "example.com", Request: "GARBAGE",
+			}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := parseErrorLine(tt.line, time.UTC)
+			if !ok {
+				t.Fatal("not parsed")
+			}
+			if got != tt.want {
+				t.Errorf("got  %+v\nwant %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseErrorLineInvalid(t *testing.T) {
+	for _, line := range []string{
+		"",
+		"nginx: [emerg] unknown directive",
+		"2024/13/45 16:00:00 [error] 1#1: bad date",
+		"2024-02-19 16:00:00 [error] 1#1: dashes",
+		`10.0.0.1 - - [19/Feb/2024:16:00:01 +0000] "GET / HTTP/1.1" 200 1 "-" "curl"`,
+	} {
+		if e, ok := parseErrorLine(line, time.UTC); ok {
+			t.Errorf("parsed %q as %+v", line, e)
+		}
+	}
+}
+
+func TestParseErrorLineLocation(t *testing.T) {
+	// Error log times are local, without an offset
+	loc := time.FixedZone("UTC+7", 7*60*60)
+	e, ok := parseErrorLine("2024/02/19 23:00:00 [error] 1#1: *1 x", loc)
+	if !ok || !e.TimeStamp.Equal(time.Date(2024, 2, 19, 16, 0, 0, 0, time.UTC)) {
+		t.Errorf("got %v", e.TimeStamp)
+	}
+}
+
+func TestBuildErrorReportCorrelation(t *testing.T) {
+	access := func(ts, ip, request string, status int) string {
+		return ip + ` - - [19/Feb/2024:` + ts + ` +0000] "` + request + ` HTTP/1.1" ` + strconv.Itoa(status) + ` 0 "-" "curl" 0.1 - - - -`
+	}
+	failure := func(ts, ip, request string) string {
+		return `2024/02/19 ` + ts + ` [error] 7#7: *1 upstream timed out (110: Connection timed out) while reading response header from upstream, client: ` + ip + `, server: example.com, request: "` + request + ` HTTP/1.1", host: "example.com"`
+	}
+	src := newTestSource(t, []string{
+		access("16:00:40", "10.0.0.1", "GET /slow", 504),
+		access("16:15:01", "10.0.0.2", "GET /late", 504),
+		access("16:19:59", "10.0.0.3", "GET /before", 504),
+		access("16:35:00", "10.0.0.4", "GET /edge", 504),
+		access("16:40:30", "10.0.0.5", "GET /twice", 504),
+		access("16:41:00", "10.0.0.5", "GET /twice", 200),
+		// Another client, method or URI isn't the same request
+		access("16:50:01", "10.0.0.9", "GET /other", 504),
+		access("16:50:01", "10.0.0.6", "POST /other", 504),
+		access("16:50:01", "10.0.0.6", "GET /other?x", 504),
+		// Requests are still looked for after the end of the range
+		access("17:02:00", "10.0.0.7", "GET /end", 502),
+	})
+	src.ErrorLog = writeTestFile(t, "error.log", strings.Join([]string{
+		failure("16:00:10", "10.0.0.1", "GET /slow"),
+		failure("16:10:00", "10.0.0.2", "GET /late"),
+		failure("16:20:00", "10.0.0.3", "GET /before"),
+		failure("16:30:00", "10.0.0.4", "GET /edge"),
+		failure("16:40:00", "10.0.0.5", "GET /twice"),
+		failure("16:50:00", "10.0.0.6", "GET /other"),
+		failure("16:59:00", "10.0.0.7", "GET /end"),
+	}, "\n")+"\n")
+
+	start := time.Date(2024, 2, 19, 16, 0, 0, 0, time.UTC)
+	report, err := buildErrorReport(src, start, start.Add(time.Hour), nil, ErrorQuery{Limit: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := map[string]string{ // request URI to the time of its access entry
+		"/slow":   "16:00:40",
+		"/late":   "", // logged 5m1s after the error, past correlationWindow
+		"/before": "", // logged before the error
+		"/edge":   "16:35:00",
+		"/twice":  "16:40:30",
+		"/other":  "",
+		"/end":    "17:02:00",
+	}
+	if report.Total != len(want) || len(report.Errors) != len(want) || report.Correlated != 4 {
+		t.Errorf("%d errors, %d listed, %d correlated", report.Total, len(report.Errors), report.Correlated)
+	}
+	for _, e := range report.Errors {
+		got := ""
+		if e.Access != nil {
+			got = e.Access.TimeStamp.UTC().Format("15:04:05")
+		}
+		if got != want[e.RequestURI] {
+			t.Errorf("%s: access entry at %q, want %q", e.RequestURI, got, want[e.RequestURI])
+		}
+	}
+	if row := report.Categories[0]; row.Category != "upstream timeout" || len(row.Statuses) != 2 || row.Statuses[0] != (ErrorCount{"504", 3}) {
+		t.Errorf("statuses of the correlated requests: %+v", row)
+	}
+
+	// A filter on the access entry's fields only keeps correlated errors
+	filter, _ := ParseFilter("status=504")
+	report, err = buildErrorReport(src, start, start.Add(time.Hour), filter, ErrorQuery{Limit: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Total != 3 {
+		t.Errorf("status=504: %d errors, want 3", report.Total)
+	}
+}
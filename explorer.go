@@ -0,0 +1,388 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"net/url"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Limits of the raw log explorer
+const (
+	maxContextLines     = 50 // around a single entry
+	maxListContextLines = 10 // around each entry of a page
+)
+
+// errEntryNotFound is returned when a permalink no longer points to a line
+var errEntryNotFound = errors.New("log entry not found")
+
+// LogLine is a raw line of a log file together with what it parsed to
+type LogLine struct {
+	File      string        `json:"file"` // base name of the file
+	Offset    int64         `json:"offset"`
+	Hash      string        `json:"hash"`
+	Raw       string        `json:"raw"`
+	Entry     *LogEntry     `json:"entry,omitempty"` // nil if the line didn't parse
+	Permalink string        `json:"permalink"`
+	Before    []LogLine     `json:"before,omitempty"`
+	After     []LogLine     `json:"after,omitempty"`
+	Segments  []LineSegment `json:"-"`
+	Target    bool          `json:"-"` // the line a permalink points to
+}
+
+// lineHash identifies the content of a line so permalinks can find it again
+// after the file was rotated
+func lineHash(line string) string {
+	return fmt.Sprintf("%08x", crc32.ChecksumIEEE([]byte(line)))
+}
+
+// entryURL is the permalink of a line
+func entryURL(site, file string, offset int64, hash string) string {
+	values := url.Values{}
+	values.Set("file", file)
+	values.Set("offset", strconv.FormatInt(offset, 10))
+	values.Set("h", hash)
+	return "/site/" + url.PathEscape(site) + "/entry?" + values.Encode()
+}
+
+// newLogLine parses a raw line of the source
+func (s *Source) newLogLine(file string, offset int64, raw string) LogLine {
+	line := LogLine{
+		File:     filepath.Base(file),
+		Offset:   offset,
+		Hash:     lineHash(raw),
+		Raw:      raw,
+		Segments: s.format.Segments(raw),
+	}
+	if entry, ok := s.parseLine(file, raw); ok {
+		line.Entry = &entry
+	}
+	line.Permalink = entryURL(s.Name, line.File, offset, line.Hash)
+	return line
+}
+
+// rawLine is a line not parsed yet, kept for context
+type rawLine struct {
+	offset int64
+	text   string
+}
+
+// ExploreQuery selects the raw lines shown by the explorer
+type ExploreQuery struct {
+	Text    string         // case-insensitive substring of the raw line
+	Regex   *regexp.Regexp // matched against the raw line
+	Context int            // lines shown before and after each entry
+	Limit   int
+	Page    int
+}
+
+// parseExploreQuery reads text, re, context, limit and page
+func parseExploreQuery(values url.Values, topN int) (ExploreQuery, error) {
+	q := ExploreQuery{Text: values.Get("text")}
+	if re := values.Get("re"); re != "" {
+		regex, err := regexp.Compile(re)
+		if err != nil {
+			return q, fmt.Errorf("re: %v", err)
+		}
+		q.Regex = regex
+	}
+
+	var err error
+	if q.Limit, err = parsePositive(values, "limit"); err != nil {
+		return q, err
+	}
+	if q.Limit == 0 {
+		q.Limit = topN
+	}
+	q.Limit = min(q.Limit, maxTableLimit)
+	if q.Page, err = parsePositive(values, "page"); err != nil {
+		return q, err
+	}
+	q.Page = max(q.Page, 1)
+	if q.Context, err = parseContext(values, 0); err != nil {
+		return q, err
+	}
+	q.Context = min(q.Context, maxListContextLines)
+	return q, nil
+}
+
+// matchRaw applies the text and regex search to a raw line
+func (q ExploreQuery) matchRaw(raw string) bool {
+	if q.Text != "" && !strings.Contains(strings.ToLower(raw), strings.ToLower(q.Text)) {
+		return false
+	}
+	return q.Regex == nil || q.Regex.MatchString(raw)
+}
+
+// ExploreResult is one page of raw lines
+type ExploreResult struct {
+	Lines  []LogLine `json:"lines"`
+	Total  int       `json:"total"` // matching lines in the date range
+	Page   int       `json:"page"`
+	Pages  int       `json:"pages"`
+	Limit  int       `json:"limit"`
+	Date   string    `json:"date"`
+	Source string    `json:"source"`
+	Filter string    `json:"filter,omitempty"`
+
+	Text    string       `json:"-"`
+	Regex   string       `json:"-"`
+	Context int          `json:"-"`
+	Links   ExploreLinks `json:"-"`
+	Chips   []FilterChip `json:"-"`
+	Sites   []string     `json:"-"`
+	User    *User        `json:"-"`
+}
+
+// explore reads the source in file order and returns the requested page of
+// lines in the date range that match the filter and search, each with its
+// context lines
+func explore(src *Source, start, end time.Time, filter *Filter, q ExploreQuery) (*ExploreResult, error) {
+	files, err := src.Files()
+	if err != nil {
+		return nil, err
+	}
+
+	result := &ExploreResult{
+		Limit:   q.Limit,
+		Date:    fmt.Sprintf("%s - %s", start.Format(rangeLayout), end.Format(rangeLayout)),
+		Source:  src.Name,
+		Filter:  filter.String(),
+		Text:    q.Text,
+		Context: q.Context,
+	}
+	if q.Regex != nil {
+		result.Regex = q.Regex.String()
+	}
+
+	first := (q.Page - 1) * q.Limit
+	for _, name := range files {
+		// before holds the last lines for the context of the next match,
+		// pending the matches on this page still waiting for lines after them
+		var before []rawLine
+		var pending []int
+		err := src.scanFile(name, func(offset int64, raw string) bool {
+			if len(pending) > 0 {
+				line := src.newLogLine(name, offset, raw)
+				for _, i := range pending {
+					result.Lines[i].After = append(result.Lines[i].After, line)
+				}
+				for len(pending) > 0 && len(result.Lines[pending[0]].After) >= q.Context {
+					pending = pending[1:]
+				}
+			}
+
+			if q.matchRaw(raw) {
+				entry, ok := src.parseLine(name, raw)
+				if ok && !entry.TimeStamp.Before(start) && !entry.TimeStamp.After(end) && filter.Match(&entry) {
+					if result.Total >= first && len(result.Lines) < q.Limit {
+						match := src.newLogLine(name, offset, raw)
+						for _, b := range before {
+							match.Before = append(match.Before, src.newLogLine(name, b.offset, b.text))
+						}
+						result.Lines = append(result.Lines, match)
+						if q.Context > 0 {
+							pending = append(pending, len(result.Lines)-1)
+						}
+					}
+					result.Total++
+				}
+			}
+
+			if q.Context > 0 {
+				before = append(before, rawLine{offset, raw})
+				if len(before) > q.Context {
+					before = before[1:]
+				}
+			}
+			return true
+		})
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", name, err)
+		}
+	}
+
+	result.Pages = max(1, (result.Total+q.Limit-1)/q.Limit)
+	result.Page = min(q.Page, result.Pages)
+	return result, nil
+}
+
+// findEntry returns the line a permalink points to with context lines
+// around it. When the line isn't at the offset of the named file any more,
+// the other files of the source are tried, which finds it again after
+// logrotate renamed or compressed the file.
+func findEntry(src *Source, file string, offset int64, hash string, context int) ([]LogLine, error) {
+	files, err := src.Files()
+	if err != nil {
+		return nil, err
+	}
+
+	var candidates []string
+	for _, name := range files {
+		if filepath.Base(name) == file {
+			candidates = append([]string{name}, candidates...)
+		} else if hash != "" {
+			candidates = append(candidates, name)
+		}
+	}
+
+	for _, name := range candidates {
+		lines, found, err := readAround(src, name, offset, hash, context)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", name, err)
+		}
+		if found {
+			return lines, nil
+		}
+	}
+	return nil, errEntryNotFound
+}
+
+// readAround reads the line at offset of a file with up to context lines on
+// either side. found is false when no line starts at offset or its hash
+// doesn't match.
+func readAround(src *Source, name string, offset int64, hash string, context int) ([]LogLine, bool, error) {
+	var window []rawLine
+	target := -1
+	err := src.scanFile(name, func(lineOffset int64, raw string) bool {
+		if target < 0 && lineOffset > offset {
+			return false
+		}
+		window = append(window, rawLine{lineOffset, raw})
+		if target >= 0 {
+			return len(window)-1-target < context
+		}
+		if lineOffset != offset {
+			if len(window) > context {
+				window = window[1:]
+			}
+			return true
+		}
+		if hash != "" && lineHash(raw) != hash {
+			return false
+		}
+		target = len(window) - 1
+		return context > 0
+	})
+	if err != nil || target < 0 {
+		return nil, false, err
+	}
+
+	lines := make([]LogLine, len(window))
+	for i, l := range window {
+		lines[i] = src.newLogLine(name, l.offset, l.text)
+	}
+	lines[target].Target = true
+	return lines, true, nil
+}
+
+// ExploreLinks are the pagination links of the explorer
+type ExploreLinks struct {
+	First, Prev, Next, Last string
+}
+
+// exploreURL links to a page of the explorer with the same search
+func exploreURL(result *ExploreResult, page int) string {
+	values := url.Values{}
+	if result.Filter != "" {
+		values.Set("q", result.Filter)
+	}
+	if result.Text != "" {
+		values.Set("text", result.Text)
+	}
+	if result.Regex != "" {
+		values.Set("re", result.Regex)
+	}
+	if result.Context > 0 {
+		values.Set("context", strconv.Itoa(result.Context))
+	}
+	values.Set("limit", strconv.Itoa(result.Limit))
+	values.Set("page", strconv.Itoa(page))
+	return "/site/" + url.PathEscape(result.Source) + "/logs?" + values.Encode()
+}
+
+// exploreLinks builds the pagination links of an explorer page
+func exploreLinks(result *ExploreResult) ExploreLinks {
+	var links ExploreLinks
+	if result.Page > 1 {
+		links.First = exploreURL(result, 1)
+		links.Prev = exploreURL(result, result.Page-1)
+	}
+	if result.Page < result.Pages {
+		links.Next = exploreURL(result, result.Page+1)
+		links.Last = exploreURL(result, result.Pages)
+	}
+	return links
+}
+
+// EntryView is a single line shown through its permalink
+type EntryView struct {
+	Lines   []LogLine `json:"lines"` // the line with its context, in file order
+	Context int       `json:"context"`
+	Source  string    `json:"source"`
+
+	MoreContext string       `json:"-"`
+	Filter      string       `json:"-"`
+	Chips       []FilterChip `json:"-"`
+	Sites       []string     `json:"-"`
+	User        *User        `json:"-"`
+}
+
+// parseEntryQuery reads the file, offset, h and context parameters of a
+// permalink
+func parseEntryQuery(values url.Values) (file string, offset int64, hash string, context int, err error) {
+	file = values.Get("file")
+	if file == "" {
+		return "", 0, "", 0, errors.New("file is required")
+	}
+	if offset, err = strconv.ParseInt(values.Get("offset"), 10, 64); err != nil || offset < 0 {
+		return "", 0, "", 0, errors.New("offset must be a byte offset")
+	}
+	if context, err = parseContext(values, 5); err != nil {
+		return "", 0, "", 0, err
+	}
+	return file, offset, values.Get("h"), min(context, maxContextLines), nil
+}
+
+// Class returns the CSS classes highlighting a segment by its field
+func (s LineSegment) Class() string {
+	switch s.Field {
+	case "":
+		return ""
+	case "status":
+		switch {
+		case strings.HasPrefix(s.Text, "5"):
+			return "font-bold text-red-700"
+		case strings.HasPrefix(s.Text, "4"):
+			return "font-bold text-yellow-700"
+		}
+		return "font-bold text-green-700"
+	case "ip", "user":
+		return "text-purple-700"
+	case "time":
+		return "text-gray-500"
+	case "method", "uri", "protocol":
+		return "text-blue-700"
+	case "response_time", "request_time", "connect_time", "header_time":
+		return "text-red-600"
+	}
+	return "text-green-800"
+}
+
+// parseContext reads the number of context lines, def when not given
+func parseContext(values url.Values, def int) (int, error) {
+	s := values.Get("context")
+	if s == "" {
+		return def, nil
+	}
+	n, err := strconv.Atoi(s)
+	if err != nil || n < 0 {
+		return 0, errors.New("context must be a number of lines")
+	}
+	return n, nil
+}
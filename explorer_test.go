@@ -0,0 +1,204 @@
+package main
+
+import (
+	"errors"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+var explorerLines = []string{
+	`10.0.0.1 - - [19/Feb/2024:16:00:00 +0000] "GET /a HTTP/1.1" 200 1 "-" "curl" 0.1 - - - -`,
+	`not a log line`,
+	`10.0.0.2 - - [19/Feb/2024:16:01:00 +0000] "GET /b HTTP/1.1" 404 1 "-" "curl" 0.1 - - - -`,
+	`10.0.0.3 - - [19/Feb/2024:16:02:00 +0000] "GET /a?x HTTP/1.1" 500 1 "-" "curl" 0.1 - - - -`,
+	`10.0.0.4 - - [19/Feb/2024:16:03:00 +0000] "POST /a HTTP/1.1" 200 1 "-" "curl" 0.1 - - - -`,
+	`10.0.0.5 - - [19/Feb/2024:17:30:00 +0000] "GET /a HTTP/1.1" 200 1 "-" "curl" 0.1 - - - -`,
+}
+
+// explorerOffsets are the byte offsets of explorerLines
+func explorerOffsets() []int64 {
+	var offsets []int64
+	var offset int64
+	for _, line := range explorerLines {
+		offsets = append(offsets, offset)
+		offset += int64(len(line)) + 1
+	}
+	return offsets
+}
+
+func TestParseExploreQuery(t *testing.T) {
+	values, _ := url.ParseQuery("text=GET&re=^10%5C.&context=50&limit=5000&page=2")
+	q, err := parseExploreQuery(values, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if q.Text != "GET" || q.Regex.String() != `^10\.` || q.Context != maxListContextLines || q.Limit != maxTableLimit || q.Page != 2 {
+		t.Errorf("query %+v", q)
+	}
+	if q, _ := parseExploreQuery(url.Values{}, 10); q.Limit != 10 || q.Page != 1 || q.Context != 0 || q.Regex != nil {
+		t.Errorf("defaults %+v", q)
+	}
+
+	tests := map[string]string{
+		"re=(":       "re: error parsing regexp",
+		"context=-1": "context must be a number of lines",
+		"limit=x":    "limit must be a positive number",
+		"page=0":     "page must be a positive number",
+	}
+	for query, want := range tests {
+		values, _ := url.ParseQuery(query)
+		if _, err := parseExploreQuery(values, 10); err == nil || !strings.HasPrefix(err.Error(), want) {
+			t.Errorf("%s: error %v, want %q", query, err, want)
+		}
+	}
+}
+
+func TestExplore(t *testing.T) {
+	src := newTestSource(t, explorerLines)
+	offsets := explorerOffsets()
+	start := time.Date(2024, 2, 19, 16, 0, 0, 0, time.UTC)
+	end := start.Add(time.Hour)
+	statusFilter, _ := ParseFilter("status>=400")
+
+	tests := []struct {
+		name   string
+		filter *Filter
+		q      ExploreQuery
+		lines  []int // indexes into explorerLines
+		total  int
+		page   int
+		pages  int
+	}{
+		{"everything", nil, ExploreQuery{Limit: 10, Page: 1}, []int{0, 2, 3, 4}, 4, 1, 1},
+		// The search is case-insensitive, entries out of range are left out
+		{"text", nil, ExploreQuery{Text: "get /A", Limit: 10, Page: 1}, []int{0, 3}, 2, 1, 1},
+		{"regex", nil, ExploreQuery{Regex: regexp.MustCompile(`" [45]\d\d `), Limit: 10, Page: 1}, []int{2, 3}, 2, 1, 1},
+		{"filter", statusFilter, ExploreQuery{Limit: 10, Page: 1}, []int{2, 3}, 2, 1, 1},
+		{"second page", nil, ExploreQuery{Limit: 3, Page: 2}, []int{4}, 4, 2, 2},
+		{"past the last page", nil, ExploreQuery{Limit: 3, Page: 5}, nil, 4, 2, 2},
+	}
+	for _, tt := range tests {
+		result, err := explore(src, start, end, tt.filter, tt.q)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got []int
+		for _, line := range result.Lines {
+			got = append(got, slices.Index(offsets, line.Offset))
+		}
+		if !slices.Equal(got, tt.lines) || result.Total != tt.total || result.Page != tt.page || result.Pages != tt.pages {
+			t.Errorf("%s: lines %v, total %d, page %d of %d", tt.name, got, result.Total, result.Page, result.Pages)
+		}
+	}
+
+	result, err := explore(src, start, end, nil, ExploreQuery{Context: 1, Limit: 2, Page: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	first, second := result.Lines[0], result.Lines[1]
+	if first.Raw != explorerLines[0] || first.Entry == nil || first.Hash != lineHash(explorerLines[0]) ||
+		first.Permalink != entryURL("site", "access.log", 0, first.Hash) {
+		t.Errorf("first line %+v", first)
+	}
+	// Context lines include the lines that didn't parse
+	if len(first.Before) != 0 || len(first.After) != 1 || first.After[0].Raw != explorerLines[1] || first.After[0].Entry != nil {
+		t.Errorf("context of the first line: %+v, %+v", first.Before, first.After)
+	}
+	if len(second.Before) != 1 || second.Before[0].Offset != offsets[1] || len(second.After) != 1 || second.After[0].Offset != offsets[3] {
+		t.Errorf("context of the second line: %+v, %+v", second.Before, second.After)
+	}
+}
+
+func TestFindEntry(t *testing.T) {
+	src := newTestSource(t, explorerLines)
+	offsets := explorerOffsets()
+	hash := lineHash(explorerLines[2])
+
+	lines, err := findEntry(src, "access.log", offsets[2], hash, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(lines) != 3 || !lines[1].Target || lines[1].Raw != explorerLines[2] || lines[0].Raw != explorerLines[1] || lines[2].Raw != explorerLines[3] {
+		t.Errorf("lines %+v", lines)
+	}
+	if lines, err := findEntry(src, "access.log", offsets[0], "", 2); err != nil || len(lines) != 3 || !lines[0].Target {
+		t.Errorf("first line without a hash: %+v, %v", lines, err)
+	}
+
+	for name, args := range map[string]struct {
+		offset int64
+		hash   string
+	}{
+		"another line's hash": {offsets[2], lineHash(explorerLines[3])},
+		"inside a line":       {offsets[2] + 1, ""},
+		"past the end":        {offsets[5] + 1000, ""},
+	} {
+		if _, err := findEntry(src, "access.log", args.offset, args.hash, 1); !errors.Is(err, errEntryNotFound) {
+			t.Errorf("%s: error %v", name, err)
+		}
+	}
+
+	// After logrotate renamed the file, the line is found in access.log.1
+	rotated := src.Path + ".1"
+	if err := os.Rename(src.Path, rotated); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(src.Path, []byte(strings.Join(explorerLines[3:], "\n")+"\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	src.Path += "*"
+	lines, err = findEntry(src, "access.log", offsets[2], hash, 0)
+	if err != nil || len(lines) != 1 || lines[0].File != filepath.Base(rotated) || lines[0].Raw != explorerLines[2] {
+		t.Errorf("after rotation: %+v, %v", lines, err)
+	}
+}
+
+func TestParseEntryQuery(t *testing.T) {
+	values, _ := url.ParseQuery("file=access.log&offset=120&h=abc&context=500")
+	file, offset, hash, context, err := parseEntryQuery(values)
+	if err != nil || file != "access.log" || offset != 120 || hash != "abc" || context != maxContextLines {
+		t.Errorf("got %q %d %q %d %v", file, offset, hash, context, err)
+	}
+	values, _ = url.ParseQuery("file=access.log&offset=0")
+	if _, _, _, context, _ := parseEntryQuery(values); context != 5 {
+		t.Errorf("default context %d", context)
+	}
+
+	for query, want := range map[string]string{
+		"offset=1":                     "file is required",
+		"file=a&offset=-1":             "offset must be a byte offset",
+		"file=a":                       "offset must be a byte offset",
+		"file=a&offset=1&context=some": "context must be a number of lines",
+	} {
+		values, _ := url.ParseQuery(query)
+		if _, _, _, _, err := parseEntryQuery(values); err == nil || err.Error() != want {
+			t.Errorf("%s: error %v, want %q", query, err, want)
+		}
+	}
+}
+
+func TestLineSegmentClass(t *testing.T) {
+	tests := []struct {
+		segment LineSegment
+		class   string
+	}{
+		{LineSegment{Text: " - - "}, ""},
+		{LineSegment{Field: "status", Text: "503"}, "font-bold text-red-700"},
+		{LineSegment{Field: "status", Text: "404"}, "font-bold text-yellow-700"},
+		{LineSegment{Field: "status", Text: "200"}, "font-bold text-green-700"},
+		{LineSegment{Field: "ip", Text: "10.0.0.1"}, "text-purple-700"},
+		{LineSegment{Field: "request_time", Text: "0.1"}, "text-red-600"},
+		{LineSegment{Field: "user_agent", Text: "curl"}, "text-green-800"},
+	}
+	for _, tt := range tests {
+		if got := tt.segment.Class(); got != tt.class {
+			t.Errorf("%+v: %q, want %q", tt.segment, got, tt.class)
+		}
+	}
+}
@@ -0,0 +1,620 @@
+package main
+
+import (
+	"fmt"
+	"net/netip"
+	"net/url"
+	"regexp"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Filter restricts a report to the entries matching an expression such as
+//
+//	status>=500 and method=POST and uri~"^/api/" and ip in 10.0.0.0/8 and rt>1.5
+//
+// Comparisons are joined with and, or and not and grouped with parentheses.
+// A nil Filter matches every entry.
+type Filter struct {
+	text  string
+	root  filterNode
+	terms []string // the parts joined by a top-level and
+}
+
+// FilterError reports where an expression could not be parsed
+type FilterError struct {
+	Column int // 1-based position in the expression
+	Msg    string
+}
+
+func (e *FilterError) Error() string {
+	return fmt.Sprintf("invalid filter at column %d: %s", e.Column, e.Msg)
+}
+
+// filterField reads one field of an entry, as text or as a number
+type filterField struct {
+	text   func(*LogEntry) string
+	number func(*LogEntry) float64
+	ip     bool // "in" also accepts networks
+}
+
+// filterFields are the names usable in an expression
+var filterFields = map[string]filterField{
+	"ip":              {text: func(e *LogEntry) string { return e.IP }, ip: true},
+	"user":            {text: func(e *LogEntry) string { return e.UserID }},
+	"method":          {text: func(e *LogEntry) string { return e.Method }},
+	"uri":             {text: func(e *LogEntry) string { return e.RequestURI }},
+	"protocol":        {text: func(e *LogEntry) string { return e.Protocol }},
+	"referer":         {text: func(e *LogEntry) string { return e.Referer }},
+	"ua":              {text: func(e *LogEntry) string { return e.UserAgent }},
+	"source":          {text: func(e *LogEntry) string { return e.Source }},
+	"vhost":           {text: func(e *LogEntry) string { return e.VHost }},
+	"country":         {text: func(e *LogEntry) string { return e.Country }},
+	"namespace":       {text: func(e *LogEntry) string { return e.Namespace }},
+	"pod":             {text: func(e *LogEntry) string { return e.Pod }},
+	"container":       {text: func(e *LogEntry) string { return e.Container }},
+	"upstream":        {text: func(e *LogEntry) string { return e.UpstreamName }},
+	"upstream_addr":   {text: func(e *LogEntry) string { return lastUpstream(e).Addr }},
+	"request_id":      {text: func(e *LogEntry) string { return e.RequestID }},
+	"cache":           {text: func(e *LogEntry) string { return e.CacheStatus }},
+	"path":            {text: func(e *LogEntry) string { return requestPath(e.RequestURI) }},
+	"class":           {text: func(e *LogEntry) string { return strconv.Itoa(e.Status/100) + "xx" }},
+	"second":          {text: func(e *LogEntry) string { return e.TimeStamp.Format("2006-01-02 15:04:05") }},
+	"minute":          {text: func(e *LogEntry) string { return e.TimeStamp.Format("2006-01-02 15:04") }},
+	"hour":            {text: func(e *LogEntry) string { return e.TimeStamp.Format("2006-01-02 15:00") }},
+	"day":             {text: func(e *LogEntry) string { return e.TimeStamp.Format("2006-01-02") }},
+	"status":          {number: func(e *LogEntry) float64 { return float64(e.Status) }},
+	"bytes":           {number: func(e *LogEntry) float64 { return float64(e.ResponseSize) }},
+	"rt":              {number: requestDuration},
+	"upstream_time":   {number: func(e *LogEntry) float64 { return e.ResponseTime }},
+	"upstream_status": {number: func(e *LogEntry) float64 { return float64(lastUpstream(e).Status) }},
+	"attempts":        {number: func(e *LogEntry) float64 { return float64(len(e.Upstreams)) }},
+	"request_time":    {number: func(e *LogEntry) float64 { return e.RequestTime }},
+	"connect_time": {number: func(e *LogEntry) float64 {
+		return sumUpstreams(e, func(a UpstreamAttempt) float64 { return a.ConnectTime })
+	}},
+	"header_time": {number: func(e *LogEntry) float64 {
+		return sumUpstreams(e, func(a UpstreamAttempt) float64 { return a.HeaderTime })
+	}},
+}
+
+// filterAliases are longer names for some fields
+var filterAliases = map[string]string{
+	"user_agent":    "ua",
+	"response_time": "rt",
+	"request_uri":   "uri",
+}
+
+// ParseFilter parses an expression. An empty expression returns a nil
+// Filter, which matches everything.
+func ParseFilter(text string) (*Filter, error) {
+	if strings.TrimSpace(text) == "" {
+		return nil, nil
+	}
+	tokens, err := lexFilter(text)
+	if err != nil {
+		return nil, err
+	}
+	p := &filterParser{text: text, tokens: tokens}
+	root, terms, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if tok := p.peek(); tok.kind != tokEOF {
+		return nil, p.errorf(tok, "expected \"and\" or \"or\", got %s", tok)
+	}
+	return &Filter{text: strings.TrimSpace(text), root: root, terms: terms}, nil
+}
+
+// Match reports whether the entry passes the filter
+func (f *Filter) Match(entry *LogEntry) bool {
+	return f == nil || f.root.match(entry)
+}
+
+// String returns the expression the filter was parsed from
+func (f *Filter) String() string {
+	if f == nil {
+		return ""
+	}
+	return f.text
+}
+
+// Terms splits the expression at its top-level and, so each part can be
+// removed on its own. An expression with a top-level or is a single term.
+func (f *Filter) Terms() []string {
+	if f == nil {
+		return nil
+	}
+	if f.terms == nil {
+		return []string{f.text}
+	}
+	return f.terms
+}
+
+// And returns the expression narrowed by term. A term that is already part
+// of the expression isn't added twice.
+func (f *Filter) And(term string) string {
+	switch {
+	case f == nil:
+		return term
+	case slices.Contains(f.Terms(), term):
+		return f.text
+	case f.terms == nil:
+		return "(" + f.text + ") and " + term
+	}
+	return f.text + " and " + term
+}
+
+// Without returns the expression without its i-th term
+func (f *Filter) Without(i int) string {
+	terms := slices.Delete(slices.Clone(f.Terms()), i, i+1)
+	return strings.Join(terms, " and ")
+}
+
+// FilterChip is a term of the active filter with a link that removes it
+type FilterChip struct {
+	Term      string
+	RemoveURL string
+}
+
+// filterChips lists the terms of a page's filter. Removing one keeps the
+// other parameters of the page but starts again at its first page.
+func filterChips(u *url.URL, f *Filter) []FilterChip {
+	var chips []FilterChip
+	for i, term := range f.Terms() {
+		values := u.Query()
+		for key := range values {
+			if key == "page" || strings.HasSuffix(key, ".page") {
+				values.Del(key)
+			}
+		}
+		values.Del("q")
+		if rest := f.Without(i); rest != "" {
+			values.Set("q", rest)
+		}
+		remove := u.Path
+		if len(values) > 0 {
+			remove += "?" + values.Encode()
+		}
+		chips = append(chips, FilterChip{Term: term, RemoveURL: remove})
+	}
+	return chips
+}
+
+// drillURL links to the dashboard of a site narrowed by the given field and
+// value pairs on top of the current filter
+func drillURL(site, filter string, pairs ...any) string {
+	for i := 0; i+1 < len(pairs); i += 2 {
+		// The current filter was parsed before it was shown, and each step
+		// only adds a valid term
+		f, _ := ParseFilter(filter)
+		filter = f.And(filterTerm(fmt.Sprint(pairs[i]), pairs[i+1]))
+	}
+	return "/site/" + url.PathEscape(site) + "?q=" + url.QueryEscape(filter)
+}
+
+// filterTerm builds the comparison field=value, quoting the value
+func filterTerm(field string, value any) string {
+	s := fmt.Sprint(value)
+	if filterFields[field].number != nil {
+		return field + "=" + s
+	}
+	s = strings.ReplaceAll(s, `\`, `\\`)
+	return field + `="` + strings.ReplaceAll(s, `"`, `\"`) + `"`
+}
+
+type filterNode interface {
+	match(entry *LogEntry) bool
+}
+
+type andNode struct{ left, right filterNode }
+
+func (n andNode) match(e *LogEntry) bool { return n.left.match(e) && n.right.match(e) }
+
+type orNode struct{ left, right filterNode }
+
+func (n orNode) match(e *LogEntry) bool { return n.left.match(e) || n.right.match(e) }
+
+type notNode struct{ node filterNode }
+
+func (n notNode) match(e *LogEntry) bool { return !n.node.match(e) }
+
+// textCond compares a text field with one or more values or a regex
+type textCond struct {
+	field  func(*LogEntry) string
+	op     string
+	values []string
+	regex  *regexp.Regexp
+}
+
+func (c textCond) match(e *LogEntry) bool {
+	value := c.field(e)
+	switch c.op {
+	case "~":
+		return c.regex.MatchString(value)
+	case "!~":
+		return !c.regex.MatchString(value)
+	case "!=":
+		return value != c.values[0]
+	default: // = and in
+		for _, v := range c.values {
+			if value == v {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// numberCond compares a numeric field
+type numberCond struct {
+	field  func(*LogEntry) float64
+	op     string
+	values []float64
+}
+
+func (c numberCond) match(e *LogEntry) bool {
+	value := c.field(e)
+	switch c.op {
+	case "<":
+		return value < c.values[0]
+	case "<=":
+		return value <= c.values[0]
+	case ">":
+		return value > c.values[0]
+	case ">=":
+		return value >= c.values[0]
+	case "!=":
+		return value != c.values[0]
+	default: // = and in
+		for _, v := range c.values {
+			if value == v {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// networkCond matches IPs inside any of the prefixes. A masked IP, which is
+// logged as its network, matches when that network lies inside a prefix.
+type networkCond struct {
+	prefixes []netip.Prefix
+}
+
+func (c networkCond) match(e *LogEntry) bool {
+	prefix, err := netip.ParsePrefix(e.IP)
+	if err != nil {
+		addr, err := netip.ParseAddr(e.IP)
+		if err != nil {
+			return false
+		}
+		addr = addr.Unmap()
+		prefix = netip.PrefixFrom(addr, addr.BitLen())
+	}
+	for _, p := range c.prefixes {
+		if prefix.Bits() >= p.Bits() && p.Contains(prefix.Addr()) {
+			return true
+		}
+	}
+	return false
+}
+
+type filterTokenKind int
+
+const (
+	tokEOF filterTokenKind = iota
+	tokWord
+	tokString
+	tokOp
+	tokLParen
+	tokRParen
+	tokComma
+)
+
+type filterToken struct {
+	kind filterTokenKind
+	text string
+	pos  int // byte offset in the expression
+}
+
+func (t filterToken) String() string {
+	switch t.kind {
+	case tokEOF:
+		return "end of filter"
+	case tokString:
+		return strconv.Quote(t.text)
+	default:
+		return fmt.Sprintf("%q", t.text)
+	}
+}
+
+// lexFilter splits an expression into words, quoted strings, operators,
+// parentheses and commas
+func lexFilter(text string) ([]filterToken, error) {
+	var tokens []filterToken
+	for i := 0; i < len(text); {
+		c := text[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			i++
+		case c == '(':
+			tokens = append(tokens, filterToken{tokLParen, "(", i})
+			i++
+		case c == ')':
+			tokens = append(tokens, filterToken{tokRParen, ")", i})
+			i++
+		case c == ',':
+			tokens = append(tokens, filterToken{tokComma, ",", i})
+			i++
+		case c == '"' || c == '\'':
+			s, n, err := lexFilterString(text[i:])
+			if err != nil {
+				return nil, &FilterError{Column: i + 1, Msg: err.Error()}
+			}
+			tokens = append(tokens, filterToken{tokString, s, i})
+			i += n
+		case strings.ContainsRune("=!<>~", rune(c)):
+			op := text[i : i+1]
+			if i+1 < len(text) && (text[i+1] == '=' || text[i+1] == '~') && c != '~' {
+				op = text[i : i+2]
+			}
+			switch op {
+			case "==":
+				tokens = append(tokens, filterToken{tokOp, "=", i})
+			case "=", "!=", "<", "<=", ">", ">=", "~", "!~":
+				tokens = append(tokens, filterToken{tokOp, op, i})
+			default:
+				return nil, &FilterError{Column: i + 1, Msg: fmt.Sprintf("unknown operator %q", op)}
+			}
+			i += len(op)
+		default:
+			j := i
+			for j < len(text) && !strings.ContainsRune(" \t\r\n(),\"'=!<>~", rune(text[j])) {
+				j++
+			}
+			tokens = append(tokens, filterToken{tokWord, text[i:j], i})
+			i = j
+		}
+	}
+	return append(tokens, filterToken{tokEOF, "", len(text)}), nil
+}
+
+// lexFilterString reads a quoted string and returns its value and length
+func lexFilterString(s string) (string, int, error) {
+	quote := s[0]
+	var b strings.Builder
+	for i := 1; i < len(s); i++ {
+		switch s[i] {
+		case quote:
+			return b.String(), i + 1, nil
+		case '\\':
+			// Only the quote and the backslash are escaped, so regexes like
+			// "\d+" can be written as is
+			if i+1 < len(s) && (s[i+1] == quote || s[i+1] == '\\') {
+				i++
+			}
+		}
+		b.WriteByte(s[i])
+	}
+	return "", 0, fmt.Errorf("unterminated string")
+}
+
+type filterParser struct {
+	text   string
+	tokens []filterToken
+	pos    int
+}
+
+func (p *filterParser) peek() filterToken { return p.tokens[p.pos] }
+
+func (p *filterParser) next() filterToken {
+	tok := p.tokens[p.pos]
+	if tok.kind != tokEOF {
+		p.pos++
+	}
+	return tok
+}
+
+// keyword consumes a word matching name, ignoring case
+func (p *filterParser) keyword(name string) bool {
+	if tok := p.peek(); tok.kind == tokWord && strings.EqualFold(tok.text, name) {
+		p.pos++
+		return true
+	}
+	return false
+}
+
+func (p *filterParser) errorf(tok filterToken, format string, args ...any) error {
+	return &FilterError{Column: tok.pos + 1, Msg: fmt.Sprintf(format, args...)}
+}
+
+// parseOr also returns the text of the terms joined by and, or nil when
+// there is an or at this level
+func (p *filterParser) parseOr() (filterNode, []string, error) {
+	left, terms, err := p.parseAnd()
+	if err != nil {
+		return nil, nil, err
+	}
+	for p.keyword("or") {
+		right, _, err := p.parseAnd()
+		if err != nil {
+			return nil, nil, err
+		}
+		left = orNode{left, right}
+		terms = nil
+	}
+	return left, terms, nil
+}
+
+func (p *filterParser) parseAnd() (filterNode, []string, error) {
+	var left filterNode
+	var terms []string
+	for {
+		start := p.peek().pos
+		node, err := p.parseUnary()
+		if err != nil {
+			return nil, nil, err
+		}
+		terms = append(terms, strings.TrimSpace(p.text[start:p.peek().pos]))
+		if left == nil {
+			left = node
+		} else {
+			left = andNode{left, node}
+		}
+		if !p.keyword("and") {
+			return left, terms, nil
+		}
+	}
+}
+
+func (p *filterParser) parseUnary() (filterNode, error) {
+	if p.keyword("not") {
+		node, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return notNode{node}, nil
+	}
+	if tok := p.peek(); tok.kind == tokLParen {
+		p.next()
+		node, _, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if tok := p.next(); tok.kind != tokRParen {
+			return nil, p.errorf(tok, "expected \")\", got %s", tok)
+		}
+		return node, nil
+	}
+	return p.parseComparison()
+}
+
+// parseComparison reads <field> <op> <value> or <field> in <values>
+func (p *filterParser) parseComparison() (filterNode, error) {
+	tok := p.next()
+	if tok.kind != tokWord {
+		return nil, p.errorf(tok, "expected a field name, got %s", tok)
+	}
+	name := strings.ToLower(tok.text)
+	if alias, ok := filterAliases[name]; ok {
+		name = alias
+	}
+	field, ok := filterFields[name]
+	if !ok {
+		return nil, p.errorf(tok, "unknown field %q, use one of %s", tok.text, strings.Join(filterFieldNames(), ", "))
+	}
+
+	opTok := p.next()
+	op := opTok.text
+	switch {
+	case opTok.kind == tokWord && strings.EqualFold(op, "in"):
+		op = "in"
+	case opTok.kind != tokOp:
+		return nil, p.errorf(opTok, "expected an operator after %s (=, !=, <, <=, >, >=, ~, !~ or in), got %s", name, opTok)
+	}
+
+	values, valueToks, err := p.parseValues(op == "in")
+	if err != nil {
+		return nil, err
+	}
+
+	if field.number != nil {
+		if op == "~" || op == "!~" {
+			return nil, p.errorf(opTok, "%s is a number and can't be matched with %s", name, op)
+		}
+		cond := numberCond{field: field.number, op: op}
+		for i, v := range values {
+			n, err := strconv.ParseFloat(v, 64)
+			if err != nil {
+				return nil, p.errorf(valueToks[i], "%s needs a number, got %s", name, valueToks[i])
+			}
+			cond.values = append(cond.values, n)
+		}
+		return cond, nil
+	}
+
+	switch op {
+	case "<", "<=", ">", ">=":
+		return nil, p.errorf(opTok, "%s is text and can't be compared with %s", name, op)
+	case "~", "!~":
+		regex, err := regexp.Compile(values[0])
+		if err != nil {
+			return nil, p.errorf(valueToks[0], "invalid regular expression: %v", err)
+		}
+		return textCond{field: field.text, op: op, regex: regex}, nil
+	case "in":
+		if field.ip && strings.Contains(strings.Join(values, ""), "/") {
+			return p.parseNetworks(values, valueToks)
+		}
+	}
+	return textCond{field: field.text, op: op, values: values}, nil
+}
+
+// parseValues reads a single value, or for "in" also a parenthesized list
+func (p *filterParser) parseValues(list bool) ([]string, []filterToken, error) {
+	value := func() (filterToken, error) {
+		tok := p.next()
+		if tok.kind != tokWord && tok.kind != tokString {
+			return tok, p.errorf(tok, "expected a value, got %s", tok)
+		}
+		return tok, nil
+	}
+
+	if !list || p.peek().kind != tokLParen {
+		tok, err := value()
+		if err != nil {
+			return nil, nil, err
+		}
+		return []string{tok.text}, []filterToken{tok}, nil
+	}
+
+	p.next()
+	var values []string
+	var toks []filterToken
+	for {
+		tok, err := value()
+		if err != nil {
+			return nil, nil, err
+		}
+		values = append(values, tok.text)
+		toks = append(toks, tok)
+		switch sep := p.next(); sep.kind {
+		case tokComma:
+		case tokRParen:
+			return values, toks, nil
+		default:
+			return nil, nil, p.errorf(sep, "expected \",\" or \")\", got %s", sep)
+		}
+	}
+}
+
+// parseNetworks turns the values of ip in ... into prefixes; plain addresses
+// become single-address networks
+func (p *filterParser) parseNetworks(values []string, toks []filterToken) (filterNode, error) {
+	var cond networkCond
+	for i, v := range values {
+		prefix, err := netip.ParsePrefix(v)
+		if err != nil {
+			addr, addrErr := netip.ParseAddr(v)
+			if addrErr != nil {
+				return nil, p.errorf(toks[i], "%s is not an IP address or network", toks[i])
+			}
+			addr = addr.Unmap()
+			prefix = netip.PrefixFrom(addr, addr.BitLen())
+		}
+		cond.prefixes = append(cond.prefixes, prefix.Masked())
+	}
+	return cond, nil
+}
+
+func filterFieldNames() []string {
+	names := make([]string, 0, len(filterFields))
+	for name := range filterFields {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
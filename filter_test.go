@@ -0,0 +1,315 @@
+package main
+
+import (
+	"errors"
+	"net/url"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+var filterTestEntry = LogEntry{
+	IP:           "10.1.2.3",
+	UserID:       "10.1.2.3",
+	TimeStamp:    time.Date(2024, 2, 19, 16, 0, 1, 0, time.UTC),
+	Method:       "POST",
+	RequestURI:   "/api/users/42?tab=orders",
+	Status:       502,
+	ResponseSize: 0,
+	Referer:      "https://example.com/",
+	UserAgent:    `curl/8.0 "quoted"`,
+	ResponseTime: 1.5,
+	Upstreams:    []UpstreamAttempt{{Addr: "10.9.0.1:80", Status: 504}, {Addr: "10.9.0.2:80", Status: 502}},
+}
+
+func TestParseFilter(t *testing.T) {
+	tests := []struct {
+		expr  string
+		match bool
+	}{
+		{"status=502", true},
+		{"status==502", true},
+		{"status!=502", false},
+		{"status>=500", true},
+		{"status>502", false},
+		{"status<502", false},
+		{"status<=502", true},
+		{"rt>1.25", true},
+		{"response_time>1.25", true},
+		{"bytes=0", true},
+		{"method=POST", true},
+		{"method='GET'", false},
+		{"METHOD = \"POST\"", true},
+		{"class=5xx", true},
+		{"path=/api/users/42", true},
+		{"second=\"2024-02-19 16:00:01\"", true},
+		{"ua=\"curl/8.0 \\\"quoted\\\"\"", true},
+		{"user_agent~'^curl/'", true},
+		{`uri~"/users/\d+"`, true},
+		{`request_uri!~"^/api/"`, false},
+		{"method in (GET, HEAD)", false},
+		{"method in (GET,POST)", true},
+		{"method in POST", true},
+		{"status in (500, 502, 504)", true},
+		{"upstream_status=502", true},
+		{"upstream_addr=10.9.0.2:80", true},
+		{"attempts=2", true},
+		{"ip=10.1.2.3", true},
+		{"ip in 10.0.0.0/8", true},
+		{"ip in (192.168.0.0/16, 10.1.2.0/24)", true},
+		{"ip in (192.168.0.0/16, 10.1.2.4)", false},
+		{"ip in 10.1.2.3/32", true},
+		{"ip in 10.1.2.3", true},
+		{"ip in (::ffff:10.1.2.3, 192.0.2.0/24)", true},
+		{"method=GET or status=502", true},
+		{"method=GET and status=502", false},
+		{"method=get AND status=502", false},
+		{"method=POST And status=502", true},
+		{"not method=GET", true},
+		{"NOT not method=GET", false},
+		// and binds tighter than or
+		{"status=502 or method=GET and status=200", true},
+		{"(status=502 or method=GET) and status=200", false},
+		// not binds tighter than and
+		{"not method=GET and status=200", false},
+		{"not (method=GET and status=200)", true},
+		{"((status=502))", true},
+	}
+	for _, tt := range tests {
+		f, err := ParseFilter(tt.expr)
+		if err != nil {
+			t.Errorf("ParseFilter(%q): %v", tt.expr, err)
+			continue
+		}
+		if got := f.Match(&filterTestEntry); got != tt.match {
+			t.Errorf("%q matches %v, want %v", tt.expr, got, tt.match)
+		}
+	}
+}
+
+func TestParseFilterEmpty(t *testing.T) {
+	for _, expr := range []string{"", "  \t"} {
+		f, err := ParseFilter(expr)
+		if f != nil || err != nil {
+			t.Errorf("ParseFilter(%q) = %v, %v", expr, f, err)
+		}
+		if !f.Match(&filterTestEntry) || f.String() != "" || f.Terms() != nil {
+			t.Errorf("nil filter doesn't match everything")
+		}
+	}
+}
+
+func TestFilterMaskedIP(t *testing.T) {
+	// A masked IP is logged as its network and matches the networks holding it
+	entry := LogEntry{IP: "10.1.2.0/24"}
+	tests := map[string]bool{
+		"ip in 10.0.0.0/8":    true,
+		"ip in 10.1.2.0/24":   true,
+		"ip in 10.1.2.0/25":   false,
+		"ip in 10.1.2.3":      false,
+		"ip in 192.0.2.0/24":  false,
+		"ip = '10.1.2.0/24'":  true,
+		"ip in 2001:db8::/32": false,
+	}
+	for expr, want := range tests {
+		f, err := ParseFilter(expr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := f.Match(&entry); got != want {
+			t.Errorf("%q matches %v, want %v", expr, got, want)
+		}
+	}
+}
+
+func TestParseFilterErrors(t *testing.T) {
+	tests := []struct {
+		expr   string
+		column int
+		msg    string
+	}{
+		{"colour=red", 1, `unknown field "colour", use one of `},
+		{"=200", 1, `expected a field name, got "="`},
+		{"not", 4, "expected a field name, got end of filter"},
+		{"status 200", 8, "expected an operator after status"},
+		{"status>=", 9, "expected a value, got end of filter"},
+		{"status=(500)", 8, `expected a value, got "("`},
+		{"method!GET", 7, `unknown operator "!"`},
+		{"status=abc", 8, `status needs a number, got "abc"`},
+		{"status in (500, x)", 17, `status needs a number, got "x"`},
+		{"status~5", 7, "status is a number and can't be matched with ~"},
+		{"uri>5", 4, "uri is text and can't be compared with >"},
+		{`uri~"("`, 5, "invalid regular expression"},
+		{`uri="open`, 5, "unterminated string"},
+		{"ip in (10.0.0.0/8, nope)", 20, `"nope" is not an IP address or network`},
+		{"method in (GET POST)", 16, `expected "," or ")", got "POST"`},
+		{"method in (GET,", 16, "expected a value, got end of filter"},
+		{"method=GET status=200", 12, `expected "and" or "or", got "status"`},
+		{"(status=200", 12, `expected ")", got end of filter`},
+		{"status=200)", 11, `expected "and" or "or", got ")"`},
+		{"status=200 and", 15, "expected a field name, got end of filter"},
+		{"status=200 or or", 15, `unknown field "or"`},
+	}
+	for _, tt := range tests {
+		_, err := ParseFilter(tt.expr)
+		var ferr *FilterError
+		if !errors.As(err, &ferr) {
+			t.Errorf("ParseFilter(%q) error %v, want a FilterError", tt.expr, err)
+			continue
+		}
+		if ferr.Column != tt.column || !strings.HasPrefix(ferr.Msg, tt.msg) {
+			t.Errorf("ParseFilter(%q) error at column %d %q, want column %d %q", tt.expr, ferr.Column, ferr.Msg, tt.column, tt.msg)
+		}
+	}
+}
+
+func TestFilterTerms(t *testing.T) {
+	tests := []struct {
+		expr  string
+		terms []string
+	}{
+		{"status=502", []string{"status=502"}},
+		{" status>=500  and method=POST ", []string{"status>=500", "method=POST"}},
+		{"status>=500 and (method=GET or method=POST) and not ip in 10.0.0.0/8", []string{"status>=500", "(method=GET or method=POST)", "not ip in 10.0.0.0/8"}},
+		{"status>=500 and method=GET or method=POST", []string{"status>=500 and method=GET or method=POST"}},
+	}
+	for _, tt := range tests {
+		f, err := ParseFilter(tt.expr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !slices.Equal(f.Terms(), tt.terms) {
+			t.Errorf("Terms(%q) = %q, want %q", tt.expr, f.Terms(), tt.terms)
+		}
+	}
+}
+
+func TestFilterAndWithout(t *testing.T) {
+	tests := []struct {
+		expr, term string
+		and        string
+		without    string // the result without its last term
+	}{
+		{"", "status=502", "status=502", ""},
+		{"status>=500", "method=POST", "status>=500 and method=POST", "status>=500"},
+		{"status>=500 and method=POST", "method=POST", "status>=500 and method=POST", "status>=500"},
+		{"method=GET or method=POST", "status=502", "(method=GET or method=POST) and status=502", "(method=GET or method=POST)"},
+	}
+	for _, tt := range tests {
+		f, err := ParseFilter(tt.expr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got := f.And(tt.term)
+		if got != tt.and {
+			t.Errorf("%q And %q = %q, want %q", tt.expr, tt.term, got, tt.and)
+		}
+		g, err := ParseFilter(got)
+		if err != nil {
+			t.Fatalf("And produced %q: %v", got, err)
+		}
+		if rest := g.Without(len(g.Terms()) - 1); rest != tt.without {
+			t.Errorf("%q without its last term = %q, want %q", got, rest, tt.without)
+		}
+	}
+
+	f, _ := ParseFilter("status>=500 and method=POST and uri~'^/api/'")
+	for i, want := range []string{"method=POST and uri~'^/api/'", "status>=500 and uri~'^/api/'", "status>=500 and method=POST"} {
+		if got := f.Without(i); got != want {
+			t.Errorf("Without(%d) = %q, want %q", i, got, want)
+		}
+	}
+	if len(f.Terms()) != 3 {
+		t.Errorf("Without changed the filter's terms to %q", f.Terms())
+	}
+}
+
+func TestFilterTermRoundTrip(t *testing.T) {
+	// Any value a log field holds is turned into a term matching it
+	for _, value := range []string{`/a"b`, `C:\path\"x`, `it's`, "and or not ( ) ,", `\`, ""} {
+		term := filterTerm("uri", value)
+		f, err := ParseFilter(term)
+		if err != nil {
+			t.Errorf("filterTerm(%q) = %s: %v", value, term, err)
+			continue
+		}
+		if !f.Match(&LogEntry{RequestURI: value}) || f.Match(&LogEntry{RequestURI: value + "x"}) {
+			t.Errorf("%s doesn't match exactly %q", term, value)
+		}
+	}
+	if got := filterTerm("status", 502); got != "status=502" {
+		t.Errorf("number term %s", got)
+	}
+}
+
+func TestDrillURL(t *testing.T) {
+	tests := []struct {
+		site, filter string
+		pairs        []any
+		want         string
+	}{
+		{"shop", "", []any{"status", 502}, "status=502"},
+		{"shop", "method=POST", []any{"uri", `/a"b`, "status", 502}, `method=POST and uri="/a\"b" and status=502`},
+		{"shop", "status=502", []any{"status", 502}, "status=502"},
+		{"shop", "status=502 or status=504", []any{"ip", "10.0.0.1"}, `(status=502 or status=504) and ip="10.0.0.1"`},
+		{"shop eu/1", "", []any{"ua", "curl"}, `ua="curl"`},
+	}
+	for _, tt := range tests {
+		got := drillURL(tt.site, tt.filter, tt.pairs...)
+		want := "/site/" + url.PathEscape(tt.site) + "?q=" + url.QueryEscape(tt.want)
+		if got != want {
+			t.Errorf("drillURL(%q, %q, %v) = %s, want %s", tt.site, tt.filter, tt.pairs, got, want)
+		}
+		u, _ := url.Parse(got)
+		if _, err := ParseFilter(u.Query().Get("q")); err != nil {
+			t.Errorf("%s: %v", got, err)
+		}
+	}
+}
+
+func TestFilterChips(t *testing.T) {
+	f, _ := ParseFilter("status=502 and method=POST")
+	u, _ := url.Parse("/site/shop?q=x&page=3&uris.page=2&uris.sort=count&context=2")
+	chips := filterChips(u, f)
+	want := []FilterChip{
+		{"status=502", "/site/shop?context=2&q=method%3DPOST&uris.sort=count"},
+		{"method=POST", "/site/shop?context=2&q=status%3D502&uris.sort=count"},
+	}
+	if !slices.Equal(chips, want) {
+		t.Errorf("got %+v\nwant %+v", chips, want)
+	}
+
+	f, _ = ParseFilter("status=502")
+	if chips := filterChips(&url.URL{Path: "/site/shop", RawQuery: "q=status%3D502"}, f); chips[0].RemoveURL != "/site/shop" {
+		t.Errorf("removing the last term links to %s", chips[0].RemoveURL)
+	}
+}
+
+func TestFilterLatency(t *testing.T) {
+	// rt is the request time when it's logged, upstream_time the upstreams'
+	entry := LogEntry{RequestTime: 2, ResponseTime: 0.5}
+	withoutRequestTime := LogEntry{ResponseTime: 0.5}
+	tests := []struct {
+		expr  string
+		entry *LogEntry
+		match bool
+	}{
+		{"rt=2", &entry, true},
+		{"rt>1", &entry, true},
+		{"upstream_time=0.5", &entry, true},
+		{"request_time=2", &entry, true},
+		{"rt=0.5", &withoutRequestTime, true},
+		{"response_time=0.5", &withoutRequestTime, true},
+		{"request_time=0", &withoutRequestTime, true},
+	}
+	for _, tt := range tests {
+		f, err := ParseFilter(tt.expr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := f.Match(tt.entry); got != tt.match {
+			t.Errorf("%q on %+v matches %v", tt.expr, *tt.entry, got)
+		}
+	}
+}
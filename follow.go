@@ -0,0 +1,219 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Follower tails the files of the sources and hands every entry appended
+// after it started to its consumers. It polls instead of relying on inotify
+// so it works the same on every platform and on network filesystems.
+// Streams are followed from their first line, everything piped is new.
+type Follower struct {
+	sources   []*Source
+	interval  time.Duration
+	consumers []func(LogEntry)
+
+	mu      sync.Mutex
+	files   map[*Source][]followedFile
+	lines   map[*Source]int64 // next line number of streams
+	partial map[*Source]*unwrapper
+	done    chan struct{}
+	stopped chan struct{}
+}
+
+// followedFile is how far a file has been read. Files are recognised by
+// identity rather than name, so a file logrotate renamed is finished before
+// its successor is read from the start.
+type followedFile struct {
+	info   os.FileInfo
+	offset int64
+}
+
+// NewFollower creates a follower of the sources
+func NewFollower(sources []*Source) *Follower {
+	return &Follower{
+		sources: sources,
+		files:   make(map[*Source][]followedFile),
+		lines:   make(map[*Source]int64),
+		partial: make(map[*Source]*unwrapper),
+		done:    make(chan struct{}),
+		stopped: make(chan struct{}),
+	}
+}
+
+// Subscribe adds a consumer, called from the follower's goroutine for each
+// new entry. The files are polled at the shortest interval of the
+// consumers. It must be called before Start.
+func (f *Follower) Subscribe(fn func(LogEntry), interval time.Duration) {
+	f.consumers = append(f.consumers, fn)
+	if f.interval == 0 || interval < f.interval {
+		f.interval = interval
+	}
+}
+
+// Start skips what's already in the files and follows them from there on. It
+// does nothing without consumers.
+func (f *Follower) Start() {
+	if len(f.consumers) == 0 {
+		return
+	}
+	for _, src := range f.sources {
+		src.Retain()
+		f.poll(src, true)
+	}
+	go f.run()
+}
+
+// Stop ends the follower after a last poll, so the consumers see everything
+// written until then
+func (f *Follower) Stop() {
+	if len(f.consumers) == 0 {
+		return
+	}
+	close(f.done)
+	<-f.stopped
+	for _, src := range f.sources {
+		f.poll(src, false)
+	}
+}
+
+func (f *Follower) run() {
+	defer close(f.stopped)
+	ticker := time.NewTicker(f.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-f.done:
+			return
+		case <-ticker.C:
+		}
+		for _, src := range f.sources {
+			f.poll(src, false)
+		}
+	}
+}
+
+// poll reads what was appended to the files of src since the last poll. On
+// the first poll the files are only measured.
+func (f *Follower) poll(src *Source, initial bool) {
+	if src.stream != nil {
+		f.pollStream(src)
+		return
+	}
+	names, err := src.Files()
+	if err != nil {
+		log.Printf("Follow: %v", err)
+		return
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	previous := f.files[src]
+	var current []followedFile
+	for _, name := range names {
+		// Compressed files are rotated and complete
+		if strings.HasSuffix(name, ".gz") {
+			continue
+		}
+		info, err := os.Stat(name)
+		if err != nil {
+			continue
+		}
+
+		file := followedFile{info: info}
+		if initial {
+			file.offset = info.Size()
+		}
+		for _, p := range previous {
+			if os.SameFile(p.info, info) {
+				file.offset = p.offset
+				break
+			}
+		}
+		// Truncated in place, e.g. by logrotate's copytruncate
+		if file.offset > info.Size() {
+			file.offset = 0
+		}
+		if !initial && file.offset < info.Size() {
+			offset, err := f.readFrom(src, name, file.offset)
+			if err != nil {
+				log.Printf("Follow: %s: %v", name, err)
+			}
+			file.offset = offset
+		}
+		current = append(current, file)
+	}
+	f.files[src] = current
+}
+
+// pollStream passes the lines received since the last poll to the consumers
+func (f *Follower) pollStream(src *Source) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	lines, next := src.stream.since(f.lines[src])
+	f.lines[src] = next
+	// Split container lines may continue in the next poll
+	u := f.partial[src]
+	if u == nil {
+		u = newUnwrapper(src.Container)
+		f.partial[src] = u
+	}
+	for _, raw := range lines {
+		line, ok := u.line(raw)
+		if !ok {
+			continue
+		}
+		if entry, ok := src.parseLine(src.Path, line); ok {
+			for _, fn := range f.consumers {
+				fn(entry)
+			}
+		}
+	}
+}
+
+// readFrom passes the complete lines after offset to the consumers and
+// returns the offset after the last of them. A line still being written, or
+// a container line the runtime split and hasn't finished, is read again on
+// the next poll.
+func (f *Follower) readFrom(src *Source, name string, offset int64) (int64, error) {
+	file, err := os.Open(name)
+	if err != nil {
+		return offset, err
+	}
+	defer file.Close()
+	if _, err := file.Seek(offset, io.SeekStart); err != nil {
+		return offset, err
+	}
+
+	reader := bufio.NewReaderSize(file, 64*1024)
+	u := newUnwrapper(src.Container)
+	complete := offset
+	for {
+		raw, err := reader.ReadString('\n')
+		if err == io.EOF {
+			return complete, nil
+		}
+		if err != nil {
+			return complete, err
+		}
+		offset += int64(len(raw))
+		line, ok := u.line(strings.TrimRight(raw, "\r\n"))
+		if !u.pending {
+			complete = offset
+		}
+		if !ok {
+			continue
+		}
+		if entry, ok := src.parseLine(name, line); ok {
+			for _, fn := range f.consumers {
+				fn(entry)
+			}
+		}
+	}
+}
@@ -0,0 +1,504 @@
+package main
+
+import (
+	"cmp"
+	"fmt"
+	"net/url"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// groupDimensions are the fields entries can be grouped by: the text fields
+// of filters and the status code, so every group can be drilled into
+var groupDimensions = func() map[string]func(*LogEntry) string {
+	dims := map[string]func(*LogEntry) string{
+		"status": func(e *LogEntry) string { return strconv.Itoa(e.Status) },
+	}
+	for name, field := range filterFields {
+		if field.text != nil {
+			dims[name] = field.text
+		}
+	}
+	return dims
+}()
+
+// groupMetrics are the values computed for each group besides percentiles,
+// which are written as p<N> like p95 or p99.9
+var groupMetrics = []string{"count", "bytes", "avg_rt", "max_rt", "distinct_ips"}
+
+// maxGroups bounds the memory of a grouping; entries that would start a new
+// group past the limit are counted in a single "(other)" group
+const maxGroups = 100000
+
+// groupOther is the key of the group collecting entries past maxGroups
+const groupOther = "(other)"
+
+// GroupQuery selects the dimensions, metrics and page of a grouping
+type GroupQuery struct {
+	Dimensions []string
+	Metrics    []string
+	Sort       string // a metric or "key"
+	Order      string
+	Limit      int
+	Page       int
+}
+
+// parseGroupQuery reads by, metrics, sort, order, limit and page. By default
+// requests are counted and sorted by the first metric, largest first.
+func parseGroupQuery(values url.Values, topN int) (GroupQuery, error) {
+	q := GroupQuery{
+		Dimensions: splitList(values.Get("by")),
+		Metrics:    splitList(values.Get("metrics")),
+		Sort:       values.Get("sort"),
+		Order:      values.Get("order"),
+	}
+	if len(q.Dimensions) == 0 {
+		return q, fmt.Errorf("by needs at least one of %s", strings.Join(groupDimensionNames(), ", "))
+	}
+	for _, dim := range q.Dimensions {
+		if _, ok := groupDimensions[dim]; !ok {
+			return q, fmt.Errorf("unknown dimension %q, use one of %s", dim, strings.Join(groupDimensionNames(), ", "))
+		}
+	}
+	if len(q.Metrics) == 0 {
+		q.Metrics = []string{"count"}
+	}
+	for _, metric := range q.Metrics {
+		if _, ok := parsePercentile(metric); !ok && !slices.Contains(groupMetrics, metric) {
+			return q, fmt.Errorf("unknown metric %q, use one of %s or p<N> like p95", metric, strings.Join(groupMetrics, ", "))
+		}
+	}
+
+	switch {
+	case q.Sort == "":
+		q.Sort = q.Metrics[0]
+	case q.Sort != sortByKey && !slices.Contains(q.Metrics, q.Sort):
+		return q, fmt.Errorf("sort must be %q or one of the metrics", sortByKey)
+	}
+	switch q.Order {
+	case "":
+		q.Order = orderDesc
+	case orderAsc, orderDesc:
+	default:
+		return q, fmt.Errorf("order must be %q or %q", orderAsc, orderDesc)
+	}
+
+	var err error
+	if q.Limit, err = parsePositive(values, "limit"); err != nil {
+		return q, err
+	}
+	if q.Limit == 0 {
+		q.Limit = topN
+	}
+	q.Limit = min(q.Limit, maxTableLimit)
+	if q.Page, err = parsePositive(values, "page"); err != nil {
+		return q, err
+	}
+	q.Page = max(q.Page, 1)
+	return q, nil
+}
+
+// splitList splits a comma separated parameter, dropping empty items
+func splitList(s string) []string {
+	var items []string
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(strings.ToLower(item)); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// parsePercentile reads metrics like p95 or p99.9
+func parsePercentile(metric string) (float64, bool) {
+	if !strings.HasPrefix(metric, "p") {
+		return 0, false
+	}
+	p, err := strconv.ParseFloat(metric[1:], 64)
+	if err != nil || p <= 0 || p > 100 {
+		return 0, false
+	}
+	return p, true
+}
+
+func groupDimensionNames() []string {
+	names := make([]string, 0, len(groupDimensions))
+	for name := range groupDimensions {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// requestPath strips the query string of a request URI
+func requestPath(uri string) string {
+	if i := strings.IndexByte(uri, '?'); i >= 0 {
+		return uri[:i]
+	}
+	return uri
+}
+
+// groupAcc accumulates the entries of one group. Response times and IPs are
+// only kept when a metric needs them.
+type groupAcc struct {
+	keys      []string
+	count     int
+	bytes     int64
+	rtSum     float64
+	rtMax     float64
+	latencies []float64
+	ips       map[string]struct{}
+}
+
+// grouper aggregates entries by the dimensions of a query
+type grouper struct {
+	query        GroupQuery
+	groups       map[string]*groupAcc
+	keepLatency  bool
+	keepIPs      bool
+	truncated    bool
+	keyBuilder   strings.Builder
+	dimensionFns []func(*LogEntry) string
+}
+
+func newGrouper(q GroupQuery) *grouper {
+	g := &grouper{query: q, groups: make(map[string]*groupAcc)}
+	for _, dim := range q.Dimensions {
+		g.dimensionFns = append(g.dimensionFns, groupDimensions[dim])
+	}
+	for _, metric := range q.Metrics {
+		if _, ok := parsePercentile(metric); ok {
+			g.keepLatency = true
+		}
+		if metric == "distinct_ips" {
+			g.keepIPs = true
+		}
+	}
+	return g
+}
+
+// Add counts an entry in its group
+func (g *grouper) Add(entry *LogEntry) {
+	g.keyBuilder.Reset()
+	for i, fn := range g.dimensionFns {
+		if i > 0 {
+			g.keyBuilder.WriteByte(0)
+		}
+		g.keyBuilder.WriteString(fn(entry))
+	}
+	key := g.keyBuilder.String()
+
+	acc, ok := g.groups[key]
+	if !ok {
+		keys := strings.Split(key, "\x00")
+		if len(g.groups) >= maxGroups {
+			g.truncated = true
+			key = groupOther
+			for i := range keys {
+				keys[i] = groupOther
+			}
+		}
+		if acc, ok = g.groups[key]; !ok {
+			acc = &groupAcc{keys: keys}
+			if g.keepIPs {
+				acc.ips = make(map[string]struct{})
+			}
+			g.groups[key] = acc
+		}
+	}
+
+	acc.count++
+	acc.bytes += int64(entry.ResponseSize)
+	duration := requestDuration(entry)
+	acc.rtSum += duration
+	acc.rtMax = max(acc.rtMax, duration)
+	if g.keepLatency {
+		acc.latencies = append(acc.latencies, duration)
+	}
+	if g.keepIPs {
+		acc.ips[entry.IP] = struct{}{}
+	}
+}
+
+// value computes a metric of a group whose latencies are sorted
+func (acc *groupAcc) value(metric string) float64 {
+	switch metric {
+	case "count":
+		return float64(acc.count)
+	case "bytes":
+		return float64(acc.bytes)
+	case "avg_rt":
+		return acc.rtSum / float64(acc.count)
+	case "max_rt":
+		return acc.rtMax
+	case "distinct_ips":
+		return float64(len(acc.ips))
+	}
+	p, _ := parsePercentile(metric)
+	return percentile(acc.latencies, p)
+}
+
+// formatMetric renders a metric value for the pivot table
+func formatMetric(metric string, v float64) string {
+	switch metric {
+	case "count", "distinct_ips":
+		return formatNumberWithCommas(int(v))
+	case "bytes":
+		return formatBytes(int64(v))
+	}
+	return strconv.FormatFloat(v, 'f', 3, 64)
+}
+
+// GroupRow is one group with its metrics in the order of the query
+type GroupRow struct {
+	Keys    []string  `json:"keys"`
+	Values  []float64 `json:"values"`
+	Display []string  `json:"-"`
+}
+
+// PivotTable crosses the first two dimensions for the first metric
+type PivotTable struct {
+	Columns []string
+	Rows    []PivotRow
+}
+
+// PivotRow is a row of the pivot table, with one cell per column
+type PivotRow struct {
+	Key   string
+	Cells []string
+}
+
+// maxPivotColumns keeps the pivot table readable; the columns with the most
+// requests are shown
+const maxPivotColumns = 20
+
+// GroupReport is the result of a grouping, one page of rows
+type GroupReport struct {
+	Dimensions []string   `json:"dimensions"`
+	Metrics    []string   `json:"metrics"`
+	Rows       []GroupRow `json:"rows"`
+	Total      int        `json:"total"` // groups in the full result
+	Page       int        `json:"page"`
+	Pages      int        `json:"pages"`
+	Limit      int        `json:"limit"`
+	Sort       string     `json:"sort"`
+	Order      string     `json:"order"`
+	Truncated  bool       `json:"truncated,omitempty"` // more than maxGroups groups
+	Date       string     `json:"date"`
+	Source     string     `json:"source"`
+	Filter     string     `json:"filter,omitempty"`
+	Stats      ParseStats `json:"-"` // lines read from the sources
+
+	Pivot  *PivotTable  `json:"-"`
+	Chips  []FilterChip `json:"-"`
+	Links  GroupLinks   `json:"-"`
+	Params GroupParams  `json:"-"`
+	Sites  []string     `json:"-"`
+	User   *User        `json:"-"`
+	Fields GroupChoices `json:"-"`
+}
+
+// GroupParams are the raw parameters echoed back into the group form
+type GroupParams struct {
+	By, Metrics string
+}
+
+// GroupChoices lists what the group form accepts
+type GroupChoices struct {
+	Dimensions []string
+	Metrics    []string
+}
+
+// buildGroupReport reads the sources and groups the entries between start and
+// end. Like buildReport, fields are masked before grouping and filtering.
+func buildGroupReport(sources []*Source, start, end time.Time, opts ReportOptions, q GroupQuery) (*GroupReport, error) {
+	g := newGrouper(q)
+	var total ParseStats
+	var names []string
+	for _, src := range sources {
+		stats, err := src.ReadEntries(func(entry LogEntry) {
+			if entry.TimeStamp.Before(start) || entry.TimeStamp.After(end) {
+				return
+			}
+			opts.Mask.Apply(&entry)
+			if !opts.Filter.Match(&entry) {
+				return
+			}
+			g.Add(&entry)
+		})
+		if err != nil {
+			return nil, err
+		}
+		total.Lines += stats.Lines
+		total.Parsed += stats.Parsed
+		total.Failed += stats.Failed
+		names = append(names, src.Name)
+	}
+
+	report := &GroupReport{
+		Dimensions: q.Dimensions,
+		Metrics:    q.Metrics,
+		Total:      len(g.groups),
+		Limit:      q.Limit,
+		Sort:       q.Sort,
+		Order:      q.Order,
+		Truncated:  g.truncated,
+		Date:       fmt.Sprintf("%s - %s", start.Format(rangeLayout), end.Format(rangeLayout)),
+		Source:     strings.Join(names, ","),
+		Filter:     opts.Filter.String(),
+		Stats:      total,
+		Params:     GroupParams{By: strings.Join(q.Dimensions, ","), Metrics: strings.Join(q.Metrics, ",")},
+		Fields:     GroupChoices{Dimensions: groupDimensionNames(), Metrics: append(slices.Clone(groupMetrics), "p50", "p95", "p99")},
+	}
+
+	rows := make([]GroupRow, 0, len(g.groups))
+	for _, acc := range g.groups {
+		slices.Sort(acc.latencies)
+		row := GroupRow{Keys: acc.keys}
+		for _, metric := range q.Metrics {
+			v := acc.value(metric)
+			row.Values = append(row.Values, v)
+			row.Display = append(row.Display, formatMetric(metric, v))
+		}
+		rows = append(rows, row)
+	}
+	sortIndex := slices.Index(q.Metrics, q.Sort)
+	slices.SortFunc(rows, func(a, b GroupRow) int {
+		c := 0
+		if sortIndex >= 0 {
+			c = cmp.Compare(a.Values[sortIndex], b.Values[sortIndex])
+		}
+		if c == 0 {
+			c = slices.Compare(a.Keys, b.Keys)
+		}
+		if q.Order == orderDesc {
+			c = -c
+		}
+		return c
+	})
+
+	if len(q.Dimensions) == 2 {
+		report.Pivot = pivot(rows, q)
+	}
+
+	report.Pages = max(1, (len(rows)+q.Limit-1)/q.Limit)
+	report.Page = min(q.Page, report.Pages)
+	first := min((report.Page-1)*q.Limit, len(rows))
+	report.Rows = rows[first:min(first+q.Limit, len(rows))]
+	return report, nil
+}
+
+// pivot lays out the sorted rows with the first dimension down and the second
+// across. Rows follow the sort order, columns are the values of the second
+// dimension with the most requests in the first metric.
+func pivot(rows []GroupRow, q GroupQuery) *PivotTable {
+	metric := q.Metrics[0]
+	columnTotals := make(map[string]float64)
+	cells := make(map[[2]string]float64)
+	var rowKeys []string
+	seenRow := make(map[string]bool)
+	for _, row := range rows {
+		r, c := row.Keys[0], row.Keys[1]
+		columnTotals[c] += row.Values[0]
+		cells[[2]string{r, c}] = row.Values[0]
+		if !seenRow[r] && len(rowKeys) < q.Limit {
+			seenRow[r] = true
+			rowKeys = append(rowKeys, r)
+		}
+	}
+
+	columns := make([]string, 0, len(columnTotals))
+	for c := range columnTotals {
+		columns = append(columns, c)
+	}
+	slices.SortFunc(columns, func(a, b string) int {
+		if c := cmp.Compare(columnTotals[b], columnTotals[a]); c != 0 {
+			return c
+		}
+		return cmp.Compare(a, b)
+	})
+	columns = columns[:min(len(columns), maxPivotColumns)]
+
+	table := &PivotTable{Columns: columns}
+	for _, r := range rowKeys {
+		row := PivotRow{Key: r}
+		for _, c := range columns {
+			cell := ""
+			if v, ok := cells[[2]string{r, c}]; ok {
+				cell = formatMetric(metric, v)
+			}
+			row.Cells = append(row.Cells, cell)
+		}
+		table.Rows = append(table.Rows, row)
+	}
+	return table
+}
+
+// GroupLinks are the pagination and sorting links of a group page
+type GroupLinks struct {
+	First, Prev, Next, Last string
+	SortKey                 string
+	SortMetrics             []string // one per metric
+}
+
+// groupURL links to a group page of a site
+func groupURL(site, filter string, q GroupQuery) string {
+	values := url.Values{}
+	if filter != "" {
+		values.Set("q", filter)
+	}
+	values.Set("by", strings.Join(q.Dimensions, ","))
+	values.Set("metrics", strings.Join(q.Metrics, ","))
+	values.Set("sort", q.Sort)
+	values.Set("order", q.Order)
+	values.Set("limit", strconv.Itoa(q.Limit))
+	values.Set("page", strconv.Itoa(q.Page))
+	return "/site/" + url.PathEscape(site) + "/group?" + values.Encode()
+}
+
+// groupLinks builds the links of a group page
+func groupLinks(report *GroupReport) GroupLinks {
+	q := GroupQuery{
+		Dimensions: report.Dimensions,
+		Metrics:    report.Metrics,
+		Sort:       report.Sort,
+		Order:      report.Order,
+		Limit:      report.Limit,
+		Page:       report.Page,
+	}
+	at := func(p int) string {
+		q := q
+		q.Page = p
+		return groupURL(report.Source, report.Filter, q)
+	}
+
+	var links GroupLinks
+	if report.Page > 1 {
+		links.First = at(1)
+		links.Prev = at(report.Page - 1)
+	}
+	if report.Page < report.Pages {
+		links.Next = at(report.Page + 1)
+		links.Last = at(report.Pages)
+	}
+
+	// Clicking the current sort column flips the order
+	sortLink := func(by string) string {
+		s := q
+		s.Page = 1
+		s.Sort = by
+		s.Order = orderDesc
+		if q.Sort == by && q.Order == orderDesc {
+			s.Order = orderAsc
+		}
+		return groupURL(report.Source, report.Filter, s)
+	}
+	links.SortKey = sortLink(sortByKey)
+	for _, metric := range report.Metrics {
+		links.SortMetrics = append(links.SortMetrics, sortLink(metric))
+	}
+	return links
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseGroupQuery(t *testing.T) {
+	tests := []struct {
+		query string
+		want  GroupQuery
+	}{
+		{"by=path", GroupQuery{Dimensions: []string{"path"}, Metrics: []string{"count"}, Sort: "count", Order: orderDesc, Limit: 10, Page: 1}},
+		{"by=Method,+status,&metrics=p99.9,avg_rt&sort=avg_rt&order=asc&limit=5000&page=3",
+			GroupQuery{Dimensions: []string{"method", "status"}, Metrics: []string{"p99.9", "avg_rt"}, Sort: "avg_rt", Order: orderAsc, Limit: maxTableLimit, Page: 3}},
+		{"by=ip&sort=key", GroupQuery{Dimensions: []string{"ip"}, Metrics: []string{"count"}, Sort: sortByKey, Order: orderDesc, Limit: 10, Page: 1}},
+	}
+	for _, tt := range tests {
+		values, _ := url.ParseQuery(tt.query)
+		q, err := parseGroupQuery(values, 10)
+		if err != nil {
+			t.Errorf("%s: %v", tt.query, err)
+			continue
+		}
+		if !slices.Equal(q.Dimensions, tt.want.Dimensions) || !slices.Equal(q.Metrics, tt.want.Metrics) ||
+			q.Sort != tt.want.Sort || q.Order != tt.want.Order || q.Limit != tt.want.Limit || q.Page != tt.want.Page {
+			t.Errorf("%s: %+v, want %+v", tt.query, q, tt.want)
+		}
+	}
+}
+
+func TestParseGroupQueryErrors(t *testing.T) {
+	tests := []struct {
+		query, err string
+	}{
+		{"", "by needs at least one of"},
+		{"by=,", "by needs at least one of"},
+		{"by=colour", `unknown dimension "colour"`},
+		{"by=path&metrics=median", `unknown metric "median"`},
+		{"by=path&metrics=p0", `unknown metric "p0"`},
+		{"by=path&metrics=p101", `unknown metric "p101"`},
+		{"by=path&metrics=count&sort=bytes", `sort must be "key" or one of the metrics`},
+		{"by=path&order=up", `order must be "asc" or "desc"`},
+		{"by=path&limit=0", "limit must be a positive number"},
+		{"by=path&page=x", "page must be a positive number"},
+	}
+	for _, tt := range tests {
+		values, _ := url.ParseQuery(tt.query)
+		_, err := parseGroupQuery(values, 10)
+		if err == nil || !strings.HasPrefix(err.Error(), tt.err) {
+			t.Errorf("%q: error %v, want %q", tt.query, err, tt.err)
+		}
+	}
+}
+
+func TestGrouperMetrics(t *testing.T) {
+	g := newGrouper(GroupQuery{Dimensions: []string{"path"}, Metrics: []string{"count", "bytes", "avg_rt", "max_rt", "distinct_ips", "p50"}})
+	for i, e := range []LogEntry{
+		{RequestURI: "/a?x=1", IP: "10.0.0.1", ResponseSize: 100, RequestTime: 0.1, ResponseTime: 9},
+		{RequestURI: "/a", IP: "10.0.0.1", ResponseSize: 200, RequestTime: 0.2},
+		{RequestURI: "/a?y", IP: "10.0.0.2", ResponseSize: 300, RequestTime: 0.6},
+		{RequestURI: "/b", IP: "10.0.0.3", ResponseSize: 50, ResponseTime: 1},
+	} {
+		e.TimeStamp = time.Unix(int64(i), 0)
+		g.Add(&e)
+	}
+	tests := map[string][]float64{
+		// Latency is the request time, the upstream time without it
+		"/a": {3, 600, 0.3, 0.6, 2, 0.2},
+		"/b": {1, 50, 1, 1, 1, 1},
+	}
+	if len(g.groups) != len(tests) {
+		t.Fatalf("%d groups", len(g.groups))
+	}
+	for key, want := range tests {
+		acc := g.groups[key]
+		slices.Sort(acc.latencies)
+		for i, metric := range g.query.Metrics {
+			if got := acc.value(metric); fmt.Sprintf("%.6f", got) != fmt.Sprintf("%.6f", want[i]) {
+				t.Errorf("%s %s = %v, want %v", key, metric, got, want[i])
+			}
+		}
+	}
+
+	// Latencies and IPs are only kept for metrics needing them
+	g = newGrouper(GroupQuery{Dimensions: []string{"path"}, Metrics: []string{"count", "avg_rt"}})
+	g.Add(&LogEntry{RequestURI: "/a", IP: "10.0.0.1", RequestTime: 1})
+	if acc := g.groups["/a"]; acc.latencies != nil || acc.ips != nil {
+		t.Errorf("kept %v and %v", acc.latencies, acc.ips)
+	}
+}
+
+func TestGrouperTruncates(t *testing.T) {
+	g := newGrouper(GroupQuery{Dimensions: []string{"uri", "method"}, Metrics: []string{"count"}})
+	for i := range maxGroups + 5 {
+		g.Add(&LogEntry{RequestURI: "/" + strconv.Itoa(i), Method: "GET"})
+	}
+	// Existing groups keep counting past the limit
+	g.Add(&LogEntry{RequestURI: "/0", Method: "GET"})
+
+	if !g.truncated || len(g.groups) != maxGroups+1 {
+		t.Fatalf("truncated %v with %d groups", g.truncated, len(g.groups))
+	}
+	if acc := g.groups[groupOther]; acc.count != 5 || !slices.Equal(acc.keys, []string{groupOther, groupOther}) {
+		t.Errorf("other group %+v", acc)
+	}
+	if acc := g.groups["/0\x00GET"]; acc.count != 2 {
+		t.Errorf("first group counted %d", acc.count)
+	}
+}
+
+func TestBuildGroupReport(t *testing.T) {
+	var lines []string
+	add := func(n int, request string, status int) {
+		for i := range n {
+			lines = append(lines, fmt.Sprintf(`10.0.0.1 - - [19/Feb/2024:16:%02d:00 +0000] "%s HTTP/1.1" %d 1 "-" "curl" 0.1 - - - -`, len(lines)+i, request, status))
+		}
+	}
+	add(5, "GET /a", 200)
+	add(2, "GET /b", 404)
+	add(3, "POST /a", 200)
+	add(1, "POST /a", 500)
+	src := newTestSource(t, lines)
+	start := time.Date(2024, 2, 19, 16, 0, 0, 0, time.UTC)
+
+	build := func(query string) *GroupReport {
+		t.Helper()
+		values, _ := url.ParseQuery(query)
+		q, err := parseGroupQuery(values, 10)
+		if err != nil {
+			t.Fatal(err)
+		}
+		report, err := buildGroupReport([]*Source{src}, start, start.Add(time.Hour), ReportOptions{}, q)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return report
+	}
+	rowKeys := func(report *GroupReport) []string {
+		var keys []string
+		for _, row := range report.Rows {
+			keys = append(keys, fmt.Sprint(row.Keys, row.Display))
+		}
+		return keys
+	}
+
+	report := build("by=method,status&limit=2&page=2")
+	if got, want := rowKeys(report), []string{"[GET 404] [2]", "[POST 500] [1]"}; !slices.Equal(got, want) {
+		t.Errorf("page 2: %q, want %q", got, want)
+	}
+	if report.Total != 4 || report.Page != 2 || report.Pages != 2 || report.Stats.Parsed != 11 {
+		t.Errorf("report %+v", report)
+	}
+
+	// The pivot crosses the rows of every page, columns with the most
+	// requests first
+	want := &PivotTable{
+		Columns: []string{"200", "404", "500"},
+		Rows:    []PivotRow{{"GET", []string{"5", "2", ""}}, {"POST", []string{"3", "", "1"}}},
+	}
+	if got := report.Pivot; fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("pivot %+v, want %+v", got, want)
+	}
+
+	report = build("by=method,status&sort=key&order=asc")
+	if got, want := rowKeys(report), []string{"[GET 200] [5]", "[GET 404] [2]", "[POST 200] [3]", "[POST 500] [1]"}; !slices.Equal(got, want) {
+		t.Errorf("by key: %q, want %q", got, want)
+	}
+
+	// Pages past the end show the last one, a single dimension has no pivot
+	report = build("by=path&page=9")
+	if got, want := rowKeys(report), []string{"[/a] [9]", "[/b] [2]"}; !slices.Equal(got, want) || report.Page != 1 || report.Pivot != nil {
+		t.Errorf("by path: %q, page %d, pivot %v", got, report.Page, report.Pivot)
+	}
+}
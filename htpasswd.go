@@ -0,0 +1,148 @@
+package main
+
+import (
+	"bufio"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// Htpasswd holds the users loaded from an Apache style htpasswd file
+type Htpasswd struct {
+	users map[string]string
+}
+
+// LoadHtpasswd reads an htpasswd file. Only the {SHA} and $apr1$ schemes are
+// supported because they can be verified with the standard library; create
+// entries with `htpasswd -m` or `htpasswd -s`.
+func LoadHtpasswd(path string) (*Htpasswd, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	h := &Htpasswd{users: make(map[string]string)}
+	scanner := bufio.NewScanner(file)
+	lineNo := 0
+	for scanner.Scan() {
+		lineNo++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		user, hash, ok := strings.Cut(line, ":")
+		if !ok || user == "" {
+			return nil, fmt.Errorf("%s:%d: expected user:hash", path, lineNo)
+		}
+		switch {
+		case strings.HasPrefix(hash, "{SHA}"), strings.HasPrefix(hash, "$apr1$"):
+		case strings.HasPrefix(hash, "$2"):
+			return nil, fmt.Errorf("%s:%d: bcrypt hashes are not supported, use htpasswd -m or -s", path, lineNo)
+		default:
+			return nil, fmt.Errorf("%s:%d: unsupported hash format for user %q", path, lineNo, user)
+		}
+		h.users[user] = hash
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return h, nil
+}
+
+// Verify reports whether password matches the stored hash for user
+func (h *Htpasswd) Verify(user, password string) bool {
+	hash, ok := h.users[user]
+	if !ok {
+		// Burn roughly the same time as a real check so unknown users can't be
+		// told apart from wrong passwords.
+		apr1Crypt(password, "dummysal")
+		return false
+	}
+
+	var computed string
+	switch {
+	case strings.HasPrefix(hash, "{SHA}"):
+		sum := sha1.Sum([]byte(password))
+		computed = "{SHA}" + base64.StdEncoding.EncodeToString(sum[:])
+	case strings.HasPrefix(hash, "$apr1$"):
+		salt, _, _ := strings.Cut(strings.TrimPrefix(hash, "$apr1$"), "$")
+		computed = apr1Crypt(password, salt)
+	}
+	return subtle.ConstantTimeCompare([]byte(computed), []byte(hash)) == 1
+}
+
+// apr1Crypt implements the Apache variant of the MD5 based crypt(3) scheme
+func apr1Crypt(password, salt string) string {
+	const magic = "$apr1$"
+	const itoa64 = "./0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz"
+
+	if len(salt) > 8 {
+		salt = salt[:8]
+	}
+	pw := []byte(password)
+
+	alt := md5.New()
+	alt.Write(pw)
+	alt.Write([]byte(salt))
+	alt.Write(pw)
+	altSum := alt.Sum(nil)
+
+	ctx := md5.New()
+	ctx.Write(pw)
+	ctx.Write([]byte(magic))
+	ctx.Write([]byte(salt))
+	for i := len(pw); i > 0; i -= 16 {
+		ctx.Write(altSum[:min(i, 16)])
+	}
+	for i := len(pw); i > 0; i >>= 1 {
+		if i&1 != 0 {
+			ctx.Write([]byte{0})
+		} else {
+			ctx.Write(pw[:1])
+		}
+	}
+	final := ctx.Sum(nil)
+
+	for i := 0; i < 1000; i++ {
+		round := md5.New()
+		if i&1 != 0 {
+			round.Write(pw)
+		} else {
+			round.Write(final)
+		}
+		if i%3 != 0 {
+			round.Write([]byte(salt))
+		}
+		if i%7 != 0 {
+			round.Write(pw)
+		}
+		if i&1 != 0 {
+			round.Write(final)
+		} else {
+			round.Write(pw)
+		}
+		final = round.Sum(nil)
+	}
+
+	out := make([]byte, 0, 22)
+	to64 := func(v uint32, n int) {
+		for ; n > 0; n-- {
+			out = append(out, itoa64[v&0x3f])
+			v >>= 6
+		}
+	}
+	b := func(i int) uint32 { return uint32(final[i]) }
+	to64(b(0)<<16|b(6)<<8|b(12), 4)
+	to64(b(1)<<16|b(7)<<8|b(13), 4)
+	to64(b(2)<<16|b(8)<<8|b(14), 4)
+	to64(b(3)<<16|b(9)<<8|b(15), 4)
+	to64(b(4)<<16|b(10)<<8|b(5), 4)
+	to64(b(11), 2)
+
+	return magic + salt + "$" + string(out)
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestApr1Crypt(t *testing.T) {
+	// Hashes from `openssl passwd -apr1 -salt <salt> <password>`
+	tests := []struct {
+		password, salt, want string
+	}{
+		{"password", "saltsalt", "$apr1$saltsalt$yAAkm4libquA.ZWLHbSBq/"},
+		{"pass word!", "r31.....", "$apr1$r31.....$cL4n81qLKAbdB9vrqvIE1/"},
+		{"password", "saltsaltlonger", "$apr1$saltsalt$yAAkm4libquA.ZWLHbSBq/"},
+	}
+	for _, tt := range tests {
+		if got := apr1Crypt(tt.password, tt.salt); got != tt.want {
+			t.Errorf("apr1Crypt(%q, %q) = %q, want %q", tt.password, tt.salt, got, tt.want)
+		}
+	}
+}
+
+func writeTestFile(t *testing.T, name, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestHtpasswdVerify(t *testing.T) {
+	h, err := LoadHtpasswd(writeTestFile(t, "htpasswd", `# users
+alice:$apr1$saltsalt$yAAkm4libquA.ZWLHbSBq/
+bob:{SHA}W6ph5Mm5Pz8GgiULbPgzG37mj9g=
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		user, password string
+		want           bool
+	}{
+		{"alice", "password", true},
+		{"alice", "Password", false},
+		{"alice", "", false},
+		{"bob", "password", true},
+		{"bob", "password ", false},
+		{"carol", "password", false},
+	}
+	for _, tt := range tests {
+		if got := h.Verify(tt.user, tt.password); got != tt.want {
+			t.Errorf("Verify(%q, %q) = %v, want %v", tt.user, tt.password, got, tt.want)
+		}
+	}
+}
+
+func TestLoadHtpasswdErrors(t *testing.T) {
+	tests := []struct {
+		content, err string
+	}{
+		{"alice:$2y$05$abcdefghijklmnopqrstuv\n", "bcrypt"},
+		{"alice:plain\n", "unsupported hash format"},
+		{"alice\n", "expected user:hash"},
+		{":{SHA}W6ph5Mm5Pz8GgiULbPgzG37mj9g=\n", "expected user:hash"},
+	}
+	for _, tt := range tests {
+		_, err := LoadHtpasswd(writeTestFile(t, "htpasswd", tt.content))
+		if err == nil || !strings.Contains(err.Error(), tt.err) {
+			t.Errorf("LoadHtpasswd(%q) error %v, want %q", tt.content, err, tt.err)
+		}
+	}
+}
@@ -3,15 +3,15 @@ package main
 import (
 	"bufio"
 	"encoding/csv"
+	"encoding/json"
 	"flag"
 	"fmt"
+	"io"
 	"log"
 	"net/http"
 	"os"
-	"regexp"
-	"sort"
 	"strconv"
-	"text/template"
+	"strings"
 	"time"
 )
 
@@ -22,579 +22,229 @@ type LogEntry struct {
 	TimeStamp    time.Time `json:"timestamp"`
 	Method       string    `json:"method"`
 	RequestURI   string    `json:"request_uri"`
+	Protocol     string    `json:"protocol,omitempty"`
 	Status       int       `json:"status"`
 	ResponseSize int       `json:"response_size"`
+	Referer      string    `json:"referer,omitempty"`
 	UserAgent    string    `json:"user_agent"`
-	ResponseTime float64   `json:"response_time"`
+	ResponseTime float64   `json:"response_time"`          // $upstream_response_time, of all attempts
+	RequestTime  float64   `json:"request_time,omitempty"` // $request_time, from the first byte read from the client to the last byte sent
+	Source       string    `json:"source"`
+	VHost        string    `json:"vhost,omitempty"`
+	Country      string    `json:"country,omitempty"`
+	Namespace    string    `json:"namespace,omitempty"` // Kubernetes pod of container logs
+	Pod          string    `json:"pod,omitempty"`
+	Container    string    `json:"container,omitempty"`
+
+	UpstreamName string            `json:"upstream_name,omitempty"` // $proxy_upstream_name, namespace-service-port on ingress-nginx
+	Upstreams    []UpstreamAttempt `json:"upstreams,omitempty"`     // servers tried in order, the last one answered
+	RequestID    string            `json:"request_id,omitempty"`
+	CacheStatus  string            `json:"cache_status,omitempty"` // $upstream_cache_status, empty when the request skipped the cache
 }
 
 func main() {
-	// Replace with the actual path to your Nginx log file
-	filePath := "siap-koja.jambikota.go.id.log"
-	// Replace with the desired start and end dates in "2006-01-02 15:04:05" format
-	startDateStr := "2024-02-19 16:00:00"
-	endDateStr := "2024-02-19 18:00:59"
-
-	// Define command-line flags
-	inputFilePath := flag.String("input", filePath, "Path to the input Nginx log file")
-	outputFilePath := flag.String("output", "nginx_access.csv", "Path to the output CSV file")
-	flag.Parse()
-
-	// Call the convertToCSV function
-	err := convertToCSV(*inputFilePath, *outputFilePath)
-	if err != nil {
-		log.Fatal(err)
+	// Without a command, or with flags only, the viewer converts the logs
+	// and then serves the dashboard like it always did
+	if len(os.Args) < 2 || strings.HasPrefix(os.Args[1], "-") {
+		os.Exit(legacyCommand(os.Args[1:]))
+	}
+	name := os.Args[1]
+	if name == "help" {
+		os.Exit(helpCommand(os.Args[2:]))
+	}
+	cmd, ok := findCommand(name)
+	if !ok {
+		fmt.Fprintf(os.Stderr, "unknown command %q\n\n", name)
+		printUsage(os.Stderr)
+		os.Exit(exitUsage)
 	}
+	os.Exit(cmd.run(os.Args[2:]))
+}
 
-	startDateTime, err := time.Parse("2006-01-02 15:04:05", startDateStr)
-	if err != nil {
-		fmt.Println("Error parsing start date:", err)
-		return
+// legacyCommand runs the viewer without a command: convert to CSV unless the
+// output is empty, then serve
+func legacyCommand(args []string) int {
+	cfg := DefaultConfig()
+	fs := flag.NewFlagSet(programName(), flag.ContinueOnError)
+	fs.Usage = func() { printUsage(fs.Output()) }
+
+	// Command-line flags override the config file and environment
+	configFile := fs.String("config", os.Getenv("NLV_CONFIG"), "Path to the TOML config file (default $NLV_CONFIG)")
+	inputFilePath := fs.String("input", "", "Path to the input Nginx log file, replaces the configured sources")
+	fs.StringVar(&cfg.CSVOutput, "output", cfg.CSVOutput, "Path to the output CSV file, empty to skip the conversion")
+	filterText := fs.String("filter", "", `Only convert entries matching this filter, e.g. status>=500 and uri~"^/api/"`)
+	addRangeFlags(fs, cfg)
+	addServerFlags(fs, cfg)
+	if err := fs.Parse(args); err != nil {
+		return exitUsage
 	}
+	log.Printf("Running without a command is deprecated, use %s serve and %s convert", programName(), programName())
 
-	endDateTime, err := time.Parse("2006-01-02 15:04:05", endDateStr)
+	sources := loadServeConfig(fs, cfg, *configFile, *inputFilePath)
+	filter, err := ParseFilter(*filterText)
 	if err != nil {
-		fmt.Println("Error parsing end date:", err)
-		return
+		log.Fatal(err)
 	}
-
-	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
-		// Open the log file
-		file, err := os.Open(filePath)
-		if err != nil {
-			http.Error(w, "Error opening file", http.StatusInternalServerError)
-			return
-		}
-		defer file.Close()
-
-		// Create a regular expression to parse the Nginx log format
-		// logRegex := regexp.MustCompile(`^(\S+) \S+ \S+ \[([^\]]+)\] "(\S+) (\S+) \S+" (\d+) \d+ "([^"]+)" "([^"]+)"`)
-		logRegex := regexp.MustCompile(`^(\S+) - \[([^\]]+)\] "(\S+) (\S+) (\S+)" (\d+) (\d+) - "([^"]+)" - (\d+\.\d+)$`)
-
-		// Track the number of requests per second, RequestURIs, requests per minute, total requests, and RequestURIs per second
-		requestsPerSecond := make(map[string]int)
-		requestURICounts := make(map[string]int)
-		requestsPerMinute := make(map[string]int)
-		totalRequests := 0
-		requestURIsPerSecond := make(map[string]map[string]int)
-		userAgentCounts := make(map[string]int)
-		statusCodeCounts := make(map[int]int)
-		httpStatusCodes := make(map[int]map[string]int)
-		topResponseTimes := make([]LogEntry, 0, 10)
-		requestIPCounts := make(map[string]int)
-		// Create a scanner to read the file line by line
-		scanner := bufio.NewScanner(file)
-
-		// Iterate through each line in the log file
-		for scanner.Scan() {
-			line := scanner.Text()
-
-			// Use the regular expression to extract relevant information
-			matches := logRegex.FindStringSubmatch(line)
-			if matches != nil {
-				timestamp, err := time.Parse("02/Jan/2006:15:04:05 +0700", matches[2])
-				if err != nil {
-					fmt.Println("Error parsing timestamp:", err)
-					continue
-				}
-
-				// Check if the entry's date matches the desired date range
-				if timestamp.Before(startDateTime) || timestamp.After(endDateTime) {
-					continue
-				}
-
-				entry := LogEntry{
-					// IP:         matches[1],
-					// TimeStamp:  timestamp,
-					// Method:     matches[3],
-					// RequestURI: truncateString(matches[4], 100), // Limit RequestURI to 200 characters
-					// Status:     atoi(matches[5]),
-					// UserAgent:  matches[7],
-					IP:           matches[1],
-					UserID:       matches[1], // Assuming user ID is the same as IP, change accordingly
-					TimeStamp:    timestamp,
-					Method:       matches[3],
-					RequestURI:   truncateString(matches[4], 100), // Limit RequestURI to 200 characters
-					Status:       atoi(matches[6]),
-					ResponseSize: atoi(matches[7]),
-					UserAgent:    matches[8],
-					ResponseTime: atof(matches[9]),
-				}
-
-				// Count requests per second
-				secondKey := entry.TimeStamp.Format("2006-01-02 15:04:05")
-				requestsPerSecond[secondKey]++
-
-				// Count RequestURIs
-				requestURICounts[entry.RequestURI]++
-
-				// Count RequestURIs
-				requestIPCounts[entry.IP]++
-
-				// Count requests per minute
-				minuteKey := entry.TimeStamp.Format("2006-01-02 15:04")
-				requestsPerMinute[minuteKey]++
-
-				// Increment total requests
-				totalRequests++
-
-				// Count RequestURIs per second
-				if _, ok := requestURIsPerSecond[secondKey]; !ok {
-					requestURIsPerSecond[secondKey] = make(map[string]int)
-				}
-				requestURIsPerSecond[secondKey][entry.RequestURI]++
-
-				// Count RequestURIs per second
-				if _, ok := requestURIsPerSecond[secondKey]; !ok {
-					requestURIsPerSecond[secondKey] = make(map[string]int)
-				}
-				requestURIsPerSecond[secondKey][entry.RequestURI]++
-
-				// Count User Agents
-				userAgentCounts[entry.UserAgent]++
-
-				// Count Status Codes
-				statusCodeCounts[entry.Status]++
-
-				// Count http response status codes and corresponding RequestURIs
-				if _, ok := httpStatusCodes[entry.Status]; !ok {
-					httpStatusCodes[entry.Status] = make(map[string]int)
-				}
-				httpStatusCodes[entry.Status][entry.RequestURI]++
-
-				// Track top response times
-				if len(topResponseTimes) < 10 || entry.ResponseTime > topResponseTimes[9].ResponseTime {
-					topResponseTimes = append(topResponseTimes, entry)
-					// Sort top response times
-					sort.Slice(topResponseTimes, func(i, j int) bool {
-						return topResponseTimes[i].ResponseTime > topResponseTimes[j].ResponseTime
-					})
-					// Keep only the top 10
-					if len(topResponseTimes) > 10 {
-						topResponseTimes = topResponseTimes[:10]
-					}
-				}
-			}
-		}
-
-		// Sort requests per second in descending order
-		sortedKeys := make([]string, 0, len(requestsPerSecond))
-		for key := range requestsPerSecond {
-			sortedKeys = append(sortedKeys, key)
-		}
-		sort.Slice(sortedKeys, func(i, j int) bool {
-			return requestsPerSecond[sortedKeys[i]] > requestsPerSecond[sortedKeys[j]]
-		})
-
-		// Sort RequestURIs in descending order
-		sortedURIs := make([]string, 0, len(requestURICounts))
-		for uri := range requestURICounts {
-			sortedURIs = append(sortedURIs, uri)
-		}
-		sort.Slice(sortedURIs, func(i, j int) bool {
-			return requestURICounts[sortedURIs[i]] > requestURICounts[sortedURIs[j]]
-		})
-
-		// Sort RequestURIs in descending order
-		sortedAPI := make([]string, 0, len(requestIPCounts))
-		for ip := range requestIPCounts {
-			sortedAPI = append(sortedAPI, ip)
-		}
-		sort.Slice(sortedAPI, func(i, j int) bool {
-			return requestIPCounts[sortedAPI[i]] > requestIPCounts[sortedAPI[j]]
-		})
-
-		// Sort requests per minute in descending order
-		sortedMinutes := make([]string, 0, len(requestsPerMinute))
-		for minute := range requestsPerMinute {
-			sortedMinutes = append(sortedMinutes, minute)
-		}
-		sort.Slice(sortedMinutes, func(i, j int) bool {
-			return requestsPerMinute[sortedMinutes[i]] > requestsPerMinute[sortedMinutes[j]]
-		})
-
-		// Sort User Agents in descending order
-		sortedUserAgents := make([]string, 0, len(userAgentCounts))
-		for userAgent := range userAgentCounts {
-			sortedUserAgents = append(sortedUserAgents, userAgent)
-		}
-		sort.Slice(sortedUserAgents, func(i, j int) bool {
-			return userAgentCounts[sortedUserAgents[i]] > userAgentCounts[sortedUserAgents[j]]
-		})
-
-		// Sort Status Codes in descending order
-		sortedStatusCodes := make([]int, 0, len(statusCodeCounts))
-		for code := range statusCodeCounts {
-			sortedStatusCodes = append(sortedStatusCodes, code)
-		}
-		sort.Slice(sortedStatusCodes, func(i, j int) bool {
-			return sortedStatusCodes[i] > sortedStatusCodes[j]
-		})
-
-		// Prepare data for the template
-		type ViewData struct {
-			HttpStatusCodes      map[int]map[string]int
-			HttpStatusCodesSlice []struct {
-				StatusCode int
-				URIs       map[string]int
-			}
-			Date                      string
-			TopRequestsPerSecond      map[string]int
-			TopRequestsPerSecondSlice []struct {
-				Timestamp string
-				Count     int
-				URIs      map[string]int
-			}
-			TopRequestURIs      map[string]int
-			TopRequestURIsSlice []struct {
-				RequestURI string
-				Count      int
-			}
-
-			TopRequestIP       map[string]int
-			TopRequestAPISlice []struct {
-				IP    string
-				Count int
+	if cfg.CSVOutput != "" {
+		// Converting would read the piped log to its end before the
+		// dashboard could retain it
+		for _, src := range sources {
+			if src.stream != nil {
+				log.Printf("Source %s is piped and can't be both converted and served, use %s serve or -output \"\"", src.Name, programName())
+				return exitUsage
 			}
-			RequestsPerMinute      map[string]int
-			RequestsPerMinuteSlice []struct {
-				Minute string
-				Count  int
-			}
-			UserAgentCounts      map[string]int
-			UserAgentCountsSlice []struct {
-				UserAgent string
-				Count     int
-			}
-			TotalRequests          int
-			TotalRequestsFormatted string
-
-			StatusCodeCounts      map[int]int
-			StatusCodeCountsSlice []struct {
-				StatusCode int
-				Count      int
-			}
-			TopResponseTimes []LogEntry
 		}
-
-		viewData := ViewData{
-			Date:                 fmt.Sprintf("%s - %s", startDateTime.Format("2006-01-02 15:04:05"), endDateTime.Format("2006-01-02 15:04:05")),
-			TopRequestsPerSecond: requestsPerSecond,
-			TopRequestsPerSecondSlice: []struct {
-				Timestamp string
-				Count     int
-				URIs      map[string]int
-			}{},
-			TopRequestURIs: requestURICounts,
-			TopRequestURIsSlice: []struct {
-				RequestURI string
-				Count      int
-			}{},
-
-			TopRequestIP: requestIPCounts,
-			TopRequestAPISlice: []struct {
-				IP    string
-				Count int
-			}{},
-
-			RequestsPerMinute: requestsPerMinute,
-			RequestsPerMinuteSlice: []struct {
-				Minute string
-				Count  int
-			}{},
-			UserAgentCounts: userAgentCounts,
-			UserAgentCountsSlice: []struct {
-				UserAgent string
-				Count     int
-			}{},
-			TotalRequests:          totalRequests,
-			TotalRequestsFormatted: formatNumberWithCommas(totalRequests),
-
-			StatusCodeCounts: statusCodeCounts,
-			StatusCodeCountsSlice: []struct {
-				StatusCode int
-				Count      int
-			}{},
-
-			HttpStatusCodes: httpStatusCodes,
-			HttpStatusCodesSlice: []struct {
-				StatusCode int
-				URIs       map[string]int
-			}{},
-			TopResponseTimes: topResponseTimes,
-		}
-
-		// Populate the slice for the template (Top Requests Per Second)
-		for i, key := range sortedKeys {
-			if i >= 10 {
-				break
-			}
-			viewData.TopRequestsPerSecondSlice = append(viewData.TopRequestsPerSecondSlice, struct {
-				Timestamp string
-				Count     int
-				URIs      map[string]int
-			}{Timestamp: key, Count: requestsPerSecond[key], URIs: requestURIsPerSecond[key]})
+		if _, err := convertLogs(sources, cfg.CSVOutput, "csv", filter); err != nil {
+			log.Fatal(err)
 		}
+	}
+	serve(cfg, sources)
+	return exitOK
+}
 
-		// Populate the slice for the template (Top RequestURIs)
-		for i, uri := range sortedURIs {
-			if i >= 10 {
-				break
-			}
-			viewData.TopRequestURIsSlice = append(viewData.TopRequestURIsSlice, struct {
-				RequestURI string
-				Count      int
-			}{RequestURI: uri, Count: requestURICounts[uri]})
-		}
+// serveCommand implements `serve`
+func serveCommand(args []string) int {
+	cfg := DefaultConfig()
+	fs := newFlagSet("serve")
+	configFile := fs.String("config", os.Getenv("NLV_CONFIG"), "Path to the TOML config file (default $NLV_CONFIG)")
+	input := fs.String("input", "", "Path to an Nginx log file, replaces the configured sources")
+	addRangeFlags(fs, cfg)
+	addServerFlags(fs, cfg)
+	if err := fs.Parse(args); err != nil {
+		return exitUsage
+	}
 
-		// Populate the slice for the template (Top RequestURIs)
-		for i, ip := range sortedAPI {
-			if i >= 10 {
-				break
-			}
-			viewData.TopRequestAPISlice = append(viewData.TopRequestAPISlice, struct {
-				IP    string
-				Count int
-			}{IP: ip, Count: requestIPCounts[ip]})
-		}
+	serve(cfg, loadServeConfig(fs, cfg, *configFile, *input))
+	return exitOK
+}
 
-		// Populate the slice for the template (Requests Per Minute)
-		for i, minute := range sortedMinutes {
-			if i >= 10 {
-				break
-			}
-			viewData.RequestsPerMinuteSlice = append(viewData.RequestsPerMinuteSlice, struct {
-				Minute string
-				Count  int
-			}{Minute: minute, Count: requestsPerMinute[minute]})
-		}
+// addServerFlags registers the flags of the web server and authentication
+func addServerFlags(fs *flag.FlagSet, cfg *Config) {
+	fs.IntVar(&cfg.TopN, "top", cfg.TopN, "Rows shown in each table")
+
+	// Authentication flags, the dashboard is open when none of them are set
+	fs.StringVar(&cfg.Auth.HtpasswdFile, "htpasswd", "", "Path to an htpasswd file enabling basic auth")
+	fs.StringVar(&cfg.Auth.TokenFile, "auth-tokens", "", "Path to a file of API bearer tokens (name:token per line)")
+	fs.StringVar(&cfg.Auth.OIDC.Issuer, "oidc-issuer", "", "OpenID Connect issuer URL enabling browser login")
+	fs.StringVar(&cfg.Auth.OIDC.ClientID, "oidc-client-id", "", "OpenID Connect client id")
+	fs.StringVar(&cfg.Auth.OIDC.ClientSecret, "oidc-client-secret", "", "OpenID Connect client secret (default $OIDC_CLIENT_SECRET)")
+	fs.StringVar(&cfg.Auth.OIDC.RedirectURL, "oidc-redirect-url", cfg.Auth.OIDC.RedirectURL, "OpenID Connect redirect URL, must end in /auth/callback")
+	fs.DurationVar(&cfg.Auth.SessionTTL, "session-ttl", cfg.Auth.SessionTTL, "Lifetime of a login session")
+	fs.StringVar(&cfg.Auth.RolesFile, "roles", "", "Path to a JSON file restricting sources and fields per user or group")
+
+	// Server flags
+	fs.StringVar(&cfg.Server.Listen, "listen", cfg.Server.Listen, "Address to listen on, host:port or unix:/path/to/socket")
+	fs.StringVar(&cfg.Server.TLSCert, "tls-cert", "", "TLS certificate file, reloaded automatically when it changes")
+	fs.StringVar(&cfg.Server.TLSKey, "tls-key", "", "TLS private key file")
+	fs.DurationVar(&cfg.Server.ReadTimeout, "read-timeout", cfg.Server.ReadTimeout, "Maximum duration for reading a request")
+	fs.DurationVar(&cfg.Server.WriteTimeout, "write-timeout", cfg.Server.WriteTimeout, "Maximum duration for writing a response, including building the report")
+	fs.DurationVar(&cfg.Server.IdleTimeout, "idle-timeout", cfg.Server.IdleTimeout, "How long idle keep-alive connections are kept open")
+	fs.DurationVar(&cfg.Server.ShutdownTimeout, "shutdown-timeout", cfg.Server.ShutdownTimeout, "How long to wait for in-flight requests on shutdown")
+}
 
-		// Populate the slice for the template (User Agent Counts)
-		for i, userAgent := range sortedUserAgents {
-			if i >= 10 {
-				break
-			}
-			viewData.UserAgentCountsSlice = append(viewData.UserAgentCountsSlice, struct {
-				UserAgent string
-				Count     int
-			}{UserAgent: userAgent, Count: userAgentCounts[userAgent]})
+// loadServeConfig loads and validates the config of the server, exiting on
+// errors
+func loadServeConfig(fs *flag.FlagSet, cfg *Config, configFile, input string) []*Source {
+	if err := loadConfig(fs, cfg, configFile); err != nil {
+		log.Fatal(err)
+	}
+	if input != "" {
+		cfg.Sources = []SourceConfig{{Path: input}}
+		cfg.fillSourceDefaults()
+	}
+	if cfg.Auth.OIDC.ClientSecret == "" {
+		cfg.Auth.OIDC.ClientSecret = os.Getenv("OIDC_CLIENT_SECRET")
+	}
+	if errs := cfg.Validate(); len(errs) > 0 {
+		for _, err := range errs {
+			log.Print(err)
 		}
+		os.Exit(exitError)
+	}
 
-		// Populate the slice for the template (HTTP Status Code Counts)
-		for i, code := range sortedStatusCodes {
-			if i >= 10 {
-				break
-			}
-			viewData.StatusCodeCountsSlice = append(viewData.StatusCodeCountsSlice, struct {
-				StatusCode int
-				Count      int
-			}{StatusCode: code, Count: statusCodeCounts[code]})
-		}
+	sources, err := cfg.BuildSources()
+	if err != nil {
+		log.Fatal(err)
+	}
+	return sources
+}
 
-		for code, uris := range httpStatusCodes {
-			if code != 200 {
-				viewData.HttpStatusCodesSlice = append(viewData.HttpStatusCodesSlice, struct {
-					StatusCode int
-					URIs       map[string]int
-				}{StatusCode: code, URIs: uris})
-			}
+// serve runs the dashboard and the followers of the logs until the server
+// shuts down
+func serve(cfg *Config, sources []*Source) {
+	// Piped sources are kept in memory, reports show what arrived so far
+	for _, src := range sources {
+		src.Retain()
+	}
 
-		}
+	auth, err := NewAuth(cfg.Auth)
+	if err != nil {
+		log.Fatal(err)
+	}
 
-		// Render the template
-		tmpl, err := template.New("index").Parse(`
-		<!DOCTYPE html>
-		<html lang="en">
-		<head>
-			<meta charset="UTF-8">
-			<meta name="viewport" content="width=device-width, initial-scale=1.0">
-			<title>Nginx Log Analysis Dashboard</title>
-			<link href="https://cdn.jsdelivr.net/npm/tailwindcss@2.2.19/dist/tailwind.min.css" rel="stylesheet">
-		</head>
-		<body class="bg-gray-100">
-		
-			<div class="container mx-auto p-4">
-		
-				<h1 class="text-3xl font-bold text-blue-700 mt-8 mb-4">Log Analysis Dashboard</h1>
-		
-				<h2 class="text-2xl font-bold text-blue-700 mb-4">Date Range: {{.Date}}</h2>
-		
-
-				<p class="mb-4 font-bold">Total Requests: {{.TotalRequests}}</p>
-		
-				<h3 class="text-xl font-bold text-blue-700 mb-4">Top 10 Requests Per Second for {{.Date}}</h3>
-				<table class="border border-collapse border-blue-500 w-full">
-					<tr class="bg-blue-200">
-						<th class="border border-blue-500 px-4 py-2">Timestamp</th>
-						<th class="border border-blue-500 px-4 py-2">Request</th>
-						<th class="border border-blue-500 px-4 py-2">RequestURIs (Grouped)</th>
-					</tr>
-					{{range .TopRequestsPerSecondSlice}}
-					<tr>
-						<td class="border border-blue-500 px-4 py-2">{{.Timestamp}}</td>
-						<td class="border border-blue-500 px-4 py-2">{{.Count}}</td>
-						<td class="border border-blue-500 px-4 py-2">
-							<table class="border border-collapse border-blue-500 w-full">
-								<tr class="bg-blue-100">
-									<th class="border border-blue-500 px-4 py-2">RequestURI</th>
-									<th class="border border-blue-500 px-4 py-2">Request</th>
-								</tr>
-								{{range $uri, $count := .URIs}}
-								<tr>
-									<td class="border border-blue-500 px-4 py-2">{{$uri}}</td>
-									<td class="border border-blue-500 px-4 py-2">{{$count}}</td>
-								</tr>
-								{{end}}
-							</table>
-						</td>
-					</tr>
-					{{end}}
-				</table>
-		
-				<h3 class="text-xl font-bold text-blue-700 mt-8 mb-4">Top 10 Request URL for {{.Date}} </h3>
-				<table class="border border-collapse border-blue-500 w-full">
-					<tr class="bg-blue-200">
-						<th class="border border-blue-500 px-4 py-2">RequestURI</th>
-						<th class="border border-blue-500 px-4 py-2">Request</th>
-					</tr>
-					{{range .TopRequestURIsSlice}}
-					<tr>
-						<td class="border border-blue-500 px-4 py-2">{{.RequestURI}}</td>
-						<td class="border border-blue-500 px-4 py-2">{{.Count}}</td>
-					</tr>
-					{{end}}
-				</table>
-
-				<h3 class="text-xl font-bold text-blue-700 mt-8 mb-4">Top 10 Request IP for {{.Date}} </h3>
-				<table class="border border-collapse border-blue-500 w-full">
-					<tr class="bg-blue-200">
-						<th class="border border-blue-500 px-4 py-2">IP</th>
-						<th class="border border-blue-500 px-4 py-2">Request</th>
-					</tr>
-					{{range .TopRequestAPISlice}}
-					<tr>
-						<td class="border border-blue-500 px-4 py-2">{{.IP}}</td>
-						<td class="border border-blue-500 px-4 py-2">{{.Count}}</td>
-					</tr>
-					{{end}}
-				</table>
-		
-				<h3 class="text-xl font-bold text-blue-700 mt-8 mb-4">Top 10 Requests Per Minute for {{.Date}}</h3>
-				<table class="border border-collapse border-blue-500 w-full">
-					<tr class="bg-blue-200">
-						<th class="border border-blue-500 px-4 py-2">Minute</th>
-						<th class="border border-blue-500 px-4 py-2">Request</th>
-					</tr>
-					{{range .RequestsPerMinuteSlice}}
-					<tr>
-						<td class="border border-blue-500 px-4 py-2">{{.Minute}}</td>
-						<td class="border border-blue-500 px-4 py-2">{{.Count}}</td>
-					</tr>
-					{{end}}
-				</table>
-		
-				<h3 class="text-xl font-bold text-blue-700 mt-8 mb-4">Toop 10 User Agent Request for {{.Date}}</h3>
-				<table class="border border-collapse border-blue-500 w-full">
-					<tr class="bg-blue-200">
-						<th class="border border-blue-500 px-4 py-2">User Agent</th>
-						<th class="border border-blue-500 px-4 py-2">Request</th>
-					</tr>
-					{{range .UserAgentCountsSlice}}
-					<tr>
-						<td class="border border-blue-500 px-4 py-2">{{.UserAgent}}</td>
-						<td class="border border-blue-500 px-4 py-2">{{.Count}}</td>
-					</tr>
-					{{end}}
-				</table>
-
-				
-				<h3 class="text-xl font-bold text-blue-700 mt-8 mb-4">HTTP Status Code Request for {{.Date}}</h1>
-
-				<table class="border border-collapse border-blue-500 w-full">
-					<tr class="bg-blue-200">
-						<th class="border border-blue-500 px-4 py-2">Status Code</th>
-						<th class="border border-blue-500 px-4 py-2">Request</th>
-					</tr>
-					{{range .StatusCodeCountsSlice}}
-					<tr>
-						<td class="border border-blue-500 px-4 py-2">{{.StatusCode}}</td>
-						<td class="border border-blue-500 px-4 py-2">{{.Count}}</td>
-					</tr>
-					{{end}}
-				</table>
-
-				<h3 class="text-xl font-bold text-blue-700 mt-8 mb-4">Failed HTTP Status Codes for {{.Date}}</h1>
-
-				<table class="border border-collapse border-blue-500 w-full">
-					<tr class="bg-blue-200">
-						<th class="border border-blue-500 px-4 py-2">Status Code</th>
-						<th class="border border-blue-500 px-4 py-2">RequestURIs (Grouped)</th>
-					</tr>
-					{{range .HttpStatusCodesSlice}}
-					<tr>
-						<td class="border border-blue-500 px-4 py-2">{{.StatusCode}}</td>
-						<td class="border border-blue-500 px-4 py-2">
-							<table class="border border-collapse border-blue-500 w-full">
-								<tr class="bg-blue-100">
-									<th class="border border-blue-500 px-4 py-2">RequestURI</th>
-									<th class="border border-blue-500 px-4 py-2">Request</th>
-								</tr>
-								{{range $uri, $count := .URIs}}
-								<tr>
-									<td class="border border-blue-500 px-4 py-2">{{$uri}}</td>
-									<td class="border border-blue-500 px-4 py-2">{{$count}}</td>
-								</tr>
-								{{end}}
-							</table>
-						</td>
-					</tr>
-					{{end}}
-				</table>
-
-				<h3 class="text-xl font-bold text-blue-700 my-4">Top 10 Slow Response Times</h3>
-			<table class="border border-collapse border-blue-500 w-full">
-				<tr class="bg-blue-200">
-					<th class="border border-blue-500 px-4 py-2">Timestamp</th>
-					<th class="border border-blue-500 px-4 py-2">IP</th>
-					<th class="border border-blue-500 px-4 py-2">RequestURI</th>
-					<th class="border border-blue-500 px-4 py-2">Status</th>
-					<th class="border border-blue-500 px-4 py-2">Response Size</th>
-					<th class="border border-blue-500 px-4 py-2">User Agent</th>
-					<th class="border border-blue-500 px-4 py-2">Response Time</th>
-				</tr>
-				{{range .TopResponseTimes}}
-				<tr>
-					<td class="border border-blue-500 px-4 py-2">{{.TimeStamp.Format "2006-01-02 15:04:05"}}</td>
-					<td class="border border-blue-500 px-4 py-2">{{.IP}}</td>
-					<td class="border border-blue-500 px-4 py-2">{{.RequestURI}}</td>
-					<td class="border border-blue-500 px-4 py-2">{{.Status}}</td>
-					<td class="border border-blue-500 px-4 py-2">{{.ResponseSize}}</td>
-					<td class="border border-blue-500 px-4 py-2">{{.UserAgent}}</td>
-					<td class="border border-blue-500 px-4 py-2">{{printf "%.3f" .ResponseTime}}</td>
-				</tr>
-				{{end}}
-			</table>
-		
-			</div>
-		
-		</body>
-		</html>
-		`)
+	var roles *RolesConfig
+	if cfg.Auth.RolesFile != "" {
+		roles, err = LoadRoles(cfg.Auth.RolesFile)
 		if err != nil {
-			http.Error(w, "Error rendering template", http.StatusInternalServerError)
-			return
+			log.Fatal(err)
 		}
+	}
 
-		err = tmpl.Execute(w, viewData)
-		if err != nil {
-			http.Error(w, "Error executing template", http.StatusInternalServerError)
-			return
+	// Alerts, metrics, sinks and rollups follow the lines appended to the logs
+	alerts, err := NewAlertEngine(cfg.Alerts, sources)
+	if err != nil {
+		log.Fatal(err)
+	}
+	metrics := NewMetrics(cfg.Metrics)
+	sinks, err := NewSinks(cfg.Sinks)
+	if err != nil {
+		log.Fatal(err)
+	}
+	rollups, err := NewRollups(cfg.Rollups)
+	if err != nil {
+		log.Fatal(err)
+	}
+	follower := NewFollower(sources)
+	if alerts != nil {
+		follower.Subscribe(alerts.Observe, cfg.Alerts.Interval)
+		alerts.Start()
+		defer alerts.Stop()
+	}
+	if metrics != nil {
+		follower.Subscribe(metrics.Observe, cfg.Metrics.Interval)
+	}
+	for _, sink := range sinks {
+		if err := sink.Start(); err != nil {
+			log.Fatal(err)
 		}
-	})
+		defer sink.Stop()
+		follower.Subscribe(sink.Observe, sink.FlushInterval())
+	}
+	for _, rollup := range rollups {
+		rollup.Start()
+		defer rollup.Stop()
+		follower.Subscribe(rollup.Observe, rollup.PollInterval())
+	}
+	follower.Start()
+	defer follower.Stop()
+
+	mux := http.NewServeMux()
+	auth.RegisterRoutes(mux)
+	NewApp(cfg, sources, roles, alerts, metrics).Routes(mux)
 
 	// Start the web server
-	fmt.Println("Server is running on http://localhost:8080")
-	http.ListenAndServe(":8080", nil)
+	if err := runServer(cfg.Server, auth.Middleware(mux)); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// writeJSON sends v as the JSON response body
+func writeJSON(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Printf("Error encoding JSON response: %v", err)
+	}
 }
 
 // atoi is a helper function to convert a string to an integer
@@ -641,59 +291,92 @@ func formatNumberWithCommas(n int) string {
 	return string(result)
 }
 
-func convertToCSV(inputFilePath string, outputFilePath string) error {
-	// Open the Nginx log file
-	file, err := os.Open(inputFilePath)
-	if err != nil {
-		return err
-	}
-	defer file.Close()
-
-	// Create a CSV file
-	csvFile, err := os.Create(outputFilePath)
-	if err != nil {
-		return err
-	}
-	defer csvFile.Close()
-
-	// Create a CSV writer
-	writer := csv.NewWriter(csvFile)
-	defer writer.Flush()
-
-	// Define a regular expression for common Nginx log format
-	nginxLogRegex := regexp.MustCompile(`^([\d.]+) - \[(\d{2}/\w+/\d{4}:\d{2}:\d{2}:\d{2} [+\-\d]+)\] "(GET|POST|PUT|DELETE) ([^"]+)" (\d+) (\d+) - "([^"]+)" - (\d+\.\d+)$`)
+// csvHeader are the columns of the converted CSV
+var csvHeader = []string{"Source", "IP", "User", "Time", "Method", "RequestURI", "Protocol", "Status", "BytesSent", "Referer", "UserAgent", "ResponseTime"}
 
-	// Write CSV header
-	header := []string{"IP", "User", "Time", "Request", "Status", "BytesSent", "Referer", "UserAgent"}
-	err = writer.Write(header)
-	if err != nil {
-		return err
+// convertLogs writes the entries of the sources matching filter to the output
+// file, or stdout when it is "-", as CSV or as JSON lines. It returns the
+// parse stats of each source.
+func convertLogs(sources []*Source, outputFilePath, format string, filter *Filter) ([]ParseStats, error) {
+	out := io.Writer(os.Stdout)
+	if outputFilePath != "-" {
+		file, err := os.Create(outputFilePath)
+		if err != nil {
+			return nil, err
+		}
+		defer file.Close()
+		out = file
 	}
-
-	// Read and parse Nginx log entries
-	scanner := bufio.NewScanner(file)
-	for scanner.Scan() {
-		line := scanner.Text()
-		matches := nginxLogRegex.FindStringSubmatch(line)
-		if len(matches) == 0 {
-			log.Printf("Failed to parse line: %s", line)
-			continue
+	// Both writers buffer, flush writes the rest
+	var write func(entry *LogEntry) error
+	var flush func() error
+	switch format {
+	case "csv":
+		writer := csv.NewWriter(out)
+		if err := writer.Write(csvHeader); err != nil {
+			return nil, err
+		}
+		write = func(entry *LogEntry) error { return writer.Write(csvRecord(entry)) }
+		flush = func() error {
+			writer.Flush()
+			return writer.Error()
 		}
+	case "json":
+		buf := bufio.NewWriter(out)
+		enc := json.NewEncoder(buf)
+		write = func(entry *LogEntry) error { return enc.Encode(entry) }
+		flush = buf.Flush
+	default:
+		return nil, fmt.Errorf("unknown format %q, use csv or json", format)
+	}
 
-		// Extract relevant fields
-		record := matches[1:]
-		err := writer.Write(record)
+	// Read and parse Nginx log entries of every source
+	var allStats []ParseStats
+	for _, src := range sources {
+		var writeErr error
+		stats, err := src.ReadEntries(func(entry LogEntry) {
+			if writeErr != nil || !filter.Match(&entry) {
+				return
+			}
+			writeErr = write(&entry)
+		})
 		if err != nil {
-			return err
+			return nil, err
+		}
+		if writeErr != nil {
+			return nil, writeErr
+		}
+		if stats.Failed > 0 {
+			log.Printf("Failed to parse %d of %d lines in source %s", stats.Failed, stats.Lines, src.Name)
 		}
+		allStats = append(allStats, stats)
 	}
 
-	if err := scanner.Err(); err != nil {
-		return err
+	if err := flush(); err != nil {
+		return nil, err
 	}
+	if outputFilePath != "-" {
+		log.Printf("Conversion completed. Output saved to: %s", outputFilePath)
+	}
+	return allStats, nil
+}
 
-	log.Printf("Conversion completed. CSV file saved to: %s", outputFilePath)
-	return nil
+// csvRecord is the CSV row of an entry
+func csvRecord(entry *LogEntry) []string {
+	return []string{
+		entry.Source,
+		entry.IP,
+		entry.UserID,
+		entry.TimeStamp.Format(time.RFC3339),
+		entry.Method,
+		entry.RequestURI,
+		entry.Protocol,
+		strconv.Itoa(entry.Status),
+		strconv.Itoa(entry.ResponseSize),
+		entry.Referer,
+		entry.UserAgent,
+		strconv.FormatFloat(entry.ResponseTime, 'f', 3, 64),
+	}
 }
 
 // atof converts a string to a float64, returning 0.0 if there is an error
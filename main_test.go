@@ -0,0 +1,24 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+)
+
+func TestLegacyCommandRejectsConvertingStreams(t *testing.T) {
+	fifo := filepath.Join(t.TempDir(), "access.pipe")
+	if err := syscall.Mkfifo(fifo, 0o600); err != nil {
+		t.Skip(err)
+	}
+	output := filepath.Join(t.TempDir(), "out.csv")
+
+	// Converting would drain the pipe before the dashboard retains it
+	if code := legacyCommand([]string{"-input", fifo, "-output", output}); code != exitUsage {
+		t.Errorf("exit code %d, want %d", code, exitUsage)
+	}
+	if _, err := os.Stat(output); !os.IsNotExist(err) {
+		t.Errorf("the conversion ran: %v", err)
+	}
+}
@@ -0,0 +1,320 @@
+package main
+
+import (
+	"cmp"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"path"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// otherRoute is the route label of the requests beyond max_routes
+const otherRoute = "other"
+
+// defaultLatencyBuckets are the upper bounds of the latency histogram, in seconds
+var defaultLatencyBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// metricMethods are the methods kept as labels, anything else is OTHER
+var metricMethods = []string{"GET", "HEAD", "POST", "PUT", "DELETE", "PATCH", "OPTIONS", "CONNECT", "TRACE"}
+
+// MetricsConfig enables the Prometheus exporter at /metrics
+type MetricsConfig struct {
+	Enabled   bool          `toml:"enabled"`
+	Interval  time.Duration `toml:"interval"`   // how often the logs are read
+	MaxRoutes int           `toml:"max_routes"` // route labels per source, later routes are "other"
+	Routes    []string      `toml:"routes"`     // path.Match patterns used as routes, e.g. /api/users/*
+	Buckets   []float64     `toml:"buckets"`    // latency histogram bounds in seconds
+}
+
+// Validate checks the exporter settings
+func (c *MetricsConfig) Validate() []error {
+	if !c.Enabled {
+		return nil
+	}
+	var errs []error
+	if c.Interval <= 0 {
+		errs = append(errs, errors.New("metrics.interval must be positive"))
+	}
+	if c.MaxRoutes <= 0 {
+		errs = append(errs, errors.New("metrics.max_routes must be positive"))
+	}
+	for _, pattern := range c.Routes {
+		if _, err := path.Match(pattern, ""); err != nil || !strings.HasPrefix(pattern, "/") {
+			errs = append(errs, fmt.Errorf("metrics.routes: invalid pattern %q", pattern))
+		}
+	}
+	for i, bound := range c.Buckets {
+		if bound <= 0 || i > 0 && bound <= c.Buckets[i-1] {
+			errs = append(errs, errors.New("metrics.buckets must be positive and increasing"))
+			break
+		}
+	}
+	if len(c.Buckets) == 0 {
+		errs = append(errs, errors.New("metrics.buckets must not be empty"))
+	}
+	return errs
+}
+
+// Metrics aggregates followed log entries into Prometheus counters and
+// histograms. Like any exporter the counters start at zero when the viewer
+// starts, entries already in the logs are not counted.
+type Metrics struct {
+	cfg MetricsConfig
+
+	mu      sync.Mutex
+	sources map[string]*sourceMetrics
+}
+
+// sourceMetrics are the series of one source. Routes get a label in the
+// order they are first seen until max_routes is reached, so the series of a
+// route never move to "other" once they exist.
+type sourceMetrics struct {
+	routes    map[string]bool
+	requests  map[requestSeries]uint64
+	bytes     map[string]uint64
+	latency   map[string]*histogram
+	lastEntry time.Time
+}
+
+type requestSeries struct {
+	route, method string
+	status        int
+}
+
+// histogram counts observations per bucket, the last bucket is +Inf
+type histogram struct {
+	counts []uint64
+	sum    float64
+}
+
+// NewMetrics creates the exporter, or nil when it is disabled
+func NewMetrics(cfg MetricsConfig) *Metrics {
+	if !cfg.Enabled {
+		return nil
+	}
+	return &Metrics{cfg: cfg, sources: make(map[string]*sourceMetrics)}
+}
+
+// Observe counts an entry, it is subscribed to the follower
+func (m *Metrics) Observe(entry LogEntry) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	sm := m.sources[entry.Source]
+	if sm == nil {
+		sm = &sourceMetrics{
+			routes:   make(map[string]bool),
+			requests: make(map[requestSeries]uint64),
+			bytes:    make(map[string]uint64),
+			latency:  make(map[string]*histogram),
+		}
+		m.sources[entry.Source] = sm
+	}
+
+	route := m.route(sm, entry.RequestURI)
+	sm.requests[requestSeries{route, metricMethod(entry.Method), entry.Status}]++
+	sm.bytes[route] += uint64(max(entry.ResponseSize, 0))
+	h := sm.latency[route]
+	if h == nil {
+		h = &histogram{counts: make([]uint64, len(m.cfg.Buckets)+1)}
+		sm.latency[route] = h
+	}
+	duration := requestDuration(&entry)
+	i, _ := slices.BinarySearch(m.cfg.Buckets, duration)
+	h.counts[i]++
+	h.sum += duration
+	if entry.TimeStamp.After(sm.lastEntry) {
+		sm.lastEntry = entry.TimeStamp
+	}
+}
+
+// route returns the route label of a request URI, admitting new routes
+// while there is room
+func (m *Metrics) route(sm *sourceMetrics, uri string) string {
+	p := requestPath(uri)
+	if !strings.HasPrefix(p, "/") {
+		return otherRoute
+	}
+	for _, pattern := range m.cfg.Routes {
+		if ok, _ := path.Match(pattern, p); ok {
+			return pattern
+		}
+	}
+	route := normalizeRoute(p)
+	if sm.routes[route] {
+		return route
+	}
+	if len(sm.routes) >= m.cfg.MaxRoutes {
+		return otherRoute
+	}
+	sm.routes[route] = true
+	return route
+}
+
+// normalizeRoute replaces the path segments that look like identifiers, so
+// /users/42/orders/9f1c... becomes /users/:id/orders/:hash
+func normalizeRoute(p string) string {
+	segments := strings.Split(p, "/")
+	for i, s := range segments {
+		switch {
+		case s == "":
+		case isDigits(s):
+			segments[i] = ":id"
+		case isUUID(s):
+			segments[i] = ":uuid"
+		case len(s) >= 16 && isHex(s):
+			segments[i] = ":hash"
+		case len(s) >= 24 && strings.ContainsAny(s, "0123456789"):
+			segments[i] = ":token"
+		}
+	}
+	return strings.Join(segments, "/")
+}
+
+func isDigits(s string) bool {
+	for _, c := range s {
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+func isHex(s string) bool {
+	for _, c := range s {
+		if !(c >= '0' && c <= '9' || c >= 'a' && c <= 'f' || c >= 'A' && c <= 'F') {
+			return false
+		}
+	}
+	return true
+}
+
+func isUUID(s string) bool {
+	if len(s) != 36 {
+		return false
+	}
+	for i, c := range s {
+		if i == 8 || i == 13 || i == 18 || i == 23 {
+			if c != '-' {
+				return false
+			}
+		} else if !isHex(string(c)) {
+			return false
+		}
+	}
+	return true
+}
+
+func metricMethod(method string) string {
+	if slices.Contains(metricMethods, method) {
+		return method
+	}
+	return "OTHER"
+}
+
+// Write writes the series of the sources the user can view in the Prometheus
+// text format, or OpenMetrics when openMetrics is set
+func (m *Metrics) Write(w io.Writer, access Access, openMetrics bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var names []string
+	for name := range m.sources {
+		if access.CanView(name) {
+			names = append(names, name)
+		}
+	}
+	slices.Sort(names)
+
+	// OpenMetrics names counter families without the _total suffix
+	counter := func(name, help string) {
+		family := name
+		if openMetrics {
+			family = strings.TrimSuffix(name, "_total")
+		}
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n", family, help, family)
+	}
+
+	counter("nginx_http_requests_total", "Requests by route, method and status.")
+	for _, name := range names {
+		sm := m.sources[name]
+		series := make([]requestSeries, 0, len(sm.requests))
+		for s := range sm.requests {
+			series = append(series, s)
+		}
+		slices.SortFunc(series, func(a, b requestSeries) int {
+			return cmp.Or(strings.Compare(a.route, b.route), strings.Compare(a.method, b.method), cmp.Compare(a.status, b.status))
+		})
+		for _, s := range series {
+			fmt.Fprintf(w, "nginx_http_requests_total{source=%s,route=%s,method=%s,status=\"%d\"} %d\n",
+				labelValue(name), labelValue(s.route), labelValue(s.method), s.status, sm.requests[s])
+		}
+	}
+
+	counter("nginx_http_response_bytes_total", "Response body bytes sent by route.")
+	for _, name := range names {
+		sm := m.sources[name]
+		for _, route := range sortedKeys(sm.bytes) {
+			fmt.Fprintf(w, "nginx_http_response_bytes_total{source=%s,route=%s} %d\n",
+				labelValue(name), labelValue(route), sm.bytes[route])
+		}
+	}
+
+	fmt.Fprintf(w, "# HELP nginx_http_request_duration_seconds Request time by route.\n# TYPE nginx_http_request_duration_seconds histogram\n")
+	for _, name := range names {
+		sm := m.sources[name]
+		for _, route := range sortedKeys(sm.latency) {
+			h := sm.latency[route]
+			labels := fmt.Sprintf("source=%s,route=%s", labelValue(name), labelValue(route))
+			var cumulative uint64
+			for i, count := range h.counts {
+				cumulative += count
+				le := "+Inf"
+				if i < len(m.cfg.Buckets) {
+					le = strconv.FormatFloat(m.cfg.Buckets[i], 'g', -1, 64)
+				}
+				fmt.Fprintf(w, "nginx_http_request_duration_seconds_bucket{%s,le=\"%s\"} %d\n", labels, le, cumulative)
+			}
+			fmt.Fprintf(w, "nginx_http_request_duration_seconds_sum{%s} %s\n", labels, strconv.FormatFloat(h.sum, 'g', -1, 64))
+			fmt.Fprintf(w, "nginx_http_request_duration_seconds_count{%s} %d\n", labels, cumulative)
+		}
+	}
+
+	fmt.Fprintf(w, "# HELP nginx_log_last_entry_timestamp_seconds Time of the newest entry read from the log.\n# TYPE nginx_log_last_entry_timestamp_seconds gauge\n")
+	for _, name := range names {
+		fmt.Fprintf(w, "nginx_log_last_entry_timestamp_seconds{source=%s} %d\n", labelValue(name), m.sources[name].lastEntry.Unix())
+	}
+
+	if openMetrics {
+		io.WriteString(w, "# EOF\n")
+	}
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	slices.Sort(keys)
+	return keys
+}
+
+// labelValue quotes a label value, escaping backslashes, quotes and newlines
+func labelValue(s string) string {
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(s) + `"`
+}
+
+// serve writes the metrics, in OpenMetrics when the scraper asks for it
+func (m *Metrics) serve(w http.ResponseWriter, r *http.Request, access Access) {
+	openMetrics := strings.Contains(r.Header.Get("Accept"), "application/openmetrics-text")
+	if openMetrics {
+		w.Header().Set("Content-Type", "application/openmetrics-text; version=1.0.0; charset=utf-8")
+	} else {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	}
+	m.Write(w, access, openMetrics)
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestNormalizeRoute(t *testing.T) {
+	tests := map[string]string{
+		"/":                  "/",
+		"/users/42":          "/users/:id",
+		"/users/42/orders/7": "/users/:id/orders/:id",
+		"/orders/3f2a9c1e-5b7d-4e2f-9a1b-0c8d7e6f5a4b": "/orders/:uuid",
+		"/blobs/9f1c2b3a4d5e6f70":                      "/blobs/:hash",
+		"/blobs/9f1c2b3a4d5e6f7":                       "/blobs/9f1c2b3a4d5e6f7",
+		"/reset/abcdefghijklmnopqrstuvw1":              "/reset/:token",
+		"/reset/abcdefghijklmnopqrstuvwx":              "/reset/abcdefghijklmnopqrstuvwx",
+		"/v2/api":                                      "/v2/api",
+		"/static/app.js":                               "/static/app.js",
+		"/users/":                                      "/users/",
+	}
+	for p, want := range tests {
+		if got := normalizeRoute(p); got != want {
+			t.Errorf("normalizeRoute(%q) = %q, want %q", p, got, want)
+		}
+	}
+}
+
+func newTestMetrics(maxRoutes int, routes ...string) *Metrics {
+	return NewMetrics(MetricsConfig{Enabled: true, Interval: time.Second, MaxRoutes: maxRoutes, Routes: routes, Buckets: []float64{0.1, 0.5, 1}})
+}
+
+func TestMetricsRoutes(t *testing.T) {
+	m := newTestMetrics(3, "/api/users/*")
+	tests := []struct {
+		uri, want string
+	}{
+		{"/users/1?tab=orders", "/users/:id"},
+		{"/api/users/alice", "/api/users/*"},
+		{"/health", "/health"},
+		{"/users/2", "/users/:id"},
+		{"/about", "/about"},
+		// max_routes reached, new routes are counted as other
+		{"/contact", otherRoute},
+		{"/users/3", "/users/:id"},
+		// configured patterns don't take a slot
+		{"/api/users/bob", "/api/users/*"},
+		{"*", otherRoute},
+	}
+	for _, tt := range tests {
+		m.Observe(LogEntry{Source: "shop", RequestURI: tt.uri, Method: "GET", Status: 200})
+		if got := m.route(m.sources["shop"], tt.uri); got != tt.want {
+			t.Errorf("route(%q) = %q, want %q", tt.uri, got, tt.want)
+		}
+	}
+
+	// Other sources have their own routes
+	if got := m.route(&sourceMetrics{routes: make(map[string]bool)}, "/contact"); got != "/contact" {
+		t.Errorf("route of another source %q", got)
+	}
+}
+
+func TestMetricsWrite(t *testing.T) {
+	m := newTestMetrics(10)
+	at := time.Date(2024, 2, 19, 16, 0, 0, 0, time.UTC)
+	for _, entry := range []LogEntry{
+		{RequestURI: "/a", Method: "GET", Status: 200, ResponseSize: 100, RequestTime: 0.05, TimeStamp: at},
+		{RequestURI: "/a", Method: "GET", Status: 200, ResponseSize: 50, RequestTime: 0.3, ResponseTime: 0.01, TimeStamp: at},
+		// without $request_time the upstream time is observed
+		{RequestURI: "/a", Method: "POST", Status: 502, ResponseTime: 0.7, TimeStamp: at.Add(time.Second)},
+		{RequestURI: "/a", Method: "PROPFIND", Status: 405, RequestTime: 2, TimeStamp: at},
+	} {
+		entry.Source = "shop"
+		m.Observe(entry)
+	}
+	m.Observe(LogEntry{Source: "secret", RequestURI: "/", Method: "GET", Status: 200, TimeStamp: at})
+
+	var b strings.Builder
+	m.Write(&b, Access{Sources: []string{"shop"}}, false)
+	want := `# HELP nginx_http_requests_total Requests by route, method and status.
+# TYPE nginx_http_requests_total counter
+nginx_http_requests_total{source="shop",route="/a",method="GET",status="200"} 2
+nginx_http_requests_total{source="shop",route="/a",method="OTHER",status="405"} 1
+nginx_http_requests_total{source="shop",route="/a",method="POST",status="502"} 1
+# HELP nginx_http_response_bytes_total Response body bytes sent by route.
+# TYPE nginx_http_response_bytes_total counter
+nginx_http_response_bytes_total{source="shop",route="/a"} 150
+# HELP nginx_http_request_duration_seconds Request time by route.
+# TYPE nginx_http_request_duration_seconds histogram
+nginx_http_request_duration_seconds_bucket{source="shop",route="/a",le="0.1"} 1
+nginx_http_request_duration_seconds_bucket{source="shop",route="/a",le="0.5"} 2
+nginx_http_request_duration_seconds_bucket{source="shop",route="/a",le="1"} 3
+nginx_http_request_duration_seconds_bucket{source="shop",route="/a",le="+Inf"} 4
+nginx_http_request_duration_seconds_sum{source="shop",route="/a"} 3.05
+nginx_http_request_duration_seconds_count{source="shop",route="/a"} 4
+# HELP nginx_log_last_entry_timestamp_seconds Time of the newest entry read from the log.
+# TYPE nginx_log_last_entry_timestamp_seconds gauge
+nginx_log_last_entry_timestamp_seconds{source="shop"} 1708358401
+`
+	if b.String() != want {
+		t.Errorf("got\n%s\nwant\n%s", b.String(), want)
+	}
+}
+
+func TestMetricsBucketBounds(t *testing.T) {
+	m := newTestMetrics(10)
+	// A value on a bound is counted in that bucket, le is inclusive
+	for _, d := range []float64{0.1, 0.5, 1, 1.01} {
+		m.Observe(LogEntry{Source: "shop", RequestURI: "/", RequestTime: d})
+	}
+	h := m.sources["shop"].latency["/"]
+	if got := h.counts; len(got) != 4 || got[0] != 1 || got[1] != 1 || got[2] != 1 || got[3] != 1 {
+		t.Errorf("bucket counts %v", got)
+	}
+}
+
+func TestLabelValue(t *testing.T) {
+	if got := labelValue("a\\b\"c\nd"); got != `"a\\b\"c\nd"` {
+		t.Errorf("labelValue = %s", got)
+	}
+}
+
+func TestMetricsContentNegotiation(t *testing.T) {
+	m := newTestMetrics(10)
+	m.Observe(LogEntry{Source: "shop", RequestURI: "/", Method: "GET", Status: 200})
+
+	tests := []struct {
+		accept, contentType string
+		openMetrics         bool
+	}{
+		{"", "text/plain; version=0.0.4; charset=utf-8", false},
+		{"text/plain;version=0.0.4;q=0.5,*/*;q=0.1", "text/plain; version=0.0.4; charset=utf-8", false},
+		{"application/openmetrics-text;version=1.0.0,text/plain;version=0.0.4;q=0.5", "application/openmetrics-text; version=1.0.0; charset=utf-8", true},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest(http.MethodGet, "/metrics", nil)
+		if tt.accept != "" {
+			r.Header.Set("Accept", tt.accept)
+		}
+		w := httptest.NewRecorder()
+		m.serve(w, r, fullAccess)
+		body := w.Body.String()
+
+		if ct := w.Header().Get("Content-Type"); ct != tt.contentType {
+			t.Errorf("Accept %q: Content-Type %q", tt.accept, ct)
+		}
+		if strings.HasSuffix(body, "# EOF\n") != tt.openMetrics {
+			t.Errorf("Accept %q: # EOF terminator %v, want %v", tt.accept, !tt.openMetrics, tt.openMetrics)
+		}
+		// OpenMetrics counter families drop the _total suffix, the samples keep it
+		family := "# TYPE nginx_http_requests_total counter\n"
+		if tt.openMetrics {
+			family = "# TYPE nginx_http_requests counter\n"
+		}
+		if !strings.Contains(body, family) || !strings.Contains(body, "\nnginx_http_requests_total{") {
+			t.Errorf("Accept %q: missing %q in\n%s", tt.accept, family, body)
+		}
+	}
+}
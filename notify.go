@@ -0,0 +1,195 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"mime"
+	"net"
+	"net/http"
+	"net/smtp"
+	"strings"
+	"time"
+)
+
+// Notifications and sink batches are retried with a doubling backoff
+const (
+	deliveryAttempts = 3
+	deliveryBackoff  = time.Second
+	deliveryTimeout  = 10 * time.Second
+)
+
+// ReceiverConfig is where alert notifications are sent
+type ReceiverConfig struct {
+	Name         string   `toml:"name"`
+	Type         string   `toml:"type"`          // webhook, slack or email
+	URL          string   `toml:"url"`           // of the webhook, or Slack/Mattermost incoming webhook
+	Channel      string   `toml:"channel"`       // slack, overrides the webhook's default channel
+	Username     string   `toml:"username"`      // slack, the name the messages are posted as
+	SMTP         string   `toml:"smtp"`          // email, host:port of the mail server
+	SMTPUser     string   `toml:"smtp_user"`     // email, PLAIN auth when set
+	SMTPPassword string   `toml:"smtp_password"` // best set with NLV_ALERTS_RECEIVERS_<n>_SMTP_PASSWORD
+	From         string   `toml:"from"`
+	To           []string `toml:"to"`
+}
+
+func (c ReceiverConfig) validate() error {
+	switch c.Type {
+	case "webhook", "slack":
+		if !strings.HasPrefix(c.URL, "http://") && !strings.HasPrefix(c.URL, "https://") {
+			return errors.New("url must be an http or https URL")
+		}
+	case "email":
+		if _, _, err := net.SplitHostPort(c.SMTP); err != nil {
+			return errors.New("smtp must be host:port")
+		}
+		if c.From == "" || len(c.To) == 0 {
+			return errors.New("from and to are required")
+		}
+	default:
+		return fmt.Errorf("unknown type %q, use webhook, slack or email", c.Type)
+	}
+	return nil
+}
+
+// Notifier delivers alerts to a receiver
+type Notifier interface {
+	Notify(alerts []Alert) error
+}
+
+// NewNotifier creates the notifier of a receiver
+func NewNotifier(c ReceiverConfig) (Notifier, error) {
+	if err := c.validate(); err != nil {
+		return nil, err
+	}
+	client := &http.Client{Timeout: deliveryTimeout}
+	switch c.Type {
+	case "webhook":
+		return &webhookNotifier{url: c.URL, client: client}, nil
+	case "slack":
+		return &slackNotifier{url: c.URL, channel: c.Channel, username: c.Username, client: client}, nil
+	}
+	return &emailNotifier{cfg: c}, nil
+}
+
+// notifyWithRetry tries a notifier a few times before giving up
+func notifyWithRetry(n Notifier, alerts []Alert) error {
+	return retry(func() error { return n.Notify(alerts) })
+}
+
+// permanentError is a delivery failure that retrying won't fix, like a
+// payload the receiver rejected
+type permanentError struct {
+	err error
+}
+
+func (e *permanentError) Error() string { return e.err.Error() }
+
+func (e *permanentError) Unwrap() error { return e.err }
+
+// retry calls fn until it succeeds, fails permanently or runs out of attempts
+func retry(fn func() error) error {
+	var err error
+	backoff := deliveryBackoff
+	for attempt := 1; attempt <= deliveryAttempts; attempt++ {
+		if err = fn(); err == nil {
+			return nil
+		}
+		var permanent *permanentError
+		if errors.As(err, &permanent) {
+			return err
+		}
+		if attempt < deliveryAttempts {
+			time.Sleep(backoff)
+			backoff *= 2
+		}
+	}
+	return err
+}
+
+// postJSON posts v and expects a 2xx response. Like sink batches, requests
+// rejected with a client error aren't retried.
+func postJSON(client *http.Client, url string, v any) error {
+	body, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	_, err = postPayload(client, url, "application/json", nil, body)
+	return err
+}
+
+// webhookNotifier posts the alerts as JSON:
+// {"alerts": [{"rule": ..., "state": "firing", ...}]}
+type webhookNotifier struct {
+	url    string
+	client *http.Client
+}
+
+func (n *webhookNotifier) Notify(alerts []Alert) error {
+	return postJSON(n.client, n.url, struct {
+		Alerts []Alert `json:"alerts"`
+	}{alerts})
+}
+
+// slackNotifier posts a message to a Slack or Mattermost incoming webhook
+type slackNotifier struct {
+	url, channel, username string
+	client                 *http.Client
+}
+
+func (n *slackNotifier) Notify(alerts []Alert) error {
+	return postJSON(n.client, n.url, struct {
+		Text     string `json:"text"`
+		Channel  string `json:"channel,omitempty"`
+		Username string `json:"username,omitempty"`
+	}{alertText(alerts, true), n.channel, n.username})
+}
+
+// emailNotifier sends a plain text mail, using STARTTLS when the server
+// offers it
+type emailNotifier struct {
+	cfg ReceiverConfig
+}
+
+func (n *emailNotifier) Notify(alerts []Alert) error {
+	var auth smtp.Auth
+	if n.cfg.SMTPUser != "" {
+		host, _, _ := net.SplitHostPort(n.cfg.SMTP)
+		auth = smtp.PlainAuth("", n.cfg.SMTPUser, n.cfg.SMTPPassword, host)
+	}
+
+	subject := fmt.Sprintf("[%s] %s", strings.ToUpper(alerts[0].State), alerts[0].Summary)
+	if len(alerts) > 1 {
+		subject = fmt.Sprintf("%d alerts changed", len(alerts))
+	}
+	subject = mime.QEncoding.Encode("utf-8", strings.NewReplacer("\r", "", "\n", "").Replace(subject))
+	var msg bytes.Buffer
+	fmt.Fprintf(&msg, "From: %s\r\n", n.cfg.From)
+	fmt.Fprintf(&msg, "To: %s\r\n", strings.Join(n.cfg.To, ", "))
+	fmt.Fprintf(&msg, "Subject: %s\r\n", subject)
+	fmt.Fprintf(&msg, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	msg.WriteString("MIME-Version: 1.0\r\nContent-Type: text/plain; charset=utf-8\r\n\r\n")
+	msg.WriteString(strings.ReplaceAll(alertText(alerts, false), "\n", "\r\n"))
+	return smtp.SendMail(n.cfg.SMTP, auth, n.cfg.From, n.cfg.To, msg.Bytes())
+}
+
+// alertText lists the alerts one per line, with emoji for chat
+func alertText(alerts []Alert, emoji bool) string {
+	var b strings.Builder
+	for _, a := range alerts {
+		if emoji {
+			if a.State == alertResolved {
+				b.WriteString(":white_check_mark: ")
+			} else {
+				b.WriteString(":rotating_light: ")
+			}
+		}
+		fmt.Fprintf(&b, "[%s]", strings.ToUpper(a.State))
+		if a.Severity != "" {
+			fmt.Fprintf(&b, " (%s)", a.Severity)
+		}
+		fmt.Fprintf(&b, " %s since %s\n", a.Summary, a.Since.Format(rangeLayout))
+	}
+	return b.String()
+}
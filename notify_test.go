@@ -0,0 +1,258 @@
+package main
+
+import (
+	"bufio"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+var testAlert = Alert{
+	Rule:     "api-5xx",
+	Source:   "shop",
+	State:    alertFiring,
+	Since:    time.Date(2024, 2, 19, 16, 0, 0, 0, time.Local),
+	Severity: "critical",
+	Summary:  "api-5xx on shop: ratio 7.20% > 5% over 1m0s",
+}
+
+func TestWebhookNotifier(t *testing.T) {
+	var got struct {
+		Alerts []Alert `json:"alerts"`
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost || r.Header.Get("Content-Type") != "application/json" {
+			t.Errorf("%s with Content-Type %q", r.Method, r.Header.Get("Content-Type"))
+		}
+		if err := json.NewDecoder(r.Body).Decode(&got); err != nil {
+			t.Error(err)
+		}
+	}))
+	defer server.Close()
+
+	n, err := NewNotifier(ReceiverConfig{Name: "hook", Type: "webhook", URL: server.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := n.Notify([]Alert{testAlert}); err != nil {
+		t.Fatal(err)
+	}
+	if len(got.Alerts) != 1 || got.Alerts[0].Rule != "api-5xx" || got.Alerts[0].State != alertFiring {
+		t.Errorf("received %+v", got.Alerts)
+	}
+}
+
+func TestSlackNotifier(t *testing.T) {
+	var got map[string]string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := json.NewDecoder(r.Body).Decode(&got); err != nil {
+			t.Error(err)
+		}
+	}))
+	defer server.Close()
+
+	n, err := NewNotifier(ReceiverConfig{Name: "chat", Type: "slack", URL: server.URL, Channel: "#ops", Username: "nginx"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	resolved := testAlert
+	resolved.State = alertResolved
+	if err := n.Notify([]Alert{testAlert, resolved}); err != nil {
+		t.Fatal(err)
+	}
+	want := ":rotating_light: [FIRING] (critical) api-5xx on shop: ratio 7.20% > 5% over 1m0s since 2024-02-19 16:00:00\n" +
+		":white_check_mark: [RESOLVED] (critical) api-5xx on shop: ratio 7.20% > 5% over 1m0s since 2024-02-19 16:00:00\n"
+	if got["text"] != want || got["channel"] != "#ops" || got["username"] != "nginx" {
+		t.Errorf("received %q", got)
+	}
+}
+
+func TestNotifyRetry(t *testing.T) {
+	tests := []struct {
+		name      string
+		statuses  []int
+		requests  int
+		permanent bool
+	}{
+		{"ok", []int{200}, 1, false},
+		{"bad request", []int{400}, 1, true},
+		{"unauthorized", []int{401}, 1, true},
+		{"not found", []int{404}, 1, true},
+		{"server error then ok", []int{503, 204}, 2, false},
+		{"rate limited then ok", []int{429, 200}, 2, false},
+		{"timeout then ok", []int{408, 200}, 2, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var requests atomic.Int32
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				n := int(requests.Add(1))
+				w.WriteHeader(tt.statuses[min(n, len(tt.statuses))-1])
+			}))
+			defer server.Close()
+
+			n, err := NewNotifier(ReceiverConfig{Name: "hook", Type: "webhook", URL: server.URL})
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = notifyWithRetry(n, []Alert{testAlert})
+			if int(requests.Load()) != tt.requests {
+				t.Errorf("%d requests, want %d", requests.Load(), tt.requests)
+			}
+			var permanent *permanentError
+			if errors.As(err, &permanent) != tt.permanent {
+				t.Errorf("error %v, permanent %v", err, tt.permanent)
+			}
+			if !tt.permanent && err != nil {
+				t.Errorf("unexpected error %v", err)
+			}
+		})
+	}
+}
+
+// fakeSMTP accepts one mail, with PLAIN auth, and keeps what it was sent
+type fakeSMTP struct {
+	addr       string
+	auth       string
+	from       string
+	recipients []string
+	data       string
+	done       chan struct{}
+}
+
+func newFakeSMTP(t *testing.T) *fakeSMTP {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	s := &fakeSMTP{addr: ln.Addr().String(), done: make(chan struct{})}
+
+	go func() {
+		defer close(s.done)
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		r := bufio.NewReader(conn)
+		reply := func(line string) { conn.Write([]byte(line + "\r\n")) }
+
+		reply("220 localhost ESMTP")
+		for {
+			line, err := r.ReadString('\n')
+			if err != nil {
+				return
+			}
+			line = strings.TrimRight(line, "\r\n")
+			verb, arg, _ := strings.Cut(line, " ")
+			switch strings.ToUpper(verb) {
+			case "EHLO", "HELO":
+				reply("250-localhost")
+				reply("250 AUTH PLAIN")
+			case "AUTH":
+				credentials, _ := base64.StdEncoding.DecodeString(strings.TrimPrefix(arg, "PLAIN "))
+				s.auth = string(credentials)
+				reply("235 2.7.0 Authentication successful")
+			case "MAIL":
+				s.from = arg
+				reply("250 OK")
+			case "RCPT":
+				s.recipients = append(s.recipients, arg)
+				reply("250 OK")
+			case "DATA":
+				reply("354 End data with <CR><LF>.<CR><LF>")
+				var data strings.Builder
+				for {
+					line, err := r.ReadString('\n')
+					if err != nil {
+						return
+					}
+					if line == ".\r\n" {
+						break
+					}
+					data.WriteString(line)
+				}
+				s.data = data.String()
+				reply("250 OK")
+			case "QUIT":
+				reply("221 Bye")
+				return
+			default:
+				reply("250 OK")
+			}
+		}
+	}()
+	return s
+}
+
+func TestEmailNotifier(t *testing.T) {
+	server := newFakeSMTP(t)
+	n, err := NewNotifier(ReceiverConfig{
+		Name:         "mail",
+		Type:         "email",
+		SMTP:         server.addr,
+		SMTPUser:     "alerts",
+		SMTPPassword: "s3cret",
+		From:         "viewer@example.com",
+		To:           []string{"ops@example.com", "oncall@example.com"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := n.Notify([]Alert{testAlert}); err != nil {
+		t.Fatal(err)
+	}
+	<-server.done
+
+	if server.auth != "\x00alerts\x00s3cret" {
+		t.Errorf("auth %q", server.auth)
+	}
+	if server.from != "FROM:<viewer@example.com>" || len(server.recipients) != 2 || server.recipients[1] != "TO:<oncall@example.com>" {
+		t.Errorf("envelope from %q to %q", server.from, server.recipients)
+	}
+	for _, want := range []string{
+		"To: ops@example.com, oncall@example.com\r\n",
+		"Subject: [FIRING] api-5xx on shop: ratio 7.20% > 5% over 1m0s\r\n",
+		"\r\n\r\n[FIRING] (critical) api-5xx on shop: ratio 7.20% > 5% over 1m0s since 2024-02-19 16:00:00\r\n",
+	} {
+		if !strings.Contains(server.data, want) {
+			t.Errorf("mail does not contain %q:\n%s", want, server.data)
+		}
+	}
+
+	// Subjects that aren't plain ASCII are encoded
+	server = newFakeSMTP(t)
+	n, _ = NewNotifier(ReceiverConfig{Name: "mail", Type: "email", SMTP: server.addr, From: "viewer@example.com", To: []string{"ops@example.com"}})
+	alert := testAlert
+	alert.Summary = "latency on café:\r\n p95 > 2s"
+	if err := n.Notify([]Alert{alert}); err != nil {
+		t.Fatal(err)
+	}
+	<-server.done
+	if want := "Subject: =?utf-8?q?[FIRING]_latency_on_caf=C3=A9:_p95_>_2s?=\r\n"; !strings.Contains(server.data, want) {
+		t.Errorf("mail does not contain %q:\n%s", want, server.data)
+	}
+}
+
+func TestReceiverConfigValidate(t *testing.T) {
+	for _, c := range []ReceiverConfig{
+		{Type: "webhook", URL: "ftp://example.com"},
+		{Type: "slack"},
+		{Type: "email", SMTP: "mail.example.com", From: "a@example.com", To: []string{"b@example.com"}},
+		{Type: "email", SMTP: "mail.example.com:25"},
+		{Type: "pager"},
+	} {
+		if err := c.validate(); err == nil {
+			t.Errorf("%+v is valid", c)
+		}
+	}
+}
@@ -0,0 +1,302 @@
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// mockIdP is an OpenID Connect provider serving discovery, JWKS and token
+// endpoints, issuing ID tokens signed with its current key
+type mockIdP struct {
+	*httptest.Server
+	t *testing.T
+
+	mu         sync.Mutex
+	kid        string
+	keys       map[string]*rsa.PrivateKey
+	challenge  string // code_challenge of the pending login
+	claims     map[string]any
+	jwksLoaded int
+}
+
+func newMockIdP(t *testing.T) *mockIdP {
+	idp := &mockIdP{t: t, keys: make(map[string]*rsa.PrivateKey)}
+	idp.rotate("key-1")
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]string{
+			"issuer":                 idp.URL,
+			"authorization_endpoint": idp.URL + "/authorize",
+			"token_endpoint":         idp.URL + "/token",
+			"jwks_uri":               idp.URL + "/jwks",
+		})
+	})
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		idp.mu.Lock()
+		defer idp.mu.Unlock()
+		idp.jwksLoaded++
+		var keys []map[string]string
+		for kid, key := range idp.keys {
+			keys = append(keys, map[string]string{
+				"kid": kid,
+				"kty": "RSA",
+				"n":   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+				"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+			})
+		}
+		json.NewEncoder(w).Encode(map[string]any{"keys": keys})
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		user, secret, _ := r.BasicAuth()
+		if user != "viewer" || secret != "s3cret" {
+			http.Error(w, `{"error":"invalid_client"}`, http.StatusUnauthorized)
+			return
+		}
+		sum := sha256.Sum256([]byte(r.PostFormValue("code_verifier")))
+		idp.mu.Lock()
+		challenge, claims := idp.challenge, idp.claims
+		idp.mu.Unlock()
+		if r.PostFormValue("grant_type") != "authorization_code" || r.PostFormValue("code") != "code-1" ||
+			base64.RawURLEncoding.EncodeToString(sum[:]) != challenge {
+			http.Error(w, `{"error":"invalid_grant"}`, http.StatusBadRequest)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]string{"id_token": idp.sign(claims)})
+	})
+	idp.Server = httptest.NewServer(mux)
+	t.Cleanup(idp.Close)
+	return idp
+}
+
+// rotate replaces the signing keys with a new key
+func (idp *mockIdP) rotate(kid string) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		idp.t.Fatal(err)
+	}
+	idp.mu.Lock()
+	defer idp.mu.Unlock()
+	idp.kid = kid
+	idp.keys = map[string]*rsa.PrivateKey{kid: key}
+}
+
+// sign issues an RS256 token with the current key
+func (idp *mockIdP) sign(claims map[string]any) string {
+	idp.mu.Lock()
+	kid, key := idp.kid, idp.keys[idp.kid]
+	idp.mu.Unlock()
+	return signToken(idp.t, key, kid, claims)
+}
+
+func signToken(t *testing.T, key *rsa.PrivateKey, kid string, claims map[string]any) string {
+	t.Helper()
+	header, _ := json.Marshal(map[string]string{"alg": "RS256", "kid": kid, "typ": "JWT"})
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signed := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	digest := sha256.Sum256([]byte(signed))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+func (idp *mockIdP) validClaims() map[string]any {
+	return map[string]any{
+		"iss":                idp.URL,
+		"sub":                "1234",
+		"aud":                "viewer",
+		"exp":                time.Now().Add(time.Hour).Unix(),
+		"nonce":              "nonce-1",
+		"preferred_username": "alice",
+		"groups":             []string{"ops"},
+	}
+}
+
+func newTestProvider(t *testing.T, idp *mockIdP) *OIDCProvider {
+	t.Helper()
+	p, err := NewOIDCProvider(context.Background(), OIDCConfig{
+		Issuer:       idp.URL,
+		ClientID:     "viewer",
+		ClientSecret: "s3cret",
+		RedirectURL:  "http://viewer.test/auth/callback",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+// login starts a login at the provider and returns the verifier
+func (idp *mockIdP) login(t *testing.T, p *OIDCProvider, nonce string) string {
+	t.Helper()
+	verifier := "verifier-" + nonce
+	u, err := url.Parse(p.AuthCodeURL("state-1", nonce, verifier))
+	if err != nil {
+		t.Fatal(err)
+	}
+	q := u.Query()
+	if q.Get("code_challenge_method") != "S256" || q.Get("nonce") != nonce || q.Get("client_id") != "viewer" {
+		t.Fatalf("unexpected authorization request %s", u)
+	}
+	idp.mu.Lock()
+	idp.challenge = q.Get("code_challenge")
+	idp.mu.Unlock()
+	return verifier
+}
+
+func TestOIDCExchange(t *testing.T) {
+	idp := newMockIdP(t)
+	p := newTestProvider(t, idp)
+	idp.claims = idp.validClaims()
+	verifier := idp.login(t, p, "nonce-1")
+
+	claims, raw, err := p.Exchange(context.Background(), "code-1", verifier, "nonce-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if claims.PreferredUsername != "alice" || claims.Subject != "1234" || len(claims.Groups) != 1 || raw == "" {
+		t.Errorf("unexpected claims %+v", claims)
+	}
+
+	if _, _, err := p.Exchange(context.Background(), "code-1", "other-verifier", "nonce-1"); err == nil {
+		t.Error("exchange with the wrong PKCE verifier succeeded")
+	}
+}
+
+func TestOIDCExchangeNonceMismatch(t *testing.T) {
+	idp := newMockIdP(t)
+	p := newTestProvider(t, idp)
+	idp.claims = idp.validClaims()
+	verifier := idp.login(t, p, "nonce-2")
+
+	_, _, err := p.Exchange(context.Background(), "code-1", verifier, "nonce-2")
+	if err == nil || !strings.Contains(err.Error(), "nonce") {
+		t.Errorf("got %v, want a nonce mismatch", err)
+	}
+	if _, _, err := p.Exchange(context.Background(), "code-1", verifier, ""); err == nil {
+		t.Error("exchange without a nonce succeeded")
+	}
+}
+
+func TestOIDCVerify(t *testing.T) {
+	idp := newMockIdP(t)
+	p := newTestProvider(t, idp)
+	other, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name  string
+		token func(claims map[string]any) string
+		err   string
+	}{
+		{"valid", idp.sign, ""},
+		{"audience list", func(c map[string]any) string {
+			c["aud"] = []string{"other", "viewer"}
+			return idp.sign(c)
+		}, ""},
+		{"bad signature", func(c map[string]any) string {
+			return signToken(t, other, "key-1", c)
+		}, "invalid id token signature"},
+		{"tampered claims", func(c map[string]any) string {
+			parts := strings.Split(idp.sign(c), ".")
+			c["preferred_username"] = "admin"
+			payload, _ := json.Marshal(c)
+			return parts[0] + "." + base64.RawURLEncoding.EncodeToString(payload) + "." + parts[2]
+		}, "invalid id token signature"},
+		{"wrong audience", func(c map[string]any) string {
+			c["aud"] = "other"
+			return idp.sign(c)
+		}, "not issued for this client"},
+		{"audience list without client", func(c map[string]any) string {
+			c["aud"] = []string{"other"}
+			return idp.sign(c)
+		}, "not issued for this client"},
+		{"wrong issuer", func(c map[string]any) string {
+			c["iss"] = "https://evil.example"
+			return idp.sign(c)
+		}, "unexpected issuer"},
+		{"expired", func(c map[string]any) string {
+			c["exp"] = time.Now().Add(-2 * time.Minute).Unix()
+			return idp.sign(c)
+		}, "expired"},
+		{"unknown key", func(c map[string]any) string {
+			return signToken(t, other, "key-9", c)
+		}, "unknown signing key"},
+		{"alg none", func(c map[string]any) string {
+			header, _ := json.Marshal(map[string]string{"alg": "none", "kid": "key-1"})
+			payload, _ := json.Marshal(c)
+			return base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload) + "."
+		}, "unsupported id token algorithm"},
+		{"malformed", func(map[string]any) string { return "not-a-jwt" }, "malformed"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := p.Verify(context.Background(), tt.token(idp.validClaims()))
+			switch {
+			case tt.err == "" && err != nil:
+				t.Errorf("unexpected error %v", err)
+			case tt.err != "" && (err == nil || !strings.Contains(err.Error(), tt.err)):
+				t.Errorf("got error %v, want %q", err, tt.err)
+			}
+		})
+	}
+}
+
+func TestOIDCKeyRotation(t *testing.T) {
+	idp := newMockIdP(t)
+	p := newTestProvider(t, idp)
+
+	before := idp.sign(idp.validClaims())
+	if _, err := p.Verify(context.Background(), before); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := p.Verify(context.Background(), before); err != nil {
+		t.Fatal(err)
+	}
+	if idp.jwksLoaded != 1 {
+		t.Errorf("jwks loaded %d times, want the keys to be cached", idp.jwksLoaded)
+	}
+
+	idp.rotate("key-2")
+	if _, err := p.Verify(context.Background(), idp.sign(idp.validClaims())); err != nil {
+		t.Fatalf("token signed with the rotated key: %v", err)
+	}
+	if idp.jwksLoaded != 2 {
+		t.Errorf("jwks loaded %d times, want a refresh for the new key", idp.jwksLoaded)
+	}
+	if _, err := p.Verify(context.Background(), before); err == nil {
+		t.Error("token signed with the retired key was accepted")
+	}
+}
+
+func TestNewOIDCProviderIssuerMismatch(t *testing.T) {
+	idp := newMockIdP(t)
+	_, err := NewOIDCProvider(context.Background(), OIDCConfig{
+		Issuer:      idp.URL + "/",
+		ClientID:    "viewer",
+		RedirectURL: "http://viewer.test/auth/callback",
+	})
+	if err == nil || !strings.Contains(err.Error(), "issuer mismatch") {
+		t.Errorf("got %v, want an issuer mismatch", err)
+	}
+}
@@ -0,0 +1,504 @@
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Upstream variables hold one value per server tried, separated by ", " and
+// by " : " between upstream groups after an internal redirect, and "-" when
+// no server answered
+const (
+	upstreamTimes    = `(?:[\d.]+|-)(?:(?:, | : )(?:[\d.]+|-))*`
+	upstreamStatuses = `(?:\d{3}|-)(?:(?:, | : )(?:\d{3}|-))*`
+	upstreamAddrs    = `[^\s,"\]]+(?:(?:, | : )[^\s,"\]]+)*`
+)
+
+// defaultLogFormat matches the log_format shown in the README:
+//
+//	log_format custom '$remote_addr - [$time_local] "$request" $status $body_bytes_sent - "$http_user_agent" - $upstream_response_time';
+const defaultLogFormat = `^(?P<ip>\S+) - \[(?P<time>[^\]]+)\] "(?P<method>\S+) (?P<uri>\S+) (?P<protocol>\S+)" (?P<status>\d+) (?P<bytes>\d+) - "(?P<user_agent>[^"]+)" - (?P<response_time>` + upstreamTimes + `)$`
+
+// builtinFormats can be referenced by name from a source
+var builtinFormats = map[string]string{
+	"default":  defaultLogFormat,
+	"combined": `$remote_addr - $remote_user [$time_local] "$request" $status $body_bytes_sent "$http_referer" "$http_user_agent"`,
+	"main":     `$remote_addr - $remote_user [$time_local] "$request" $status $body_bytes_sent "$http_referer" "$http_user_agent" "$http_x_forwarded_for"`,
+	// the upstreaminfo format of ingress-nginx
+	"ingress": `$remote_addr - $remote_user [$time_local] "$request" $status $body_bytes_sent "$http_referer" "$http_user_agent" $request_length $request_time [$proxy_upstream_name] [$proxy_alternative_upstream_name] $upstream_addr $upstream_response_length $upstream_response_time $upstream_status $req_id`,
+}
+
+// nginxVariables maps nginx log_format variables to the named groups
+// understood by LogFormat.Parse
+var nginxVariables = map[string]string{
+	"remote_addr":              `(?P<ip>\S+)`,
+	"remote_user":              `(?P<user>\S+)`,
+	"time_local":               `(?P<time>[^\]]+)`,
+	"time_iso8601":             `(?P<time>\S+)`,
+	"request":                  `(?P<method>[^\s"]+) (?P<uri>[^\s"]+)(?: (?P<protocol>[^"]*))?`,
+	"request_method":           `(?P<method>\S+)`,
+	"request_uri":              `(?P<uri>\S+)`,
+	"server_protocol":          `(?P<protocol>\S+)`,
+	"status":                   `(?P<status>\d{3})`,
+	"body_bytes_sent":          `(?P<bytes>\d+)`,
+	"bytes_sent":               `(?P<bytes>\d+)`,
+	"http_referer":             `(?P<referer>[^"]*)`,
+	"http_user_agent":          `(?P<user_agent>[^"]*)`,
+	"upstream_response_time":   `(?P<response_time>` + upstreamTimes + `)`,
+	"upstream_status":          `(?P<upstream_status>` + upstreamStatuses + `)`,
+	"upstream_addr":            `(?P<upstream_addr>` + upstreamAddrs + `)`,
+	"upstream_response_length": `(?:` + upstreamTimes + `)`,
+	"upstream_connect_time":    `(?P<connect_time>` + upstreamTimes + `)`,
+	"upstream_header_time":     `(?P<header_time>` + upstreamTimes + `)`,
+	"upstream_cache_status":    `(?P<cache_status>[A-Z]+|-)`,
+	"proxy_upstream_name":      `(?P<upstream_name>[^\s"\]]*)`,
+	"request_id":               `(?P<request_id>[^\s"]*)`,
+	"req_id":                   `(?P<request_id>[^\s"]*)`,
+	"request_time":             `(?P<request_time>[\d.]+)`,
+}
+
+// LogFormat turns a log line into a LogEntry using a regex with named groups
+type LogFormat struct {
+	Name  string
+	regex *regexp.Regexp
+	group map[string]int
+}
+
+// CompileLogFormat accepts either a regular expression with named groups or
+// an nginx log_format string such as `$remote_addr - [$time_local] ...`
+func CompileLogFormat(name, format string) (*LogFormat, error) {
+	pattern := format
+	if strings.Contains(format, "$") && !strings.Contains(format, "(?P<") {
+		pattern = nginxFormatToRegex(format)
+	}
+
+	regex, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, fmt.Errorf("format %q: %w", name, err)
+	}
+
+	f := &LogFormat{Name: name, regex: regex, group: make(map[string]int)}
+	for i, groupName := range regex.SubexpNames() {
+		if groupName != "" {
+			f.group[groupName] = i
+		}
+	}
+	if _, ok := f.group["time"]; !ok {
+		return nil, fmt.Errorf("format %q: no time field ($time_local or (?P<time>...))", name)
+	}
+	return f, nil
+}
+
+// nginxFormatToRegex translates an nginx log_format into an anchored regex.
+// Variables without a known meaning still have to match but aren't captured.
+func nginxFormatToRegex(format string) string {
+	var b strings.Builder
+	b.WriteString("^")
+	used := make(map[string]bool)
+	for i := 0; i < len(format); {
+		if format[i] != '$' {
+			j := strings.IndexByte(format[i:], '$')
+			if j < 0 {
+				j = len(format) - i
+			}
+			b.WriteString(regexp.QuoteMeta(format[i : i+j]))
+			i += j
+			continue
+		}
+
+		j := i + 1
+		braced := j < len(format) && format[j] == '{'
+		if braced {
+			j++
+		}
+		start := j
+		for j < len(format) && (isBareKeyChar(format[j]) && format[j] != '-') {
+			j++
+		}
+		variable := format[start:j]
+		if braced && j < len(format) && format[j] == '}' {
+			j++
+		}
+
+		quoted := i > 0 && format[i-1] == '"'
+		pattern, known := nginxVariables[variable]
+		if !known || used[pattern] {
+			// Regexes can't repeat a group name, so a variable logged twice,
+			// or an alias like $req_id, is only captured the first time
+			if quoted {
+				pattern = `[^"]*`
+			} else {
+				pattern = `\S*`
+			}
+		}
+		used[pattern] = true
+		b.WriteString(pattern)
+		i = j
+	}
+	b.WriteString("$")
+	return b.String()
+}
+
+// timeLayouts are tried in order for the time field
+var timeLayouts = []string{"02/Jan/2006:15:04:05 -0700", time.RFC3339, "2006/01/02 15:04:05"}
+
+// Parse extracts an entry from line. The timestamp is converted to loc, or
+// kept in its logged offset when loc is nil.
+func (f *LogFormat) Parse(line string, loc *time.Location) (LogEntry, bool) {
+	matches := f.regex.FindStringSubmatch(line)
+	if matches == nil {
+		return LogEntry{}, false
+	}
+	field := func(name string) string {
+		if i, ok := f.group[name]; ok {
+			return matches[i]
+		}
+		return ""
+	}
+
+	parseLoc := loc
+	if parseLoc == nil {
+		parseLoc = time.Local
+	}
+	var timestamp time.Time
+	var err error
+	for _, layout := range timeLayouts {
+		if timestamp, err = time.ParseInLocation(layout, field("time"), parseLoc); err == nil {
+			break
+		}
+	}
+	if err != nil {
+		return LogEntry{}, false
+	}
+	if loc != nil {
+		timestamp = timestamp.In(loc)
+	}
+
+	entry := LogEntry{
+		IP:           field("ip"),
+		UserID:       field("ip"), // Assuming user ID is the same as IP, change accordingly
+		TimeStamp:    timestamp,
+		Method:       field("method"),
+		RequestURI:   field("uri"),
+		Protocol:     field("protocol"),
+		Status:       atoi(field("status")),
+		ResponseSize: atoi(field("bytes")),
+		Referer:      field("referer"),
+		UserAgent:    field("user_agent"),
+		RequestTime:  atof(field("request_time")),
+		UpstreamName: field("upstream_name"),
+		RequestID:    field("request_id"),
+	}
+	entry.Upstreams, entry.ResponseTime = parseUpstreams(field("upstream_addr"), field("upstream_status"), field("response_time"), field("connect_time"), field("header_time"))
+	if user := field("user"); user != "" && user != "-" {
+		entry.UserID = user
+	}
+	if cache := field("cache_status"); cache != "-" {
+		entry.CacheStatus = cache
+	}
+	return entry, true
+}
+
+// LineSegment is a part of a raw log line, Field names the parsed field it
+// holds or is empty for the text between fields
+type LineSegment struct {
+	Text  string `json:"text"`
+	Field string `json:"field,omitempty"`
+}
+
+// Segments splits line into the fields matched by the format and the text
+// between them, so the raw line can be shown with its fields highlighted. A
+// line that doesn't match is returned as a single segment.
+func (f *LogFormat) Segments(line string) []LineSegment {
+	loc := f.regex.FindStringSubmatchIndex(line)
+	if loc == nil {
+		return []LineSegment{{Text: line}}
+	}
+
+	type span struct {
+		start, end int
+		field      string
+	}
+	var spans []span
+	for name, i := range f.group {
+		if start, end := loc[2*i], loc[2*i+1]; start >= 0 && end > start {
+			spans = append(spans, span{start, end, name})
+		}
+	}
+	sort.Slice(spans, func(i, j int) bool { return spans[i].start < spans[j].start })
+
+	var segments []LineSegment
+	pos := 0
+	for _, sp := range spans {
+		if sp.start < pos {
+			continue // nested in a group already shown
+		}
+		if sp.start > pos {
+			segments = append(segments, LineSegment{Text: line[pos:sp.start]})
+		}
+		segments = append(segments, LineSegment{Text: line[sp.start:sp.end], Field: sp.field})
+		pos = sp.end
+	}
+	if pos < len(line) {
+		segments = append(segments, LineSegment{Text: line[pos:]})
+	}
+	return segments
+}
+
+// ParseStats counts what happened while reading a source
+type ParseStats struct {
+	Lines  int
+	Parsed int
+	Failed int
+}
+
+// Source is a named log source ready to be read
+type Source struct {
+	SourceConfig
+	format *LogFormat
+	enrich *Enricher
+	stream *logStream // stdin or a named pipe, nil for files
+
+	containers sync.Map // file name to its containerMeta
+
+	// location is the configured timezone; without one the offset of the
+	// first logged timestamp is used so ranges match the log's wall clock
+	location     *time.Location
+	locationOnce sync.Once
+}
+
+// Location returns the timezone entries and date ranges are shown in
+func (s *Source) Location() *time.Location {
+	s.locationOnce.Do(func() {
+		if s.location == nil {
+			s.location = s.detectLocation()
+		}
+	})
+	return s.location
+}
+
+// detectLocation reads the start of the newest file for a logged offset
+func (s *Source) detectLocation() *time.Location {
+	var lines []string
+	if s.stream != nil {
+		lines = s.stream.peek()
+	} else {
+		files, err := s.Files()
+		if err != nil {
+			return time.Local
+		}
+		reader, err := openLogFile(files[len(files)-1])
+		if err != nil {
+			return time.Local
+		}
+		defer reader.Close()
+		scanner := bufio.NewScanner(reader)
+		for i := 0; i < 100 && scanner.Scan(); i++ {
+			lines = append(lines, scanner.Text())
+		}
+	}
+
+	u := newUnwrapper(s.Container)
+	for _, line := range lines {
+		if line, ok := u.line(line); ok {
+			if entry, ok := s.format.Parse(line, nil); ok {
+				name, offset := entry.TimeStamp.Zone()
+				return time.FixedZone(name, offset)
+			}
+		}
+	}
+	return time.Local
+}
+
+// Files returns the files matched by the source path, oldest first so
+// rotated logs (access.log.2.gz, access.log.1, access.log) are read in order
+func (s *Source) Files() ([]string, error) {
+	if s.stream != nil {
+		return []string{s.Path}, nil
+	}
+	files, err := globByModTime(s.Path)
+	if err != nil {
+		return nil, err
+	}
+	if len(files) == 0 {
+		return nil, fmt.Errorf("source %q: no files match %s", s.Name, s.Path)
+	}
+	return files, nil
+}
+
+// globByModTime returns the files matching pattern, oldest first
+func globByModTime(pattern string) ([]string, error) {
+	files, err := filepath.Glob(pattern)
+	if err != nil {
+		return nil, err
+	}
+	modTimes := make(map[string]time.Time, len(files))
+	for _, name := range files {
+		if info, err := os.Stat(name); err == nil {
+			modTimes[name] = info.ModTime()
+		}
+	}
+	sort.SliceStable(files, func(i, j int) bool {
+		return modTimes[files[i]].Before(modTimes[files[j]])
+	})
+	return files, nil
+}
+
+// ReadEntries parses every file of the source and calls fn for each entry.
+// Lines that don't match the format are counted in the returned stats.
+func (s *Source) ReadEntries(fn func(LogEntry)) (ParseStats, error) {
+	var stats ParseStats
+	files, err := s.Files()
+	if err != nil {
+		return stats, err
+	}
+
+	for _, name := range files {
+		if err := s.readFile(name, &stats, fn); err != nil {
+			return stats, fmt.Errorf("%s: %w", name, err)
+		}
+	}
+	return stats, nil
+}
+
+func (s *Source) readFile(name string, stats *ParseStats, fn func(LogEntry)) error {
+	return s.scanFile(name, func(_ int64, line string) bool {
+		stats.Lines++
+		entry, ok := s.parseLine(name, line)
+		if !ok {
+			stats.Failed++
+			return true
+		}
+		stats.Parsed++
+		fn(entry)
+		return true
+	})
+}
+
+// parseLine parses one line of a file of the source into an enriched entry
+func (s *Source) parseLine(file, line string) (LogEntry, bool) {
+	entry, ok := s.format.Parse(line, s.Location())
+	if !ok {
+		return entry, false
+	}
+	entry.Source = s.Name
+	entry.VHost = s.VHost
+	s.containerMeta(file).apply(&entry)
+	s.enrich.Apply(&entry)
+	return entry, true
+}
+
+// containerMeta returns the pod and container of a file, read once from its
+// path
+func (s *Source) containerMeta(file string) containerMeta {
+	if s.stream != nil || s.Container == containerNone {
+		return containerMeta{}
+	}
+	if meta, ok := s.containers.Load(file); ok {
+		return meta.(containerMeta)
+	}
+	meta := containerMetaOf(file)
+	s.containers.Store(file, meta)
+	return meta
+}
+
+// scanFile scans a file of the source, or the lines of a stream with their
+// line number as offset. Container log lines are unwrapped, a line the
+// runtime split is passed once with the offset of its first part.
+func (s *Source) scanFile(name string, fn func(offset int64, line string) bool) error {
+	scan := func(fn func(offset int64, line string) bool) error { return scanFile(name, fn) }
+	if s.stream != nil {
+		// Peek for the time zone before the lines are consumed
+		s.Location()
+		scan = s.stream.scan
+	}
+	if s.Container == containerNone {
+		return scan(fn)
+	}
+
+	u := newUnwrapper(s.Container)
+	var start int64
+	return scan(func(offset int64, raw string) bool {
+		if !u.pending {
+			start = offset
+		}
+		line, ok := u.line(raw)
+		return !ok || fn(start, line)
+	})
+}
+
+// Retain keeps the lines of a stream as they arrive, so it can be read
+// repeatedly and followed. It does nothing for files.
+func (s *Source) Retain() {
+	if s.stream != nil {
+		s.stream.retain(func() { s.Location() })
+	}
+}
+
+// scanFile calls fn with the offset and text of every line of a file until
+// fn returns false. Offsets of .gz files count decompressed bytes, so they
+// stay valid when a log is compressed by logrotate.
+func scanFile(name string, fn func(offset int64, line string) bool) error {
+	reader, err := openLogFile(name)
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+
+	// Create a scanner to read the file line by line, remembering how many
+	// bytes each line took including its line ending
+	var offset, lineLen int64
+	scanner := bufio.NewScanner(reader)
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+	scanner.Split(func(data []byte, atEOF bool) (int, []byte, error) {
+		advance, token, err := bufio.ScanLines(data, atEOF)
+		if token != nil {
+			lineLen = int64(advance)
+		}
+		return advance, token, err
+	})
+	for scanner.Scan() {
+		if !fn(offset, scanner.Text()) {
+			return nil
+		}
+		offset += lineLen
+	}
+	return scanner.Err()
+}
+
+// openLogFile opens a log file, transparently decompressing .gz files
+func openLogFile(name string) (io.ReadCloser, error) {
+	file, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	if !strings.HasSuffix(name, ".gz") {
+		return file, nil
+	}
+	gz, err := gzip.NewReader(file)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	return gzipFile{gz, file}, nil
+}
+
+// gzipFile closes both the decompressor and the underlying file
+type gzipFile struct {
+	*gzip.Reader
+	file *os.File
+}
+
+func (g gzipFile) Close() error {
+	g.Reader.Close()
+	return g.file.Close()
+}
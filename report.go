@@ -0,0 +1,248 @@
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+// SecondRow is a row of the requests per second table
+type SecondRow struct {
+	Timestamp string
+	Count     int
+	URIs      map[string]int
+}
+
+// URIRow is a row of the request URL table
+type URIRow struct {
+	RequestURI string
+	Count      int
+}
+
+// IPRow is a row of the request IP table
+type IPRow struct {
+	IP    string
+	Count int
+}
+
+// MinuteRow is a row of the requests per minute table
+type MinuteRow struct {
+	Minute string
+	Count  int
+}
+
+// UserAgentRow is a row of the user agent table
+type UserAgentRow struct {
+	UserAgent string
+	Count     int
+}
+
+// StatusRow is a row of the status code table
+type StatusRow struct {
+	StatusCode int
+	Count      int
+}
+
+// StatusURIsRow is a row of the failed status codes table
+type StatusURIsRow struct {
+	StatusCode int
+	Count      int
+	URIs       map[string]int
+}
+
+// ViewData is the analysis rendered by the dashboard
+type ViewData struct {
+	HttpStatusCodes           map[int]map[string]int `json:"-"`
+	HttpStatusCodesSlice      []StatusURIsRow
+	Date                      string
+	TopRequestsPerSecond      map[string]int `json:"-"`
+	TopRequestsPerSecondSlice []SecondRow
+	TopRequestURIs            map[string]int `json:"-"`
+	TopRequestURIsSlice       []URIRow
+
+	TopRequestIP           map[string]int `json:"-"`
+	TopRequestAPISlice     []IPRow
+	RequestsPerMinute      map[string]int `json:"-"`
+	RequestsPerMinuteSlice []MinuteRow
+	UserAgentCounts        map[string]int `json:"-"`
+	UserAgentCountsSlice   []UserAgentRow
+	TotalRequests          int
+	TotalRequestsFormatted string
+
+	StatusCodeCounts      map[int]int `json:"-"`
+	StatusCodeCountsSlice []StatusRow
+	TopResponseTimes      []LogEntry
+	Pages                 map[string]TablePage
+	Source                string
+	Filter                string
+	Chips                 []FilterChip `json:"-"`
+	Stats                 ParseStats
+	Sites                 []string      `json:"-"`
+	User                  *User         `json:"-"`
+	Alerts                []Alert       `json:"-"`          // firing alerts of the source
+	ErrorLog              bool          `json:"-"`          // the error log can be shown
+	Cache                 *CacheSummary `json:",omitempty"` // nil when no request passed through a cache
+}
+
+// ReportOptions tune what a report contains
+type ReportOptions struct {
+	Mask        FieldMask             // fields redacted before aggregation
+	TopN        int                   // rows per table unless configured otherwise
+	TableLimits map[string]int        // configured rows per table
+	Tables      map[string]TableQuery // requested page of each table
+	Filter      *Filter               // entries to include, nil for all
+}
+
+// buildReport reads the log source and aggregates the entries between
+// startDateTime and endDateTime. Fields hidden by the mask are redacted
+// before aggregation so they never reach any table, and before filtering so
+// a filter can't be used to guess them.
+func buildReport(src *Source, startDateTime, endDateTime time.Time, opts ReportOptions) (*ViewData, error) {
+	// Track the number of requests per second, RequestURIs, requests per minute, total requests, and RequestURIs per second
+	requestsPerSecond := make(map[string]int)
+	requestURICounts := make(map[string]int)
+	requestsPerMinute := make(map[string]int)
+	totalRequests := 0
+	requestURIsPerSecond := make(map[string]map[string]int)
+	userAgentCounts := make(map[string]int)
+	statusCodeCounts := make(map[int]int)
+	httpStatusCodes := make(map[int]map[string]int)
+	var cache cacheCounter
+	slowQuery := opts.tableQuery("slow")
+	topResponseTimes := &slowestEntries{n: slowQuery.Page * slowQuery.Limit}
+	requestIPCounts := make(map[string]int)
+	// Read every file of the source and aggregate the entries in range
+	stats, err := src.ReadEntries(func(entry LogEntry) {
+		// Check if the entry's date matches the desired date range
+		if entry.TimeStamp.Before(startDateTime) || entry.TimeStamp.After(endDateTime) {
+			return
+		}
+		opts.Mask.Apply(&entry)
+		if !opts.Filter.Match(&entry) {
+			return
+		}
+
+		// Count requests per second
+		secondKey := entry.TimeStamp.Format("2006-01-02 15:04:05")
+		requestsPerSecond[secondKey]++
+
+		// Count RequestURIs
+		requestURICounts[entry.RequestURI]++
+
+		// Count RequestURIs
+		requestIPCounts[entry.IP]++
+
+		// Count requests per minute
+		minuteKey := entry.TimeStamp.Format("2006-01-02 15:04")
+		requestsPerMinute[minuteKey]++
+
+		// Increment total requests
+		totalRequests++
+
+		// Count RequestURIs per second
+		if _, ok := requestURIsPerSecond[secondKey]; !ok {
+			requestURIsPerSecond[secondKey] = make(map[string]int)
+		}
+		requestURIsPerSecond[secondKey][entry.RequestURI]++
+
+		// Count User Agents
+		userAgentCounts[entry.UserAgent]++
+
+		// Count Status Codes
+		statusCodeCounts[entry.Status]++
+
+		// Count http response status codes and corresponding RequestURIs
+		if _, ok := httpStatusCodes[entry.Status]; !ok {
+			httpStatusCodes[entry.Status] = make(map[string]int)
+		}
+		httpStatusCodes[entry.Status][entry.RequestURI]++
+
+		// Track top response times
+		topResponseTimes.Add(entry)
+
+		cache.add(&entry)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	viewData := ViewData{
+		Date:                   fmt.Sprintf("%s - %s", startDateTime.Format("2006-01-02 15:04:05"), endDateTime.Format("2006-01-02 15:04:05")),
+		TopRequestsPerSecond:   requestsPerSecond,
+		TopRequestURIs:         requestURICounts,
+		TopRequestIP:           requestIPCounts,
+		RequestsPerMinute:      requestsPerMinute,
+		UserAgentCounts:        userAgentCounts,
+		TotalRequests:          totalRequests,
+		TotalRequestsFormatted: formatNumberWithCommas(totalRequests),
+		StatusCodeCounts:       statusCodeCounts,
+		HttpStatusCodes:        httpStatusCodes,
+		Pages:                  make(map[string]TablePage),
+		Source:                 src.Name,
+		Filter:                 opts.Filter.String(),
+		Stats:                  stats,
+	}
+	if cache.requests > 0 {
+		summary := cache.summary()
+		viewData.Cache = &summary
+	}
+
+	// Populate the slice for the template (Top Requests Per Second)
+	keys, page := pageKeys("rps", requestsPerSecond, opts.tableQuery("rps"))
+	viewData.Pages["rps"] = page
+	for _, key := range keys {
+		viewData.TopRequestsPerSecondSlice = append(viewData.TopRequestsPerSecondSlice, SecondRow{Timestamp: key, Count: requestsPerSecond[key], URIs: requestURIsPerSecond[key]})
+	}
+
+	// Populate the slice for the template (Top RequestURIs)
+	uris, page := pageKeys("uris", requestURICounts, opts.tableQuery("uris"))
+	viewData.Pages["uris"] = page
+	for _, uri := range uris {
+		viewData.TopRequestURIsSlice = append(viewData.TopRequestURIsSlice, URIRow{RequestURI: uri, Count: requestURICounts[uri]})
+	}
+
+	// Populate the slice for the template (Top Request IPs)
+	ips, page := pageKeys("ips", requestIPCounts, opts.tableQuery("ips"))
+	viewData.Pages["ips"] = page
+	for _, ip := range ips {
+		viewData.TopRequestAPISlice = append(viewData.TopRequestAPISlice, IPRow{IP: ip, Count: requestIPCounts[ip]})
+	}
+
+	// Populate the slice for the template (Requests Per Minute)
+	minutes, page := pageKeys("rpm", requestsPerMinute, opts.tableQuery("rpm"))
+	viewData.Pages["rpm"] = page
+	for _, minute := range minutes {
+		viewData.RequestsPerMinuteSlice = append(viewData.RequestsPerMinuteSlice, MinuteRow{Minute: minute, Count: requestsPerMinute[minute]})
+	}
+
+	// Populate the slice for the template (User Agent Counts)
+	userAgents, page := pageKeys("agents", userAgentCounts, opts.tableQuery("agents"))
+	viewData.Pages["agents"] = page
+	for _, userAgent := range userAgents {
+		viewData.UserAgentCountsSlice = append(viewData.UserAgentCountsSlice, UserAgentRow{UserAgent: userAgent, Count: userAgentCounts[userAgent]})
+	}
+
+	// Populate the slice for the template (HTTP Status Code Counts)
+	codes, page := pageKeys("status", statusCodeCounts, opts.tableQuery("status"))
+	viewData.Pages["status"] = page
+	for _, code := range codes {
+		viewData.StatusCodeCountsSlice = append(viewData.StatusCodeCountsSlice, StatusRow{StatusCode: code, Count: statusCodeCounts[code]})
+	}
+
+	// Populate the slice for the template (Failed HTTP Status Codes, everything but 200)
+	failedCounts := make(map[int]int)
+	for code, count := range statusCodeCounts {
+		if code != 200 {
+			failedCounts[code] = count
+		}
+	}
+	failed, page := pageKeys("failed", failedCounts, opts.tableQuery("failed"))
+	viewData.Pages["failed"] = page
+	for _, code := range failed {
+		viewData.HttpStatusCodesSlice = append(viewData.HttpStatusCodesSlice, StatusURIsRow{StatusCode: code, Count: failedCounts[code], URIs: httpStatusCodes[code]})
+	}
+
+	// Populate the slice for the template (Slow Response Times)
+	viewData.TopResponseTimes, viewData.Pages["slow"] = topResponseTimes.Page(slowQuery)
+
+	return &viewData, nil
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+// newTestSource builds a source reading lines in the format of newTestApp
+func newTestSource(t *testing.T, lines []string) *Source {
+	t.Helper()
+	cfg := DefaultConfig()
+	format := builtinFormats["combined"] + ` $request_time $upstream_addr $upstream_status $upstream_response_time $upstream_cache_status`
+	cfg.Sources = []SourceConfig{
+		{Name: "site", Path: writeTestFile(t, "access.log", strings.Join(lines, "\n")+"\n"), Format: format, Timezone: "UTC"},
+	}
+	cfg.fillSourceDefaults()
+	sources, err := cfg.BuildSources()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return sources[0]
+}
+
+func TestBuildReportRequestsPerSecond(t *testing.T) {
+	src := newTestSource(t, []string{
+		`10.0.0.1 - - [19/Feb/2024:16:00:01 +0000] "GET /a HTTP/1.1" 200 1 "-" "curl" 0.1 - - - -`,
+		`10.0.0.1 - - [19/Feb/2024:16:00:01 +0000] "GET /a HTTP/1.1" 200 1 "-" "curl" 0.1 - - - -`,
+		`10.0.0.2 - - [19/Feb/2024:16:00:01 +0000] "GET /b HTTP/1.1" 200 1 "-" "curl" 0.1 - - - -`,
+		`10.0.0.2 - - [19/Feb/2024:16:00:02 +0000] "GET /b HTTP/1.1" 200 1 "-" "curl" 0.1 - - - -`,
+	})
+	start := time.Date(2024, 2, 19, 16, 0, 0, 0, time.UTC)
+	data, err := buildReport(src, start, start.Add(time.Hour), ReportOptions{TopN: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := map[string]map[string]int{
+		"2024-02-19 16:00:01": {"/a": 2, "/b": 1},
+		"2024-02-19 16:00:02": {"/b": 1},
+	}
+	if len(data.TopRequestsPerSecondSlice) != len(want) {
+		t.Fatalf("%d seconds, want %d", len(data.TopRequestsPerSecondSlice), len(want))
+	}
+	for _, row := range data.TopRequestsPerSecondSlice {
+		total := 0
+		for uri, count := range row.URIs {
+			if count != want[row.Timestamp][uri] {
+				t.Errorf("%s %s: %d requests, want %d", row.Timestamp, uri, count, want[row.Timestamp][uri])
+			}
+			total += count
+		}
+		// The URIs of a second add up to its requests
+		if total != row.Count {
+			t.Errorf("%s: URIs add up to %d of %d requests", row.Timestamp, total, row.Count)
+		}
+	}
+}
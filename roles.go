@@ -0,0 +1,184 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/netip"
+	"os"
+	"path"
+	"strings"
+)
+
+// FieldMask lists the LogEntry fields that are redacted for a user
+type FieldMask struct {
+	IP         bool
+	UserAgent  bool
+	RequestURI bool
+}
+
+// maskFieldNames maps the names used in the roles file to mask fields
+var maskFieldNames = map[string]func(*FieldMask){
+	"ip":          func(m *FieldMask) { m.IP = true },
+	"user_agent":  func(m *FieldMask) { m.UserAgent = true },
+	"request_uri": func(m *FieldMask) { m.RequestURI = true },
+}
+
+// Apply redacts the masked fields of entry. IPs are reduced to their network
+// (/24 for IPv4, /48 for IPv6) so traffic can still be grouped, and request
+// URIs and referers lose their query string.
+func (m FieldMask) Apply(entry *LogEntry) {
+	if m.IP {
+		entry.IP = maskIP(entry.IP)
+		entry.UserID = entry.IP
+	}
+	if m.UserAgent {
+		entry.UserAgent = "(masked)"
+	}
+	if m.RequestURI {
+		entry.RequestURI = maskQuery(entry.RequestURI)
+		entry.Referer = maskQuery(entry.Referer)
+	}
+}
+
+func maskQuery(uri string) string {
+	if i := strings.IndexByte(uri, '?'); i >= 0 {
+		return uri[:i] + "?(masked)"
+	}
+	return uri
+}
+
+func maskIP(ip string) string {
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return "(masked)"
+	}
+	bits := 24
+	if addr.Is6() && !addr.Is4In6() {
+		bits = 48
+	}
+	prefix, err := addr.Unmap().Prefix(bits)
+	if err != nil {
+		return "(masked)"
+	}
+	return prefix.String()
+}
+
+// Role grants access to a set of log sources, optionally with masked fields
+type Role struct {
+	Sources []string `json:"sources"` // source names or path.Match patterns
+	Mask    []string `json:"mask"`    // ip, user_agent, request_uri
+}
+
+// RolesConfig assigns roles to users and OIDC groups
+type RolesConfig struct {
+	Roles        map[string]Role     `json:"roles"`
+	Users        map[string][]string `json:"users"`
+	Groups       map[string][]string `json:"groups"`
+	DefaultRoles []string            `json:"default_roles"`
+}
+
+// Access is what a single user may see
+type Access struct {
+	Sources []string
+	Mask    FieldMask
+}
+
+// fullAccess is used when no roles file is configured
+var fullAccess = Access{Sources: []string{"*"}}
+
+// LoadRoles reads and validates a JSON roles file
+func LoadRoles(filename string) (*RolesConfig, error) {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	var cfg RolesConfig
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		return nil, fmt.Errorf("%s: %w", filename, err)
+	}
+
+	for name, role := range cfg.Roles {
+		for _, pattern := range role.Sources {
+			if _, err := path.Match(pattern, ""); err != nil {
+				return nil, fmt.Errorf("%s: role %q: bad source pattern %q", filename, name, pattern)
+			}
+		}
+		for _, field := range role.Mask {
+			if _, ok := maskFieldNames[field]; !ok {
+				return nil, fmt.Errorf("%s: role %q: unknown mask field %q", filename, name, field)
+			}
+		}
+	}
+
+	check := func(owner string, roles []string) error {
+		for _, role := range roles {
+			if _, ok := cfg.Roles[role]; !ok {
+				return fmt.Errorf("%s: %s refers to undefined role %q", filename, owner, role)
+			}
+		}
+		return nil
+	}
+	for user, roles := range cfg.Users {
+		if err := check("user "+user, roles); err != nil {
+			return nil, err
+		}
+	}
+	for group, roles := range cfg.Groups {
+		if err := check("group "+group, roles); err != nil {
+			return nil, err
+		}
+	}
+	if err := check("default_roles", cfg.DefaultRoles); err != nil {
+		return nil, err
+	}
+	return &cfg, nil
+}
+
+// AccessFor combines the roles of user. Sources are the union of all roles,
+// and a field is only masked if every role masks it. Users without a role
+// get the default roles; anonymous requests only happen with auth disabled.
+func (c *RolesConfig) AccessFor(user *User) Access {
+	if c == nil {
+		return fullAccess
+	}
+
+	var roleNames []string
+	if user != nil {
+		roleNames = append(roleNames, c.Users[user.Name]...)
+		for _, group := range user.Groups {
+			roleNames = append(roleNames, c.Groups[group]...)
+		}
+	}
+	if len(roleNames) == 0 {
+		roleNames = c.DefaultRoles
+	}
+	if len(roleNames) == 0 {
+		return Access{}
+	}
+
+	access := Access{Mask: FieldMask{IP: true, UserAgent: true, RequestURI: true}}
+	for _, name := range roleNames {
+		role := c.Roles[name]
+		access.Sources = append(access.Sources, role.Sources...)
+
+		var mask FieldMask
+		for _, field := range role.Mask {
+			maskFieldNames[field](&mask)
+		}
+		access.Mask.IP = access.Mask.IP && mask.IP
+		access.Mask.UserAgent = access.Mask.UserAgent && mask.UserAgent
+		access.Mask.RequestURI = access.Mask.RequestURI && mask.RequestURI
+	}
+	return access
+}
+
+// CanView reports whether the named log source is visible
+func (a Access) CanView(source string) bool {
+	for _, pattern := range a.Sources {
+		if ok, _ := path.Match(pattern, source); ok {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+var testRoles = &RolesConfig{
+	Roles: map[string]Role{
+		"admin":   {Sources: []string{"*"}},
+		"support": {Sources: []string{"shop-*"}, Mask: []string{"ip", "user_agent", "request_uri"}},
+		"auditor": {Sources: []string{"billing"}, Mask: []string{"ip"}},
+	},
+	Users:        map[string][]string{"alice": {"admin"}, "bob": {"support", "auditor"}},
+	Groups:       map[string][]string{"ops": {"auditor"}},
+	DefaultRoles: []string{"support"},
+}
+
+func TestAccessFor(t *testing.T) {
+	tests := []struct {
+		name    string
+		user    *User
+		mask    FieldMask
+		visible []string
+		hidden  []string
+	}{
+		{"admin", &User{Name: "alice"}, FieldMask{}, []string{"shop-eu", "billing", "other"}, nil},
+		{"default roles", &User{Name: "carol"}, FieldMask{IP: true, UserAgent: true, RequestURI: true}, []string{"shop-eu", "shop-us"}, []string{"shop", "billing", "shop-eu/x"}},
+		{"anonymous", nil, FieldMask{IP: true, UserAgent: true, RequestURI: true}, []string{"shop-eu"}, []string{"billing"}},
+		// Only the fields every role masks stay masked
+		{"two roles", &User{Name: "bob"}, FieldMask{IP: true}, []string{"shop-eu", "billing"}, []string{"other"}},
+		{"role from a group", &User{Name: "dave", Groups: []string{"ops"}}, FieldMask{IP: true}, []string{"billing"}, []string{"shop-eu"}},
+		{"user and group roles", &User{Name: "alice", Groups: []string{"ops"}}, FieldMask{}, []string{"billing", "other"}, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			access := testRoles.AccessFor(tt.user)
+			if access.Mask != tt.mask {
+				t.Errorf("mask %+v, want %+v", access.Mask, tt.mask)
+			}
+			for _, source := range tt.visible {
+				if !access.CanView(source) {
+					t.Errorf("cannot view %q", source)
+				}
+			}
+			for _, source := range tt.hidden {
+				if access.CanView(source) {
+					t.Errorf("can view %q", source)
+				}
+			}
+		})
+	}
+}
+
+func TestAccessForWithoutRoles(t *testing.T) {
+	var none *RolesConfig
+	if access := none.AccessFor(nil); !access.CanView("anything") || access.Mask != (FieldMask{}) {
+		t.Errorf("no roles file: %+v", access)
+	}
+
+	noDefault := &RolesConfig{Roles: testRoles.Roles}
+	if access := noDefault.AccessFor(&User{Name: "carol"}); access.CanView("shop-eu") {
+		t.Errorf("user without roles: %+v", access)
+	}
+}
+
+func TestFieldMaskApply(t *testing.T) {
+	tests := []struct {
+		name        string
+		mask        FieldMask
+		entry, want LogEntry
+	}{
+		{"ipv4", FieldMask{IP: true},
+			LogEntry{IP: "203.0.113.77", UserID: "203.0.113.77"},
+			LogEntry{IP: "203.0.113.0/24", UserID: "203.0.113.0/24"}},
+		{"ipv6", FieldMask{IP: true},
+			LogEntry{IP: "2001:db8:1234:5678::1"},
+			LogEntry{IP: "2001:db8:1234::/48", UserID: "2001:db8:1234::/48"}},
+		{"ipv4 mapped ipv6", FieldMask{IP: true},
+			LogEntry{IP: "::ffff:198.51.100.9"},
+			LogEntry{IP: "198.51.100.0/24", UserID: "198.51.100.0/24"}},
+		{"not an ip", FieldMask{IP: true},
+			LogEntry{IP: "unix:"},
+			LogEntry{IP: "(masked)", UserID: "(masked)"}},
+		{"user agent", FieldMask{UserAgent: true},
+			LogEntry{UserAgent: "curl/8.5.0"},
+			LogEntry{UserAgent: "(masked)"}},
+		{"query strings", FieldMask{RequestURI: true},
+			LogEntry{RequestURI: "/reset?token=secret&u=1", Referer: "https://shop.example.com/cart?session=abc"},
+			LogEntry{RequestURI: "/reset?(masked)", Referer: "https://shop.example.com/cart?(masked)"}},
+		{"no query string", FieldMask{RequestURI: true},
+			LogEntry{RequestURI: "/about", Referer: "https://example.com/"},
+			LogEntry{RequestURI: "/about", Referer: "https://example.com/"}},
+		{"unmasked", FieldMask{},
+			LogEntry{IP: "203.0.113.77", UserAgent: "curl/8.5.0", RequestURI: "/?q=1", Referer: "/?r=2"},
+			LogEntry{IP: "203.0.113.77", UserAgent: "curl/8.5.0", RequestURI: "/?q=1", Referer: "/?r=2"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			entry := tt.entry
+			tt.mask.Apply(&entry)
+			if entry.IP != tt.want.IP || entry.UserID != tt.want.UserID || entry.UserAgent != tt.want.UserAgent ||
+				entry.RequestURI != tt.want.RequestURI || entry.Referer != tt.want.Referer {
+				t.Errorf("got %+v\nwant %+v", entry, tt.want)
+			}
+		})
+	}
+}
+
+func TestLoadRolesErrors(t *testing.T) {
+	tests := []struct {
+		json, err string
+	}{
+		{`{"roles": {"a": {"sources": ["["]}}}`, "bad source pattern"},
+		{`{"roles": {"a": {"mask": ["email"]}}}`, `unknown mask field "email"`},
+		{`{"roles": {}, "users": {"alice": ["admin"]}}`, `user alice refers to undefined role "admin"`},
+		{`{"roles": {}, "groups": {"ops": ["admin"]}}`, `group ops refers to undefined role "admin"`},
+		{`{"default_roles": ["viewer"]}`, `default_roles refers to undefined role "viewer"`},
+		{`{"roles": []}`, "roles.json"},
+	}
+	for _, tt := range tests {
+		_, err := LoadRoles(writeTestFile(t, "roles.json", tt.json))
+		if err == nil || !strings.Contains(err.Error(), tt.err) {
+			t.Errorf("LoadRoles(%s) error %v, want %q", tt.json, err, tt.err)
+		}
+	}
+}
@@ -0,0 +1,428 @@
+package main
+
+import (
+	"bytes"
+	"cmp"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"path"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Rollup defaults, used for the settings left unset
+const (
+	defaultRollupInterval = time.Minute
+	defaultRollupPrefix   = "nginx"
+)
+
+// maxRollupPoll is the longest the logs are left unread, so entries are
+// counted in about the interval they were written in
+const maxRollupPoll = 10 * time.Second
+
+// maxUDPPayload keeps datagrams below the usual MTU
+const maxUDPPayload = 1432
+
+// graphiteUnsafe matches what can't be part of a Graphite path segment
+var graphiteUnsafe = regexp.MustCompile(`[^A-Za-z0-9_-]`)
+
+// RollupConfig periodically writes aggregates of the entries appended to
+// the sources to a metrics store
+type RollupConfig struct {
+	Name     string            `toml:"name"`
+	Type     string            `toml:"type"`     // influxdb, graphite or statsd
+	URL      string            `toml:"url"`      // http(s):// or udp:// for influxdb, tcp:// or udp:// for graphite, udp:// for statsd
+	Source   string            `toml:"source"`   // name or pattern, all sources when unset
+	Filter   string            `toml:"filter"`   // only count the entries matching it
+	Interval time.Duration     `toml:"interval"` // the rollup period
+	Prefix   string            `toml:"prefix"`   // influxdb measurement, or the first path segment
+	Tags     map[string]string `toml:"tags"`     // field -> tag name, e.g. class = "status_class"
+	Tagged   bool              `toml:"tagged"`   // graphite 1.1 or DogStatsD tags instead of path segments
+	Headers  map[string]string `toml:"headers"`  // e.g. Authorization = "Token ..." for InfluxDB 2
+}
+
+// rollupTag is a field written as a tag
+type rollupTag struct {
+	name  string
+	value func(*LogEntry) string
+}
+
+// rollupGroup accumulates the entries with the same tag values
+type rollupGroup struct {
+	tags      []string
+	count     int64
+	bytes     int64
+	classes   [6]int64 // by status / 100
+	rtSum     float64
+	rtMax     float64
+	latencies []float64
+}
+
+// rollupField is a value written for a group. Counters are the totals of
+// the interval, the others are gauges.
+type rollupField struct {
+	name    string
+	value   float64
+	counter bool
+}
+
+// Rollup aggregates entries per interval and writes them as InfluxDB line
+// protocol, Graphite plaintext or StatsD packets
+type Rollup struct {
+	cfg    RollupConfig
+	filter *Filter
+	tags   []rollupTag
+	scheme string
+	host   string
+	client *http.Client
+
+	mu      sync.Mutex
+	groups  map[string]*rollupGroup
+	done    chan struct{}
+	stopped chan struct{}
+}
+
+// NewRollups creates the configured rollups, ready to be started
+func NewRollups(configs []RollupConfig) ([]*Rollup, error) {
+	var rollups []*Rollup
+	for _, c := range configs {
+		rollup, err := newRollup(c)
+		if err != nil {
+			return nil, fmt.Errorf("rollup %q: %w", c.Name, err)
+		}
+		rollups = append(rollups, rollup)
+	}
+	return rollups, nil
+}
+
+// validateRollups reports the problems of the rollup configs
+func validateRollups(configs []RollupConfig) []error {
+	var errs []error
+	names := make(map[string]bool)
+	for i, c := range configs {
+		if c.Name == "" || names[c.Name] {
+			errs = append(errs, fmt.Errorf("rollups[%d]: missing or duplicate name %q", i, c.Name))
+		}
+		names[c.Name] = true
+		if _, err := newRollup(c); err != nil {
+			errs = append(errs, fmt.Errorf("rollup %q: %w", c.Name, err))
+		}
+	}
+	return errs
+}
+
+func newRollup(c RollupConfig) (*Rollup, error) {
+	u, err := url.Parse(c.URL)
+	if err != nil || u.Host == "" {
+		return nil, fmt.Errorf("invalid url %q", c.URL)
+	}
+	schemes := map[string][]string{
+		"influxdb": {"http", "https", "udp"},
+		"graphite": {"tcp", "udp"},
+		"statsd":   {"udp"},
+	}
+	allowed, ok := schemes[c.Type]
+	if !ok {
+		return nil, fmt.Errorf("unknown type %q, use influxdb, graphite or statsd", c.Type)
+	}
+	if !slices.Contains(allowed, u.Scheme) {
+		return nil, fmt.Errorf("%s url must start with %s://", c.Type, strings.Join(allowed, ":// or "))
+	}
+	if _, err := path.Match(c.Source, ""); err != nil {
+		return nil, fmt.Errorf("invalid source pattern %q", c.Source)
+	}
+	filter, err := ParseFilter(c.Filter)
+	if err != nil {
+		return nil, fmt.Errorf("filter: %w", err)
+	}
+	if c.Interval == 0 {
+		c.Interval = defaultRollupInterval
+	}
+	if c.Interval < time.Second {
+		return nil, errors.New("interval must be at least 1s")
+	}
+	c.Prefix = cmp.Or(c.Prefix, defaultRollupPrefix)
+
+	tagMap := c.Tags
+	if tagMap == nil {
+		tagMap = map[string]string{"source": "source"}
+	}
+	var tags []rollupTag
+	for field, name := range tagMap {
+		value := groupDimensions[field]
+		if value == nil {
+			return nil, fmt.Errorf("unknown tag field %q", field)
+		}
+		tags = append(tags, rollupTag{name: cmp.Or(name, field), value: value})
+	}
+	slices.SortFunc(tags, func(a, b rollupTag) int { return strings.Compare(a.name, b.name) })
+
+	return &Rollup{
+		cfg:     c,
+		filter:  filter,
+		tags:    tags,
+		scheme:  u.Scheme,
+		host:    u.Host,
+		client:  &http.Client{Timeout: deliveryTimeout},
+		groups:  make(map[string]*rollupGroup),
+		done:    make(chan struct{}),
+		stopped: make(chan struct{}),
+	}, nil
+}
+
+// PollInterval is how often the rollup needs the logs read
+func (r *Rollup) PollInterval() time.Duration {
+	return min(r.cfg.Interval, maxRollupPoll)
+}
+
+// Start begins writing a rollup at the end of every interval
+func (r *Rollup) Start() {
+	go r.run()
+}
+
+// Stop ends the rollup, writing the partial last interval
+func (r *Rollup) Stop() {
+	close(r.done)
+	<-r.stopped
+}
+
+// Observe counts an entry, it is subscribed to the follower
+func (r *Rollup) Observe(entry LogEntry) {
+	if r.cfg.Source != "" {
+		if ok, _ := path.Match(r.cfg.Source, entry.Source); !ok {
+			return
+		}
+	}
+	if !r.filter.Match(&entry) {
+		return
+	}
+
+	values := make([]string, len(r.tags))
+	for i, tag := range r.tags {
+		values[i] = tag.value(&entry)
+	}
+	key := strings.Join(values, "\x00")
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	g := r.groups[key]
+	if g == nil {
+		g = &rollupGroup{tags: values}
+		r.groups[key] = g
+	}
+	g.count++
+	g.bytes += int64(entry.ResponseSize)
+	if class := entry.Status / 100; class >= 1 && class <= 5 {
+		g.classes[class]++
+	}
+	duration := requestDuration(&entry)
+	g.rtSum += duration
+	g.rtMax = max(g.rtMax, duration)
+	g.latencies = append(g.latencies, duration)
+}
+
+// run writes the rollups at the interval boundaries, like 12:01:00 for
+// one minute, so several viewers line up
+func (r *Rollup) run() {
+	defer close(r.stopped)
+	for {
+		now := time.Now()
+		next := now.Truncate(r.cfg.Interval).Add(r.cfg.Interval)
+		timer := time.NewTimer(next.Sub(now))
+		select {
+		case <-r.done:
+			timer.Stop()
+			r.flush(time.Now())
+			return
+		case <-timer.C:
+		}
+		r.flush(next)
+	}
+}
+
+// flush writes the groups of the interval ending at ts and starts a new one
+func (r *Rollup) flush(ts time.Time) {
+	r.mu.Lock()
+	groups := r.groups
+	r.groups = make(map[string]*rollupGroup)
+	r.mu.Unlock()
+	if len(groups) == 0 {
+		return
+	}
+
+	keys := make([]string, 0, len(groups))
+	for key := range groups {
+		keys = append(keys, key)
+	}
+	slices.Sort(keys)
+	var lines []string
+	for _, key := range keys {
+		g := groups[key]
+		fields := r.fields(g)
+		switch r.cfg.Type {
+		case "influxdb":
+			lines = append(lines, r.influxLine(g, fields, ts))
+		case "graphite":
+			lines = append(lines, r.graphiteLines(g, fields, ts)...)
+		case "statsd":
+			lines = append(lines, r.statsdLines(g, fields)...)
+		}
+	}
+	if err := r.send(lines); err != nil {
+		log.Printf("Rollup %s: %v", r.cfg.Name, err)
+	}
+}
+
+// fields computes the values of a group, per second rates and latencies
+// like the dashboard's
+func (r *Rollup) fields(g *rollupGroup) []rollupField {
+	slices.Sort(g.latencies)
+	fields := []rollupField{
+		{"requests", float64(g.count), true},
+		{"rps", float64(g.count) / r.cfg.Interval.Seconds(), false},
+		{"bytes", float64(g.bytes), true},
+	}
+	for class := 1; class <= 5; class++ {
+		fields = append(fields, rollupField{fmt.Sprintf("status_%dxx", class), float64(g.classes[class]), true})
+	}
+	return append(fields,
+		rollupField{"rt_avg", g.rtSum / float64(g.count), false},
+		rollupField{"rt_p50", percentile(g.latencies, 50), false},
+		rollupField{"rt_p95", percentile(g.latencies, 95), false},
+		rollupField{"rt_p99", percentile(g.latencies, 99), false},
+		rollupField{"rt_max", g.rtMax, false},
+	)
+}
+
+// influxLine writes a group as one line, e.g.
+// nginx,source=shop requests=12i,rps=0.2,...,rt_max=1.2 1700000000000000000
+func (r *Rollup) influxLine(g *rollupGroup, fields []rollupField, ts time.Time) string {
+	escape := strings.NewReplacer(",", `\,`, " ", `\ `, "=", `\=`)
+	var b strings.Builder
+	b.WriteString(strings.NewReplacer(",", `\,`, " ", `\ `).Replace(r.cfg.Prefix))
+	for i, tag := range r.tags {
+		// Empty tag values aren't allowed
+		if g.tags[i] != "" {
+			fmt.Fprintf(&b, ",%s=%s", escape.Replace(tag.name), escape.Replace(g.tags[i]))
+		}
+	}
+	for i, f := range fields {
+		sep := ","
+		if i == 0 {
+			sep = " "
+		}
+		if f.counter {
+			fmt.Fprintf(&b, "%s%s=%di", sep, f.name, int64(f.value))
+		} else {
+			fmt.Fprintf(&b, "%s%s=%s", sep, f.name, strconv.FormatFloat(f.value, 'g', -1, 64))
+		}
+	}
+	fmt.Fprintf(&b, " %d", ts.UnixNano())
+	return b.String()
+}
+
+// graphiteLines writes a line per field, e.g. nginx.shop.requests 12 1700000000,
+// or nginx.requests;source=shop 12 1700000000 when tagged
+func (r *Rollup) graphiteLines(g *rollupGroup, fields []rollupField, ts time.Time) []string {
+	prefix, suffix := r.metricPath(g, func(name, value string) string {
+		return ";" + name + "=" + strings.NewReplacer(";", "_", "~", "_", " ", "_").Replace(value)
+	})
+	lines := make([]string, len(fields))
+	for i, f := range fields {
+		lines[i] = fmt.Sprintf("%s.%s%s %s %d", prefix, f.name, suffix, strconv.FormatFloat(f.value, 'f', -1, 64), ts.Unix())
+	}
+	return lines
+}
+
+// statsdLines writes counters and gauges, e.g. nginx.shop.requests:12|c, or
+// nginx.requests:12|c|#source:shop when tagged
+func (r *Rollup) statsdLines(g *rollupGroup, fields []rollupField) []string {
+	first := true
+	prefix, suffix := r.metricPath(g, func(name, value string) string {
+		sep := ","
+		if first {
+			sep, first = "|#", false
+		}
+		return sep + name + ":" + strings.NewReplacer(",", "_", "|", "_", "#", "_").Replace(value)
+	})
+	lines := make([]string, len(fields))
+	for i, f := range fields {
+		kind := "g"
+		if f.counter {
+			kind = "c"
+		}
+		lines[i] = fmt.Sprintf("%s.%s:%s|%s%s", prefix, f.name, strconv.FormatFloat(f.value, 'f', -1, 64), kind, suffix)
+	}
+	return lines
+}
+
+// metricPath returns what goes before and after the field name: the tag
+// values as path segments, or the tags written by tag when tagged
+func (r *Rollup) metricPath(g *rollupGroup, tag func(name, value string) string) (string, string) {
+	if r.cfg.Tagged {
+		var suffix strings.Builder
+		for i, t := range r.tags {
+			if g.tags[i] != "" {
+				suffix.WriteString(tag(t.name, g.tags[i]))
+			}
+		}
+		return r.cfg.Prefix, suffix.String()
+	}
+	segments := []string{r.cfg.Prefix}
+	for _, value := range g.tags {
+		segments = append(segments, graphiteUnsafe.ReplaceAllString(cmp.Or(value, "none"), "_"))
+	}
+	return strings.Join(segments, "."), ""
+}
+
+// send writes the lines over the url's transport. HTTP and TCP are retried,
+// UDP datagrams are sent once, split at line boundaries.
+func (r *Rollup) send(lines []string) error {
+	switch r.scheme {
+	case "http", "https":
+		payload := []byte(strings.Join(lines, "\n") + "\n")
+		return retry(func() error {
+			_, err := postPayload(r.client, r.cfg.URL, "text/plain; charset=utf-8", r.cfg.Headers, payload)
+			return err
+		})
+	case "tcp":
+		payload := []byte(strings.Join(lines, "\n") + "\n")
+		return retry(func() error {
+			conn, err := net.DialTimeout("tcp", r.host, deliveryTimeout)
+			if err != nil {
+				return err
+			}
+			defer conn.Close()
+			conn.SetWriteDeadline(time.Now().Add(deliveryTimeout))
+			_, err = conn.Write(payload)
+			return err
+		})
+	}
+
+	conn, err := net.Dial("udp", r.host)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	var packet bytes.Buffer
+	for _, line := range lines {
+		if packet.Len() > 0 && packet.Len()+len(line)+1 > maxUDPPayload {
+			if _, err := conn.Write(packet.Bytes()); err != nil {
+				return err
+			}
+			packet.Reset()
+		}
+		packet.WriteString(line)
+		packet.WriteByte('\n')
+	}
+	_, err = conn.Write(packet.Bytes())
+	return err
+}
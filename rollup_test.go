@@ -0,0 +1,206 @@
+package main
+
+import (
+	"cmp"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestNewRollupErrors(t *testing.T) {
+	valid := RollupConfig{Name: "r", Type: "influxdb", URL: "http://localhost:8086/write"}
+	tests := []struct {
+		change func(*RollupConfig)
+		err    string
+	}{
+		{func(c *RollupConfig) { c.URL = "" }, `invalid url ""`},
+		{func(c *RollupConfig) { c.Type = "prometheus" }, `unknown type "prometheus", use influxdb, graphite or statsd`},
+		{func(c *RollupConfig) { c.Type = "graphite" }, "graphite url must start with tcp:// or udp://"},
+		{func(c *RollupConfig) { c.Type, c.URL = "statsd", "tcp://localhost:8125" }, "statsd url must start with udp://"},
+		{func(c *RollupConfig) { c.Source = "[" }, `invalid source pattern "["`},
+		{func(c *RollupConfig) { c.Filter = "status>>1" }, "filter: "},
+		{func(c *RollupConfig) { c.Interval = 500 * time.Millisecond }, "interval must be at least 1s"},
+		{func(c *RollupConfig) { c.Tags = map[string]string{"colour": ""} }, `unknown tag field "colour"`},
+	}
+	for _, tt := range tests {
+		c := valid
+		tt.change(&c)
+		_, err := newRollup(c)
+		if err == nil || !strings.HasPrefix(err.Error(), tt.err) {
+			t.Errorf("%+v: error %v, want %q", c, err, tt.err)
+		}
+	}
+
+	errs := validateRollups([]RollupConfig{valid, valid, {Type: "statsd", URL: "udp://localhost:8125"}})
+	if len(errs) != 2 || !strings.Contains(errs[0].Error(), `duplicate name "r"`) || !strings.Contains(errs[1].Error(), `duplicate name ""`) {
+		t.Errorf("validateRollups = %v", errs)
+	}
+}
+
+func TestRollupObserve(t *testing.T) {
+	r, err := newRollup(RollupConfig{Type: "statsd", URL: "udp://localhost:8125", Source: "shop-*", Filter: "status>=500",
+		Tags: map[string]string{"source": "", "path": "route"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, e := range []LogEntry{
+		{Source: "shop-eu", RequestURI: "/a?x", Status: 500, ResponseSize: 10, RequestTime: 0.5, ResponseTime: 0.1},
+		{Source: "shop-eu", RequestURI: "/a", Status: 503, ResponseSize: 20, ResponseTime: 1.5},
+		{Source: "shop-eu", RequestURI: "/a", Status: 200},
+		{Source: "shop-us", RequestURI: "/b", Status: 502},
+		{Source: "blog", RequestURI: "/a", Status: 500},
+	} {
+		r.Observe(e)
+	}
+
+	if len(r.groups) != 2 {
+		t.Fatalf("%d groups", len(r.groups))
+	}
+	// Tags are ordered by their name
+	g := r.groups["/a\x00shop-eu"]
+	if g == nil || g.count != 2 || g.bytes != 30 || g.classes[5] != 2 || g.rtMax != 1.5 || g.rtSum != 2 {
+		t.Fatalf("group %+v", g)
+	}
+	fields := make(map[string]float64)
+	for _, f := range r.fields(g) {
+		fields[f.name] = f.value
+	}
+	want := map[string]float64{
+		"requests": 2, "rps": 2.0 / 60, "bytes": 30, "status_2xx": 0, "status_5xx": 2,
+		"rt_avg": 1, "rt_p50": 0.5, "rt_p95": 1.5, "rt_max": 1.5,
+	}
+	for name, v := range want {
+		if fields[name] != v {
+			t.Errorf("%s = %v, want %v", name, fields[name], v)
+		}
+	}
+}
+
+// testRollupGroup is a group of a single request from a source whose name
+// needs escaping
+func testRollupGroup(t *testing.T, c RollupConfig) (*Rollup, *rollupGroup) {
+	t.Helper()
+	c.URL = cmp.Or(c.URL, "udp://localhost:9999")
+	c.Tags = map[string]string{"source": "", "class": "", "user": ""}
+	r, err := newRollup(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.Observe(LogEntry{Source: "my shop,eu", Status: 200, ResponseSize: 100, RequestTime: 0.5})
+	for _, g := range r.groups {
+		return r, g
+	}
+	t.Fatal("no group")
+	return nil, nil
+}
+
+func TestRollupLines(t *testing.T) {
+	ts := time.Date(2024, 2, 19, 16, 1, 0, 0, time.UTC)
+
+	r, g := testRollupGroup(t, RollupConfig{Type: "influxdb", URL: "http://localhost:8086/write", Prefix: "web requests"})
+	want := fmt.Sprintf(`web\ requests,class=2xx,source=my\ shop\,eu requests=1i,rps=%v,bytes=100i,status_1xx=0i,status_2xx=1i,status_3xx=0i,status_4xx=0i,status_5xx=0i,`+
+		`rt_avg=0.5,rt_p50=0.5,rt_p95=0.5,rt_p99=0.5,rt_max=0.5 %d`, 1.0/60, ts.UnixNano())
+	if got := r.influxLine(g, r.fields(g), ts); got != want {
+		t.Errorf("influx\n%s\nwant\n%s", got, want)
+	}
+
+	tests := []struct {
+		cfg         RollupConfig
+		first, last string
+	}{
+		{RollupConfig{Type: "graphite"},
+			fmt.Sprintf("nginx.2xx.my_shop_eu.none.requests 1 %d", ts.Unix()), fmt.Sprintf("nginx.2xx.my_shop_eu.none.rt_max 0.5 %d", ts.Unix())},
+		{RollupConfig{Type: "graphite", Tagged: true},
+			fmt.Sprintf("nginx.requests;class=2xx;source=my_shop,eu 1 %d", ts.Unix()), fmt.Sprintf("nginx.rt_max;class=2xx;source=my_shop,eu 0.5 %d", ts.Unix())},
+		{RollupConfig{Type: "statsd"}, "nginx.2xx.my_shop_eu.none.requests:1|c", "nginx.2xx.my_shop_eu.none.rt_max:0.5|g"},
+		{RollupConfig{Type: "statsd", Tagged: true, Prefix: "app"}, "app.requests:1|c|#class:2xx,source:my shop_eu", "app.rt_max:0.5|g|#class:2xx,source:my shop_eu"},
+	}
+	for _, tt := range tests {
+		r, g := testRollupGroup(t, tt.cfg)
+		var lines []string
+		if tt.cfg.Type == "graphite" {
+			lines = r.graphiteLines(g, r.fields(g), ts)
+		} else {
+			lines = r.statsdLines(g, r.fields(g))
+		}
+		if len(lines) != 13 || lines[0] != tt.first || lines[12] != tt.last {
+			t.Errorf("%+v: %q", tt.cfg, lines)
+		}
+	}
+}
+
+func TestRollupFlushHTTP(t *testing.T) {
+	var bodies []string
+	var auth string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		bodies = append(bodies, string(body))
+		auth = r.Header.Get("Authorization")
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer srv.Close()
+
+	r, err := newRollup(RollupConfig{Type: "influxdb", URL: srv.URL, Headers: map[string]string{"Authorization": "Token secret"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.Observe(LogEntry{Source: "b", Status: 200})
+	r.Observe(LogEntry{Source: "a", Status: 404})
+	ts := time.Date(2024, 2, 19, 16, 1, 0, 0, time.UTC)
+	r.flush(ts)
+	// An interval without entries writes nothing
+	r.flush(ts.Add(time.Minute))
+
+	if len(bodies) != 1 || auth != "Token secret" {
+		t.Fatalf("%d requests, authorization %q", len(bodies), auth)
+	}
+	lines := strings.Split(strings.TrimSuffix(bodies[0], "\n"), "\n")
+	if len(lines) != 2 || !strings.HasPrefix(lines[0], "nginx,source=a ") || !strings.HasPrefix(lines[1], "nginx,source=b ") {
+		t.Errorf("lines %q", lines)
+	}
+}
+
+func TestRollupSendUDP(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	r, err := newRollup(RollupConfig{Type: "statsd", URL: "udp://" + conn.LocalAddr().String()})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var lines []string
+	for i := range 5 {
+		lines = append(lines, fmt.Sprintf("%d%s", i, strings.Repeat("x", 499)))
+	}
+	if err := r.send(lines); err != nil {
+		t.Fatal(err)
+	}
+	// Datagrams stay below maxUDPPayload and end at a line
+	var packets []int
+	buf := make([]byte, 64*1024)
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for received := 0; received < 5; {
+		n, _, err := conn.ReadFrom(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		packetLines := strings.Split(strings.TrimSuffix(string(buf[:n]), "\n"), "\n")
+		if n > maxUDPPayload || packetLines[0] != lines[received] {
+			t.Errorf("packet of %d bytes starting %.5q", n, packetLines[0])
+		}
+		packets = append(packets, len(packetLines))
+		received += len(packetLines)
+	}
+	if !slices.Equal(packets, []int{2, 2, 1}) {
+		t.Errorf("lines per packet %v", packets)
+	}
+}
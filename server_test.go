@@ -0,0 +1,189 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// writeTestCert writes a self-signed certificate for name and its key
+func writeTestCert(t *testing.T, certFile, keyFile, name string) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		DNSNames:     []string{name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCertReloader(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	writeTestCert(t, certFile, keyFile, "first.example")
+
+	r := &certReloader{certFile: certFile, keyFile: keyFile, done: make(chan struct{})}
+	if err := r.reload(); err != nil {
+		t.Fatal(err)
+	}
+	go r.watch(10 * time.Millisecond)
+	defer r.Stop()
+
+	srv := httptest.NewUnstartedServer(http.NotFoundHandler())
+	srv.Listener = tls.NewListener(srv.Listener, &tls.Config{GetCertificate: r.GetCertificate})
+	srv.Start()
+	defer srv.Close()
+
+	served := func() string {
+		conn, err := tls.Dial("tcp", srv.Listener.Addr().String(), &tls.Config{InsecureSkipVerify: true})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		return conn.ConnectionState().PeerCertificates[0].Subject.CommonName
+	}
+	// waitFor polls for the certificate the watcher should load
+	waitFor := func(name string) {
+		t.Helper()
+		for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(20 * time.Millisecond) {
+			if served() == name {
+				return
+			}
+		}
+		t.Fatalf("serving %s, want %s", served(), name)
+	}
+	// touch moves the files' time on, file systems may not see two writes
+	// within the same tick apart
+	touch := func(names ...string) {
+		later := time.Now().Add(time.Minute)
+		for _, name := range names {
+			if err := os.Chtimes(name, later, later); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	if got := served(); got != "first.example" {
+		t.Fatalf("serving %s", got)
+	}
+
+	writeTestCert(t, certFile, keyFile, "second.example")
+	touch(certFile, keyFile)
+	waitFor("second.example")
+
+	// A certificate replaced before its key doesn't load, the previous pair
+	// is served until the key follows
+	next := filepath.Join(dir, "next")
+	writeTestCert(t, next+".pem", next+".key", "third.example")
+	if err := os.Rename(next+".pem", certFile); err != nil {
+		t.Fatal(err)
+	}
+	touch(certFile)
+	time.Sleep(50 * time.Millisecond)
+	if got := served(); got != "second.example" {
+		t.Errorf("with a mismatched key serving %s", got)
+	}
+	if err := os.Rename(next+".key", keyFile); err != nil {
+		t.Fatal(err)
+	}
+	touch(keyFile)
+	waitFor("third.example")
+}
+
+func TestNewCertReloaderErrors(t *testing.T) {
+	if _, err := newCertReloader("cert.pem", ""); err == nil {
+		t.Error("no error without a key file")
+	}
+	if _, err := newCertReloader(filepath.Join(t.TempDir(), "missing.pem"), "missing.key"); err == nil {
+		t.Error("no error for missing files")
+	}
+}
+
+func TestListenUnixSocket(t *testing.T) {
+	socket := filepath.Join(t.TempDir(), "viewer.sock")
+
+	// A socket left behind by a process that didn't exit cleanly
+	stale, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stale.(*net.UnixListener).SetUnlinkOnClose(false)
+	stale.Close()
+	if _, err := os.Stat(socket); err != nil {
+		t.Fatal(err)
+	}
+
+	listener, err := listen("unix:" + socket)
+	if err != nil {
+		t.Fatalf("listening over a stale socket: %v", err)
+	}
+	info, err := os.Stat(socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode()&os.ModeSocket == 0 || info.Mode().Perm() != 0o660 {
+		t.Errorf("socket mode %v, want a socket with 0660", info.Mode())
+	}
+
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	}))
+	srv.Listener = listener
+	srv.Start()
+	client := &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, "unix", socket)
+		},
+	}}
+	resp, err := client.Get("http://viewer/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	srv.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("status %d over the socket", resp.StatusCode)
+	}
+
+	// A regular file in the socket's place is never removed
+	file := writeTestFile(t, "not-a-socket", "data")
+	if l, err := listen("unix:" + file); err == nil {
+		l.Close()
+		t.Error("listened in place of a regular file")
+	}
+	if data, err := os.ReadFile(file); err != nil || string(data) != "data" {
+		t.Errorf("regular file changed: %q, %v", data, err)
+	}
+}
@@ -0,0 +1,628 @@
+package main
+
+import (
+	"bytes"
+	"cmp"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Sink defaults, used for the settings left unset
+const (
+	defaultSinkBatchSize     = 500
+	defaultSinkFlushInterval = 5 * time.Second
+	defaultSinkBufferMB      = 100
+	defaultSinkIndex         = "nginx-access"
+	defaultSinkService       = "nginx"
+)
+
+// maxQueuedBatches bounds the entries held in memory while a sink is busy
+// delivering, later entries are dropped
+const maxQueuedBatches = 20
+
+// SinkConfig forwards the parsed entries of the sources to a log store
+type SinkConfig struct {
+	Name          string            `toml:"name"`
+	Type          string            `toml:"type"`    // elasticsearch, loki or otlp
+	URL           string            `toml:"url"`     // the _bulk, /loki/api/v1/push or /v1/logs endpoint
+	Source        string            `toml:"source"`  // name or pattern, all sources when unset
+	Filter        string            `toml:"filter"`  // only forward the entries matching it
+	Headers       map[string]string `toml:"headers"` // e.g. Authorization or X-Scope-OrgID
+	Index         string            `toml:"index"`   // elasticsearch index or data stream
+	Labels        []string          `toml:"labels"`  // loki stream labels, fields like source or status
+	Service       string            `toml:"service"` // otlp service.name
+	BatchSize     int               `toml:"batch_size"`
+	FlushInterval time.Duration     `toml:"flush_interval"`
+	BufferDir     string            `toml:"buffer_dir"` // keeps the batches that couldn't be delivered
+	BufferMB      int               `toml:"buffer_mb"`  // oldest batches are dropped beyond it
+}
+
+// sinkFormat encodes batches for a type of log store
+type sinkFormat interface {
+	ContentType() string
+	Encode(entries []LogEntry) ([]byte, error)
+	// Check inspects a successful response for rejected entries
+	Check(body []byte) error
+}
+
+// Sink batches entries and posts them to its endpoint. Batches that still
+// fail after the retries are written to the buffer directory and delivered,
+// oldest first, once the endpoint is back.
+type Sink struct {
+	cfg    SinkConfig
+	filter *Filter
+	format sinkFormat
+	client *http.Client
+
+	mu      sync.Mutex
+	queue   []LogEntry
+	dropped int
+	seq     int
+	full    chan struct{}
+	done    chan struct{}
+	stopped chan struct{}
+}
+
+// NewSinks creates the configured sinks, ready to be started
+func NewSinks(configs []SinkConfig) ([]*Sink, error) {
+	var sinks []*Sink
+	for _, c := range configs {
+		sink, err := newSink(c)
+		if err != nil {
+			return nil, fmt.Errorf("sink %q: %w", c.Name, err)
+		}
+		sinks = append(sinks, sink)
+	}
+	return sinks, nil
+}
+
+// validateSinks reports the problems of the sink configs
+func validateSinks(configs []SinkConfig) []error {
+	var errs []error
+	names := make(map[string]bool)
+	for i, c := range configs {
+		if c.Name == "" || names[c.Name] {
+			errs = append(errs, fmt.Errorf("sinks[%d]: missing or duplicate name %q", i, c.Name))
+		}
+		names[c.Name] = true
+		if _, err := newSink(c); err != nil {
+			errs = append(errs, fmt.Errorf("sink %q: %w", c.Name, err))
+		}
+	}
+	return errs
+}
+
+func newSink(c SinkConfig) (*Sink, error) {
+	if !strings.HasPrefix(c.URL, "http://") && !strings.HasPrefix(c.URL, "https://") {
+		return nil, errors.New("url must be an http or https URL")
+	}
+	if _, err := path.Match(c.Source, ""); err != nil {
+		return nil, fmt.Errorf("invalid source pattern %q", c.Source)
+	}
+	filter, err := ParseFilter(c.Filter)
+	if err != nil {
+		return nil, fmt.Errorf("filter: %w", err)
+	}
+	if c.BatchSize == 0 {
+		c.BatchSize = defaultSinkBatchSize
+	}
+	if c.FlushInterval == 0 {
+		c.FlushInterval = defaultSinkFlushInterval
+	}
+	if c.BufferMB == 0 {
+		c.BufferMB = defaultSinkBufferMB
+	}
+	if c.BatchSize < 0 || c.FlushInterval < 0 || c.BufferMB < 0 {
+		return nil, errors.New("batch_size, flush_interval and buffer_mb must be positive")
+	}
+
+	var format sinkFormat
+	switch c.Type {
+	case "elasticsearch":
+		format = elasticsearchFormat{index: cmp.Or(c.Index, defaultSinkIndex)}
+	case "loki":
+		labels := c.Labels
+		if len(labels) == 0 {
+			labels = []string{"source", "vhost"}
+		}
+		f := lokiFormat{labels: labels}
+		for _, name := range labels {
+			value := groupDimensions[name]
+			if value == nil {
+				return nil, fmt.Errorf("unknown label field %q", name)
+			}
+			f.values = append(f.values, value)
+		}
+		format = f
+	case "otlp":
+		format = otlpFormat{service: cmp.Or(c.Service, defaultSinkService)}
+	default:
+		return nil, fmt.Errorf("unknown type %q, use elasticsearch, loki or otlp", c.Type)
+	}
+
+	return &Sink{
+		cfg:     c,
+		filter:  filter,
+		format:  format,
+		client:  &http.Client{Timeout: deliveryTimeout},
+		full:    make(chan struct{}, 1),
+		done:    make(chan struct{}),
+		stopped: make(chan struct{}),
+	}, nil
+}
+
+// FlushInterval is how often the sink delivers its queue
+func (s *Sink) FlushInterval() time.Duration {
+	return s.cfg.FlushInterval
+}
+
+// Start creates the buffer directory and begins delivering
+func (s *Sink) Start() error {
+	if s.cfg.BufferDir != "" {
+		if err := os.MkdirAll(s.cfg.BufferDir, 0o700); err != nil {
+			return fmt.Errorf("sink %q: %w", s.cfg.Name, err)
+		}
+	}
+	go s.run()
+	return nil
+}
+
+// Stop delivers or buffers what's queued and ends the sink
+func (s *Sink) Stop() {
+	close(s.done)
+	<-s.stopped
+}
+
+// Observe queues an entry, it is subscribed to the follower
+func (s *Sink) Observe(entry LogEntry) {
+	if s.cfg.Source != "" {
+		if ok, _ := path.Match(s.cfg.Source, entry.Source); !ok {
+			return
+		}
+	}
+	if !s.filter.Match(&entry) {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.queue) >= maxQueuedBatches*s.cfg.BatchSize {
+		s.dropped++
+		return
+	}
+	s.queue = append(s.queue, entry)
+	if len(s.queue) >= s.cfg.BatchSize {
+		select {
+		case s.full <- struct{}{}:
+		default:
+		}
+	}
+}
+
+func (s *Sink) run() {
+	defer close(s.stopped)
+	ticker := time.NewTicker(s.cfg.FlushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.done:
+			s.flush(true)
+			return
+		case <-ticker.C:
+		case <-s.full:
+		}
+		s.flush(false)
+	}
+}
+
+// flush delivers the queue in batches. Buffered batches go first so the
+// store receives the entries in order; while they can't be delivered new
+// batches are buffered behind them. On shutdown the queue is buffered
+// without retrying when possible.
+func (s *Sink) flush(final bool) {
+	s.mu.Lock()
+	queue := s.queue
+	s.queue = nil
+	dropped := s.dropped
+	s.dropped = 0
+	s.mu.Unlock()
+	if dropped > 0 {
+		log.Printf("Sink %s: dropped %d entries, the queue was full", s.cfg.Name, dropped)
+	}
+
+	backlog := final || !s.drainBuffer()
+	for batch := range slices.Chunk(queue, s.cfg.BatchSize) {
+		payload, err := s.format.Encode(batch)
+		if err != nil {
+			log.Printf("Sink %s: %v", s.cfg.Name, err)
+			continue
+		}
+		if backlog && s.cfg.BufferDir != "" {
+			s.buffer(payload)
+			continue
+		}
+		err = retry(func() error { return s.post(payload) })
+		var permanent *permanentError
+		var rejected *rejectedError
+		switch {
+		case err == nil:
+		case errors.As(err, &rejected):
+			log.Printf("Sink %s: delivered %d entries, %v", s.cfg.Name, len(batch)-rejected.count, err)
+		case errors.As(err, &permanent) || s.cfg.BufferDir == "":
+			log.Printf("Sink %s: dropped %d entries: %v", s.cfg.Name, len(batch), err)
+		default:
+			log.Printf("Sink %s: buffering %d entries: %v", s.cfg.Name, len(batch), err)
+			s.buffer(payload)
+			backlog = true
+		}
+	}
+}
+
+// drainBuffer delivers the buffered batches oldest first and reports
+// whether the buffer is empty. It stops at the first failure, without
+// retrying, as the endpoint is most likely still down.
+func (s *Sink) drainBuffer() bool {
+	if s.cfg.BufferDir == "" {
+		return true
+	}
+	for _, name := range s.bufferedFiles() {
+		payload, err := os.ReadFile(name)
+		if err != nil {
+			log.Printf("Sink %s: %v", s.cfg.Name, err)
+			return false
+		}
+		err = s.post(payload)
+		var permanent *permanentError
+		var rejected *rejectedError
+		switch {
+		case err == nil:
+		case errors.As(err, &rejected):
+			log.Printf("Sink %s: delivered a buffered batch, %v", s.cfg.Name, err)
+		case errors.As(err, &permanent):
+			log.Printf("Sink %s: dropped a buffered batch: %v", s.cfg.Name, err)
+		default:
+			return false
+		}
+		os.Remove(name)
+	}
+	return true
+}
+
+// bufferedFiles lists the buffered batches, oldest first
+func (s *Sink) bufferedFiles() []string {
+	names, _ := filepath.Glob(filepath.Join(s.cfg.BufferDir, "*.batch"))
+	slices.Sort(names)
+	return names
+}
+
+// buffer writes a batch to the buffer directory, dropping the oldest
+// batches when it's full
+func (s *Sink) buffer(payload []byte) {
+	s.seq++
+	name := filepath.Join(s.cfg.BufferDir, fmt.Sprintf("%020d-%06d.batch", time.Now().UnixNano(), s.seq%1000000))
+	// Renamed into place so a crash never leaves half a batch
+	if err := os.WriteFile(name+".tmp", payload, 0o600); err != nil {
+		log.Printf("Sink %s: %v", s.cfg.Name, err)
+		return
+	}
+	if err := os.Rename(name+".tmp", name); err != nil {
+		log.Printf("Sink %s: %v", s.cfg.Name, err)
+		return
+	}
+
+	files := s.bufferedFiles()
+	var total int64
+	sizes := make([]int64, len(files))
+	for i, file := range files {
+		if info, err := os.Stat(file); err == nil {
+			sizes[i] = info.Size()
+			total += sizes[i]
+		}
+	}
+	for i := 0; total > int64(s.cfg.BufferMB)<<20 && i < len(files)-1; i++ {
+		log.Printf("Sink %s: buffer full, dropped %s", s.cfg.Name, filepath.Base(files[i]))
+		os.Remove(files[i])
+		total -= sizes[i]
+	}
+}
+
+// post sends a payload once
+func (s *Sink) post(payload []byte) error {
+	body, err := postPayload(s.client, s.cfg.URL, s.format.ContentType(), s.cfg.Headers, payload)
+	if err != nil {
+		return err
+	}
+	return s.format.Check(body)
+}
+
+// postPayload posts a payload and returns the response body. Client errors
+// other than 408 and 429 are permanent, as sending the same payload again
+// would fail the same way.
+func postPayload(client *http.Client, url, contentType string, headers map[string]string, payload []byte) ([]byte, error) {
+	req, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(payload))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", contentType)
+	for key, value := range headers {
+		req.Header.Set(key, value)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode/100 != 2 {
+		err := fmt.Errorf("%s: %s: %s", url, resp.Status, truncateString(strings.TrimSpace(string(body)), 200))
+		if resp.StatusCode/100 == 4 && resp.StatusCode != http.StatusRequestTimeout && resp.StatusCode != http.StatusTooManyRequests {
+			return nil, &permanentError{err}
+		}
+		return nil, err
+	}
+	return body, nil
+}
+
+// maxRejectedItems is how many of the rejected entries of a batch are logged
+const maxRejectedItems = 3
+
+// rejectedError is a batch the store accepted except for some entries.
+// Sending it again would duplicate the others, so it's wrapped in a
+// permanentError.
+type rejectedError struct {
+	count int
+	items []string // why the first entries were rejected
+}
+
+func (e *rejectedError) Error() string {
+	msg := fmt.Sprintf("%d rejected", e.count)
+	if len(e.items) > 0 {
+		msg += ": " + strings.Join(e.items, "; ")
+	}
+	return msg
+}
+
+// elasticsearchFormat writes _bulk NDJSON, one create action and document
+// per entry so it works with both indices and data streams
+type elasticsearchFormat struct {
+	index string
+}
+
+func (f elasticsearchFormat) ContentType() string { return "application/x-ndjson" }
+
+func (f elasticsearchFormat) Encode(entries []LogEntry) ([]byte, error) {
+	action, err := json.Marshal(map[string]any{"create": map[string]string{"_index": f.index}})
+	if err != nil {
+		return nil, err
+	}
+	var b bytes.Buffer
+	enc := json.NewEncoder(&b)
+	for _, entry := range entries {
+		b.Write(action)
+		b.WriteByte('\n')
+		err := enc.Encode(struct {
+			Timestamp string `json:"@timestamp"`
+			LogEntry
+		}{entry.TimeStamp.Format(time.RFC3339Nano), entry})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return b.Bytes(), nil
+}
+
+// Check reports the documents Elasticsearch rejected. The others were
+// stored, so the batch isn't sent again.
+func (f elasticsearchFormat) Check(body []byte) error {
+	var resp struct {
+		Errors bool `json:"errors"`
+		Items  []map[string]struct {
+			Status int `json:"status"`
+			Error  struct {
+				Type   string `json:"type"`
+				Reason string `json:"reason"`
+			} `json:"error"`
+		} `json:"items"`
+	}
+	if err := json.Unmarshal(body, &resp); err != nil || !resp.Errors {
+		return nil
+	}
+	rejected := &rejectedError{}
+	for i, item := range resp.Items {
+		for _, result := range item {
+			if result.Status/100 == 2 {
+				continue
+			}
+			rejected.count++
+			if len(rejected.items) < maxRejectedItems {
+				rejected.items = append(rejected.items, fmt.Sprintf("document %d: %d %s: %s", i, result.Status, result.Error.Type, result.Error.Reason))
+			}
+		}
+	}
+	if rejected.count == 0 {
+		return nil
+	}
+	return &permanentError{rejected}
+}
+
+// lokiFormat groups the entries into streams by their label values. The
+// log line is the entry as JSON, for LogQL's json parser.
+type lokiFormat struct {
+	labels []string
+	values []func(*LogEntry) string
+}
+
+func (f lokiFormat) ContentType() string { return "application/json" }
+
+func (f lokiFormat) Encode(entries []LogEntry) ([]byte, error) {
+	type stream struct {
+		Stream map[string]string `json:"stream"`
+		Values [][2]string       `json:"values"`
+	}
+	var streams []*stream
+	byKey := make(map[string]*stream)
+	for i := range entries {
+		entry := &entries[i]
+		labels := make(map[string]string, len(f.labels))
+		var key strings.Builder
+		for j, name := range f.labels {
+			value := f.values[j](entry)
+			if value != "" {
+				labels[name] = value
+			}
+			key.WriteString(value)
+			key.WriteByte(0)
+		}
+		st := byKey[key.String()]
+		if st == nil {
+			st = &stream{Stream: labels}
+			byKey[key.String()] = st
+			streams = append(streams, st)
+		}
+		line, err := json.Marshal(entry)
+		if err != nil {
+			return nil, err
+		}
+		st.Values = append(st.Values, [2]string{strconv.FormatInt(entry.TimeStamp.UnixNano(), 10), string(line)})
+	}
+	return json.Marshal(map[string]any{"streams": streams})
+}
+
+func (f lokiFormat) Check(body []byte) error { return nil }
+
+// otlpFormat writes OTLP/HTTP JSON logs, a resource per source and the
+// fields as OpenTelemetry semantic convention attributes
+type otlpFormat struct {
+	service string
+}
+
+type otlpAttribute struct {
+	Key   string         `json:"key"`
+	Value map[string]any `json:"value"`
+}
+
+type otlpLogRecord struct {
+	TimeUnixNano         string          `json:"timeUnixNano"`
+	ObservedTimeUnixNano string          `json:"observedTimeUnixNano"`
+	SeverityNumber       int             `json:"severityNumber"`
+	SeverityText         string          `json:"severityText"`
+	Body                 map[string]any  `json:"body"`
+	Attributes           []otlpAttribute `json:"attributes"`
+}
+
+func (f otlpFormat) ContentType() string { return "application/json" }
+
+func (f otlpFormat) Encode(entries []LogEntry) ([]byte, error) {
+	type scopeLogs struct {
+		Scope      map[string]string `json:"scope"`
+		LogRecords []otlpLogRecord   `json:"logRecords"`
+	}
+	type resourceLogs struct {
+		Resource  map[string][]otlpAttribute `json:"resource"`
+		ScopeLogs []*scopeLogs               `json:"scopeLogs"`
+	}
+
+	var resources []resourceLogs
+	bySource := make(map[string]*scopeLogs)
+	observed := strconv.FormatInt(time.Now().UnixNano(), 10)
+	for _, entry := range entries {
+		scope := bySource[entry.Source]
+		if scope == nil {
+			scope = &scopeLogs{Scope: map[string]string{"name": "nginx-log-viewer"}}
+			bySource[entry.Source] = scope
+			resources = append(resources, resourceLogs{
+				Resource: map[string][]otlpAttribute{"attributes": {
+					otlpString("service.name", f.service),
+					otlpString("nginx.source", entry.Source),
+				}},
+				ScopeLogs: []*scopeLogs{scope},
+			})
+		}
+
+		severity, text := 9, "INFO"
+		switch {
+		case entry.Status >= 500:
+			severity, text = 17, "ERROR"
+		case entry.Status >= 400:
+			severity, text = 13, "WARN"
+		}
+		urlPath, query, _ := strings.Cut(entry.RequestURI, "?")
+		var attrs []otlpAttribute
+		for _, a := range []otlpAttribute{
+			otlpString("client.address", entry.IP),
+			otlpString("enduser.id", entry.UserID),
+			otlpString("http.request.method", entry.Method),
+			otlpString("url.path", urlPath),
+			otlpString("url.query", query),
+			otlpString("network.protocol.version", strings.TrimPrefix(entry.Protocol, "HTTP/")),
+			otlpString("http.request.header.referer", entry.Referer),
+			otlpString("user_agent.original", entry.UserAgent),
+			otlpString("server.address", entry.VHost),
+			otlpString("client.geo.country.iso_code", entry.Country),
+		} {
+			if a.Value["stringValue"] != "" {
+				attrs = append(attrs, a)
+			}
+		}
+		attrs = append(attrs,
+			otlpAttribute{"http.response.status_code", map[string]any{"intValue": strconv.Itoa(entry.Status)}},
+			otlpAttribute{"http.response.body.size", map[string]any{"intValue": strconv.Itoa(entry.ResponseSize)}},
+		)
+		if entry.RequestTime > 0 {
+			attrs = append(attrs, otlpAttribute{"nginx.request_time", map[string]any{"doubleValue": entry.RequestTime}})
+		}
+		if len(entry.Upstreams) > 0 || entry.ResponseTime > 0 {
+			attrs = append(attrs, otlpAttribute{"nginx.upstream_response_time", map[string]any{"doubleValue": entry.ResponseTime}})
+		}
+
+		scope.LogRecords = append(scope.LogRecords, otlpLogRecord{
+			TimeUnixNano:         strconv.FormatInt(entry.TimeStamp.UnixNano(), 10),
+			ObservedTimeUnixNano: observed,
+			SeverityNumber:       severity,
+			SeverityText:         text,
+			Body:                 map[string]any{"stringValue": fmt.Sprintf("%s %s %s %d", entry.Method, entry.RequestURI, entry.Protocol, entry.Status)},
+			Attributes:           attrs,
+		})
+	}
+	return json.Marshal(map[string]any{"resourceLogs": resources})
+}
+
+func otlpString(key, value string) otlpAttribute {
+	return otlpAttribute{key, map[string]any{"stringValue": value}}
+}
+
+// Check reports the records the collector rejected
+func (f otlpFormat) Check(body []byte) error {
+	var resp struct {
+		PartialSuccess struct {
+			RejectedLogRecords json.Number `json:"rejectedLogRecords"`
+			ErrorMessage       string      `json:"errorMessage"`
+		} `json:"partialSuccess"`
+	}
+	if err := json.Unmarshal(body, &resp); err != nil {
+		return nil
+	}
+	if n, _ := resp.PartialSuccess.RejectedLogRecords.Int64(); n > 0 {
+		rejected := &rejectedError{count: int(n)}
+		if resp.PartialSuccess.ErrorMessage != "" {
+			rejected.items = []string{resp.PartialSuccess.ErrorMessage}
+		}
+		return &permanentError{rejected}
+	}
+	return nil
+}
@@ -0,0 +1,352 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+var sinkEntries = []LogEntry{
+	{
+		Source: "shop", VHost: "shop.example.com", IP: "10.0.0.1", Method: "GET", RequestURI: "/search?q=shoes",
+		Protocol: "HTTP/1.1", Status: 200, ResponseSize: 512, UserAgent: "curl/8.0",
+		TimeStamp: time.Date(2024, 2, 19, 16, 0, 1, 0, time.UTC), RequestTime: 0.25, ResponseTime: 0.2,
+		Upstreams: []UpstreamAttempt{{Addr: "10.1.0.1:80", Status: 200, ResponseTime: 0.2}},
+	},
+	{
+		Source: "shop", VHost: "shop.example.com", IP: "10.0.0.2", Method: "POST", RequestURI: "/cart",
+		Protocol: "HTTP/2.0", Status: 502, TimeStamp: time.Date(2024, 2, 19, 16, 0, 2, 0, time.UTC), RequestTime: 1.5,
+	},
+	{
+		Source: "blog", VHost: "blog.example.com", IP: "10.0.0.3", Method: "GET", RequestURI: "/",
+		Protocol: "HTTP/1.1", Status: 404, TimeStamp: time.Date(2024, 2, 19, 16, 0, 3, 0, time.UTC),
+	},
+}
+
+func TestElasticsearchEncode(t *testing.T) {
+	payload, err := elasticsearchFormat{index: "logs-nginx"}.Encode(sinkEntries)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSuffix(string(payload), "\n"), "\n")
+	if len(lines) != 2*len(sinkEntries) {
+		t.Fatalf("got %d lines, want an action and a document per entry:\n%s", len(lines), payload)
+	}
+	for i, entry := range sinkEntries {
+		if lines[2*i] != `{"create":{"_index":"logs-nginx"}}` {
+			t.Errorf("action %q", lines[2*i])
+		}
+		var doc map[string]any
+		if err := json.Unmarshal([]byte(lines[2*i+1]), &doc); err != nil {
+			t.Fatal(err)
+		}
+		if doc["@timestamp"] != entry.TimeStamp.Format(time.RFC3339Nano) || doc["ip"] != entry.IP {
+			t.Errorf("document %d: %s", i, lines[2*i+1])
+		}
+	}
+}
+
+func TestElasticsearchCheck(t *testing.T) {
+	f := elasticsearchFormat{}
+	if err := f.Check([]byte(`{"took":3,"errors":false,"items":[{"create":{"status":201}}]}`)); err != nil {
+		t.Errorf("no errors: %v", err)
+	}
+
+	err := f.Check([]byte(`{"errors":true,"items":[
+		{"create":{"status":201}},
+		{"create":{"status":400,"error":{"type":"mapper_parsing_exception","reason":"failed to parse field [status]"}}},
+		{"create":{"status":201}},
+		{"create":{"status":409,"error":{"type":"version_conflict_engine_exception","reason":"document already exists"}}}
+	]}`))
+	var permanent *permanentError
+	var rejected *rejectedError
+	if !errors.As(err, &permanent) || !errors.As(err, &rejected) {
+		t.Fatalf("got %v, want a permanent rejection", err)
+	}
+	want := "2 rejected: document 1: 400 mapper_parsing_exception: failed to parse field [status]; " +
+		"document 3: 409 version_conflict_engine_exception: document already exists"
+	if rejected.count != 2 || err.Error() != want {
+		t.Errorf("got %q", err)
+	}
+}
+
+func TestLokiEncode(t *testing.T) {
+	sink, err := newSink(SinkConfig{Name: "loki", Type: "loki", URL: "http://loki/loki/api/v1/push", Labels: []string{"source", "status"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	payload, err := sink.format.Encode(sinkEntries)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var push struct {
+		Streams []struct {
+			Stream map[string]string `json:"stream"`
+			Values [][2]string       `json:"values"`
+		} `json:"streams"`
+	}
+	if err := json.Unmarshal(payload, &push); err != nil {
+		t.Fatal(err)
+	}
+	if len(push.Streams) != 3 {
+		t.Fatalf("got %d streams, want one per source and status: %s", len(push.Streams), payload)
+	}
+	st := push.Streams[0]
+	if st.Stream["source"] != "shop" || st.Stream["status"] != "200" || len(st.Values) != 1 {
+		t.Errorf("first stream %+v", st)
+	}
+	if st.Values[0][0] != "1708358401000000000" || !strings.Contains(st.Values[0][1], `"request_uri":"/search?q=shoes"`) {
+		t.Errorf("first value %q", st.Values[0])
+	}
+
+	if _, err := newSink(SinkConfig{Type: "loki", URL: "http://loki", Labels: []string{"colour"}}); err == nil {
+		t.Error("unknown label accepted")
+	}
+}
+
+func TestOTLPEncode(t *testing.T) {
+	payload, err := otlpFormat{service: "edge"}.Encode(sinkEntries)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var logs struct {
+		ResourceLogs []struct {
+			Resource struct {
+				Attributes []otlpAttribute `json:"attributes"`
+			} `json:"resource"`
+			ScopeLogs []struct {
+				LogRecords []otlpLogRecord `json:"logRecords"`
+			} `json:"scopeLogs"`
+		} `json:"resourceLogs"`
+	}
+	if err := json.Unmarshal(payload, &logs); err != nil {
+		t.Fatal(err)
+	}
+	if len(logs.ResourceLogs) != 2 {
+		t.Fatalf("got %d resources, want one per source", len(logs.ResourceLogs))
+	}
+	resource := attributeMap(logs.ResourceLogs[0].Resource.Attributes)
+	if resource["service.name"] != "edge" || resource["nginx.source"] != "shop" {
+		t.Errorf("resource %v", resource)
+	}
+
+	records := logs.ResourceLogs[0].ScopeLogs[0].LogRecords
+	if len(records) != 2 {
+		t.Fatalf("got %d records for shop", len(records))
+	}
+	ok := attributeMap(records[0].Attributes)
+	for key, want := range map[string]any{
+		"client.address":               "10.0.0.1",
+		"url.path":                     "/search",
+		"url.query":                    "q=shoes",
+		"network.protocol.version":     "1.1",
+		"http.response.status_code":    "200",
+		"nginx.request_time":           0.25,
+		"nginx.upstream_response_time": 0.2,
+	} {
+		if ok[key] != want {
+			t.Errorf("%s = %v, want %v", key, ok[key], want)
+		}
+	}
+	if records[0].SeverityText != "INFO" || records[1].SeverityText != "ERROR" || records[0].TimeUnixNano != "1708358401000000000" {
+		t.Errorf("records %+v", records)
+	}
+	failed := attributeMap(records[1].Attributes)
+	if _, ok := failed["nginx.upstream_response_time"]; ok {
+		t.Error("upstream time of a request that wasn't proxied")
+	}
+	if _, ok := failed["url.query"]; ok {
+		t.Error("empty attribute sent")
+	}
+}
+
+// attributeMap flattens OTLP attributes to their values
+func attributeMap(attrs []otlpAttribute) map[string]any {
+	m := make(map[string]any)
+	for _, a := range attrs {
+		for _, v := range a.Value {
+			m[a.Key] = v
+		}
+	}
+	return m
+}
+
+func TestOTLPCheck(t *testing.T) {
+	f := otlpFormat{}
+	if err := f.Check([]byte(`{}`)); err != nil {
+		t.Errorf("full success: %v", err)
+	}
+	err := f.Check([]byte(`{"partialSuccess":{"rejectedLogRecords":"2","errorMessage":"timestamp too old"}}`))
+	var rejected *rejectedError
+	if !errors.As(err, &rejected) || rejected.count != 2 || err.Error() != "2 rejected: timestamp too old" {
+		t.Errorf("got %v", err)
+	}
+}
+
+// fakeStore is a log store answering with the next status and recording
+// the documents it stored
+type fakeStore struct {
+	*httptest.Server
+
+	mu       sync.Mutex
+	statuses []int // answered in turn, the last one repeats
+	requests int
+	stored   []string
+	received chan struct{}
+}
+
+func newFakeStore(t *testing.T, statuses ...int) *fakeStore {
+	s := &fakeStore{statuses: statuses, received: make(chan struct{}, 100)}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.mu.Lock()
+		s.requests++
+		status := s.statuses[min(s.requests, len(s.statuses))-1]
+		if status/100 == 2 {
+			scanner := bufio.NewScanner(r.Body)
+			for scanner.Scan() {
+				var doc struct {
+					URI string `json:"request_uri"`
+				}
+				if json.Unmarshal(scanner.Bytes(), &doc) == nil && doc.URI != "" {
+					s.stored = append(s.stored, doc.URI)
+				}
+			}
+		}
+		s.mu.Unlock()
+		w.WriteHeader(status)
+		w.Write([]byte(`{"errors":false}`))
+		s.received <- struct{}{}
+	}))
+	t.Cleanup(s.Close)
+	return s
+}
+
+func (s *fakeStore) wait(t *testing.T, requests int) {
+	t.Helper()
+	for range requests {
+		select {
+		case <-s.received:
+		case <-time.After(10 * time.Second):
+			got, _ := s.result()
+			t.Fatalf("the store got %d requests, want %d", got, requests)
+		}
+	}
+}
+
+func (s *fakeStore) result() (int, []string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.requests, s.stored
+}
+
+func newTestSink(t *testing.T, url, bufferDir string) *Sink {
+	t.Helper()
+	sink, err := newSink(SinkConfig{Name: "es", Type: "elasticsearch", URL: url, BatchSize: 2, FlushInterval: time.Hour, BufferDir: bufferDir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := sink.Start(); err != nil {
+		t.Fatal(err)
+	}
+	return sink
+}
+
+func observe(sink *Sink, uris ...string) {
+	for _, uri := range uris {
+		sink.Observe(LogEntry{Source: "shop", RequestURI: uri, TimeStamp: time.Now()})
+	}
+}
+
+func TestSinkDelivery(t *testing.T) {
+	tests := []struct {
+		name     string
+		statuses []int
+		requests int
+		stored   []string
+		buffered int
+	}{
+		{"delivered", []int{200}, 1, []string{"/a", "/b"}, 0},
+		{"retried", []int{503, 200}, 2, []string{"/a", "/b"}, 0},
+		{"rate limited", []int{429, 200}, 2, []string{"/a", "/b"}, 0},
+		{"rejected", []int{400}, 1, nil, 0},
+		{"down", []int{503}, deliveryAttempts, nil, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := newFakeStore(t, tt.statuses...)
+			dir := t.TempDir()
+			sink := newTestSink(t, store.URL, dir)
+			observe(sink, "/a", "/b")
+			store.wait(t, tt.requests)
+			sink.Stop()
+
+			requests, stored := store.result()
+			if requests != tt.requests || strings.Join(stored, " ") != strings.Join(tt.stored, " ") {
+				t.Errorf("%d requests storing %q, want %d storing %q", requests, stored, tt.requests, tt.stored)
+			}
+			if files := sink.bufferedFiles(); len(files) != tt.buffered {
+				t.Errorf("%d batches buffered, want %d", len(files), tt.buffered)
+			}
+		})
+	}
+}
+
+func TestSinkBufferReplay(t *testing.T) {
+	dir := t.TempDir()
+
+	// Stopping buffers the queue, as if the viewer restarted
+	down := newFakeStore(t, 503)
+	sink := newTestSink(t, down.URL, dir)
+	observe(sink, "/1")
+	sink.Stop()
+	sink = newTestSink(t, down.URL, dir)
+	observe(sink, "/2")
+	sink.Stop()
+	if requests, _ := down.result(); requests != 0 {
+		t.Errorf("%d requests on shutdown, want the queue buffered", requests)
+	}
+	files, _ := filepath.Glob(filepath.Join(dir, "*"))
+	if len(files) != 2 {
+		t.Fatalf("buffer has %q, want 2 batches", files)
+	}
+	if payload, _ := os.ReadFile(files[0]); !bytes.Contains(payload, []byte(`"request_uri":"/1"`)) {
+		t.Errorf("first batch %s", payload)
+	}
+
+	// Once the store is back the buffer is delivered first, oldest batch
+	// first, and emptied
+	up := newFakeStore(t, 200)
+	sink = newTestSink(t, up.URL, dir)
+	observe(sink, "/3", "/4")
+	up.wait(t, 3)
+	sink.Stop()
+	if _, stored := up.result(); strings.Join(stored, " ") != "/1 /2 /3 /4" {
+		t.Errorf("stored %q, want the buffered entries first", stored)
+	}
+	if files := sink.bufferedFiles(); len(files) != 0 {
+		t.Errorf("%d batches left in the buffer", len(files))
+	}
+}
+
+func TestSinkBufferLimit(t *testing.T) {
+	sink, err := newSink(SinkConfig{Name: "es", Type: "elasticsearch", URL: "http://es", BufferDir: t.TempDir(), BufferMB: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	batch := bytes.Repeat([]byte("x"), 400<<10)
+	for range 4 {
+		sink.buffer(batch)
+	}
+	if files := sink.bufferedFiles(); len(files) != 2 {
+		t.Errorf("%d batches buffered, want the oldest dropped to stay under 1MB", len(files))
+	}
+}
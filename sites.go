@@ -0,0 +1,169 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"sync"
+	"time"
+)
+
+// SiteSummary compares one source with the others on the overview page
+type SiteSummary struct {
+	Name             string  `json:"name"`
+	VHost            string  `json:"vhost"`
+	Date             string  `json:"date"`
+	Requests         int     `json:"requests"`
+	RequestsPerMin   float64 `json:"requests_per_minute"`
+	ClientErrors     int     `json:"client_errors"`
+	ServerErrors     int     `json:"server_errors"`
+	ClientErrorRate  float64 `json:"client_error_rate"` // percent of requests with a 4xx status
+	ServerErrorRate  float64 `json:"server_error_rate"` // percent of requests with a 5xx status
+	BytesSent        int64   `json:"bytes_sent"`
+	LatencyP50       float64 `json:"latency_p50"`
+	LatencyP95       float64 `json:"latency_p95"`
+	LatencyP99       float64 `json:"latency_p99"`
+	FailedLines      int     `json:"failed_lines"`
+	Error            string  `json:"error,omitempty"`
+	BytesSentDisplay string  `json:"-"`
+}
+
+// OverviewData is rendered by the overview page
+type OverviewData struct {
+	Summaries []SiteSummary `json:"sites"`
+	Total     SiteSummary   `json:"total"`
+	Filter    string        `json:"filter,omitempty"`
+	Chips     []FilterChip  `json:"-"`
+	Sites     []string      `json:"-"`
+	Source    string        `json:"-"`
+	User      *User         `json:"-"`
+	Alerts    []Alert       `json:"-"` // firing alerts of the visible sources
+}
+
+// overviewWorkers limits how many sources are read at the same time
+const overviewWorkers = 4
+
+// buildOverview summarizes the sources in parallel. A source that can't be
+// read is listed with its error instead of failing the whole page. Only the
+// mask and filter of opts are used.
+func buildOverview(sources []*Source, rangeConfig RangeConfig, now time.Time, opts ReportOptions) (*OverviewData, error) {
+	summaries := make([]SiteSummary, len(sources))
+	errs := make([]error, len(sources))
+	latencies := make([][]float64, len(sources))
+
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, overviewWorkers)
+	for i, src := range sources {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+
+			start, end, err := rangeConfig.Resolve(now, src.Location())
+			if err != nil {
+				errs[i] = err
+				return
+			}
+			summaries[i], latencies[i] = buildSiteSummary(src, start, end, opts)
+		}()
+	}
+	wg.Wait()
+	for _, err := range errs {
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	overview := &OverviewData{Summaries: summaries, Total: SiteSummary{Name: "All sites"}, Filter: opts.Filter.String()}
+	var all []float64
+	for i, s := range summaries {
+		overview.Total.Requests += s.Requests
+		overview.Total.RequestsPerMin += s.RequestsPerMin
+		overview.Total.ClientErrors += s.ClientErrors
+		overview.Total.ServerErrors += s.ServerErrors
+		overview.Total.BytesSent += s.BytesSent
+		overview.Total.FailedLines += s.FailedLines
+		all = append(all, latencies[i]...)
+	}
+	finishSiteSummary(&overview.Total, all)
+	return overview, nil
+}
+
+// buildSiteSummary reads one source and returns its summary together with
+// the sorted response times
+func buildSiteSummary(src *Source, start, end time.Time, opts ReportOptions) (SiteSummary, []float64) {
+	summary := SiteSummary{
+		Name:  src.Name,
+		VHost: src.VHost,
+		Date:  fmt.Sprintf("%s - %s", start.Format(rangeLayout), end.Format(rangeLayout)),
+	}
+
+	var latencies []float64
+	stats, err := src.ReadEntries(func(entry LogEntry) {
+		if entry.TimeStamp.Before(start) || entry.TimeStamp.After(end) {
+			return
+		}
+		opts.Mask.Apply(&entry)
+		if !opts.Filter.Match(&entry) {
+			return
+		}
+		summary.Requests++
+		summary.BytesSent += int64(entry.ResponseSize)
+		switch {
+		case entry.Status >= 500:
+			summary.ServerErrors++
+		case entry.Status >= 400:
+			summary.ClientErrors++
+		}
+		latencies = append(latencies, requestDuration(&entry))
+	})
+	if err != nil {
+		log.Printf("Error reading source %s: %v", src.Name, err)
+		summary.Error = err.Error()
+	}
+	summary.FailedLines = stats.Failed
+
+	if minutes := end.Sub(start).Minutes(); minutes > 0 {
+		summary.RequestsPerMin = float64(summary.Requests) / minutes
+	}
+	finishSiteSummary(&summary, latencies)
+	return summary, latencies
+}
+
+// finishSiteSummary fills in the rates and latency percentiles
+func finishSiteSummary(s *SiteSummary, latencies []float64) {
+	if s.Requests > 0 {
+		s.ClientErrorRate = 100 * float64(s.ClientErrors) / float64(s.Requests)
+		s.ServerErrorRate = 100 * float64(s.ServerErrors) / float64(s.Requests)
+	}
+	sort.Float64s(latencies)
+	s.LatencyP50 = percentile(latencies, 50)
+	s.LatencyP95 = percentile(latencies, 95)
+	s.LatencyP99 = percentile(latencies, 99)
+	s.BytesSentDisplay = formatBytes(s.BytesSent)
+}
+
+// percentile returns the p-th percentile of sorted values (nearest rank)
+func percentile(sorted []float64, p float64) float64 {
+	if len(sorted) == 0 {
+		return 0
+	}
+	rank := int(p/100*float64(len(sorted))+0.5) - 1
+	rank = max(0, min(rank, len(sorted)-1))
+	return sorted[rank]
+}
+
+// formatBytes renders a byte count with a binary unit
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestPercentile(t *testing.T) {
+	sorted := []float64{1, 2, 3, 4, 5, 6, 7, 8, 9, 10}
+	tests := map[float64]float64{0: 1, 10: 1, 50: 5, 55: 6, 95: 10, 99: 10, 100: 10}
+	for p, want := range tests {
+		if got := percentile(sorted, p); got != want {
+			t.Errorf("p%g = %v, want %v", p, got, want)
+		}
+	}
+	if got := percentile(nil, 50); got != 0 {
+		t.Errorf("p50 of nothing = %v", got)
+	}
+}
+
+func TestFormatBytes(t *testing.T) {
+	tests := map[int64]string{
+		0:             "0 B",
+		1023:          "1023 B",
+		1024:          "1.0 KiB",
+		1536:          "1.5 KiB",
+		5 * 1 << 20:   "5.0 MiB",
+		3 * (1 << 40): "3.0 TiB",
+	}
+	for n, want := range tests {
+		if got := formatBytes(n); got != want {
+			t.Errorf("formatBytes(%d) = %q, want %q", n, got, want)
+		}
+	}
+}
+
+func TestBuildOverview(t *testing.T) {
+	line := func(clock string, status int, rt float64) string {
+		return fmt.Sprintf(`10.0.0.1 - - [19/Feb/2024:%s +0000] "GET / HTTP/1.1" %d 100 "-" "curl" %.3f - - - -`, clock, status, rt)
+	}
+	shop := newTestSource(t, []string{
+		line("16:00:01", 200, 0.1),
+		line("16:10:00", 404, 0.2),
+		line("16:20:00", 500, 0.3),
+		line("16:30:00", 200, 0.4),
+		"garbage",
+		line("18:00:00", 500, 9),
+	})
+	shop.Name = "shop"
+	blog := newTestSource(t, []string{
+		line("16:05:00", 200, 1),
+		line("16:06:00", 503, 2),
+	})
+	blog.Name = "blog"
+	broken := newTestSource(t, nil)
+	broken.Name = "broken"
+	if err := os.Remove(broken.Path); err != nil {
+		t.Fatal(err)
+	}
+
+	rangeConfig := RangeConfig{Start: "2024-02-19 16:00:00", End: "2024-02-19 17:00:00"}
+	overview, err := buildOverview([]*Source{shop, blog, broken}, rangeConfig, time.Now(), ReportOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(overview.Summaries) != 3 {
+		t.Fatalf("%d summaries", len(overview.Summaries))
+	}
+
+	s := overview.Summaries[0]
+	if s.Name != "shop" || s.Requests != 4 || s.ClientErrors != 1 || s.ServerErrors != 1 || s.ClientErrorRate != 25 ||
+		s.BytesSent != 400 || s.BytesSentDisplay != "400 B" || s.FailedLines != 1 || s.LatencyP50 != 0.2 || s.LatencyP99 != 0.4 {
+		t.Errorf("shop %+v", s)
+	}
+	if s.Date != "2024-02-19 16:00:00 - 2024-02-19 17:00:00" || s.RequestsPerMin != 4.0/60 {
+		t.Errorf("shop over %s at %v/min", s.Date, s.RequestsPerMin)
+	}
+	// A source that can't be read is listed with its error
+	if s := overview.Summaries[2]; s.Name != "broken" || s.Error == "" || s.Requests != 0 {
+		t.Errorf("broken %+v", s)
+	}
+
+	// The total's percentiles are over the requests of every site
+	total := overview.Total
+	if total.Name != "All sites" || total.Requests != 6 || total.ClientErrors != 1 || total.ServerErrors != 2 ||
+		total.BytesSent != 600 || total.FailedLines != 1 || total.LatencyP50 != 0.3 || total.LatencyP95 != 2 || total.RequestsPerMin != 6.0/60 {
+		t.Errorf("total %+v", total)
+	}
+
+	filter, _ := ParseFilter("status>=500")
+	overview, err = buildOverview([]*Source{shop, blog}, rangeConfig, time.Now(), ReportOptions{Filter: filter})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if overview.Total.Requests != 2 || overview.Total.ServerErrorRate != 100 || overview.Filter != "status>=500" {
+		t.Errorf("filtered total %+v", overview.Total)
+	}
+
+	if _, err := buildOverview([]*Source{shop}, RangeConfig{Start: "yesterday", End: "now"}, time.Now(), ReportOptions{}); err == nil {
+		t.Error("no error for an invalid range")
+	}
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"sync"
+)
+
+// stdinPath is the source path reading the standard input
+const stdinPath = "-"
+
+// maxStreamLines bounds the lines of a stream kept in memory, the oldest
+// lines are dropped past it
+const maxStreamLines = 1 << 20
+
+// logStream is a source read from stdin or a named pipe, which can only be
+// read once. Commands read it straight through; the server, the terminal UI
+// and followers retain its lines as they arrive, so reports are rebuilt from
+// what was received so far.
+type logStream struct {
+	path string
+	fifo bool // reopened when the writer closes it
+
+	reader *bufio.Reader
+	closer io.Closer
+
+	retainOnce sync.Once
+	done       chan struct{} // closed when a retained stream ended
+
+	mu       sync.Mutex
+	retained bool
+	consumed bool     // read through by a command
+	lines    []string // retained lines, lines[0] is line number first
+	first    int64
+}
+
+// newLogStream returns the stream of a source path, or nil when the path is
+// an ordinary file or glob
+func newLogStream(path string) *logStream {
+	if path == stdinPath {
+		return &logStream{path: path, done: make(chan struct{})}
+	}
+	if info, err := os.Stat(path); err == nil && info.Mode()&os.ModeNamedPipe != 0 {
+		return &logStream{path: path, fifo: true, done: make(chan struct{})}
+	}
+	return nil
+}
+
+// open opens the stream unless it is open. Opening a named pipe waits for a
+// writer.
+func (s *logStream) open() (*bufio.Reader, error) {
+	if s.reader != nil {
+		return s.reader, nil
+	}
+	var r io.ReadCloser = os.Stdin
+	if s.fifo {
+		file, err := os.Open(s.path)
+		if err != nil {
+			return nil, err
+		}
+		r = file
+	}
+	s.reader = bufio.NewReaderSize(r, 64*1024)
+	s.closer = r
+	return s.reader, nil
+}
+
+// peek returns the first complete lines without consuming them, waiting for
+// at least one line or the end of the stream
+func (s *logStream) peek() []string {
+	r, err := s.open()
+	if err != nil {
+		return nil
+	}
+	for r.Buffered() < r.Size() {
+		data, _ := r.Peek(r.Buffered())
+		if bytes.IndexByte(data, '\n') >= 0 {
+			break
+		}
+		if _, err := r.Peek(r.Buffered() + 1); err != nil {
+			break
+		}
+	}
+	data, _ := r.Peek(r.Buffered())
+	if i := bytes.LastIndexByte(data, '\n'); i >= 0 {
+		data = data[:i]
+	}
+	return strings.Split(string(data), "\n")
+}
+
+// readLines calls fn for each line until the end of the stream
+func (s *logStream) readLines(fn func(line string)) error {
+	r, err := s.open()
+	if err != nil {
+		return err
+	}
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		fn(scanner.Text())
+	}
+	return scanner.Err()
+}
+
+// retain reads the stream in the background and keeps its lines. before is
+// called first from the reading goroutine, while the stream can still be
+// peeked.
+func (s *logStream) retain(before func()) {
+	s.retainOnce.Do(func() {
+		s.mu.Lock()
+		s.retained = true
+		s.mu.Unlock()
+		go s.run(before)
+	})
+}
+
+func (s *logStream) run(before func()) {
+	defer close(s.done)
+	before()
+	for {
+		err := s.readLines(func(line string) {
+			s.mu.Lock()
+			defer s.mu.Unlock()
+			s.lines = append(s.lines, line)
+			if len(s.lines) > maxStreamLines {
+				// Copy the newest lines so the dropped ones can be freed
+				drop := len(s.lines) - maxStreamLines*3/4
+				s.lines = append([]string(nil), s.lines[drop:]...)
+				s.first += int64(drop)
+			}
+		})
+		if err != nil {
+			log.Printf("Stream %s: %v", s.path, err)
+		}
+		if s.closer != nil {
+			s.closer.Close()
+		}
+		s.reader, s.closer = nil, nil
+		// The next writer of a named pipe continues the stream
+		if !s.fifo || err != nil {
+			return
+		}
+	}
+}
+
+// scan calls fn with the line number and text of each line until fn returns
+// false. A retained stream replays the lines received so far, otherwise the
+// stream is read through once.
+func (s *logStream) scan(fn func(offset int64, line string) bool) error {
+	s.mu.Lock()
+	if !s.retained {
+		if s.consumed {
+			s.mu.Unlock()
+			return errors.New("a stream can only be read once")
+		}
+		s.consumed = true
+		s.mu.Unlock()
+
+		var offset int64
+		stop := false
+		return s.readLines(func(line string) {
+			if !stop && !fn(offset, line) {
+				stop = true
+			}
+			offset++
+		})
+	}
+	// Lines are only appended to the slice or the slice is replaced, so the
+	// snapshot stays valid without the lock
+	lines, first := s.lines, s.first
+	s.mu.Unlock()
+
+	for i, line := range lines {
+		if !fn(first+int64(i), line) {
+			break
+		}
+	}
+	return nil
+}
+
+// since returns the retained lines from line number next on, and the line
+// number following them
+func (s *logStream) since(next int64) ([]string, int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	i := max(next-s.first, 0)
+	if i >= int64(len(s.lines)) {
+		return nil, s.first + int64(len(s.lines))
+	}
+	return s.lines[i:], s.first + int64(len(s.lines))
+}
+
+// checkStreams rejects configurations reading stdin more than once
+func checkStreams(sources []*Source) error {
+	var names []string
+	for _, src := range sources {
+		if src.stream != nil && !src.stream.fifo {
+			names = append(names, src.Name)
+		}
+	}
+	if len(names) > 1 {
+		return fmt.Errorf("sources %s all read stdin, only one can", strings.Join(names, ", "))
+	}
+	return nil
+}
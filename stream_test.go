@@ -0,0 +1,182 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+)
+
+// newPipeStream returns a stream reading what is written to the returned
+// writer, like stdin fed by another process
+func newPipeStream() (*logStream, *io.PipeWriter) {
+	r, w := io.Pipe()
+	s := &logStream{path: stdinPath, done: make(chan struct{})}
+	s.reader = bufio.NewReaderSize(r, 64*1024)
+	s.closer = r
+	return s, w
+}
+
+// writeChunks writes the chunks from another goroutine, io.Pipe blocks until
+// they are read
+func writeChunks(w *io.PipeWriter, chunks ...string) <-chan struct{} {
+	written := make(chan struct{})
+	go func() {
+		defer close(written)
+		for _, chunk := range chunks {
+			if _, err := io.WriteString(w, chunk); err != nil {
+				return
+			}
+		}
+	}()
+	return written
+}
+
+// waitLines waits until the stream retained n lines and returns them
+func waitLines(t *testing.T, s *logStream, n int) []string {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		lines, next := s.since(0)
+		if len(lines) >= n || time.Now().After(deadline) {
+			if len(lines) != n || next != int64(n) {
+				t.Fatalf("retained %q up to %d, want %d lines", lines, next, n)
+			}
+			return lines
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestLogStreamScanOnce(t *testing.T) {
+	s, w := newPipeStream()
+	go func() {
+		<-writeChunks(w, "GET /a", "\nGET /b\nGE", "T /c\n", "GET /d")
+		w.Close()
+	}()
+
+	var got []string
+	err := s.scan(func(offset int64, line string) bool {
+		if offset != int64(len(got)) {
+			t.Errorf("line %q at offset %d, want %d", line, offset, len(got))
+		}
+		got = append(got, line)
+		return true
+	})
+	// Lines split across writes are joined, the last line needs no newline
+	if err != nil || !slices.Equal(got, []string{"GET /a", "GET /b", "GET /c", "GET /d"}) {
+		t.Errorf("scanned %q, %v", got, err)
+	}
+	if err := s.scan(func(int64, string) bool { return true }); err == nil {
+		t.Error("a stream that isn't retained was read twice")
+	}
+}
+
+func TestLogStreamRetain(t *testing.T) {
+	s, w := newPipeStream()
+	writeChunks(w, "first\nsec")
+
+	var peeked []string
+	s.retain(func() { peeked = s.peek() })
+	// peeked is written before the first line is retained
+	waitLines(t, s, 1)
+	if !slices.Equal(peeked, []string{"first"}) {
+		t.Errorf("peeked %q", peeked)
+	}
+
+	// A partial line is retained once its rest arrives
+	<-writeChunks(w, "ond\nthird")
+	waitLines(t, s, 2)
+	<-writeChunks(w, "\n")
+	lines := waitLines(t, s, 3)
+	if !slices.Equal(lines, []string{"first", "second", "third"}) {
+		t.Errorf("retained %q", lines)
+	}
+	if lines, next := s.since(2); !slices.Equal(lines, []string{"third"}) || next != 3 {
+		t.Errorf("since 2: %q, %d", lines, next)
+	}
+	if lines, next := s.since(7); lines != nil || next != 3 {
+		t.Errorf("since 7: %q, %d", lines, next)
+	}
+
+	// A retained stream is replayed to every scan, up to fn returning false
+	for range 2 {
+		var got []string
+		s.scan(func(offset int64, line string) bool {
+			got = append(got, fmt.Sprint(offset, line))
+			return len(got) < 2
+		})
+		if !slices.Equal(got, []string{"0first", "1second"}) {
+			t.Errorf("scanned %q", got)
+		}
+	}
+
+	w.Close()
+	select {
+	case <-s.done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("stream not done after the writer closed")
+	}
+}
+
+func TestLogStreamConcurrentReaders(t *testing.T) {
+	const n = 2000
+	s, w := newPipeStream()
+	s.retain(func() {})
+	go func() {
+		for i := range n {
+			// Half the lines are written in two parts
+			line := fmt.Sprintf("line %d\n", i)
+			if i%2 == 0 {
+				io.WriteString(w, line)
+			} else {
+				io.WriteString(w, line[:3])
+				io.WriteString(w, line[3:])
+			}
+		}
+		w.Close()
+	}()
+
+	var wg sync.WaitGroup
+	for range 4 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			var next int64
+			for {
+				// Each scan sees a prefix of the stream, in order
+				var count int64
+				s.scan(func(offset int64, line string) bool {
+					if offset != count || line != fmt.Sprintf("line %d", offset) {
+						t.Errorf("scan: line %q at %d, want line %d", line, offset, count)
+						return false
+					}
+					count++
+					return true
+				})
+				lines, following := s.since(next)
+				for i, line := range lines {
+					if want := fmt.Sprintf("line %d", next+int64(i)); line != want {
+						t.Errorf("since %d: %q, want %q", next, line, want)
+						return
+					}
+				}
+				next = following
+				select {
+				case <-s.done:
+					if lines, _ := s.since(next); len(lines) == 0 {
+						return
+					}
+				default:
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	if lines := waitLines(t, s, n); lines[n-1] != fmt.Sprintf("line %d", n-1) {
+		t.Errorf("last line %q", lines[n-1])
+	}
+}
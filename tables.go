@@ -0,0 +1,415 @@
+package main
+
+import (
+	"cmp"
+	"container/heap"
+	"fmt"
+	"net/url"
+	"slices"
+	"strconv"
+)
+
+// Sort orders understood by every table. "count" sorts by the number of
+// requests (or response time for the slow table), "key" by the row label.
+const (
+	sortByCount = "count"
+	sortByKey   = "key"
+	orderAsc    = "asc"
+	orderDesc   = "desc"
+)
+
+// maxTableLimit caps the rows of a single page
+const maxTableLimit = 1000
+
+// tableDef describes one of the dashboard tables
+type tableDef struct {
+	ID          string
+	Title       string
+	KeyLabel    string
+	DefaultSort string
+	Sortable    bool   // the slow table is always ordered by response time
+	Field       string // filter field of the row keys, for drilling down
+}
+
+// tableDefs lists the tables in the order they appear on the dashboard
+var tableDefs = []tableDef{
+	{ID: "rps", Title: "Requests Per Second", KeyLabel: "Timestamp", DefaultSort: sortByCount, Sortable: true, Field: "second"},
+	{ID: "uris", Title: "Request URL", KeyLabel: "RequestURI", DefaultSort: sortByCount, Sortable: true, Field: "uri"},
+	{ID: "ips", Title: "Request IP", KeyLabel: "IP", DefaultSort: sortByCount, Sortable: true, Field: "ip"},
+	{ID: "rpm", Title: "Requests Per Minute", KeyLabel: "Minute", DefaultSort: sortByCount, Sortable: true, Field: "minute"},
+	{ID: "agents", Title: "User Agent Request", KeyLabel: "User Agent", DefaultSort: sortByCount, Sortable: true, Field: "ua"},
+	{ID: "status", Title: "HTTP Status Code Request", KeyLabel: "Status Code", DefaultSort: sortByKey, Sortable: true, Field: "status"},
+	{ID: "failed", Title: "Failed HTTP Status Codes", KeyLabel: "Status Code", DefaultSort: sortByCount, Sortable: true, Field: "status"},
+	{ID: "slow", Title: "Slow Response Times", KeyLabel: "Timestamp", DefaultSort: sortByCount},
+}
+
+// findTableDef returns the definition of the table with the given id
+func findTableDef(id string) (tableDef, bool) {
+	for _, def := range tableDefs {
+		if def.ID == id {
+			return def, true
+		}
+	}
+	return tableDef{}, false
+}
+
+// TableQuery selects one page of a table
+type TableQuery struct {
+	Limit int
+	Page  int
+	Sort  string
+	Order string
+}
+
+// TablePage describes the page of a table that was returned
+type TablePage struct {
+	Table string `json:"table"`
+	Title string `json:"title"`
+	Total int    `json:"total"` // rows in the full result
+	Page  int    `json:"page"`
+	Pages int    `json:"pages"`
+	Limit int    `json:"limit"`
+	Sort  string `json:"sort"`
+	Order string `json:"order"`
+}
+
+// Offset is the index of the first row of the page
+func (p TablePage) Offset() int {
+	return (p.Page - 1) * p.Limit
+}
+
+// parseTableQueries reads the paging parameters of a dashboard request. Each
+// table takes <table>.limit, <table>.page, <table>.sort and <table>.order, and
+// a bare limit applies to every table.
+func parseTableQueries(values url.Values) (map[string]TableQuery, error) {
+	queries := make(map[string]TableQuery)
+	globalLimit, err := parsePositive(values, "limit")
+	if err != nil {
+		return nil, err
+	}
+
+	for _, def := range tableDefs {
+		q, err := parseTableQuery(values, def.ID+".")
+		if err != nil {
+			return nil, err
+		}
+		if q.Limit == 0 {
+			q.Limit = globalLimit
+		}
+		queries[def.ID] = q
+	}
+	return queries, nil
+}
+
+// parseTableQuery reads the limit, page, sort and order parameters of one
+// table, each name prefixed with prefix
+func parseTableQuery(values url.Values, prefix string) (TableQuery, error) {
+	var q TableQuery
+	var err error
+	if q.Limit, err = parsePositive(values, prefix+"limit"); err != nil {
+		return q, err
+	}
+	if q.Page, err = parsePositive(values, prefix+"page"); err != nil {
+		return q, err
+	}
+	q.Sort = values.Get(prefix + "sort")
+	q.Order = values.Get(prefix + "order")
+	if q.Sort != "" && q.Sort != sortByCount && q.Sort != sortByKey {
+		return q, fmt.Errorf("%ssort must be %q or %q", prefix, sortByCount, sortByKey)
+	}
+	if q.Order != "" && q.Order != orderAsc && q.Order != orderDesc {
+		return q, fmt.Errorf("%sorder must be %q or %q", prefix, orderAsc, orderDesc)
+	}
+	return q, nil
+}
+
+func parsePositive(values url.Values, name string) (int, error) {
+	s := values.Get(name)
+	if s == "" {
+		return 0, nil
+	}
+	n, err := strconv.Atoi(s)
+	if err != nil || n < 1 {
+		return 0, fmt.Errorf("%s must be a positive number", name)
+	}
+	return n, nil
+}
+
+// tableQuery fills in the defaults for one table: the configured per-table
+// limit (or top_n), the first page and the table's natural sort order
+func (o ReportOptions) tableQuery(table string) TableQuery {
+	q := o.Tables[table]
+	if q.Limit <= 0 {
+		q.Limit = o.TableLimits[table]
+	}
+	if q.Limit <= 0 {
+		q.Limit = o.TopN
+	}
+	q.Limit = min(q.Limit, maxTableLimit)
+	if q.Page <= 0 {
+		q.Page = 1
+	}
+	def, _ := findTableDef(table)
+	if q.Sort == "" || !def.Sortable {
+		q.Sort = def.DefaultSort
+	}
+	if q.Order == "" || !def.Sortable {
+		q.Order = orderDesc
+	}
+	return q
+}
+
+// pageKeys sorts the keys of counts as requested and returns one page of them.
+// Ties are broken by key so pages are stable between requests.
+func pageKeys[K cmp.Ordered](table string, counts map[K]int, q TableQuery) ([]K, TablePage) {
+	keys := make([]K, 0, len(counts))
+	for key := range counts {
+		keys = append(keys, key)
+	}
+	slices.SortFunc(keys, func(a, b K) int {
+		c := 0
+		if q.Sort == sortByCount {
+			c = cmp.Compare(counts[a], counts[b])
+		}
+		if c == 0 {
+			c = cmp.Compare(a, b)
+		}
+		if q.Order == orderDesc {
+			c = -c
+		}
+		return c
+	})
+
+	page := newTablePage(table, len(keys), q)
+	start := min(page.Offset(), len(keys))
+	end := min(start+page.Limit, len(keys))
+	return keys[start:end], page
+}
+
+func newTablePage(table string, total int, q TableQuery) TablePage {
+	def, _ := findTableDef(table)
+	pages := max(1, (total+q.Limit-1)/q.Limit)
+	return TablePage{
+		Table: table,
+		Title: def.Title,
+		Total: total,
+		Page:  min(q.Page, pages),
+		Pages: pages,
+		Limit: q.Limit,
+		Sort:  q.Sort,
+		Order: q.Order,
+	}
+}
+
+// slowestEntries keeps the n entries with the highest response time in a
+// min-heap, so only n entries are held in memory however large the log is.
+// Of equally slow entries the earlier ones are kept and listed first, so
+// pages don't depend on the order the log files were read in.
+type slowestEntries struct {
+	n       int
+	entries []LogEntry
+	total   int
+}
+
+func (s *slowestEntries) Len() int { return len(s.entries) }
+func (s *slowestEntries) Less(i, j int) bool {
+	return compareSlowest(s.entries[i], s.entries[j]) > 0
+}
+func (s *slowestEntries) Swap(i, j int) { s.entries[i], s.entries[j] = s.entries[j], s.entries[i] }
+func (s *slowestEntries) Push(x any)    { s.entries = append(s.entries, x.(LogEntry)) }
+func (s *slowestEntries) Pop() any {
+	last := s.entries[len(s.entries)-1]
+	s.entries = s.entries[:len(s.entries)-1]
+	return last
+}
+
+// Add offers an entry to the set
+func (s *slowestEntries) Add(entry LogEntry) {
+	s.total++
+	if len(s.entries) < s.n {
+		heap.Push(s, entry)
+	} else if s.n > 0 && compareSlowest(entry, s.entries[0]) < 0 {
+		s.entries[0] = entry
+		heap.Fix(s, 0)
+	}
+}
+
+// compareSlowest orders entries slowest first, then earliest first
+func compareSlowest(a, b LogEntry) int {
+	if c := cmp.Compare(requestDuration(&b), requestDuration(&a)); c != 0 {
+		return c
+	}
+	return a.TimeStamp.Compare(b.TimeStamp)
+}
+
+// Page returns the requested page, slowest first
+func (s *slowestEntries) Page(q TableQuery) ([]LogEntry, TablePage) {
+	sorted := slices.Clone(s.entries)
+	slices.SortFunc(sorted, compareSlowest)
+	page := newTablePage("slow", s.total, q)
+	start := min(page.Offset(), len(sorted))
+	end := min(start+page.Limit, len(sorted))
+	return sorted[start:end], page
+}
+
+// tableURL links to the page of a single table. Only the paging parameters
+// of that table and the filter are kept.
+func tableURL(site, table, filter string, q TableQuery) string {
+	values := url.Values{}
+	if filter != "" {
+		values.Set("q", filter)
+	}
+	values.Set("page", strconv.Itoa(q.Page))
+	values.Set("limit", strconv.Itoa(q.Limit))
+	values.Set("sort", q.Sort)
+	values.Set("order", q.Order)
+	return "/site/" + url.PathEscape(site) + "/table/" + table + "?" + values.Encode()
+}
+
+// TableLinks are the navigation links of a table page
+type TableLinks struct {
+	First, Prev, Next, Last string
+	SortKey, SortCount      string
+	KeyArrow, CountArrow    string
+	Limits                  []TableLimitLink
+}
+
+// TableLimitLink switches the number of rows per page
+type TableLimitLink struct {
+	Limit   int
+	URL     string
+	Current bool
+}
+
+// tableLinks builds the pagination and sorting links for a table page
+func tableLinks(site, filter string, page TablePage, sortable bool) TableLinks {
+	q := TableQuery{Limit: page.Limit, Page: page.Page, Sort: page.Sort, Order: page.Order}
+	at := func(p int) string {
+		q := q
+		q.Page = p
+		return tableURL(site, page.Table, filter, q)
+	}
+
+	var links TableLinks
+	if page.Page > 1 {
+		links.First = at(1)
+		links.Prev = at(page.Page - 1)
+	}
+	if page.Page < page.Pages {
+		links.Next = at(page.Page + 1)
+		links.Last = at(page.Pages)
+	}
+
+	if sortable {
+		// Clicking the current sort column flips the order
+		sortLink := func(by string) string {
+			s := q
+			s.Page = 1
+			s.Sort = by
+			s.Order = orderDesc
+			if page.Sort == by && page.Order == orderDesc {
+				s.Order = orderAsc
+			}
+			return tableURL(site, page.Table, filter, s)
+		}
+		links.SortKey = sortLink(sortByKey)
+		links.SortCount = sortLink(sortByCount)
+		links.KeyArrow = sortArrow(page, sortByKey)
+		links.CountArrow = sortArrow(page, sortByCount)
+	}
+
+	for _, limit := range []int{10, 50, 100, 500, maxTableLimit} {
+		l := q
+		l.Page = 1
+		l.Limit = limit
+		links.Limits = append(links.Limits, TableLimitLink{Limit: limit, URL: tableURL(site, page.Table, filter, l), Current: limit == page.Limit})
+	}
+	return links
+}
+
+// sortArrow marks the column a table page is sorted by
+func sortArrow(page TablePage, by string) string {
+	if page.Sort != by {
+		return ""
+	}
+	if page.Order == orderAsc {
+		return " ▲"
+	}
+	return " ▼"
+}
+
+// TableRow is a row of any counting table. URIs is only set for the
+// requests per second and failed status tables.
+type TableRow struct {
+	Key   string         `json:"key"`
+	Count int            `json:"count"`
+	URIs  map[string]int `json:"uris,omitempty"`
+}
+
+// TableView is a single table of a site's report, shown on its own page
+type TableView struct {
+	Page     TablePage    `json:"page"`
+	KeyLabel string       `json:"key_label"`
+	Field    string       `json:"-"`
+	Date     string       `json:"date"`
+	Rows     []TableRow   `json:"rows,omitempty"`
+	Entries  []LogEntry   `json:"entries,omitempty"` // rows of the slow table
+	Sortable bool         `json:"-"`
+	Links    TableLinks   `json:"-"`
+	Source   string       `json:"source"`
+	Filter   string       `json:"filter,omitempty"`
+	Chips    []FilterChip `json:"-"`
+	Sites    []string     `json:"-"`
+	User     *User        `json:"-"`
+}
+
+// newTableView picks one table out of a report
+func newTableView(v *ViewData, def tableDef) *TableView {
+	view := &TableView{
+		Page:     v.Pages[def.ID],
+		KeyLabel: def.KeyLabel,
+		Field:    def.Field,
+		Date:     v.Date,
+		Sortable: def.Sortable,
+		Source:   v.Source,
+		Filter:   v.Filter,
+		Chips:    v.Chips,
+		Sites:    v.Sites,
+		User:     v.User,
+	}
+	view.Links = tableLinks(v.Source, v.Filter, view.Page, def.Sortable)
+
+	switch def.ID {
+	case "rps":
+		for _, row := range v.TopRequestsPerSecondSlice {
+			view.Rows = append(view.Rows, TableRow{Key: row.Timestamp, Count: row.Count, URIs: row.URIs})
+		}
+	case "uris":
+		for _, row := range v.TopRequestURIsSlice {
+			view.Rows = append(view.Rows, TableRow{Key: row.RequestURI, Count: row.Count})
+		}
+	case "ips":
+		for _, row := range v.TopRequestAPISlice {
+			view.Rows = append(view.Rows, TableRow{Key: row.IP, Count: row.Count})
+		}
+	case "rpm":
+		for _, row := range v.RequestsPerMinuteSlice {
+			view.Rows = append(view.Rows, TableRow{Key: row.Minute, Count: row.Count})
+		}
+	case "agents":
+		for _, row := range v.UserAgentCountsSlice {
+			view.Rows = append(view.Rows, TableRow{Key: row.UserAgent, Count: row.Count})
+		}
+	case "status":
+		for _, row := range v.StatusCodeCountsSlice {
+			view.Rows = append(view.Rows, TableRow{Key: strconv.Itoa(row.StatusCode), Count: row.Count})
+		}
+	case "failed":
+		for _, row := range v.HttpStatusCodesSlice {
+			view.Rows = append(view.Rows, TableRow{Key: strconv.Itoa(row.StatusCode), Count: row.Count, URIs: row.URIs})
+		}
+	case "slow":
+		view.Entries = v.TopResponseTimes
+	}
+	return view
+}
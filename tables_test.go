@@ -0,0 +1,216 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseTableQueries(t *testing.T) {
+	values, _ := url.ParseQuery("limit=20&uris.limit=5&uris.page=3&uris.sort=key&uris.order=asc&ips.page=2")
+	queries, err := parseTableQueries(values)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := map[string]TableQuery{
+		"uris": {Limit: 5, Page: 3, Sort: sortByKey, Order: orderAsc},
+		"ips":  {Limit: 20, Page: 2},
+		"slow": {Limit: 20},
+	}
+	for table, want := range tests {
+		if got := queries[table]; got != want {
+			t.Errorf("%s: got %+v, want %+v", table, got, want)
+		}
+	}
+	if len(queries) != len(tableDefs) {
+		t.Errorf("%d queries for %d tables", len(queries), len(tableDefs))
+	}
+}
+
+func TestParseTableQueriesErrors(t *testing.T) {
+	tests := []struct {
+		query, err string
+	}{
+		{"limit=0", "limit must be a positive number"},
+		{"limit=-5", "limit must be a positive number"},
+		{"limit=ten", "limit must be a positive number"},
+		{"uris.limit=1.5", "uris.limit must be a positive number"},
+		{"rps.page=0", "rps.page must be a positive number"},
+		{"ips.sort=size", `ips.sort must be "count" or "key"`},
+		{"status.order=up", `status.order must be "asc" or "desc"`},
+		{"slow.sort=key&slow.order=sideways", `slow.order must be "asc" or "desc"`},
+	}
+	for _, tt := range tests {
+		values, _ := url.ParseQuery(tt.query)
+		_, err := parseTableQueries(values)
+		if err == nil || err.Error() != tt.err {
+			t.Errorf("%s: error %v, want %q", tt.query, err, tt.err)
+		}
+	}
+}
+
+func TestTableQueryDefaults(t *testing.T) {
+	opts := ReportOptions{
+		TopN:        10,
+		TableLimits: map[string]int{"ips": 25},
+		Tables: map[string]TableQuery{
+			"uris":   {Limit: 5000, Page: 2, Sort: sortByKey, Order: orderAsc},
+			"slow":   {Sort: sortByKey, Order: orderAsc},
+			"agents": {Limit: 3},
+		},
+	}
+	tests := map[string]TableQuery{
+		"rps":    {Limit: 10, Page: 1, Sort: sortByCount, Order: orderDesc},
+		"status": {Limit: 10, Page: 1, Sort: sortByKey, Order: orderDesc},
+		"ips":    {Limit: 25, Page: 1, Sort: sortByCount, Order: orderDesc},
+		"agents": {Limit: 3, Page: 1, Sort: sortByCount, Order: orderDesc},
+		"uris":   {Limit: maxTableLimit, Page: 2, Sort: sortByKey, Order: orderAsc},
+		// The slow table is always ordered by response time
+		"slow": {Limit: 10, Page: 1, Sort: sortByCount, Order: orderDesc},
+	}
+	for table, want := range tests {
+		if got := opts.tableQuery(table); got != want {
+			t.Errorf("%s: got %+v, want %+v", table, got, want)
+		}
+	}
+}
+
+func TestPageKeys(t *testing.T) {
+	counts := map[string]int{"/a": 5, "/b": 3, "/c": 3, "/d": 1, "/e": 3}
+	tests := []struct {
+		q     TableQuery
+		keys  []string
+		page  int
+		pages int
+	}{
+		// Ties are ordered by key, in the direction of the sort
+		{TableQuery{Limit: 2, Page: 1, Sort: sortByCount, Order: orderDesc}, []string{"/a", "/e"}, 1, 3},
+		{TableQuery{Limit: 2, Page: 2, Sort: sortByCount, Order: orderDesc}, []string{"/c", "/b"}, 2, 3},
+		{TableQuery{Limit: 2, Page: 3, Sort: sortByCount, Order: orderDesc}, []string{"/d"}, 3, 3},
+		// Pages past the end show the last page
+		{TableQuery{Limit: 2, Page: 9, Sort: sortByCount, Order: orderDesc}, []string{"/d"}, 3, 3},
+		{TableQuery{Limit: 2, Page: 1, Sort: sortByCount, Order: orderAsc}, []string{"/d", "/b"}, 1, 3},
+		{TableQuery{Limit: 3, Page: 2, Sort: sortByKey, Order: orderAsc}, []string{"/d", "/e"}, 2, 2},
+		{TableQuery{Limit: 3, Page: 1, Sort: sortByKey, Order: orderDesc}, []string{"/e", "/d", "/c"}, 1, 2},
+		{TableQuery{Limit: 5, Page: 1, Sort: sortByCount, Order: orderDesc}, []string{"/a", "/e", "/c", "/b", "/d"}, 1, 1},
+	}
+	for _, tt := range tests {
+		keys, page := pageKeys("uris", counts, tt.q)
+		if !slices.Equal(keys, tt.keys) {
+			t.Errorf("%+v: keys %q, want %q", tt.q, keys, tt.keys)
+		}
+		if page.Page != tt.page || page.Pages != tt.pages || page.Total != len(counts) || page.Title != "Request URL" {
+			t.Errorf("%+v: page %+v, want page %d of %d", tt.q, page, tt.page, tt.pages)
+		}
+	}
+
+	keys, page := pageKeys("uris", map[string]int{}, TableQuery{Limit: 10, Page: 2})
+	if len(keys) != 0 || page.Page != 1 || page.Pages != 1 || page.Offset() != 0 {
+		t.Errorf("empty table: %q, %+v", keys, page)
+	}
+
+	statuses, _ := pageKeys("status", map[int]int{404: 1, 200: 9, 500: 1}, TableQuery{Limit: 10, Page: 1, Sort: sortByKey, Order: orderAsc})
+	if !slices.Equal(statuses, []int{200, 404, 500}) {
+		t.Errorf("status codes sorted as %v", statuses)
+	}
+}
+
+func TestSlowestEntries(t *testing.T) {
+	at := time.Date(2024, 2, 19, 16, 0, 0, 0, time.UTC)
+	entry := func(second int, rt float64) LogEntry {
+		return LogEntry{TimeStamp: at.Add(time.Duration(second) * time.Second), ResponseTime: rt}
+	}
+	entries := []LogEntry{
+		entry(0, 0.5), entry(1, 2), entry(2, 0.5), entry(3, 1), entry(4, 2),
+		entry(5, 0.1), entry(6, 1), entry(7, 0.5), entry(8, 3),
+	}
+	// The slowest four, the earlier of equally slow entries first
+	want := []LogEntry{entry(8, 3), entry(1, 2), entry(4, 2), entry(3, 1)}
+
+	reversed := slices.Clone(entries)
+	slices.Reverse(reversed)
+	orders := map[string][]LogEntry{"log order": entries, "reversed": reversed}
+	for name, order := range orders {
+		s := &slowestEntries{n: 4}
+		for _, e := range order {
+			s.Add(e)
+		}
+		if len(s.entries) != 4 || s.total != len(entries) {
+			t.Errorf("%s: kept %d of %d entries", name, len(s.entries), s.total)
+		}
+
+		first, page := s.Page(TableQuery{Limit: 2, Page: 1})
+		second, _ := s.Page(TableQuery{Limit: 2, Page: 2})
+		if got := append(first, second...); !slices.EqualFunc(got, want, sameEntry) {
+			t.Errorf("%s: got %v, want %v", name, got, want)
+		}
+		// Pages count every entry offered, not just the kept ones
+		if page.Total != len(entries) || page.Pages != 5 {
+			t.Errorf("%s: page %+v", name, page)
+		}
+	}
+
+	// Of equally slow entries the earliest are kept, whatever order they come in
+	s := &slowestEntries{n: 2}
+	for _, e := range []LogEntry{entry(1, 1), entry(2, 1), entry(3, 1), entry(0, 1)} {
+		s.Add(e)
+	}
+	if got, _ := s.Page(TableQuery{Limit: 2, Page: 1}); !slices.EqualFunc(got, []LogEntry{entry(0, 1), entry(1, 1)}, sameEntry) {
+		t.Errorf("ties: got %v", got)
+	}
+
+	// Entries are ordered by their request time, when the format logs it
+	s = &slowestEntries{n: 2}
+	for _, e := range []LogEntry{
+		{TimeStamp: at, RequestTime: 0.5, ResponseTime: 0.1},
+		{TimeStamp: at, RequestTime: 3, ResponseTime: 0.2},
+		{TimeStamp: at, ResponseTime: 1},
+	} {
+		s.Add(e)
+	}
+	if got, _ := s.Page(TableQuery{Limit: 2, Page: 1}); len(got) != 2 || got[0].RequestTime != 3 || got[1].ResponseTime != 1 {
+		t.Errorf("by request time: got %+v", got)
+	}
+
+	empty := &slowestEntries{n: 0}
+	empty.Add(entry(0, 1))
+	if got, page := empty.Page(TableQuery{Limit: 10, Page: 1}); len(got) != 0 || page.Total != 1 {
+		t.Errorf("n=0 kept %v, %+v", got, page)
+	}
+}
+
+func sameEntry(a, b LogEntry) bool {
+	return a.TimeStamp.Equal(b.TimeStamp) && a.ResponseTime == b.ResponseTime
+}
+
+func TestTableRequests(t *testing.T) {
+	handler := newTestApp(t, hostileLines, nil)
+	tests := []struct {
+		path   string
+		status int
+		body   string
+	}{
+		{"/site/site?limit=0", http.StatusBadRequest, "limit must be a positive number"},
+		{"/site/site?uris.sort=size", http.StatusBadRequest, `uris.sort must be "count" or "key"`},
+		{"/site/site?ips.order=up", http.StatusBadRequest, `ips.order must be "asc" or "desc"`},
+		{"/api/summary?source=site&rps.page=-1", http.StatusBadRequest, "rps.page must be a positive number"},
+		{"/site/site/table/uris?page=x", http.StatusBadRequest, "page must be a positive number"},
+		{"/site/site/table/uris?sort=uri", http.StatusBadRequest, `sort must be "count" or "key"`},
+		{"/api/table?source=site&table=uris&limit=many", http.StatusBadRequest, "limit must be a positive number"},
+		{"/site/site/table/nope", http.StatusNotFound, "Unknown table"},
+		{"/api/table?source=site&table=uris&limit=2&page=9", http.StatusOK, `"page":2,"pages":2,"limit":2`},
+		{"/api/table?source=site&table=slow&limit=1&page=2&sort=key&order=asc", http.StatusOK, `"page":2,"pages":3,"limit":1,"sort":"count","order":"desc"`},
+		{"/site/site?limit=5000", http.StatusOK, ""},
+	}
+	for _, tt := range tests {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, tt.path, nil))
+		if w.Code != tt.status || !strings.Contains(w.Body.String(), tt.body) {
+			t.Errorf("%s: %d %q, want %d with %q", tt.path, w.Code, w.Body.String(), tt.status, tt.body)
+		}
+	}
+}
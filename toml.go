@@ -0,0 +1,586 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// decodeTOML parses the subset of TOML used by the config file (tables,
+// arrays of tables, strings, numbers, booleans, arrays and inline tables)
+// into v. Struct fields are matched by their `toml` tag and unknown keys are
+// reported as errors so typos don't go unnoticed.
+func decodeTOML(data []byte, v any) error {
+	tree, err := parseTOML(string(data))
+	if err != nil {
+		return err
+	}
+	return decodeTOMLValue(tree, reflect.ValueOf(v).Elem(), "")
+}
+
+type tomlParser struct {
+	src  string
+	pos  int
+	line int
+}
+
+func (p *tomlParser) errorf(format string, args ...any) error {
+	return fmt.Errorf("line %d: %s", p.line, fmt.Sprintf(format, args...))
+}
+
+func parseTOML(src string) (map[string]any, error) {
+	p := &tomlParser{src: src, line: 1}
+	root := make(map[string]any)
+	current := root
+
+	for {
+		p.skipSpace(true)
+		if p.pos >= len(p.src) {
+			return root, nil
+		}
+
+		if p.src[p.pos] == '[' {
+			array := strings.HasPrefix(p.src[p.pos:], "[[")
+			if array {
+				p.pos += 2
+			} else {
+				p.pos++
+			}
+			keys, err := p.parseKey()
+			if err != nil {
+				return nil, err
+			}
+			p.skipSpace(false)
+			closing := "]"
+			if array {
+				closing = "]]"
+			}
+			if !strings.HasPrefix(p.src[p.pos:], closing) {
+				return nil, p.errorf("expected %q after table name", closing)
+			}
+			p.pos += len(closing)
+			if current, err = p.openTable(root, keys, array); err != nil {
+				return nil, err
+			}
+		} else {
+			keys, err := p.parseKey()
+			if err != nil {
+				return nil, err
+			}
+			p.skipSpace(false)
+			if p.pos >= len(p.src) || p.src[p.pos] != '=' {
+				return nil, p.errorf("expected '=' after key %q", strings.Join(keys, "."))
+			}
+			p.pos++
+			p.skipSpace(false)
+			value, err := p.parseValue()
+			if err != nil {
+				return nil, err
+			}
+			if err := p.setKey(current, keys, value); err != nil {
+				return nil, err
+			}
+		}
+
+		// Only a comment may follow on the same line
+		p.skipSpace(false)
+		if p.pos < len(p.src) && p.src[p.pos] != '\n' && p.src[p.pos] != '\r' {
+			return nil, p.errorf("unexpected %q at end of line", p.src[p.pos])
+		}
+	}
+}
+
+// openTable returns the table named by keys, creating it as needed. For
+// array tables a new element is appended.
+func (p *tomlParser) openTable(root map[string]any, keys []string, array bool) (map[string]any, error) {
+	table := root
+	for i, key := range keys {
+		last := i == len(keys)-1
+		switch existing := table[key].(type) {
+		case nil:
+			if last && array {
+				next := make(map[string]any)
+				table[key] = []any{next}
+				return next, nil
+			}
+			next := make(map[string]any)
+			table[key] = next
+			table = next
+		case map[string]any:
+			if last && array {
+				return nil, p.errorf("%q is a table, not an array of tables", strings.Join(keys, "."))
+			}
+			table = existing
+		case []any:
+			if len(existing) == 0 {
+				return nil, p.errorf("%q is not a table", strings.Join(keys, "."))
+			}
+			if last && array {
+				next := make(map[string]any)
+				table[key] = append(existing, next)
+				return next, nil
+			}
+			elem, ok := existing[len(existing)-1].(map[string]any)
+			if !ok {
+				return nil, p.errorf("%q is not a table", strings.Join(keys, "."))
+			}
+			table = elem
+		default:
+			return nil, p.errorf("%q is already a value", strings.Join(keys[:i+1], "."))
+		}
+	}
+	return table, nil
+}
+
+func (p *tomlParser) setKey(table map[string]any, keys []string, value any) error {
+	for _, key := range keys[:len(keys)-1] {
+		next, ok := table[key].(map[string]any)
+		if !ok {
+			if table[key] != nil {
+				return p.errorf("%q is already a value", key)
+			}
+			next = make(map[string]any)
+			table[key] = next
+		}
+		table = next
+	}
+	key := keys[len(keys)-1]
+	if _, exists := table[key]; exists {
+		return p.errorf("duplicate key %q", key)
+	}
+	table[key] = value
+	return nil
+}
+
+// skipSpace skips blanks and comments, and newlines too when multiline is set
+func (p *tomlParser) skipSpace(multiline bool) {
+	for p.pos < len(p.src) {
+		switch c := p.src[p.pos]; {
+		case c == ' ' || c == '\t':
+			p.pos++
+		case c == '#':
+			for p.pos < len(p.src) && p.src[p.pos] != '\n' {
+				p.pos++
+			}
+		case multiline && (c == '\n' || c == '\r'):
+			if c == '\n' {
+				p.line++
+			}
+			p.pos++
+		default:
+			return
+		}
+	}
+}
+
+func (p *tomlParser) parseKey() ([]string, error) {
+	var keys []string
+	for {
+		p.skipSpace(false)
+		if p.pos >= len(p.src) {
+			return nil, p.errorf("expected key")
+		}
+		var key string
+		switch p.src[p.pos] {
+		case '"', '\'':
+			s, err := p.parseString()
+			if err != nil {
+				return nil, err
+			}
+			key = s
+		default:
+			start := p.pos
+			for p.pos < len(p.src) && isBareKeyChar(p.src[p.pos]) {
+				p.pos++
+			}
+			if start == p.pos {
+				return nil, p.errorf("invalid key character %q", p.src[p.pos])
+			}
+			key = p.src[start:p.pos]
+		}
+		keys = append(keys, key)
+
+		p.skipSpace(false)
+		if p.pos < len(p.src) && p.src[p.pos] == '.' {
+			p.pos++
+			continue
+		}
+		return keys, nil
+	}
+}
+
+func isBareKeyChar(c byte) bool {
+	return c == '_' || c == '-' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (c >= '0' && c <= '9')
+}
+
+func (p *tomlParser) parseValue() (any, error) {
+	if p.pos >= len(p.src) {
+		return nil, p.errorf("expected value")
+	}
+	switch c := p.src[p.pos]; {
+	case c == '"' || c == '\'':
+		return p.parseString()
+	case c == '[':
+		return p.parseArray()
+	case c == '{':
+		return p.parseInlineTable()
+	case strings.HasPrefix(p.src[p.pos:], "true"):
+		p.pos += 4
+		return true, nil
+	case strings.HasPrefix(p.src[p.pos:], "false"):
+		p.pos += 5
+		return false, nil
+	default:
+		start := p.pos
+		for p.pos < len(p.src) && strings.IndexByte("+-0123456789._eE", p.src[p.pos]) >= 0 {
+			p.pos++
+		}
+		text := strings.ReplaceAll(p.src[start:p.pos], "_", "")
+		if text == "" {
+			return nil, p.errorf("invalid value starting with %q", c)
+		}
+		if i, err := strconv.ParseInt(text, 10, 64); err == nil {
+			return i, nil
+		}
+		if f, err := strconv.ParseFloat(text, 64); err == nil {
+			return f, nil
+		}
+		return nil, p.errorf("invalid number %q", text)
+	}
+}
+
+func (p *tomlParser) parseArray() ([]any, error) {
+	p.pos++ // [
+	var values []any
+	for {
+		p.skipSpace(true)
+		if p.pos >= len(p.src) {
+			return nil, p.errorf("unterminated array")
+		}
+		if p.src[p.pos] == ']' {
+			p.pos++
+			return values, nil
+		}
+		value, err := p.parseValue()
+		if err != nil {
+			return nil, err
+		}
+		values = append(values, value)
+		p.skipSpace(true)
+		if p.pos < len(p.src) && p.src[p.pos] == ',' {
+			p.pos++
+		} else if p.pos < len(p.src) && p.src[p.pos] != ']' {
+			return nil, p.errorf("expected ',' or ']' in array")
+		}
+	}
+}
+
+func (p *tomlParser) parseInlineTable() (map[string]any, error) {
+	p.pos++ // {
+	table := make(map[string]any)
+	for {
+		p.skipSpace(false)
+		if p.pos >= len(p.src) {
+			return nil, p.errorf("unterminated inline table")
+		}
+		if p.src[p.pos] == '}' {
+			p.pos++
+			return table, nil
+		}
+		keys, err := p.parseKey()
+		if err != nil {
+			return nil, err
+		}
+		if p.pos >= len(p.src) || p.src[p.pos] != '=' {
+			return nil, p.errorf("expected '=' in inline table")
+		}
+		p.pos++
+		p.skipSpace(false)
+		value, err := p.parseValue()
+		if err != nil {
+			return nil, err
+		}
+		if err := p.setKey(table, keys, value); err != nil {
+			return nil, err
+		}
+		p.skipSpace(false)
+		if p.pos < len(p.src) && p.src[p.pos] == ',' {
+			p.pos++
+		}
+	}
+}
+
+func (p *tomlParser) parseString() (string, error) {
+	switch {
+	case strings.HasPrefix(p.src[p.pos:], "'''"):
+		return p.parseMultiline("'''", false)
+	case strings.HasPrefix(p.src[p.pos:], `"""`):
+		return p.parseMultiline(`"""`, true)
+	case p.src[p.pos] == '\'':
+		end := strings.IndexAny(p.src[p.pos+1:], "'\n")
+		if end < 0 || p.src[p.pos+1+end] != '\'' {
+			return "", p.errorf("unterminated string")
+		}
+		s := p.src[p.pos+1 : p.pos+1+end]
+		p.pos += end + 2
+		return s, nil
+	}
+
+	p.pos++ // "
+	var b strings.Builder
+	for p.pos < len(p.src) {
+		c := p.src[p.pos]
+		switch c {
+		case '"':
+			p.pos++
+			return b.String(), nil
+		case '\n':
+			return "", p.errorf("unterminated string")
+		case '\\':
+			if err := p.parseEscape(&b); err != nil {
+				return "", err
+			}
+		default:
+			b.WriteByte(c)
+			p.pos++
+		}
+	}
+	return "", p.errorf("unterminated string")
+}
+
+func (p *tomlParser) parseMultiline(delim string, escapes bool) (string, error) {
+	p.pos += len(delim)
+	// A newline directly after the opening delimiter is trimmed
+	if strings.HasPrefix(p.src[p.pos:], "\r\n") {
+		p.pos += 2
+		p.line++
+	} else if strings.HasPrefix(p.src[p.pos:], "\n") {
+		p.pos++
+		p.line++
+	}
+
+	var b strings.Builder
+	for p.pos < len(p.src) {
+		if strings.HasPrefix(p.src[p.pos:], delim) {
+			p.pos += len(delim)
+			return b.String(), nil
+		}
+		c := p.src[p.pos]
+		if c == '\n' {
+			p.line++
+		}
+		if escapes && c == '\\' {
+			if err := p.parseEscape(&b); err != nil {
+				return "", err
+			}
+			continue
+		}
+		b.WriteByte(c)
+		p.pos++
+	}
+	return "", p.errorf("unterminated multi-line string")
+}
+
+func (p *tomlParser) parseEscape(b *strings.Builder) error {
+	if p.pos+1 >= len(p.src) {
+		return p.errorf("unterminated escape sequence")
+	}
+	c := p.src[p.pos+1]
+	p.pos += 2
+	switch c {
+	case 'n':
+		b.WriteByte('\n')
+	case 't':
+		b.WriteByte('\t')
+	case 'r':
+		b.WriteByte('\r')
+	case '"', '\\':
+		b.WriteByte(c)
+	case 'u', 'U':
+		size := 4
+		if c == 'U' {
+			size = 8
+		}
+		if p.pos+size > len(p.src) {
+			return p.errorf("short unicode escape")
+		}
+		code, err := strconv.ParseUint(p.src[p.pos:p.pos+size], 16, 32)
+		if err != nil || !utf8.ValidRune(rune(code)) {
+			return p.errorf("invalid unicode escape")
+		}
+		b.WriteRune(rune(code))
+		p.pos += size
+	default:
+		return p.errorf("invalid escape sequence \\%c", c)
+	}
+	return nil
+}
+
+var durationType = reflect.TypeOf(time.Duration(0))
+
+// decodeTOMLValue stores a parsed value into rv, converting as needed
+func decodeTOMLValue(value any, rv reflect.Value, path string) error {
+	if rv.Type() == durationType {
+		s, ok := value.(string)
+		if !ok {
+			return fmt.Errorf("%s: expected a duration string like \"30s\"", path)
+		}
+		d, err := time.ParseDuration(s)
+		if err != nil {
+			return fmt.Errorf("%s: %w", path, err)
+		}
+		rv.SetInt(int64(d))
+		return nil
+	}
+
+	switch rv.Kind() {
+	case reflect.Struct:
+		table, ok := value.(map[string]any)
+		if !ok {
+			return fmt.Errorf("%s: expected a table", path)
+		}
+		fields := tomlFields(rv)
+		for key, v := range table {
+			field, ok := fields[key]
+			if !ok {
+				return fmt.Errorf("unknown key %q", joinPath(path, key))
+			}
+			if err := decodeTOMLValue(v, field, joinPath(path, key)); err != nil {
+				return err
+			}
+		}
+	case reflect.Map:
+		table, ok := value.(map[string]any)
+		if !ok {
+			return fmt.Errorf("%s: expected a table", path)
+		}
+		if rv.IsNil() {
+			rv.Set(reflect.MakeMap(rv.Type()))
+		}
+		for key, v := range table {
+			elem := reflect.New(rv.Type().Elem()).Elem()
+			if err := decodeTOMLValue(v, elem, joinPath(path, key)); err != nil {
+				return err
+			}
+			rv.SetMapIndex(reflect.ValueOf(key), elem)
+		}
+	case reflect.Slice:
+		list, ok := value.([]any)
+		if !ok {
+			return fmt.Errorf("%s: expected an array", path)
+		}
+		slice := reflect.MakeSlice(rv.Type(), len(list), len(list))
+		for i, v := range list {
+			if err := decodeTOMLValue(v, slice.Index(i), fmt.Sprintf("%s[%d]", path, i)); err != nil {
+				return err
+			}
+		}
+		rv.Set(slice)
+	case reflect.String:
+		s, ok := value.(string)
+		if !ok {
+			return fmt.Errorf("%s: expected a string", path)
+		}
+		rv.SetString(s)
+	case reflect.Bool:
+		b, ok := value.(bool)
+		if !ok {
+			return fmt.Errorf("%s: expected true or false", path)
+		}
+		rv.SetBool(b)
+	case reflect.Int, reflect.Int64:
+		i, ok := value.(int64)
+		if !ok {
+			return fmt.Errorf("%s: expected an integer", path)
+		}
+		rv.SetInt(i)
+	case reflect.Float64:
+		switch n := value.(type) {
+		case int64:
+			rv.SetFloat(float64(n))
+		case float64:
+			rv.SetFloat(n)
+		default:
+			return fmt.Errorf("%s: expected a number", path)
+		}
+	default:
+		return fmt.Errorf("%s: unsupported field type %s", path, rv.Type())
+	}
+	return nil
+}
+
+// tomlFields maps the toml tags of a struct to its settable fields
+func tomlFields(rv reflect.Value) map[string]reflect.Value {
+	fields := make(map[string]reflect.Value)
+	for i := 0; i < rv.NumField(); i++ {
+		name, _, _ := strings.Cut(rv.Type().Field(i).Tag.Get("toml"), ",")
+		if name == "" || name == "-" {
+			continue
+		}
+		fields[name] = rv.Field(i)
+	}
+	return fields
+}
+
+func joinPath(path, key string) string {
+	if path == "" {
+		return key
+	}
+	return path + "." + key
+}
+
+// setFromString assigns a textual value (an environment variable or flag)
+// to a scalar config field
+func setFromString(rv reflect.Value, s string) error {
+	if rv.Type() == durationType {
+		d, err := time.ParseDuration(s)
+		if err != nil {
+			return err
+		}
+		rv.SetInt(int64(d))
+		return nil
+	}
+	switch rv.Kind() {
+	case reflect.String:
+		rv.SetString(s)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(s)
+		if err != nil {
+			return err
+		}
+		rv.SetBool(b)
+	case reflect.Int, reflect.Int64:
+		i, err := strconv.ParseInt(s, 10, 64)
+		if err != nil {
+			return err
+		}
+		rv.SetInt(i)
+	case reflect.Float64:
+		f, err := strconv.ParseFloat(s, 64)
+		if err != nil {
+			return err
+		}
+		rv.SetFloat(f)
+	case reflect.Slice:
+		if rv.Type().Elem().Kind() == reflect.Struct || rv.Type().Elem().Kind() == reflect.Slice {
+			return fmt.Errorf("unsupported list type %s", rv.Type())
+		}
+		items := reflect.MakeSlice(rv.Type(), 0, 0)
+		for _, item := range strings.Split(s, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				elem := reflect.New(rv.Type().Elem()).Elem()
+				if err := setFromString(elem, item); err != nil {
+					return err
+				}
+				items = reflect.Append(items, elem)
+			}
+		}
+		rv.Set(items)
+	default:
+		return fmt.Errorf("unsupported type %s", rv.Type())
+	}
+	return nil
+}
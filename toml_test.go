@@ -0,0 +1,194 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseTOML(t *testing.T) {
+	tests := []struct {
+		name, src string
+		want      map[string]any
+	}{
+		{"bare keys", "a = 1\nb-c_2 = true\n", map[string]any{"a": int64(1), "b-c_2": true}},
+		{"comments", "# header\na = 1 # trailing\n\n  # indented\n", map[string]any{"a": int64(1)}},
+		{"dotted keys", "server.tls.cert = 'c.pem'\nserver.listen = ':80'\n", map[string]any{
+			"server": map[string]any{"listen": ":80", "tls": map[string]any{"cert": "c.pem"}},
+		}},
+		{"quoted keys", `"a.b" = 1` + "\n'c' = 2\n", map[string]any{"a.b": int64(1), "c": int64(2)}},
+		{"table", "[server]\nlisten = ':80'\n[auth.oidc]\nissuer = 'x'\n", map[string]any{
+			"server": map[string]any{"listen": ":80"},
+			"auth":   map[string]any{"oidc": map[string]any{"issuer": "x"}},
+		}},
+		{"table after dotted key", "a.b = 1\n[a.c]\nd = 2\n", map[string]any{
+			"a": map[string]any{"b": int64(1), "c": map[string]any{"d": int64(2)}},
+		}},
+		{"array of tables", "[[sources]]\nname = 'a'\n[[sources]]\nname = 'b'\n", map[string]any{
+			"sources": []any{map[string]any{"name": "a"}, map[string]any{"name": "b"}},
+		}},
+		{"subtable of array element", "[[alerts.rules]]\nname = 'a'\n[alerts.rules.labels]\nx = 1\n[[alerts.rules]]\nname = 'b'\n", map[string]any{
+			"alerts": map[string]any{"rules": []any{
+				map[string]any{"name": "a", "labels": map[string]any{"x": int64(1)}},
+				map[string]any{"name": "b"},
+			}},
+		}},
+		{"inline table", "h = { Authorization = 'Bearer x', 'X-Org' = \"1\", a.b = 2 }\n", map[string]any{
+			"h": map[string]any{"Authorization": "Bearer x", "X-Org": "1", "a": map[string]any{"b": int64(2)}},
+		}},
+		{"empty inline table", "h = {}\n", map[string]any{"h": map[string]any{}}},
+		{"arrays", "a = [1, 2.5, 'x']\nb = [\n  'y', # comment\n  'z',\n]\nc = []\n", map[string]any{
+			"a": []any{int64(1), 2.5, "x"}, "b": []any{"y", "z"}, "c": []any(nil),
+		}},
+		{"basic string escapes", `s = "tab\there \"quoted\" back\\slash \u00e9 \U0001F600 nl\n"` + "\n", map[string]any{
+			"s": "tab\there \"quoted\" back\\slash é 😀 nl\n",
+		}},
+		{"literal string", `s = 'C:\path\no "escapes"'` + "\n", map[string]any{"s": `C:\path\no "escapes"`}},
+		{"multi-line basic", "s = \"\"\"\nline 1\n\\tline 2\n\"\"\"\n", map[string]any{"s": "line 1\n\tline 2\n"}},
+		{"multi-line literal", "s = '''\n^/api/(\\d+)$\n'''\n", map[string]any{"s": "^/api/(\\d+)$\n"}},
+		{"numbers", "a = -3\nb = +4\nc = 1_000\nd = 0.5\ne = 1e3\n", map[string]any{
+			"a": int64(-3), "b": int64(4), "c": int64(1000), "d": 0.5, "e": 1000.0,
+		}},
+		{"crlf", "a = 1\r\n[t]\r\nb = 'x'\r\n", map[string]any{"a": int64(1), "t": map[string]any{"b": "x"}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseTOML(tt.src)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %#v\nwant %#v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseTOMLErrors(t *testing.T) {
+	tests := []struct {
+		src, err string
+	}{
+		{"a = 1\na = 2\n", `line 2: duplicate key "a"`},
+		{"[t]\na = 1\n[u]\n[t.b]\nc = 1\n[t]\na = 2\n", `line 7: duplicate key "a"`},
+		{"a.b = 1\na.b = 2\n", `duplicate key "b"`},
+		{"a = 1\na.b = 2\n", `"a" is already a value`},
+		{"a = 1\n[a]\n", `"a" is already a value`},
+		{"[a]\n[[a]]\n", "is a table, not an array of tables"},
+		{"h = { x = 1, x = 2 }\n", `duplicate key "x"`},
+		{"a = 1 b = 2\n", "line 1: unexpected"},
+		{"a 1\n", "expected '='"},
+		{"[a\n", `expected "]"`},
+		{"[[a]\n", `expected "]]"`},
+		{"a = \"open\n", "unterminated string"},
+		{"a = 'open\n", "unterminated string"},
+		{"a = \"\"\"open\n", "unterminated multi-line string"},
+		{`a = "\q"` + "\n", `invalid escape sequence \q`},
+		{`a = "\u12`, "short unicode escape"},
+		{`a = "\uD800"` + "\n", "invalid unicode escape"},
+		{"a = [1, 2\n", "unterminated array"},
+		{"a = [1 2]\n", "expected ',' or ']'"},
+		{"a = { b = 1", "unterminated inline table"},
+		{"a = { b = 1\n}\n", "invalid key character"},
+		{"a = yes\n", "invalid value"},
+		{"a = 1.2.3\n", "invalid number"},
+		{"\n\n= 1\n", "line 3: invalid key character"},
+	}
+	for _, tt := range tests {
+		_, err := parseTOML(tt.src)
+		if err == nil || !strings.Contains(err.Error(), tt.err) {
+			t.Errorf("parseTOML(%q) error %v, want %q", tt.src, err, tt.err)
+		}
+	}
+}
+
+type tomlTestConfig struct {
+	Name     string            `toml:"name"`
+	Count    int               `toml:"count"`
+	Ratio    float64           `toml:"ratio"`
+	Enabled  bool              `toml:"enabled"`
+	Timeout  time.Duration     `toml:"timeout"`
+	Tags     []string          `toml:"tags"`
+	Buckets  []float64         `toml:"buckets"`
+	Headers  map[string]string `toml:"headers"`
+	Nested   tomlTestNested    `toml:"nested"`
+	Items    []tomlTestNested  `toml:"items"`
+	Internal string
+}
+
+type tomlTestNested struct {
+	Key   string `toml:"key"`
+	Limit int64  `toml:"limit"`
+}
+
+func TestDecodeTOML(t *testing.T) {
+	src := `
+name = "viewer"
+count = 3
+ratio = 2 # integers are accepted for floats
+enabled = true
+timeout = "1m30s"
+tags = ["a", "b"]
+buckets = [0.1, 1, 2.5]
+headers = { X-Scope-OrgID = "tenant" }
+
+[nested]
+key = 'k'
+limit = 9_000_000_000
+
+[[items]]
+key = "first"
+
+[[items]]
+key = "second"
+limit = -1
+`
+	var got tomlTestConfig
+	if err := decodeTOML([]byte(src), &got); err != nil {
+		t.Fatal(err)
+	}
+	want := tomlTestConfig{
+		Name:    "viewer",
+		Count:   3,
+		Ratio:   2,
+		Enabled: true,
+		Timeout: 90 * time.Second,
+		Tags:    []string{"a", "b"},
+		Buckets: []float64{0.1, 1, 2.5},
+		Headers: map[string]string{"X-Scope-OrgID": "tenant"},
+		Nested:  tomlTestNested{Key: "k", Limit: 9000000000},
+		Items:   []tomlTestNested{{Key: "first"}, {Key: "second", Limit: -1}},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %+v\nwant %+v", got, want)
+	}
+}
+
+func TestDecodeTOMLErrors(t *testing.T) {
+	tests := []struct {
+		src, err string
+	}{
+		{"colour = 'red'\n", `unknown key "colour"`},
+		{"[nested]\nkye = 'k'\n", `unknown key "nested.kye"`},
+		{"[[items]]\nkey = 'a'\n[[items]]\nlimt = 1\n", `unknown key "items[1].limt"`},
+		{"Internal = 'x'\n", `unknown key "Internal"`},
+		{"timeout = 30\n", `timeout: expected a duration string like "30s"`},
+		{"timeout = '30 seconds'\n", "timeout: time: unknown unit"},
+		{"count = 1.5\n", "count: expected an integer"},
+		{"count = '1'\n", "count: expected an integer"},
+		{"ratio = 'high'\n", "ratio: expected a number"},
+		{"enabled = 'yes'\n", "enabled: expected true or false"},
+		{"name = 1\n", "name: expected a string"},
+		{"tags = 'a'\n", "tags: expected an array"},
+		{"tags = ['a', 1]\n", "tags[1]: expected a string"},
+		{"nested = 1\n", "nested: expected a table"},
+		{"headers = ['a']\n", "headers: expected a table"},
+	}
+	for _, tt := range tests {
+		var cfg tomlTestConfig
+		err := decodeTOML([]byte(tt.src), &cfg)
+		if err == nil || !strings.Contains(err.Error(), tt.err) {
+			t.Errorf("decodeTOML(%q) error %v, want %q", tt.src, err, tt.err)
+		}
+	}
+}
@@ -0,0 +1,764 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// tuiRows is how many rows of each table the terminal UI loads
+const tuiRows = 200
+
+// tuiTabs are the short names of the panels, the overview and then the
+// dashboard tables
+var tuiTabs = map[string]string{
+	"rps":    "RPS",
+	"uris":   "URLs",
+	"ips":    "IPs",
+	"rpm":    "RPM",
+	"agents": "Agents",
+	"status": "Status",
+	"failed": "Failed",
+	"slow":   "Slow",
+}
+
+// Terminal escape sequences
+const (
+	ansiReset   = "\x1b[0m"
+	ansiBold    = "\x1b[1m"
+	ansiReverse = "\x1b[7m"
+	ansiRed     = "\x1b[31m"
+	ansiYellow  = "\x1b[33m"
+	ansiDim     = "\x1b[2m"
+)
+
+// tuiCommand shows the dashboard in the terminal, for when the server can
+// only be reached over SSH
+func tuiCommand(args []string) int {
+	cfg := DefaultConfig()
+	fs := newFlagSet("tui")
+	configFile := fs.String("config", os.Getenv("NLV_CONFIG"), "Path to the TOML config file")
+	input := fs.String("input", "", "Path to an Nginx log file, replaces the configured sources")
+	source := fs.String("source", "", "Source shown first, the first one by default")
+	filterText := fs.String("filter", "", `Only show entries matching this filter, e.g. status>=500`)
+	refresh := fs.Duration("refresh", 5*time.Second, "How often the report is rebuilt")
+	fs.StringVar(&cfg.Range.Start, "start", cfg.Range.Start, "Start of the date range, \"2006-01-02 15:04:05\" or now-<duration>")
+	fs.StringVar(&cfg.Range.End, "end", cfg.Range.End, "End of the date range")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+
+	if err := loadConfig(fs, cfg, *configFile); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	if *input != "" {
+		cfg.Sources = []SourceConfig{{Path: *input}}
+		cfg.fillSourceDefaults()
+	}
+	sources, err := cfg.BuildSources()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	filter, err := ParseFilter(*filterText)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	for _, src := range sources {
+		if src.stream != nil && !src.stream.fifo {
+			fmt.Fprintln(os.Stderr, "tui reads keys from stdin, pipe the log through a named pipe instead")
+			return 1
+		}
+		src.Retain()
+	}
+	if info, err := os.Stdin.Stat(); err != nil || info.Mode()&os.ModeCharDevice == 0 {
+		fmt.Fprintln(os.Stderr, "tui needs a terminal")
+		return 1
+	}
+
+	t := &tui{
+		cfg:     cfg,
+		sources: sources,
+		filter:  filter,
+		refresh: *refresh,
+		sorts:   make(map[string]TableQuery),
+		results: make(chan tuiResult, 1),
+		out:     bufio.NewWriterSize(os.Stdout, 64*1024),
+	}
+	if *source != "" {
+		t.src = -1
+		for i, src := range sources {
+			if src.Name == *source {
+				t.src = i
+			}
+		}
+		if t.src < 0 {
+			fmt.Fprintf(os.Stderr, "unknown source %q\n", *source)
+			return 1
+		}
+	}
+
+	restore, err := enterRawMode()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "tui:", err)
+		return 1
+	}
+	// Alternate screen, hidden cursor
+	fmt.Fprint(os.Stdout, "\x1b[?1049h\x1b[?25l")
+	defer func() {
+		fmt.Fprint(os.Stdout, "\x1b[?25h\x1b[?1049l")
+		restore()
+	}()
+	t.run()
+	return 0
+}
+
+// tuiResult is a finished report, gen tells whether it is still wanted
+type tuiResult struct {
+	gen    int
+	report *ViewData
+	err    error
+}
+
+// tui is the state of the terminal dashboard
+type tui struct {
+	cfg     *Config
+	sources []*Source
+	refresh time.Duration
+	out     *bufio.Writer
+
+	src     int
+	filter  *Filter
+	history []string              // filters before each drill down
+	sorts   map[string]TableQuery // sort order per table
+	panel   int                   // 0 is the overview, then tableDefs
+	cursor  int
+	offset  int
+	editing bool   // the filter is being typed
+	text    string // the filter being typed
+	detail  *LogEntry
+	paused  bool
+	message string
+
+	report   *ViewData
+	updated  time.Time
+	gen      int
+	building bool
+	results  chan tuiResult
+	width    int
+	height   int
+}
+
+func (t *tui) run() {
+	keys := make(chan string, 16)
+	go readKeys(keys)
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	t.rebuild()
+	for {
+		t.width, t.height = terminalSize()
+		t.draw()
+		select {
+		case key, ok := <-keys:
+			if !ok || !t.handleKey(key) {
+				return
+			}
+		case r := <-t.results:
+			if r.gen != t.gen {
+				continue
+			}
+			t.building = false
+			if r.err != nil {
+				t.message = r.err.Error()
+				continue
+			}
+			t.report = r.report
+			t.updated = time.Now()
+			t.clampCursor()
+		case now := <-ticker.C:
+			if !t.paused && !t.building && now.Sub(t.updated) >= t.refresh {
+				t.rebuild()
+			}
+		}
+	}
+}
+
+// rebuild starts building the report in the background. Reports of
+// earlier settings that are still being built are dropped when they finish.
+func (t *tui) rebuild() {
+	t.gen++
+	t.building = true
+	gen, src, filter := t.gen, t.sources[t.src], t.filter
+	opts := ReportOptions{TopN: tuiRows, Filter: filter, Tables: make(map[string]TableQuery)}
+	for _, def := range tableDefs {
+		q := t.sorts[def.ID]
+		q.Limit = tuiRows
+		opts.Tables[def.ID] = q
+	}
+	go func() {
+		start, end, err := t.cfg.Range.Resolve(time.Now(), src.Location())
+		if err != nil {
+			t.results <- tuiResult{gen: gen, err: err}
+			return
+		}
+		report, err := buildReport(src, start, end, opts)
+		t.results <- tuiResult{gen: gen, report: report, err: err}
+	}()
+}
+
+// table returns the definition and rows of the current panel, false on the
+// overview
+func (t *tui) table() (tableDef, *TableView, bool) {
+	if t.panel == 0 || t.report == nil {
+		return tableDef{}, nil, false
+	}
+	def := tableDefs[t.panel-1]
+	return def, newTableView(t.report, def), true
+}
+
+func (t *tui) rowCount() int {
+	_, view, ok := t.table()
+	switch {
+	case !ok:
+		return 0
+	case view.Entries != nil:
+		return len(view.Entries)
+	}
+	return len(view.Rows)
+}
+
+func (t *tui) clampCursor() {
+	t.cursor = max(0, min(t.cursor, t.rowCount()-1))
+}
+
+// bodyHeight is the number of lines between the header and the footer
+func (t *tui) bodyHeight() int {
+	return max(1, t.height-6)
+}
+
+// handleKey applies a key press and reports whether to keep running
+func (t *tui) handleKey(key string) bool {
+	if key == "ctrl-c" {
+		return false
+	}
+	if t.editing {
+		t.editFilter(key)
+		return true
+	}
+	if t.detail != nil {
+		switch key {
+		case "q", "esc", "backspace", "enter":
+			t.detail = nil
+		}
+		return true
+	}
+
+	t.message = ""
+	page := t.bodyHeight() - 1
+	switch key {
+	case "q":
+		return false
+	case "right", "l", "tab":
+		t.setPanel((t.panel + 1) % (len(tableDefs) + 1))
+	case "left", "h", "btab":
+		t.setPanel((t.panel + len(tableDefs)) % (len(tableDefs) + 1))
+	case "up", "k":
+		t.cursor--
+	case "down", "j":
+		t.cursor++
+	case "pgup":
+		t.cursor -= page
+	case "pgdn", " ":
+		t.cursor += page
+	case "home", "g":
+		t.cursor = 0
+	case "end", "G":
+		t.cursor = t.rowCount() - 1
+	case "enter":
+		t.drill()
+	case "/":
+		t.editing, t.text = true, t.filter.String()
+	case "backspace":
+		if len(t.history) == 0 {
+			t.message = "Nothing to go back to"
+			break
+		}
+		previous := t.history[len(t.history)-1]
+		t.history = t.history[:len(t.history)-1]
+		t.filter, _ = ParseFilter(previous)
+		t.rebuild()
+	case "c":
+		if t.filter != nil {
+			t.history = append(t.history, t.filter.String())
+			t.filter = nil
+			t.rebuild()
+		}
+	case "o":
+		def, _, ok := t.table()
+		if !ok || !def.Sortable {
+			break
+		}
+		q := t.sorts[def.ID]
+		if q.Sort == sortByKey || q.Sort == "" && def.DefaultSort == sortByKey {
+			q.Sort, q.Order = sortByCount, orderDesc
+		} else {
+			q.Sort, q.Order = sortByKey, orderAsc
+		}
+		t.sorts[def.ID] = q
+		t.rebuild()
+	case "s", "S":
+		step := 1
+		if key == "S" {
+			step = len(t.sources) - 1
+		}
+		t.src = (t.src + step) % len(t.sources)
+		t.report = nil
+		t.rebuild()
+	case "p":
+		t.paused = !t.paused
+	case "r":
+		t.rebuild()
+	default:
+		if n, err := strconv.Atoi(key); err == nil && n <= len(tableDefs) {
+			t.setPanel(n)
+		}
+	}
+	t.clampCursor()
+	return true
+}
+
+func (t *tui) setPanel(panel int) {
+	t.panel, t.cursor, t.offset = panel, 0, 0
+}
+
+// drill narrows the filter to the selected row and goes to the overview,
+// like clicking a cell on the dashboard. Entries of the slow table are
+// shown in full instead.
+func (t *tui) drill() {
+	def, view, ok := t.table()
+	if !ok || t.rowCount() == 0 {
+		return
+	}
+	if view.Entries != nil {
+		entry := view.Entries[t.cursor]
+		t.detail = &entry
+		return
+	}
+	filter, err := ParseFilter(t.filter.And(filterTerm(def.Field, view.Rows[t.cursor].Key)))
+	if err != nil {
+		t.message = err.Error()
+		return
+	}
+	t.history = append(t.history, t.filter.String())
+	t.filter = filter
+	t.setPanel(0)
+	t.rebuild()
+}
+
+// editFilter handles the keys typed in the filter input
+func (t *tui) editFilter(key string) {
+	switch key {
+	case "esc":
+		t.editing, t.message = false, ""
+	case "enter":
+		filter, err := ParseFilter(t.text)
+		if err != nil {
+			t.message = err.Error()
+			return
+		}
+		t.editing, t.message = false, ""
+		if filter.String() != t.filter.String() {
+			t.history = append(t.history, t.filter.String())
+			t.filter = filter
+			t.setPanel(t.panel)
+			t.rebuild()
+		}
+	case "backspace":
+		_, size := utf8.DecodeLastRuneInString(t.text)
+		t.text = t.text[:len(t.text)-size]
+	case "ctrl-u":
+		t.text = ""
+	default:
+		if utf8.RuneCountInString(key) == 1 {
+			t.text += key
+		}
+	}
+}
+
+// draw renders the whole screen. Lines end in \r\n as the terminal is in
+// raw mode.
+func (t *tui) draw() {
+	var lines []string
+	src := t.sources[t.src]
+
+	header := fmt.Sprintf(" nginx-log-viewer  %s (%d/%d)", src.Name, t.src+1, len(t.sources))
+	if t.report != nil {
+		header += fmt.Sprintf("  %s  %s requests", t.report.Date, formatNumberWithCommas(t.report.TotalRequests))
+	}
+	status := ""
+	switch {
+	case t.building:
+		status = "loading… "
+	case t.paused:
+		status = "paused "
+	}
+	if !t.updated.IsZero() {
+		status += "updated " + t.updated.Format("15:04:05") + " "
+	}
+	lines = append(lines, ansiReverse+ansiBold+fitRight(header, status, t.width)+ansiReset)
+
+	var tabs strings.Builder
+	tabs.WriteString(" ")
+	for i := 0; i <= len(tableDefs); i++ {
+		name := "Overview"
+		if i > 0 {
+			name = tuiTabs[tableDefs[i-1].ID]
+		}
+		if i == t.panel {
+			fmt.Fprintf(&tabs, "%s %d %s %s ", ansiReverse, i, name, ansiReset)
+		} else {
+			fmt.Fprintf(&tabs, " %d %s  ", i, name)
+		}
+	}
+	lines = append(lines, tabs.String())
+
+	if t.editing {
+		lines = append(lines, ansiBold+fit(" Filter: "+t.text+"█", t.width)+ansiReset)
+	} else if t.filter != nil {
+		lines = append(lines, fit(" Filter: "+t.filter.String(), t.width))
+	} else {
+		lines = append(lines, ansiDim+fit(" Filter: none, press / to set one", t.width)+ansiReset)
+	}
+	lines = append(lines, "")
+
+	var body []string
+	switch {
+	case t.report == nil:
+		body = []string{" Loading…"}
+	case t.detail != nil:
+		body = t.detailLines()
+	case t.panel == 0:
+		body = t.overviewLines()
+	default:
+		body = t.tableLines()
+	}
+	for len(body) < t.bodyHeight() {
+		body = append(body, "")
+	}
+	lines = append(lines, body[:t.bodyHeight()]...)
+
+	if t.message != "" {
+		lines = append(lines, ansiRed+fit(" "+t.message, t.width)+ansiReset)
+	} else {
+		lines = append(lines, "")
+	}
+	help := " ←/→ panel  ↑/↓ select  enter drill down  / filter  backspace back  c clear  o sort  s source  p pause  r refresh  q quit"
+	if t.editing {
+		help = " enter apply  esc cancel  ctrl-u clear"
+	}
+	lines = append(lines, ansiDim+fit(help, t.width)+ansiReset)
+
+	t.out.WriteString("\x1b[H")
+	for i, line := range lines {
+		if i > 0 {
+			t.out.WriteString("\r\n")
+		}
+		t.out.WriteString(line + "\x1b[K")
+	}
+	t.out.WriteString("\x1b[J")
+	t.out.Flush()
+}
+
+// overviewLines shows the totals and the top rows of the main tables
+func (t *tui) overviewLines() []string {
+	v := t.report
+	classes := make([]int, 6)
+	for code, count := range v.StatusCodeCounts {
+		if code/100 < len(classes) {
+			classes[code/100] += count
+		}
+	}
+	summary := fmt.Sprintf(" %sTotal requests%s %s", ansiBold, ansiReset, formatNumberWithCommas(v.TotalRequests))
+	for class := 2; class <= 5; class++ {
+		label := fmt.Sprintf("%dxx", class)
+		summary += "   " + colorStatus(class*100, label) + " " + formatNumberWithCommas(classes[class])
+	}
+	lines := []string{
+		summary,
+		fmt.Sprintf(" %sLines%s %s parsed, %s failed", ansiBold, ansiReset,
+			formatNumberWithCommas(v.Stats.Parsed), formatNumberWithCommas(v.Stats.Failed)),
+		"",
+	}
+
+	// Two columns of small tables when the terminal is wide enough
+	blocks := [][]string{}
+	for _, id := range []string{"uris", "ips", "status", "agents", "rpm", "slow"} {
+		def, _ := findTableDef(id)
+		blocks = append(blocks, t.miniTable(def, 5))
+	}
+	if t.width >= 100 {
+		half := t.width / 2
+		for i := 0; i < len(blocks); i += 2 {
+			for j := range blocks[i] {
+				right := ""
+				if i+1 < len(blocks) && j < len(blocks[i+1]) {
+					right = blocks[i+1][j]
+				}
+				lines = append(lines, padANSI(blocks[i][j], half)+right)
+			}
+			lines = append(lines, "")
+		}
+		return lines
+	}
+	for _, block := range blocks {
+		lines = append(append(lines, block...), "")
+	}
+	return lines
+}
+
+// miniTable renders the first rows of a table for the overview, always
+// n+1 lines high
+func (t *tui) miniTable(def tableDef, n int) []string {
+	width := t.width - 2
+	if t.width >= 100 {
+		width = t.width/2 - 2
+	}
+	lines := []string{" " + ansiBold + fit(def.Title, width) + ansiReset}
+	view := newTableView(t.report, def)
+	for i := range n {
+		switch {
+		case view.Entries != nil && i < len(view.Entries):
+			e := view.Entries[i]
+			lines = append(lines, " "+colorStatus(e.Status, fit(fmt.Sprintf("%8.3fs %3d %s", requestDuration(&e), e.Status, e.RequestURI), width)))
+		case view.Entries == nil && i < len(view.Rows):
+			row := view.Rows[i]
+			lines = append(lines, " "+fit(fmt.Sprintf("%9s  %s", formatNumberWithCommas(row.Count), row.Key), width))
+		default:
+			lines = append(lines, "")
+		}
+	}
+	return lines
+}
+
+// tableLines shows the rows of the current table with bars and the cursor
+func (t *tui) tableLines() []string {
+	def, view, _ := t.table()
+	height := t.bodyHeight() - 1
+	t.offset = max(0, min(t.offset, t.cursor))
+	if t.cursor >= t.offset+height {
+		t.offset = t.cursor - height + 1
+	}
+
+	sortName := "by count"
+	if view.Page.Sort == sortByKey {
+		sortName = "by " + strings.ToLower(def.KeyLabel)
+	}
+	lines := []string{fmt.Sprintf(" %s%s%s  %s of %s rows, %s", ansiBold, def.Title, ansiReset,
+		formatNumberWithCommas(t.rowCount()), formatNumberWithCommas(view.Page.Total), sortName)}
+
+	if view.Entries != nil {
+		for i := t.offset; i < len(view.Entries) && i < t.offset+height; i++ {
+			e := view.Entries[i]
+			line := fmt.Sprintf(" %8.3fs  %s  %-15s %3d %-6s %s", requestDuration(&e), e.TimeStamp.Format(rangeLayout), e.IP, e.Status, e.Method, e.RequestURI)
+			lines = append(lines, t.rowLine(i, colorStatus(e.Status, fit(line, t.width))))
+		}
+		return lines
+	}
+
+	maxCount := 1
+	for _, row := range view.Rows {
+		maxCount = max(maxCount, row.Count)
+	}
+	const barWidth = 20
+	for i := t.offset; i < len(view.Rows) && i < t.offset+height; i++ {
+		row := view.Rows[i]
+		bar := strings.Repeat("█", max(1, row.Count*barWidth/maxCount))
+		key := row.Key
+		if len(row.URIs) > 0 {
+			top := topKeys(row.URIs, 1)
+			key += fmt.Sprintf("  (top: %s %s)", top[0], formatNumberWithCommas(row.URIs[top[0]]))
+		}
+		line := fit(fmt.Sprintf(" %9s %-*s %s", formatNumberWithCommas(row.Count), barWidth, bar, key), t.width)
+		if def.Field == "status" {
+			code, _ := strconv.Atoi(row.Key)
+			line = colorStatus(code, line)
+		}
+		lines = append(lines, t.rowLine(i, line))
+	}
+	return lines
+}
+
+// rowLine highlights the row under the cursor
+func (t *tui) rowLine(i int, line string) string {
+	if i == t.cursor {
+		return ansiReverse + line + ansiReset
+	}
+	return line
+}
+
+// detailLines shows every field of an entry
+func (t *tui) detailLines() []string {
+	e := t.detail
+	fields := [][2]string{
+		{"Time", e.TimeStamp.Format(time.RFC3339)},
+		{"IP", e.IP},
+		{"User", e.UserID},
+		{"Country", e.Country},
+		{"Method", e.Method},
+		{"URI", e.RequestURI},
+		{"Protocol", e.Protocol},
+		{"Status", strconv.Itoa(e.Status)},
+		{"Bytes", formatNumberWithCommas(e.ResponseSize)},
+		{"Response time", fmt.Sprintf("%.3fs", requestDuration(e))},
+		{"Referer", e.Referer},
+		{"User agent", e.UserAgent},
+		{"Source", e.Source},
+		{"Virtual host", e.VHost},
+	}
+	lines := []string{" " + ansiBold + "Entry" + ansiReset + ansiDim + "  esc to close" + ansiReset, ""}
+	for _, f := range fields {
+		lines = append(lines, fit(fmt.Sprintf(" %-14s %s", f[0], f[1]), t.width))
+	}
+	return lines
+}
+
+func colorStatus(code int, s string) string {
+	switch {
+	case code >= 500:
+		return ansiRed + s + ansiReset
+	case code >= 400:
+		return ansiYellow + s + ansiReset
+	}
+	return s
+}
+
+// fit cuts or pads s to width columns. Control characters, which log lines
+// can contain, are replaced so they can't drive the terminal.
+func fit(s string, width int) string {
+	var b strings.Builder
+	n, total := 0, utf8.RuneCountInString(s)
+	for _, r := range s {
+		if n == width {
+			break
+		}
+		if r < 0x20 || r == 0x7f || r >= 0x80 && r < 0xa0 {
+			r = '?'
+		}
+		if n == width-1 && n < total-1 {
+			r = '…'
+		}
+		b.WriteRune(r)
+		n++
+	}
+	return b.String() + strings.Repeat(" ", max(0, width-n))
+}
+
+// fitRight fits left and right aligned text on one line
+func fitRight(left, right string, width int) string {
+	room := width - utf8.RuneCountInString(right)
+	if room < 0 {
+		return fit(left, width)
+	}
+	return fit(left, room) + right
+}
+
+// padANSI pads a line containing escape sequences to width visible columns
+func padANSI(s string, width int) string {
+	visible, escape := 0, false
+	for _, r := range s {
+		switch {
+		case r == '\x1b':
+			escape = true
+		case escape:
+			escape = r < '@' || r > '~' || r == '['
+		default:
+			visible++
+		}
+	}
+	return s + strings.Repeat(" ", max(0, width-visible))
+}
+
+// readKeys sends the key presses on stdin, naming the special keys
+func readKeys(keys chan<- string) {
+	defer close(keys)
+	named := map[string]string{
+		"\x1b[A": "up", "\x1b[B": "down", "\x1b[C": "right", "\x1b[D": "left",
+		"\x1b[H": "home", "\x1b[F": "end", "\x1b[1~": "home", "\x1b[4~": "end",
+		"\x1b[5~": "pgup", "\x1b[6~": "pgdn", "\x1b[Z": "btab",
+		"\x1bOA": "up", "\x1bOB": "down", "\x1bOC": "right", "\x1bOD": "left",
+		"\x1bOH": "home", "\x1bOF": "end",
+		"\x1b": "esc", "\r": "enter", "\n": "enter", "\t": "tab",
+		"\x7f": "backspace", "\x08": "backspace", "\x03": "ctrl-c", "\x15": "ctrl-u",
+	}
+	buf := make([]byte, 256)
+	for {
+		n, err := os.Stdin.Read(buf)
+		if err != nil {
+			return
+		}
+		for in := string(buf[:n]); in != ""; {
+			key := in[:1]
+			switch {
+			case strings.HasPrefix(in, "\x1b[") || strings.HasPrefix(in, "\x1bO"):
+				// CSI and SS3 sequences end with a letter or ~
+				end := strings.IndexFunc(in[2:], func(r rune) bool { return r >= '@' && r <= '~' })
+				if end >= 0 {
+					key = in[:end+3]
+				}
+			case in[0] >= utf8.RuneSelf:
+				_, size := utf8.DecodeRuneInString(in)
+				key = in[:size]
+			}
+			in = in[len(key):]
+			if name, ok := named[key]; ok {
+				key = name
+			} else if key[0] < 0x20 || key[0] == 0x1b {
+				continue
+			}
+			keys <- key
+		}
+	}
+}
+
+// enterRawMode switches the terminal to reading single key presses without
+// echo, using stty so no terminal library is needed
+func enterRawMode() (func(), error) {
+	saved, err := stty("-g")
+	if err != nil {
+		return nil, err
+	}
+	if _, err := stty("raw", "-echo"); err != nil {
+		return nil, err
+	}
+	return func() { stty(strings.TrimSpace(saved)) }, nil
+}
+
+// terminalSize returns the columns and rows of the terminal
+func terminalSize() (int, int) {
+	out, err := stty("size")
+	if err == nil {
+		var rows, cols int
+		if _, err := fmt.Sscan(out, &rows, &cols); err == nil && rows > 0 && cols > 0 {
+			return cols, rows
+		}
+	}
+	return 80, 24
+}
+
+func stty(args ...string) (string, error) {
+	cmd := exec.Command("stty", args...)
+	cmd.Stdin = os.Stdin
+	out, err := cmd.Output()
+	if err != nil {
+		return "", fmt.Errorf("stty %s: %w", strings.Join(args, " "), err)
+	}
+	return string(out), nil
+}
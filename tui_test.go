@@ -0,0 +1,369 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"strings"
+	"testing"
+	"time"
+)
+
+var tuiLines = []string{
+	`10.0.0.1 - - [19/Feb/2024:16:00:01 +0000] "GET /a HTTP/1.1" 200 1 "-" "curl" 0.1 - - - -`,
+	`10.0.0.1 - - [19/Feb/2024:16:00:02 +0000] "GET /a HTTP/1.1" 200 1 "-" "curl" 0.2 - - - -`,
+	`10.0.0.2 - - [19/Feb/2024:16:00:03 +0000] "GET /a HTTP/1.1" 200 1 "-" "curl" 0.3 - - - -`,
+	`10.0.0.2 - - [19/Feb/2024:16:01:00 +0000] "GET /b HTTP/1.1" 500 1 "-" "curl" 2.5 - - - -`,
+	`10.0.0.3 - - [19/Feb/2024:16:02:00 +0000] "GET /b HTTP/1.1" 500 1 "-" "curl" 0.4 - - - -`,
+	`10.0.0.3 - - [19/Feb/2024:16:03:00 +0000] "GET /c HTTP/1.1" 404 1 "-" "curl" 0.5 - - - -`,
+}
+
+// newTestTUI is a terminal UI over sources of the given lines, with its
+// first report built
+func newTestTUI(t *testing.T, sources ...[]string) *tui {
+	t.Helper()
+	cfg := DefaultConfig()
+	cfg.Range = RangeConfig{Start: "2024-02-19 16:00:00", End: "2024-02-19 17:00:00"}
+	tu := &tui{
+		cfg:     cfg,
+		refresh: time.Hour,
+		sorts:   make(map[string]TableQuery),
+		// Room for every report started, so the dropped ones don't block
+		results: make(chan tuiResult, 64),
+		out:     bufio.NewWriter(io.Discard),
+		width:   120,
+		height:  30,
+	}
+	for i, lines := range sources {
+		src := newTestSource(t, lines)
+		src.Name = fmt.Sprintf("site%d", i+1)
+		tu.sources = append(tu.sources, src)
+	}
+	tu.rebuild()
+	settle(t, tu)
+	return tu
+}
+
+// settle waits for the latest report, like the run loop does
+func settle(t *testing.T, tu *tui) {
+	t.Helper()
+	for tu.building {
+		select {
+		case r := <-tu.results:
+			if r.gen != tu.gen {
+				continue
+			}
+			if r.err != nil {
+				t.Fatal(r.err)
+			}
+			tu.building, tu.report = false, r.report
+			tu.clampCursor()
+		case <-time.After(5 * time.Second):
+			t.Fatal("no report")
+		}
+	}
+}
+
+// tuiPanel is the panel of a table
+func tuiPanel(id string) int {
+	for i, def := range tableDefs {
+		if def.ID == id {
+			return i + 1
+		}
+	}
+	return -1
+}
+
+func TestTUIPanels(t *testing.T) {
+	tu := newTestTUI(t, tuiLines)
+	if tu.report.TotalRequests != 6 {
+		t.Fatalf("%d requests", tu.report.TotalRequests)
+	}
+
+	tests := []struct {
+		key   string
+		panel int
+	}{
+		{"right", 1},
+		{"l", 2},
+		{"left", 1},
+		{"h", 0},
+		// Going left from the overview wraps to the last table
+		{"btab", len(tableDefs)},
+		{"tab", 0},
+		{"3", 3},
+		{"9", 3},
+		{"0", 0},
+	}
+	for _, tt := range tests {
+		if !tu.handleKey(tt.key) || tu.panel != tt.panel {
+			t.Errorf("%s: panel %d, want %d", tt.key, tu.panel, tt.panel)
+		}
+	}
+
+	// The cursor stays on the rows of the table
+	tu.handleKey(fmt.Sprint(tuiPanel("uris")))
+	moves := []struct {
+		key    string
+		cursor int
+	}{
+		{"up", 0},
+		{"down", 1},
+		{"j", 2},
+		{"j", 2},
+		{"k", 1},
+		{"home", 0},
+		{"G", 2},
+		{"pgup", 0},
+		{"pgdn", 2},
+		{"g", 0},
+	}
+	for _, tt := range moves {
+		tu.handleKey(tt.key)
+		if tu.cursor != tt.cursor {
+			t.Errorf("%s: cursor %d, want %d", tt.key, tu.cursor, tt.cursor)
+		}
+	}
+	tu.handleKey("end")
+	if tu.handleKey("right"); tu.cursor != 0 {
+		t.Errorf("cursor %d on a new panel", tu.cursor)
+	}
+
+	if tu.handleKey("p"); !tu.paused {
+		t.Error("p didn't pause")
+	}
+	if tu.handleKey("q") || tu.handleKey("ctrl-c") {
+		t.Error("q and ctrl-c don't quit")
+	}
+}
+
+func TestTUIDrill(t *testing.T) {
+	tu := newTestTUI(t, tuiLines)
+	tu.handleKey(fmt.Sprint(tuiPanel("uris")))
+	tu.handleKey("down")
+	tu.handleKey("enter")
+	settle(t, tu)
+	if tu.filter.String() != `uri="/b"` || tu.panel != 0 || len(tu.history) != 1 || tu.report.TotalRequests != 2 {
+		t.Fatalf("filter %q on panel %d, history %q, %d requests", tu.filter, tu.panel, tu.history, tu.report.TotalRequests)
+	}
+
+	tu.handleKey(fmt.Sprint(tuiPanel("status")))
+	tu.handleKey("enter")
+	settle(t, tu)
+	if tu.filter.String() != `uri="/b" and status=500` || len(tu.history) != 2 {
+		t.Errorf("filter %q, history %q", tu.filter, tu.history)
+	}
+
+	// Backspace goes back one drill down at a time, c clears and can be undone
+	tu.handleKey("backspace")
+	settle(t, tu)
+	if tu.filter.String() != `uri="/b"` || len(tu.history) != 1 {
+		t.Errorf("back: filter %q, history %q", tu.filter, tu.history)
+	}
+	tu.handleKey("c")
+	settle(t, tu)
+	if tu.filter != nil || tu.report.TotalRequests != 6 || len(tu.history) != 2 {
+		t.Errorf("cleared: filter %q, history %q", tu.filter, tu.history)
+	}
+	tu.handleKey("backspace")
+	tu.handleKey("backspace")
+	tu.handleKey("backspace")
+	settle(t, tu)
+	if tu.filter != nil || tu.message != "Nothing to go back to" {
+		t.Errorf("past the first filter: %q, message %q", tu.filter, tu.message)
+	}
+
+	// The overview has nothing to drill into
+	tu.handleKey("0")
+	if tu.handleKey("enter"); tu.filter != nil || tu.building {
+		t.Errorf("drilled into the overview: %q", tu.filter)
+	}
+}
+
+func TestTUIDetail(t *testing.T) {
+	tu := newTestTUI(t, tuiLines)
+	tu.handleKey(fmt.Sprint(tuiPanel("slow")))
+	tu.handleKey("enter")
+	if tu.detail == nil || tu.detail.RequestURI != "/b" || tu.filter != nil {
+		t.Fatalf("detail %+v, filter %q", tu.detail, tu.filter)
+	}
+	lines := strings.Join(tu.detailLines(), "\n")
+	if !strings.Contains(lines, "Response time  2.500s") || !strings.Contains(lines, "IP             10.0.0.2") {
+		t.Errorf("detail lines\n%s", lines)
+	}
+	// Keys other than closing it are ignored, q closes it without quitting
+	if tu.handleKey("right"); tu.panel != tuiPanel("slow") {
+		t.Errorf("panel %d behind the detail", tu.panel)
+	}
+	if !tu.handleKey("q") || tu.detail != nil {
+		t.Errorf("detail %+v after q", tu.detail)
+	}
+}
+
+func TestTUIEditFilter(t *testing.T) {
+	tu := newTestTUI(t, tuiLines)
+	tu.handleKey("/")
+	for _, key := range []string{"s", "t", "a", "t", "u", "s", ">", ">", "up", "é"} {
+		tu.handleKey(key)
+	}
+	if !tu.editing || tu.text != "status>>é" {
+		t.Fatalf("editing %v %q", tu.editing, tu.text)
+	}
+	// A key of several bytes is removed at once
+	tu.handleKey("backspace")
+	if tu.text != "status>>" {
+		t.Errorf("after backspace %q", tu.text)
+	}
+	tu.handleKey("enter")
+	if !tu.editing || tu.message == "" || tu.filter != nil {
+		t.Errorf("invalid filter applied: editing %v, message %q", tu.editing, tu.message)
+	}
+
+	tu.handleKey("ctrl-u")
+	for _, r := range "status>=500" {
+		tu.handleKey(string(r))
+	}
+	tu.handleKey("enter")
+	settle(t, tu)
+	if tu.editing || tu.message != "" || tu.filter.String() != "status>=500" || tu.report.TotalRequests != 2 || len(tu.history) != 1 {
+		t.Errorf("filter %q, message %q, %d requests", tu.filter, tu.message, tu.report.TotalRequests)
+	}
+
+	// Escape leaves the filter as it was, the same filter adds no history
+	tu.handleKey("/")
+	tu.handleKey("ctrl-u")
+	tu.handleKey("esc")
+	tu.handleKey("/")
+	tu.handleKey("enter")
+	if tu.editing || tu.filter.String() != "status>=500" || len(tu.history) != 1 || tu.building {
+		t.Errorf("filter %q, history %q", tu.filter, tu.history)
+	}
+	if tu.handleKey("/"); !tu.handleKey("q") || tu.text != "status>=500q" {
+		t.Errorf("q while editing: %q", tu.text)
+	}
+}
+
+func TestTUISortAndSources(t *testing.T) {
+	tu := newTestTUI(t, tuiLines, tuiLines[3:])
+	tu.handleKey(fmt.Sprint(tuiPanel("uris")))
+	tu.handleKey("o")
+	settle(t, tu)
+	_, view, _ := tu.table()
+	if q := tu.sorts["uris"]; q.Sort != sortByKey || q.Order != orderAsc || view.Rows[0].Key != "/a" || view.Rows[2].Key != "/c" {
+		t.Errorf("sort %+v", q)
+	}
+	tu.handleKey("o")
+	if q := tu.sorts["uris"]; q.Sort != sortByCount || q.Order != orderDesc {
+		t.Errorf("sort %+v", q)
+	}
+	// The status table is sorted by key to start with
+	tu.handleKey(fmt.Sprint(tuiPanel("status")))
+	if tu.handleKey("o"); tu.sorts["status"].Sort != sortByCount {
+		t.Errorf("status sort %+v", tu.sorts["status"])
+	}
+	tu.handleKey(fmt.Sprint(tuiPanel("slow")))
+	if tu.handleKey("o"); tu.sorts["slow"] != (TableQuery{}) {
+		t.Errorf("sorted the slow table %+v", tu.sorts["slow"])
+	}
+
+	settle(t, tu)
+	tu.handleKey("s")
+	if tu.src != 1 || tu.report != nil {
+		t.Fatalf("source %d", tu.src)
+	}
+	settle(t, tu)
+	if tu.report.TotalRequests != 3 {
+		t.Errorf("%d requests in the second source", tu.report.TotalRequests)
+	}
+	tu.handleKey("s")
+	if tu.src != 0 {
+		t.Errorf("s wraps to source %d", tu.src)
+	}
+	tu.handleKey("S")
+	if tu.src != 1 {
+		t.Errorf("S goes back to source %d", tu.src)
+	}
+	settle(t, tu)
+}
+
+func TestTUIDraw(t *testing.T) {
+	hostile := append([]string{
+		`10.0.0.9 - - [19/Feb/2024:16:05:00 +0000] "GET /x HTTP/1.1" 200 1 "-" "evil` + "\x1b]0;pwned\x07\x1b[2J" + `" 0.1 - - - -`,
+	}, tuiLines...)
+	tu := newTestTUI(t, hostile)
+	var buf bytes.Buffer
+	tu.out = bufio.NewWriter(&buf)
+
+	for panel := range len(tableDefs) + 1 {
+		for _, width := range []int{60, 120} {
+			buf.Reset()
+			tu.setPanel(panel)
+			tu.width = width
+			tu.draw()
+			screen := buf.String()
+			if lines := strings.Count(screen, "\r\n") + 1; lines != tu.height {
+				t.Errorf("panel %d: %d lines", panel, lines)
+			}
+			if !strings.Contains(screen, " nginx-log-viewer  site1 (1/1)  2024-02-19 16:00:00 - 2024-") {
+				t.Errorf("panel %d: no header in\n%q", panel, screen)
+			}
+			// Only the UI's own escape sequences reach the terminal
+			if strings.Contains(screen, "\x07") || strings.Contains(screen, "\x1b]") || strings.Contains(screen, "\x1b[2J") {
+				t.Errorf("panel %d: control characters of the log line in\n%q", panel, screen)
+			}
+		}
+	}
+
+	buf.Reset()
+	tu.setPanel(tuiPanel("agents"))
+	tu.draw()
+	if !strings.Contains(buf.String(), "evil?]0;pwned??[2J") {
+		t.Errorf("agent not shown in\n%q", buf.String())
+	}
+}
+
+func TestFit(t *testing.T) {
+	tests := []struct {
+		s     string
+		width int
+		want  string
+	}{
+		{"abc", 5, "abc  "},
+		{"abcdef", 4, "abc…"},
+		{"abcd", 4, "abcd"},
+		{"héllo", 3, "hé…"},
+		{"a\x1b[2Jb\tc\u009b", 10, "a?[2Jb?c? "},
+		{"abc", 0, ""},
+	}
+	for _, tt := range tests {
+		if got := fit(tt.s, tt.width); got != tt.want {
+			t.Errorf("fit(%q, %d) = %q, want %q", tt.s, tt.width, got, tt.want)
+		}
+	}
+
+	if got := fitRight("left", "right", 12); got != "left   right" {
+		t.Errorf("fitRight = %q", got)
+	}
+	// Without room for the right text, only the left one is shown
+	if got := fitRight("left side", "right", 4); got != "lef…" {
+		t.Errorf("fitRight without room = %q", got)
+	}
+}
+
+func TestPadANSI(t *testing.T) {
+	s := colorStatus(503, "503") + " " + ansiReverse + "é" + ansiReset
+	if got := padANSI(s, 8); got != s+"   " {
+		t.Errorf("padANSI = %q", got)
+	}
+	if got := padANSI("too long", 3); got != "too long" {
+		t.Errorf("padANSI of a long line = %q", got)
+	}
+
+	tests := map[int]string{200: "x", 302: "x", 404: ansiYellow + "x" + ansiReset, 500: ansiRed + "x" + ansiReset}
+	for code, want := range tests {
+		if got := colorStatus(code, "x"); got != want {
+			t.Errorf("colorStatus(%d) = %q, want %q", code, got, want)
+		}
+	}
+}
@@ -0,0 +1,443 @@
+package main
+
+import (
+	"cmp"
+	"net/url"
+	"slices"
+	"strings"
+	"time"
+)
+
+// UpstreamAttempt is one server nginx passed a request to. Retries with
+// proxy_next_upstream add an attempt per server tried. The times are
+// counted from the start of the attempt: the connection is established
+// after ConnectTime, the response headers arrive after HeaderTime and the
+// body is read after ResponseTime.
+type UpstreamAttempt struct {
+	Addr         string  `json:"addr"`
+	Status       int     `json:"status,omitempty"` // 0 when the server sent no response
+	ResponseTime float64 `json:"response_time"`
+	ConnectTime  float64 `json:"connect_time,omitempty"`
+	HeaderTime   float64 `json:"header_time,omitempty"`
+
+	// The times are logged as "-" when the server couldn't be reached or
+	// sent no headers, unlike a time of 0 on a kept alive connection
+	connectLogged, headerLogged bool
+}
+
+// parseUpstreams pairs the values of $upstream_addr, $upstream_status,
+// $upstream_response_time, $upstream_connect_time and $upstream_header_time.
+// The total time is the sum of the attempts. Attempts are only returned when
+// the format logs addresses or statuses.
+func parseUpstreams(addrs, statuses, times, connectTimes, headerTimes string) ([]UpstreamAttempt, float64) {
+	addrList := splitUpstreamList(addrs)
+	statusList := splitUpstreamList(statuses)
+	timeList := splitUpstreamList(times)
+	connectList := splitUpstreamList(connectTimes)
+	headerList := splitUpstreamList(headerTimes)
+
+	var total float64
+	for _, t := range timeList {
+		total += atof(t)
+	}
+	if len(addrList) == 0 && len(statusList) == 0 {
+		return nil, total
+	}
+
+	attempts := make([]UpstreamAttempt, max(len(addrList), len(statusList), len(timeList)))
+	for i := range attempts {
+		if i < len(addrList) {
+			attempts[i].Addr = addrList[i]
+		}
+		if i < len(statusList) && statusList[i] != "-" {
+			attempts[i].Status = atoi(statusList[i])
+		}
+		if i < len(timeList) {
+			attempts[i].ResponseTime = atof(timeList[i])
+		}
+		if i < len(connectList) && connectList[i] != "-" {
+			attempts[i].ConnectTime = atof(connectList[i])
+			attempts[i].connectLogged = true
+		}
+		if i < len(headerList) && headerList[i] != "-" {
+			attempts[i].HeaderTime = atof(headerList[i])
+			attempts[i].headerLogged = true
+		}
+	}
+	return attempts, total
+}
+
+// splitUpstreamList flattens an upstream variable into its values, nil for
+// "-" or an empty value
+func splitUpstreamList(s string) []string {
+	if s == "" || s == "-" {
+		return nil
+	}
+	var values []string
+	for _, group := range strings.Split(s, " : ") {
+		values = append(values, strings.Split(group, ", ")...)
+	}
+	return values
+}
+
+// requestDuration is the time nginx spent on a request: $request_time, or
+// the upstream response time for formats not logging it
+func requestDuration(e *LogEntry) float64 {
+	if e.RequestTime > 0 {
+		return e.RequestTime
+	}
+	return e.ResponseTime
+}
+
+// lastUpstream is the attempt that produced the response
+func lastUpstream(e *LogEntry) UpstreamAttempt {
+	if len(e.Upstreams) == 0 {
+		return UpstreamAttempt{}
+	}
+	return e.Upstreams[len(e.Upstreams)-1]
+}
+
+// sumUpstreams adds up a time of every attempt, like $upstream_response_time
+// is added up for the response time
+func sumUpstreams(e *LogEntry, time func(UpstreamAttempt) float64) float64 {
+	var sum float64
+	for _, a := range e.Upstreams {
+		sum += time(a)
+	}
+	return sum
+}
+
+// attemptFailed tells whether a server failed a request: it answered with a
+// 5xx or not at all
+func attemptFailed(a UpstreamAttempt) bool {
+	return a.Status == 0 || a.Status >= 500
+}
+
+// noUpstream is the service name of requests without $proxy_upstream_name
+const noUpstream = "-"
+
+// UpstreamQuery selects how many rows each upstream table shows
+type UpstreamQuery struct {
+	Limit int
+}
+
+func parseUpstreamQuery(values url.Values, topN int) (UpstreamQuery, error) {
+	limit, err := parsePositive(values, "limit")
+	if err != nil {
+		return UpstreamQuery{}, err
+	}
+	if limit == 0 {
+		limit = max(topN, 25)
+	}
+	return UpstreamQuery{Limit: min(limit, maxTableLimit)}, nil
+}
+
+// UpstreamReport shows how requests fared at the upstreams: retries and
+// latency per upstream service, failures per backend server and the paths
+// retried most
+type UpstreamReport struct {
+	Date      string  `json:"date"`
+	Source    string  `json:"source"`
+	Filter    string  `json:"filter,omitempty"`
+	Requests  int     `json:"requests"`
+	Proxied   int     `json:"proxied"`  // requests passed to at least one server
+	Retried   int     `json:"retried"`  // requests passed to more than one server
+	Attempts  int     `json:"attempts"` // servers tried in total
+	RetryRate float64 `json:"retry_rate"`
+
+	Latency LatencyBreakdown `json:"latency"` // of the proxied requests
+
+	Services []UpstreamServiceRow `json:"services"`
+	Backends []UpstreamBackendRow `json:"backends"`
+	Retries  []UpstreamRetryRow   `json:"retries"`
+
+	Chips []FilterChip `json:"-"`
+	Sites []string     `json:"-"`
+	User  *User        `json:"-"`
+}
+
+// UpstreamServiceRow is an upstream service, $proxy_upstream_name. Latency
+// is the time spent in all attempts of a request.
+type UpstreamServiceRow struct {
+	Name      string  `json:"name"`
+	Requests  int     `json:"requests"`
+	Retried   int     `json:"retried"`
+	RetryRate float64 `json:"retry_rate"`
+	Errors    int     `json:"errors"` // 5xx responses to the client
+	ErrorRate float64 `json:"error_rate"`
+	Avg       float64 `json:"avg"`
+	P50       float64 `json:"p50"`
+	P95       float64 `json:"p95"`
+	P99       float64 `json:"p99"`
+
+	Latency LatencyBreakdown `json:"latency"`
+
+	times   []float64
+	latency latencySums
+}
+
+// UpstreamBackendRow is a server of an upstream, a pod on ingress-nginx.
+// Every attempt counts, so a server failing before a retry succeeded
+// elsewhere still shows its failure.
+type UpstreamBackendRow struct {
+	Addr      string  `json:"addr"`
+	Service   string  `json:"service"`
+	Attempts  int     `json:"attempts"`
+	Failed    int     `json:"failed"` // 5xx or no response
+	ErrorRate float64 `json:"error_rate"`
+	Avg       float64 `json:"avg"`
+	P95       float64 `json:"p95"`
+	Connect   float64 `json:"connect"` // average $upstream_connect_time
+	Header    float64 `json:"header"`  // average $upstream_header_time
+
+	times             []float64
+	connect, header   float64
+	connects, headers int // attempts logging a connect or header time
+}
+
+// LatencyBreakdown splits the average time of a request into connecting to
+// the upstreams, waiting for the response headers and reading the rest of
+// the response, and the time nginx spent on its own: reading the request,
+// sending the response to the client and everything in between. Connect and
+// Header need $upstream_connect_time and $upstream_header_time in the log
+// format, Request and Nginx need $request_time.
+type LatencyBreakdown struct {
+	Connect    float64 `json:"connect"`
+	Header     float64 `json:"header"`   // after connecting
+	Response   float64 `json:"response"` // after the headers
+	Upstream   float64 `json:"upstream"` // $upstream_response_time of all attempts
+	Request    float64 `json:"request"`  // $request_time
+	Nginx      float64 `json:"nginx"`
+	NginxShare float64 `json:"nginx_share"` // percent of the request time spent in nginx
+}
+
+// Percent returns a phase as a percentage of the whole request
+func (l LatencyBreakdown) Percent(phase float64) float64 {
+	total := max(l.Request, l.Upstream)
+	if total == 0 {
+		return 0
+	}
+	return phase * 100 / total
+}
+
+// Width is the width class of a phase's segment in the bar
+func (l LatencyBreakdown) Width(phase float64) string {
+	return widthClass(l.Percent(phase))
+}
+
+// latencySums adds up the phases of requests for a LatencyBreakdown
+type latencySums struct {
+	requests int
+	connect  float64
+	header   float64
+	response float64
+	upstream float64
+
+	timed         int // requests logging $request_time
+	request       float64
+	timedUpstream float64
+}
+
+func (s *latencySums) add(e *LogEntry) {
+	s.requests++
+	for _, a := range e.Upstreams {
+		// Each time includes the ones before it. Clamped since a server
+		// that sent no headers logs "-" as header time.
+		s.connect += a.ConnectTime
+		s.header += max(a.HeaderTime-a.ConnectTime, 0)
+		s.response += max(a.ResponseTime-max(a.HeaderTime, a.ConnectTime), 0)
+	}
+	s.upstream += e.ResponseTime
+	if e.RequestTime > 0 {
+		s.timed++
+		s.request += e.RequestTime
+		s.timedUpstream += e.ResponseTime
+	}
+}
+
+func (s *latencySums) breakdown() LatencyBreakdown {
+	var l LatencyBreakdown
+	if s.requests == 0 {
+		return l
+	}
+	n := float64(s.requests)
+	l.Connect = s.connect / n
+	l.Header = s.header / n
+	l.Response = s.response / n
+	l.Upstream = s.upstream / n
+	if s.timed > 0 {
+		l.Request = s.request / float64(s.timed)
+		l.Nginx = max(s.request-s.timedUpstream, 0) / float64(s.timed)
+		l.NginxShare = l.Nginx * 100 / l.Request
+	}
+	return l
+}
+
+// UpstreamRetryRow is a path with retried requests
+type UpstreamRetryRow struct {
+	Path      string  `json:"path"`
+	Requests  int     `json:"requests"`
+	Retried   int     `json:"retried"`
+	RetryRate float64 `json:"retry_rate"`
+}
+
+// buildUpstreamReport reads the source and aggregates the upstream attempts
+// of the entries between start and end
+func buildUpstreamReport(src *Source, start, end time.Time, opts ReportOptions, q UpstreamQuery) (*UpstreamReport, error) {
+	report := &UpstreamReport{
+		Date:   formatRange(start, end),
+		Source: src.Name,
+		Filter: opts.Filter.String(),
+	}
+	var latency latencySums
+	services := make(map[string]*UpstreamServiceRow)
+	backends := make(map[string]*UpstreamBackendRow)
+	paths := make(map[string]*UpstreamRetryRow)
+
+	_, err := src.ReadEntries(func(entry LogEntry) {
+		if entry.TimeStamp.Before(start) || entry.TimeStamp.After(end) {
+			return
+		}
+		opts.Mask.Apply(&entry)
+		if !opts.Filter.Match(&entry) {
+			return
+		}
+		report.Requests++
+		if len(entry.Upstreams) == 0 {
+			return
+		}
+		report.Proxied++
+		report.Attempts += len(entry.Upstreams)
+		retried := len(entry.Upstreams) > 1
+		if retried {
+			report.Retried++
+		}
+		latency.add(&entry)
+
+		name := cmp.Or(entry.UpstreamName, noUpstream)
+		service := services[name]
+		if service == nil {
+			if len(services) >= maxGroups {
+				return
+			}
+			service = &UpstreamServiceRow{Name: name}
+			services[name] = service
+		}
+		service.Requests++
+		if retried {
+			service.Retried++
+		}
+		if entry.Status >= 500 {
+			service.Errors++
+		}
+		service.times = append(service.times, entry.ResponseTime)
+		service.latency.add(&entry)
+
+		for _, attempt := range entry.Upstreams {
+			backend := backends[attempt.Addr]
+			if backend == nil {
+				if len(backends) >= maxGroups {
+					continue
+				}
+				backend = &UpstreamBackendRow{Addr: attempt.Addr, Service: name}
+				backends[attempt.Addr] = backend
+			}
+			backend.Attempts++
+			if attemptFailed(attempt) {
+				backend.Failed++
+			}
+			backend.times = append(backend.times, attempt.ResponseTime)
+			if attempt.connectLogged {
+				backend.connects++
+				backend.connect += attempt.ConnectTime
+			}
+			if attempt.headerLogged {
+				backend.headers++
+				backend.header += attempt.HeaderTime
+			}
+		}
+
+		p := requestPath(entry.RequestURI)
+		row := paths[p]
+		if row == nil {
+			if len(paths) >= maxGroups {
+				return
+			}
+			row = &UpstreamRetryRow{Path: p}
+			paths[p] = row
+		}
+		row.Requests++
+		if retried {
+			row.Retried++
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	report.RetryRate = percentOf(report.Retried, report.Proxied)
+	report.Latency = latency.breakdown()
+
+	for _, s := range services {
+		slices.Sort(s.times)
+		s.RetryRate = percentOf(s.Retried, s.Requests)
+		s.ErrorRate = percentOf(s.Errors, s.Requests)
+		s.Avg = average(s.times)
+		s.P50, s.P95, s.P99 = percentile(s.times, 50), percentile(s.times, 95), percentile(s.times, 99)
+		s.Latency = s.latency.breakdown()
+		report.Services = append(report.Services, *s)
+	}
+	slices.SortFunc(report.Services, func(a, b UpstreamServiceRow) int {
+		return cmp.Or(cmp.Compare(b.Requests, a.Requests), strings.Compare(a.Name, b.Name))
+	})
+	report.Services = report.Services[:min(len(report.Services), q.Limit)]
+
+	for _, b := range backends {
+		slices.Sort(b.times)
+		b.ErrorRate = percentOf(b.Failed, b.Attempts)
+		b.Avg = average(b.times)
+		b.P95 = percentile(b.times, 95)
+		if b.connects > 0 {
+			b.Connect = b.connect / float64(b.connects)
+		}
+		if b.headers > 0 {
+			b.Header = b.header / float64(b.headers)
+		}
+		report.Backends = append(report.Backends, *b)
+	}
+	// Failing servers first
+	slices.SortFunc(report.Backends, func(a, b UpstreamBackendRow) int {
+		return cmp.Or(cmp.Compare(b.Failed, a.Failed), cmp.Compare(b.Attempts, a.Attempts), strings.Compare(a.Addr, b.Addr))
+	})
+	report.Backends = report.Backends[:min(len(report.Backends), q.Limit)]
+
+	for _, r := range paths {
+		if r.Retried > 0 {
+			r.RetryRate = percentOf(r.Retried, r.Requests)
+			report.Retries = append(report.Retries, *r)
+		}
+	}
+	slices.SortFunc(report.Retries, func(a, b UpstreamRetryRow) int {
+		return cmp.Or(cmp.Compare(b.Retried, a.Retried), strings.Compare(a.Path, b.Path))
+	})
+	report.Retries = report.Retries[:min(len(report.Retries), q.Limit)]
+	return report, nil
+}
+
+// percentOf is part as a percentage of total, 0 when total is 0
+func percentOf(part, total int) float64 {
+	if total == 0 {
+		return 0
+	}
+	return float64(part) * 100 / float64(total)
+}
+
+func average(values []float64) float64 {
+	if len(values) == 0 {
+		return 0
+	}
+	var sum float64
+	for _, v := range values {
+		sum += v
+	}
+	return sum / float64(len(values))
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseUpstreams(t *testing.T) {
+	tests := []struct {
+		name                                      string
+		addrs, statuses, times, connects, headers string
+		want                                      []UpstreamAttempt
+		total                                     float64
+	}{
+		{"single attempt", "10.0.0.1:80", "200", "0.250", "0.125", "0.250",
+			[]UpstreamAttempt{{Addr: "10.0.0.1:80", Status: 200, ResponseTime: 0.25, ConnectTime: 0.125, HeaderTime: 0.25, connectLogged: true, headerLogged: true}}, 0.25},
+		{"retried", "10.0.0.1:80, 10.0.0.2:80", "502, 200", "1.000, 0.500", "0.125, 0.250", "1.000, 0.375",
+			[]UpstreamAttempt{
+				{Addr: "10.0.0.1:80", Status: 502, ResponseTime: 1, ConnectTime: 0.125, HeaderTime: 1, connectLogged: true, headerLogged: true},
+				{Addr: "10.0.0.2:80", Status: 200, ResponseTime: 0.5, ConnectTime: 0.25, HeaderTime: 0.375, connectLogged: true, headerLogged: true},
+			}, 1.5},
+		{"internal redirect", "10.0.0.1:80 : 10.0.0.9:80", "404 : 200", "0.125 : 0.250", "", "",
+			[]UpstreamAttempt{
+				{Addr: "10.0.0.1:80", Status: 404, ResponseTime: 0.125},
+				{Addr: "10.0.0.9:80", Status: 200, ResponseTime: 0.25},
+			}, 0.375},
+		{"retries and a redirect", "a:80, b:80 : c:80", "502, 504 : 200", "1.000, 2.000 : 0.500", "", "",
+			[]UpstreamAttempt{
+				{Addr: "a:80", Status: 502, ResponseTime: 1},
+				{Addr: "b:80", Status: 504, ResponseTime: 2},
+				{Addr: "c:80", Status: 200, ResponseTime: 0.5},
+			}, 3.5},
+		{"no response", "10.0.0.1:80, 10.0.0.2:80", "-, 200", "-, 0.500", "-, 0.125", "-, 0.250",
+			[]UpstreamAttempt{
+				{Addr: "10.0.0.1:80"},
+				{Addr: "10.0.0.2:80", Status: 200, ResponseTime: 0.5, ConnectTime: 0.125, HeaderTime: 0.25, connectLogged: true, headerLogged: true},
+			}, 0.5},
+		{"unix socket", "unix:/run/app.sock", "200", "0.250", "", "",
+			[]UpstreamAttempt{{Addr: "unix:/run/app.sock", Status: 200, ResponseTime: 0.25}}, 0.25},
+		{"not proxied", "-", "-", "-", "-", "-", nil, 0},
+		{"empty", "", "", "", "", "", nil, 0},
+		// Formats with $upstream_response_time but no addresses or statuses
+		// keep the time but have no attempts
+		{"only times", "", "", "0.250, 0.500", "", "", nil, 0.75},
+		{"only statuses", "", "502, 200", "", "", "",
+			[]UpstreamAttempt{{Status: 502}, {Status: 200}}, 0},
+		// Lists of different lengths make as many attempts as the longest
+		// address, status or time list
+		{"fewer statuses", "a:80, b:80, c:80", "502", "1.000, 2.000", "", "",
+			[]UpstreamAttempt{
+				{Addr: "a:80", Status: 502, ResponseTime: 1},
+				{Addr: "b:80", ResponseTime: 2},
+				{Addr: "c:80"},
+			}, 3},
+		{"more times", "a:80", "200", "1.000, 2.000", "", "",
+			[]UpstreamAttempt{{Addr: "a:80", Status: 200, ResponseTime: 1}, {ResponseTime: 2}}, 3},
+		{"extra connect and header times", "a:80", "200", "1.000", "0.125, 0.250", "0.500, 0.750, 1.000",
+			[]UpstreamAttempt{{Addr: "a:80", Status: 200, ResponseTime: 1, ConnectTime: 0.125, HeaderTime: 0.5, connectLogged: true, headerLogged: true}}, 1},
+		{"unparsable time", "a:80", "200", "soon", "", "",
+			[]UpstreamAttempt{{Addr: "a:80", Status: 200}}, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, total := parseUpstreams(tt.addrs, tt.statuses, tt.times, tt.connects, tt.headers)
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("attempts %+v\nwant %+v", got, tt.want)
+			}
+			if total != tt.total {
+				t.Errorf("total %v, want %v", total, tt.total)
+			}
+		})
+	}
+}
+
+func TestSplitUpstreamList(t *testing.T) {
+	tests := map[string][]string{
+		"":                  nil,
+		"-":                 nil,
+		"200":               {"200"},
+		"502, 200":          {"502", "200"},
+		"502 : 200":         {"502", "200"},
+		"502, - : 200, 404": {"502", "-", "200", "404"},
+	}
+	for s, want := range tests {
+		if got := splitUpstreamList(s); !slices.Equal(got, want) {
+			t.Errorf("splitUpstreamList(%q) = %q, want %q", s, got, want)
+		}
+	}
+}
+
+func TestBuildUpstreamReportBackends(t *testing.T) {
+	cfg := DefaultConfig()
+	format := `$remote_addr [$time_local] "$request" $status "$upstream_addr" "$upstream_status" "$upstream_response_time" "$upstream_connect_time" "$upstream_header_time"`
+	lines := []string{
+		`10.0.0.1 [19/Feb/2024:16:00:01 +0000] "GET /a HTTP/1.1" 200 "a:80" "200" "0.500" "0.100" "0.300"`,
+		// The first server couldn't be reached, so its times are "-"
+		`10.0.0.1 [19/Feb/2024:16:00:02 +0000] "GET /a HTTP/1.1" 200 "a:80, b:80" "502, 200" "-, 0.400" "-, 0.200" "-, 0.300"`,
+		// Connected but no headers before the timeout
+		`10.0.0.1 [19/Feb/2024:16:00:03 +0000] "GET /b HTTP/1.1" 504 "a:80" "-" "1.000" "0.500" "-"`,
+		// A kept alive connection takes no time to connect
+		`10.0.0.1 [19/Feb/2024:16:00:04 +0000] "GET /b HTTP/1.1" 200 "a:80" "200" "0.200" "0.000" "0.100"`,
+	}
+	cfg.Sources = []SourceConfig{
+		{Name: "site", Path: writeTestFile(t, "access.log", strings.Join(lines, "\n")+"\n"), Format: format, Timezone: "UTC"},
+	}
+	cfg.fillSourceDefaults()
+	sources, err := cfg.BuildSources()
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := time.Date(2024, 2, 19, 16, 0, 0, 0, time.UTC)
+	report, err := buildUpstreamReport(sources[0], start, start.Add(time.Hour), ReportOptions{}, UpstreamQuery{Limit: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Requests != 4 || report.Proxied != 4 || report.Retried != 1 || report.Attempts != 5 || report.RetryRate != 25 {
+		t.Errorf("report %+v", report)
+	}
+
+	var backends []string
+	for _, b := range report.Backends {
+		backends = append(backends, fmt.Sprintf("%s %d %d %.3f %.3f", b.Addr, b.Attempts, b.Failed, b.Connect, b.Header))
+	}
+	// The averages are over the attempts logging a time, failing servers
+	// are listed first
+	if want := []string{"a:80 4 2 0.200 0.200", "b:80 1 0 0.200 0.300"}; !slices.Equal(backends, want) {
+		t.Errorf("backends %q, want %q", backends, want)
+	}
+}